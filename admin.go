@@ -0,0 +1,113 @@
+package gocask
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+)
+
+// shardStat is what the index holds in one shard.
+type shardStat struct {
+	entries, live int
+	bytes         int64
+}
+
+func (d *KeyDir) shardStats() []shardStat {
+	stats := make([]shardStat, len(d.shards))
+	for i := range d.shards {
+		s := &d.shards[i]
+		s.RLock()
+		stats[i] = shardStat{len(s.m), int(s.live), s.bytes}
+		s.RUnlock()
+	}
+	return stats
+}
+
+// stats returns the bytes the cache holds, its budget and how many values it holds.
+func (c *valueCache) stats() (used, budget int64, n int) {
+	if c == nil {
+		return 0, 0, 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.used, c.budget, len(c.entries)
+}
+
+// WriteDebug prints the store's internals, as serve's admin listener shows them: the
+// segment map, with how much of each file the index points at, the size of every
+// index shard and how the value cache is doing.
+func (db *DB) WriteDebug(w io.Writer) error {
+	s := db.s
+	type fileStat struct {
+		keys  int
+		bytes int64
+	}
+	files := make(map[string]*fileStat)
+	s.keyDir.Range(func(key string, fo FileOffset) bool {
+		if !fo.Tombstone() {
+			f := files[fo.FileID()]
+			if f == nil {
+				f = new(fileStat)
+				files[fo.FileID()] = f
+			}
+			f.keys++
+			f.bytes += fo.recordSize(key)
+		}
+		return true
+	})
+	logs, _, err := segmentFiles(s.path)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "store %s\n\n", s.path)
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "FILE\tSIZE\tLIVE KEYS\tLIVE BYTES\tLIVE%")
+	unlock := db.lock()
+	activeSize := s.dir.activeSize
+	unlock()
+	for _, name := range append(logs, s.dir.active) {
+		size := activeSize
+		if fi, err := os.Stat(name); err == nil && name != s.dir.active {
+			size = fi.Size()
+		}
+		f := files[name]
+		if f == nil {
+			f = new(fileStat)
+		}
+		pct := 0.0
+		if size > 0 {
+			pct = 100 * float64(f.bytes) / float64(size)
+		}
+		rel, _ := filepath.Rel(s.path, name)
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%.1f\n", filepath.ToSlash(rel), size, f.keys, f.bytes, pct)
+	}
+	tw.Flush()
+
+	fmt.Fprintf(w, "\nindex: %d entries, %d live, %d live bytes\n", s.keyDir.Len(), s.keyDir.Live(), s.keyDir.LiveBytes())
+	tw = tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "SHARD\tENTRIES\tLIVE\tBYTES")
+	for i, st := range s.keyDir.shardStats() {
+		fmt.Fprintf(tw, "%d\t%d\t%d\t%d\n", i, st.entries, st.live, st.bytes)
+	}
+	tw.Flush()
+
+	hits, misses := s.dir.metrics.cacheHits.Load(), s.dir.metrics.cacheMisses.Load()
+	unlock = db.lock()
+	c := s.dir.cache
+	unlock()
+	used, budget, n := c.stats()
+	if budget == 0 {
+		_, err := fmt.Fprintf(w, "\ncache: off\n")
+		return err
+	}
+	rate := 0.0
+	if hits+misses > 0 {
+		rate = 100 * float64(hits) / float64(hits+misses)
+	}
+	_, err = fmt.Fprintf(w, "\ncache: %d hits, %d misses (%.1f%% hit rate), %d values in %d of %d bytes\n",
+		hits, misses, rate, n, used, budget)
+	return err
+}
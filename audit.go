@@ -0,0 +1,191 @@
+package gocask
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// The audit log records who changed which key and when. It is on for a store whose
+// directory has an audit/ subdirectory (gocask audit --enable creates it), so it
+// can't be skipped by forgetting a flag. Entries are json lines in audit_<unixnano>.log
+// files, a new one started whenever the current one reaches auditMaxSize.
+const (
+	auditDir     = "audit"
+	auditMaxSize = 16 << 20
+)
+
+// AuditEntry is one line of the audit log, one put or delete.
+type AuditEntry struct {
+	Time      time.Time `json:"time"`
+	Actor     string    `json:"actor"`
+	Op        string    `json:"op"` // put or del
+	Key       string    `json:"key"`
+	ValueSize int       `json:"value_size,omitempty"`
+	Node      uint16    `json:"node"`
+	Timestamp uint64    `json:"ts"` // the record timestamp, ties the entry to the data file
+}
+
+// auditLog is the audit log of one store.
+type auditLog struct {
+	on   bool
+	file *os.File // the audit file being appended to, opened by the first entry
+	size int64
+}
+
+// WithAuditActor names who the store's writes are attributed to: a server's
+// principal, or a user-supplied string. Without it that is the operating system
+// user running the process.
+func WithAuditActor(actor string) Option {
+	return withSetting(func(s *store) error {
+		s.dir.auditActor = actor
+		return nil
+	})
+}
+
+// actorKey is the context key ContextWithActor stores the actor under.
+type actorKey struct{}
+
+// ContextWithActor returns a copy of ctx naming actor as whom the writes made with it
+// are for, such as the principal a server authenticated the request of, so the audit
+// log attributes them to actor rather than to WithAuditActor's. The writes are those
+// of PutContext, PutWithTTLContext, PutWithMetaContext, DeleteContext and
+// Batch.CommitContext.
+func ContextWithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+// actingFor attributes the writes d makes until the returned func is called to the
+// actor ctx names, if it names one. Callers hold the store's mu.
+func (d *dataDir) actingFor(ctx context.Context) func() {
+	actor, _ := ctx.Value(actorKey{}).(string)
+	if actor == "" {
+		return func() {}
+	}
+	d.actor = actor
+	return func() { d.actor = "" }
+}
+
+// defaultActor is the operating system user running gocask.
+func defaultActor() string {
+	if u, err := user.Current(); err == nil {
+		return "user:" + u.Username
+	}
+	return "user:unknown"
+}
+
+// openAudit turns auditing on if the store has it enabled.
+func (d *dataDir) openAudit() error {
+	fi, err := os.Stat(d.file(auditDir))
+	if os.IsNotExist(err) {
+		d.audit.on = false
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("%s is not a directory", auditDir)
+	}
+	d.audit.on = true
+	if d.auditActor == "" {
+		d.auditActor = defaultActor()
+	}
+	return nil
+}
+
+// closeAudit closes the audit file.
+func (d *dataDir) closeAudit() {
+	if d.audit.file != nil {
+		d.audit.file.Close()
+		d.audit.file = nil
+	}
+}
+
+// auditWrite records one mutation. Writes replicated from another node are
+// attributed to that node rather than to the local actor, which is the one the write
+// is made for or else the store's.
+func (d *dataDir) auditWrite(op, key string, valueSize int, ts uint64) error {
+	if !d.audit.on || isInternalKey([]byte(key)) {
+		return nil
+	}
+	e := AuditEntry{
+		Time:      time.Now().UTC(),
+		Actor:     cmp.Or(d.actor, d.auditActor),
+		Op:        op,
+		Key:       key,
+		ValueSize: valueSize,
+		Node:      TimestampNode(ts),
+		Timestamp: ts,
+	}
+	if e.Node != d.node {
+		e.Actor = fmt.Sprintf("replication:node-%d", e.Node)
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	if d.audit.file == nil || d.audit.size+int64(len(line)) > auditMaxSize {
+		if err := d.rotateAudit(); err != nil {
+			return err
+		}
+	}
+	n, err := d.audit.file.Write(line)
+	d.audit.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("audit: %w", err)
+	}
+	return nil
+}
+
+// rotateAudit continues the newest audit file if it has room, or starts a new one.
+func (d *dataDir) rotateAudit() error {
+	d.closeAudit()
+	name := ""
+	if files, err := AuditFiles(d.path); err == nil && len(files) > 0 {
+		if fi, err := os.Stat(files[len(files)-1]); err == nil && fi.Size() < auditMaxSize {
+			name = files[len(files)-1]
+		}
+	}
+	if name == "" {
+		name = filepath.Join(d.path, auditDir, fmt.Sprintf("audit_%d.log", time.Now().UnixNano()))
+	}
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("audit: %w", err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	d.audit.file, d.audit.size = f, fi.Size()
+	return nil
+}
+
+// AuditDir is the directory of the audit log of the store in dir. Auditing is on
+// while it exists.
+func AuditDir(dir string) string { return filepath.Join(dir, auditDir) }
+
+// AuditFiles lists the audit files of the store in dir oldest first. Each holds
+// AuditEntry values as json lines.
+func AuditFiles(dir string) ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(dir, auditDir, "audit_*.log"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(files, func(i, j int) bool {
+		var a, b int64
+		fmt.Sscanf(filepath.Base(files[i]), "audit_%d.log", &a)
+		fmt.Sscanf(filepath.Base(files[j]), "audit_%d.log", &b)
+		return a < b
+	})
+	return files, nil
+}
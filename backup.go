@@ -0,0 +1,531 @@
+package gocask
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// a backup is a tar of the store's files followed by a MANIFEST.json holding the
+// size and sha256 of each, compressed according to the archive's extension.
+// Sealed segments never change, so an incremental backup only holds the segments
+// sealed after the newest one an earlier backup had, along with all hints and the
+// files still being appended to; restoring it over that backup brings it up to date.
+const backupManifestName = "MANIFEST.json"
+
+type backupManifest struct {
+	Created time.Time `json:"created"`
+	// Seq is the sequence number, the timestamp in its name, of the newest segment
+	// of the store; pass it to BackupSince for the next incremental backup.
+	Seq      int64           `json:"seq"`
+	Since    int64           `json:"since,omitempty"` // only segments after this one are in the archive
+	Segments []string        `json:"segments"`        // all of the store's, in the archive or not
+	Files    []manifestEntry `json:"files"`
+}
+
+type manifestEntry struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// only these names are ever written into or restored from an archive
+var backupFileRE = regexp.MustCompile(`^(data_\d+\.(log|hint)|data\.txt|` + regexp.QuoteMeta(cdcJournal) + `|` + legacyFormatFile + `)$`)
+
+// CompressWriter compresses what is written to it into w as the archive name says:
+// zstd for .zst, gzip for .gz, and not at all for a plain .tar. Closing it doesn't
+// close w.
+func CompressWriter(name string, w io.Writer) (io.WriteCloser, error) {
+	switch {
+	case strings.HasSuffix(name, ".zst"):
+		return zstd.NewWriter(w)
+	case strings.HasSuffix(name, ".gz"):
+		return gzip.NewWriter(w), nil
+	default:
+		return nopWriteCloser{w}, nil
+	}
+}
+
+func decompressReader(name string, r io.Reader) (io.ReadCloser, error) {
+	switch {
+	case strings.HasSuffix(name, ".zst"):
+		d, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(d), nil
+	case strings.HasSuffix(name, ".gz"):
+		return gzip.NewReader(r)
+	default:
+		return io.NopCloser(r), nil
+	}
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+// completeLength returns how many bytes of a data or journal file hold whole records,
+// so a snapshot never ends in the middle of one that is still being appended.
+func completeLength(path string) (int64, error) {
+	var end int64
+	err := scanFile(path, defaultReadAhead, func(off int64, r record) error {
+		end = off + r.size()
+		return nil
+	})
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return 0, err
+	}
+	return end, nil
+}
+
+// backupSnapshot is the set of files a backup copies, pinned so merges can't delete
+// them from under it.
+type backupSnapshot struct {
+	dir      string           // where the pinned files are
+	since    int64            // only segments after this sequence number are copied
+	seq      int64            // the newest segment's
+	segments []string         // all of them, copied or not
+	names    []string         // in the order they are archived
+	cut      map[string]int64 // how much of each file still being appended to is copied
+	release  func()           // unpins the files
+}
+
+// appendedFiles are the files a backup copies while records are still appended to them.
+var appendedFiles = []string{activeFile, cdcJournal}
+
+// pinBackup snapshots the files of the store in dir, leaving out segments up to
+// sequence number since, if it isn't 0, and logging to log. cut gives how many bytes of
+// data.txt and the changefeed journal hold whole records, or is nil to find out by
+// scanning them. The rotation lock is only held, shared, while the files are listed
+// and hard-linked into a directory of the snapshot's own: merges delete their inputs
+// under the lock, and then only remove their names from dir. Where hard links aren't
+// supported, the snapshot holds the lock until it is released instead.
+func pinBackup(dir string, since int64, cut map[string]int64, log Logger) (*backupSnapshot, error) {
+	// the store may not have been opened since it was written with every file at the top
+	if err := upgradeLayout(dir, log); err != nil {
+		return nil, err
+	}
+	lock := lockStore(dir)
+	if err := lock.RLock(); err != nil {
+		return nil, fmt.Errorf("lock store: %w", err)
+	}
+	snap := &backupSnapshot{dir: dir, since: since, seq: since, cut: cut, release: func() { lock.Unlock() }}
+	if err := snap.list(); err != nil {
+		lock.Unlock()
+		return nil, err
+	}
+
+	pinned, err := os.MkdirTemp(dir, ".backup-")
+	if err == nil {
+		for _, name := range snap.names {
+			if err = os.MkdirAll(filepath.Join(pinned, filepath.Dir(name)), 0755); err != nil {
+				break
+			}
+			if err = os.Link(filepath.Join(dir, name), filepath.Join(pinned, name)); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		if pinned != "" {
+			os.RemoveAll(pinned)
+		}
+		log.Info("backup holds the rotation lock until it is done, files can't be hard-linked", "err", err)
+		return snap, nil
+	}
+	lock.Unlock()
+	snap.dir = pinned
+	snap.release = func() { os.RemoveAll(pinned) }
+	return snap, nil
+}
+
+// list finds the files to archive: segments after since and all hints, the format,
+// then the files still being appended to, which go last.
+func (b *backupSnapshot) list() error {
+	logs, err := filepath.Glob(filepath.Join(b.dir, segmentsDir, "data_*.log"))
+	if err != nil {
+		return err
+	}
+	for _, l := range logs {
+		name, seq := filepath.Join(segmentsDir, filepath.Base(l)), extractTimestamp(l)
+		b.segments = append(b.segments, name)
+		b.seq = max(b.seq, seq)
+		if seq > b.since {
+			b.names = append(b.names, name)
+		}
+	}
+	hints, err := filepath.Glob(filepath.Join(b.dir, hintsDir, "data_*.hint"))
+	if err != nil {
+		return err
+	}
+	for _, h := range hints {
+		b.names = append(b.names, filepath.Join(hintsDir, filepath.Base(h)))
+	}
+	sort.Strings(b.segments)
+	sort.Strings(b.names)
+	if _, err := os.Stat(filepath.Join(b.dir, formatFile)); err == nil {
+		b.names = append(b.names, formatFile)
+	}
+	scan := b.cut == nil
+	if scan {
+		b.cut = make(map[string]int64)
+	}
+	for _, name := range appendedFiles {
+		path := filepath.Join(b.dir, name)
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+		b.names = append(b.names, name)
+		if scan {
+			n, err := completeLength(path)
+			if err != nil {
+				return err
+			}
+			b.cut[name] = n
+		}
+	}
+	return nil
+}
+
+// write streams the snapshot to w as a tar, the manifest last.
+func (b *backupSnapshot) write(w io.Writer) error {
+	tw := tar.NewWriter(w)
+	manifest := backupManifest{Created: time.Now().UTC(), Seq: b.seq, Since: b.since}
+	for _, name := range b.segments {
+		manifest.Segments = append(manifest.Segments, archiveName(name))
+	}
+	for _, name := range b.names {
+		size, ok := b.cut[name]
+		if !ok {
+			size = -1
+		}
+		entry, err := addTarFile(tw, filepath.Join(b.dir, name), archiveName(name), size)
+		if err != nil {
+			return fmt.Errorf("archive %s: %w", name, err)
+		}
+		manifest.Files = append(manifest.Files, entry)
+	}
+
+	m, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	hdr := &tar.Header{Name: backupManifestName, Mode: 0644, Size: int64(len(m)), ModTime: manifest.Created}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if _, err := tw.Write(m); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// BackupDir is BackupSince for the store in dir, from a process of its own next to
+// one serving the store, or with the store closed.
+func BackupDir(dir string, lastSeq int64, w io.Writer) (int64, error) {
+	snap, err := pinBackup(dir, lastSeq, nil, defaultLogger)
+	if err != nil {
+		return 0, err
+	}
+	defer snap.release()
+	return snap.seq, snap.write(w)
+}
+
+// Backup writes an archive of the store to w, as a tar that Restore reads back, while
+// the store keeps serving: the store's mu is only held to cut the active file and the
+// changefeed journal after the last write and pin the segments. An archive cut short
+// has no manifest, so Restore refuses it.
+func (db *DB) Backup(w io.Writer) error {
+	_, err := db.BackupSince(w, 0)
+	return err
+}
+
+// BackupSince is Backup leaving out the segments an earlier backup, whose sequence
+// number was lastSeq, already has; 0 backs up everything. It returns the sequence
+// number to pass for the next one. After a merge most of the store is in a new
+// segment, so the incremental backup that follows is about as big as a full one.
+// ApplyIncremental restores it over the earlier backups.
+func (db *DB) BackupSince(w io.Writer, lastSeq int64) (int64, error) {
+	unlock := db.lock()
+	cut := map[string]int64{activeFile: db.s.dir.activeSize}
+	if fi, err := os.Stat(db.s.dir.file(cdcJournal)); err == nil {
+		cut[cdcJournal] = fi.Size()
+	}
+	snap, err := pinBackup(db.s.path, lastSeq, cut, db.s.dir.logger)
+	unlock()
+	if err != nil {
+		return 0, err
+	}
+	defer snap.release()
+	return snap.seq, snap.write(w)
+}
+
+// addTarFile copies the first size bytes of path (all of it if size < 0) into tw.
+func addTarFile(tw *tar.Writer, path, name string, size int64) (manifestEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return manifestEntry{}, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return manifestEntry{}, err
+	}
+	if size < 0 {
+		size = fi.Size()
+	}
+
+	hdr := &tar.Header{Name: name, Mode: 0644, Size: size, ModTime: fi.ModTime()}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return manifestEntry{}, err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tw, h), io.LimitReader(f, size)); err != nil {
+		return manifestEntry{}, err
+	}
+	return manifestEntry{Name: name, Size: size, SHA256: hex.EncodeToString(h.Sum(nil))}, nil
+}
+
+// readBackup unpacks an archive into dir (which must exist and be empty) and checks
+// every file against the manifest and the record format. Segments an incremental
+// backup leaves out are looked for in base.
+func readBackup(r io.Reader, dir, base string) (*backupManifest, error) {
+	tr := tar.NewReader(r)
+	got := make(map[string]manifestEntry)
+	var manifest *backupManifest
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		if hdr.Name == backupManifestName {
+			manifest = new(backupManifest)
+			if err := json.NewDecoder(tr).Decode(manifest); err != nil {
+				return nil, fmt.Errorf("read manifest: %w", err)
+			}
+			continue
+		}
+		if !backupFileRE.MatchString(hdr.Name) || hdr.Typeflag != tar.TypeReg {
+			return nil, fmt.Errorf("unexpected entry %q in archive", hdr.Name)
+		}
+
+		path := filepath.Join(dir, restoredPath(hdr.Name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return nil, err
+		}
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err != nil {
+			return nil, err
+		}
+		h := sha256.New()
+		n, err := io.Copy(io.MultiWriter(f, h), tr)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return nil, fmt.Errorf("extract %s: %w", hdr.Name, err)
+		}
+		got[hdr.Name] = manifestEntry{Name: hdr.Name, Size: n, SHA256: hex.EncodeToString(h.Sum(nil))}
+	}
+
+	// read on to the end, so the compressed stream and anything checking the archive
+	// as a whole, like an object's checksum, see all of it
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		return nil, err
+	}
+	if manifest == nil {
+		return nil, fmt.Errorf("archive has no %s, it is incomplete or not a gocask backup", backupManifestName)
+	}
+	for _, want := range manifest.Files {
+		if have, ok := got[want.Name]; !ok {
+			return nil, fmt.Errorf("%s is listed in the manifest but missing", want.Name)
+		} else if have != want {
+			return nil, fmt.Errorf("%s: size/checksum mismatch (got %d bytes %s, want %d bytes %s)",
+				want.Name, have.Size, have.SHA256, want.Size, want.SHA256)
+		}
+		delete(got, want.Name)
+	}
+	for name := range got {
+		return nil, fmt.Errorf("%s is not listed in the manifest", name)
+	}
+
+	return manifest, verifyFiles(dir, base, manifest)
+}
+
+// verifyFiles decodes every restored record and checks each hint points inside its
+// segment, which is in base if the archive doesn't have it.
+func verifyFiles(dir, base string, manifest *backupManifest) error {
+	sizes := make(map[string]int64)
+	for _, name := range manifest.Segments {
+		if fi, err := os.Stat(filepath.Join(base, restoredPath(name))); err == nil {
+			sizes[name] = fi.Size()
+		}
+	}
+	for _, e := range manifest.Files {
+		sizes[e.Name] = e.Size
+	}
+	for _, e := range manifest.Files {
+		path := filepath.Join(dir, restoredPath(e.Name))
+		if e.Name == legacyFormatFile {
+			continue // opening the store checks the version
+		}
+		if strings.HasSuffix(e.Name, ".hint") {
+			segment := strings.TrimSuffix(e.Name, ".hint") + ".log"
+			limit, ok := sizes[segment]
+			if !ok && manifest.Since != 0 {
+				return fmt.Errorf("%s is missing, restore the backups this one builds on first, in order", segment)
+			} else if !ok {
+				return fmt.Errorf("%s has no matching %s", e.Name, segment)
+			}
+			err := scanHint(path, defaultReadAhead, func(pos int64, key []byte, off int64, valLen uint32, _ byte) error {
+				if off+headerSize+int64(len(key))+int64(valLen) > limit {
+					return fmt.Errorf("%s: entry for %q points past the end of %s", e.Name, key, segment)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if err := scanFile(path, defaultReadAhead, func(int64, record) error { return nil }); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Restore unpacks an archive Backup wrote into dir, which must be empty or not exist
+// yet. The files are unpacked and checked against the manifest and the record format
+// beside dir, and only take its place once all of them check out.
+func Restore(r io.Reader, dir string) error {
+	_, err := restore(r, dir)
+	return err
+}
+
+func restore(r io.Reader, dir string) (*backupManifest, error) {
+	if entries, err := os.ReadDir(dir); err == nil && len(entries) > 0 {
+		return nil, fmt.Errorf("%s is not empty, restore needs a fresh directory", dir)
+	}
+	tmp := filepath.Clean(dir) + ".restoring"
+	if err := os.Mkdir(tmp, 0755); err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+
+	manifest, err := readBackup(r, tmp, tmp)
+	if err != nil {
+		return nil, err
+	}
+	return manifest, installFull(tmp, dir, manifest)
+}
+
+// installFull moves the full backup readBackup unpacked into tmp into place as dir,
+// which is empty or missing.
+func installFull(tmp, dir string, manifest *backupManifest) error {
+	if manifest.Since != 0 {
+		return fmt.Errorf("incremental backup after sequence number %d, restore the backups it builds on first", manifest.Since)
+	}
+	os.Remove(dir)
+	return os.Rename(tmp, dir)
+}
+
+// ApplyIncremental restores an incremental backup over the store in dir, which
+// holds a restored full backup and any incremental ones taken between it and this
+// one, applied in order. The store mustn't be open. The archive is checked in full
+// before dir changes; if applying it is interrupted, apply it again.
+func ApplyIncremental(r io.Reader, dir string) error {
+	_, err := applyIncremental(r, dir)
+	return err
+}
+
+func applyIncremental(r io.Reader, dir string) (*backupManifest, error) {
+	// the backups before it may have been restored by a gocask that kept every file
+	// at the top of the directory
+	if err := upgradeLayout(dir, defaultLogger); err != nil {
+		return nil, err
+	}
+	tmp := filepath.Clean(dir) + ".restoring"
+	if err := os.Mkdir(tmp, 0755); err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+
+	manifest, err := readBackup(r, tmp, dir)
+	if err != nil {
+		return nil, err
+	}
+	return manifest, installIncremental(tmp, dir, manifest)
+}
+
+// installIncremental moves the incremental backup readBackup unpacked into tmp over
+// the store in dir.
+func installIncremental(tmp, dir string, manifest *backupManifest) error {
+	if manifest.Since == 0 {
+		return fmt.Errorf("not an incremental backup, restore it into a fresh directory")
+	}
+	carried := make(map[string]bool)
+	for _, e := range manifest.Files {
+		carried[e.Name] = true
+	}
+	kept := make(map[string]bool)
+	for _, name := range manifest.Segments {
+		kept[name] = true
+		if _, err := os.Stat(filepath.Join(dir, restoredPath(name))); err != nil && !carried[name] {
+			return fmt.Errorf("%s is missing, restore the backups this one builds on first, in order", name)
+		}
+	}
+
+	// new segments go in before anything that may refer to them, and segments merged
+	// away since the last backup go last, as a merge removes them
+	for _, e := range manifest.Files {
+		if err := os.Rename(filepath.Join(tmp, restoredPath(e.Name)), filepath.Join(dir, restoredPath(e.Name))); err != nil {
+			return err
+		}
+	}
+	for _, name := range appendedFiles {
+		if !carried[archiveName(name)] {
+			if err := os.Remove(filepath.Join(dir, name)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	logs, _, err := segmentFiles(dir)
+	if err != nil {
+		return err
+	}
+	for _, l := range logs {
+		if name := filepath.Base(l); !kept[name] {
+			if err := os.Remove(hintFile(l)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			if err := os.Remove(l); err != nil {
+				return err
+			}
+		}
+	}
+	for _, d := range []string{segmentsDir, hintsDir} {
+		if err := syncDir(filepath.Join(dir, d)); err != nil {
+			return err
+		}
+	}
+	return syncDir(dir)
+}
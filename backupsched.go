@@ -0,0 +1,405 @@
+package gocask
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule says when something recurring runs next.
+type Schedule interface {
+	// Next returns the first time after t it runs.
+	Next(t time.Time) time.Time
+}
+
+// everySchedule runs at a fixed interval.
+type everySchedule time.Duration
+
+func (e everySchedule) Next(t time.Time) time.Time { return t.Add(time.Duration(e)) }
+
+// cronSchedule runs at the minutes matching a cron expression, in local time. Each
+// field is a bitmask of the values it allows.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	anyDom, anyDow                bool // the field was *, see matchDay
+}
+
+var cronShorthands = map[string]string{
+	"@hourly":  "0 * * * *",
+	"@daily":   "0 0 * * *",
+	"@weekly":  "0 0 * * 0",
+	"@monthly": "0 0 1 * *",
+}
+
+// ParseSchedule parses an interval like "6h", or a cron expression, "minute hour
+// day-of-month month day-of-week", each field *, a value, a range a-b, a step */n or
+// a-b/n, or a comma-separated list of those, e.g. "30 2 * * mon-fri". @hourly,
+// @daily, @weekly and @monthly are short for the usual expressions.
+func ParseSchedule(s string) (Schedule, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		if d < time.Minute {
+			return nil, fmt.Errorf("schedule %q: run at most once a minute", s)
+		}
+		return everySchedule(d), nil
+	}
+	expr := s
+	if long, ok := cronShorthands[s]; ok {
+		expr = long
+	}
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("schedule %q: want an interval like 6h or a cron expression like \"0 3 * * *\"", s)
+	}
+	var c cronSchedule
+	for i, f := range []struct {
+		mask     *uint64
+		min, max int
+		names    []string
+	}{
+		{&c.minute, 0, 59, nil},
+		{&c.hour, 0, 23, nil},
+		{&c.dom, 1, 31, nil},
+		{&c.month, 1, 12, []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}},
+		{&c.dow, 0, 7, weekdays},
+	} {
+		mask, err := parseCronField(fields[i], f.min, f.max, f.names)
+		if err != nil {
+			return nil, fmt.Errorf("schedule %q: field %d: %w", s, i+1, err)
+		}
+		*f.mask = mask
+	}
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1 // 7 is sunday too
+	}
+	c.anyDom, c.anyDow = fields[2] == "*", fields[4] == "*"
+	return c, nil
+}
+
+func parseCronField(f string, min, max int, names []string) (uint64, error) {
+	value := func(s string) (int, error) {
+		for i, name := range names {
+			if strings.EqualFold(s, name) {
+				return i + min, nil
+			}
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil || n < min || n > max {
+			return 0, fmt.Errorf("%q isn't a value from %d to %d", s, min, max)
+		}
+		return n, nil
+	}
+	var mask uint64
+	for _, part := range strings.Split(f, ",") {
+		rng, step, hasStep := strings.Cut(part, "/")
+		lo, hi := min, max
+		if rng != "*" {
+			from, to, isRange := strings.Cut(rng, "-")
+			var err error
+			if lo, err = value(from); err != nil {
+				return 0, err
+			}
+			hi = lo
+			if isRange {
+				if hi, err = value(to); err != nil {
+					return 0, err
+				}
+			} else if hasStep {
+				hi = max
+			}
+			if hi < lo {
+				return 0, fmt.Errorf("range %q runs backwards", rng)
+			}
+		}
+		n := 1
+		if hasStep {
+			var err error
+			if n, err = strconv.Atoi(step); err != nil || n <= 0 {
+				return 0, fmt.Errorf("bad step %q", step)
+			}
+		}
+		for v := lo; v <= hi; v += n {
+			mask |= 1 << v
+		}
+	}
+	return mask, nil
+}
+
+// matchDay applies cron's rule for the two day fields: if both are restricted a day
+// matching either will do.
+func (c cronSchedule) matchDay(t time.Time) bool {
+	dom, dow := c.dom&(1<<t.Day()) != 0, c.dow&(1<<int(t.Weekday())) != 0
+	switch {
+	case c.anyDom && c.anyDow:
+		return true
+	case c.anyDom:
+		return dow
+	case c.anyDow:
+		return dom
+	default:
+		return dom || dow
+	}
+}
+
+func (c cronSchedule) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	// a valid expression matches within a few years; give up well after that
+	for limit := t.AddDate(5, 0, 0); t.Before(limit); {
+		switch {
+		case c.month&(1<<int(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !c.matchDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case c.hour&(1<<t.Hour()) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case c.minute&(1<<t.Minute()) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// BackupRetention says which scheduled backups to keep: the Last newest ones, and
+// the newest of each of the last Daily days, Weekly weeks and Monthly months that
+// have one, in local time. A backup any of them keeps is kept; zero keeps them all.
+type BackupRetention struct {
+	Last, Daily, Weekly, Monthly int
+}
+
+func (r BackupRetention) keepsAll() bool { return r == BackupRetention{} }
+
+// ParseBackupRetention parses a retention as gocask serve --backup-keep takes it:
+// space-separated last=<n>, daily=<n>, weekly=<n> and monthly=<n> settings.
+func ParseBackupRetention(s string) (BackupRetention, error) {
+	var r BackupRetention
+	for _, f := range strings.Fields(s) {
+		name, value, _ := strings.Cut(f, "=")
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return r, fmt.Errorf("backup retention %q: %s wants a count", s, name)
+		}
+		switch name {
+		case "last":
+			r.Last = n
+		case "daily":
+			r.Daily = n
+		case "weekly":
+			r.Weekly = n
+		case "monthly":
+			r.Monthly = n
+		default:
+			return r, fmt.Errorf("backup retention %q: unknown setting %q", s, name)
+		}
+	}
+	return r, nil
+}
+
+// keep returns which of the backups taken at times, sorted newest first, r keeps.
+func (r BackupRetention) keep(times []time.Time) []bool {
+	kept := make([]bool, len(times))
+	for i := range times {
+		kept[i] = r.keepsAll() || i < r.Last
+	}
+	for _, rule := range []struct {
+		n      int
+		period func(t time.Time) string
+	}{
+		{r.Daily, func(t time.Time) string { return t.Format("2006-01-02") }},
+		{r.Weekly, func(t time.Time) string {
+			y, w := t.ISOWeek()
+			return fmt.Sprintf("%d-%d", y, w)
+		}},
+		{r.Monthly, func(t time.Time) string { return t.Format("2006-01") }},
+	} {
+		seen := make(map[string]bool)
+		for i, t := range times {
+			p := rule.period(t.Local())
+			if len(seen) == rule.n && !seen[p] {
+				break
+			}
+			if !seen[p] {
+				seen[p] = true
+				kept[i] = true
+			}
+		}
+	}
+	return kept
+}
+
+// Scheduled backups are named gocask-<UTC time>.<format>, so they sort by age.
+const (
+	scheduledBackupPrefix = "gocask-"
+	scheduledBackupTime   = "20060102T150405Z"
+)
+
+// BackupScheduler takes full backups of the store on a schedule and prunes old ones.
+// Backups are always full, so pruning never breaks a chain of incremental ones.
+type BackupScheduler struct {
+	DB       *DB
+	Schedule Schedule
+	Dest     ObjectStore
+	Prefix   string // prepended to the backups' names in Dest
+	Format   string // tar.zst, tar.gz or tar
+	Keep     BackupRetention
+}
+
+// Run takes backups when the schedule says until stop is closed. A backup that is
+// still running then is abandoned. Only cutting the backup holds the store's mu.
+func (bs *BackupScheduler) Run(stop <-chan struct{}) {
+	// the metrics start from what the last scheduled backup, maybe taken by another
+	// process, left in the store
+	unlock := bs.DB.rlock()
+	st, ok := bs.DB.s.loadBackupStatus()
+	unlock()
+	if ok {
+		bs.DB.s.dir.metrics.setBackupStatus(st)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-stop
+		cancel()
+	}()
+	for {
+		now := time.Now()
+		next := bs.Schedule.Next(now)
+		if next.IsZero() {
+			bs.DB.s.dir.logger.Error("backup schedule never runs again")
+			return
+		}
+		timer := time.NewTimer(next.Sub(now))
+		select {
+		case <-stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		name, err := bs.backup(ctx, time.Now())
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			bs.DB.s.dir.logger.Error("scheduled backup failed", "err", err)
+		} else {
+			bs.DB.s.dir.logger.Info("scheduled backup finished", "name", name)
+		}
+		bs.DB.s.recordBackup(name, err)
+	}
+}
+
+// backup takes one backup named for now and prunes what Keep no longer keeps.
+func (bs *BackupScheduler) backup(ctx context.Context, now time.Time) (string, error) {
+	name := bs.Prefix + scheduledBackupPrefix + now.UTC().Format(scheduledBackupTime) + "." + bs.Format
+	if _, err := UploadBackup(ctx, bs.Dest, name, func(w io.Writer) (int64, error) { return bs.DB.BackupSince(w, 0) }); err != nil {
+		return name, err
+	}
+	if bs.Keep.keepsAll() {
+		return name, nil
+	}
+	return name, bs.prune(ctx, name)
+}
+
+// prune deletes the scheduled backups Keep doesn't keep, along with their checksums,
+// sparing latest, the backup just taken.
+func (bs *BackupScheduler) prune(ctx context.Context, latest string) error {
+	names, err := bs.Dest.List(ctx, bs.Prefix+scheduledBackupPrefix)
+	if err != nil {
+		return err
+	}
+	type backup struct {
+		name string
+		at   time.Time
+	}
+	var backups []backup
+	for _, name := range names {
+		stamp, ok := strings.CutSuffix(strings.TrimPrefix(name, bs.Prefix+scheduledBackupPrefix), "."+bs.Format)
+		if !ok {
+			continue // a checksum, or a backup in another format
+		}
+		if at, err := time.Parse(scheduledBackupTime, stamp); err == nil {
+			backups = append(backups, backup{name, at})
+		}
+	}
+	sort.Slice(backups, func(i, j int) bool { return backups[i].at.After(backups[j].at) })
+	times := make([]time.Time, len(backups))
+	for i, b := range backups {
+		times[i] = b.at
+	}
+	for i, kept := range bs.Keep.keep(times) {
+		// latest stays whatever the clock says, should it have gone back since
+		// the backups that look newer
+		if kept || backups[i].name == latest {
+			continue
+		}
+		// the checksum goes first: a prune cut short leaves a backup the next one
+		// lists and deletes again, where a lone checksum would never be listed
+		name := backups[i].name
+		if err := bs.Dest.Delete(ctx, name+checksumSuffix); err != nil {
+			return err
+		}
+		if err := bs.Dest.Delete(ctx, name); err != nil {
+			return err
+		}
+		bs.DB.s.dir.logger.Info("pruned scheduled backup", "name", name)
+	}
+	return nil
+}
+
+// backupStatusKey holds the outcome of the last scheduled backups, so stats can show
+// it after serve has stopped.
+const backupStatusKey = internalPrefix + "backup/status"
+
+// BackupStatus is when scheduled backups last succeeded and failed.
+type BackupStatus struct {
+	LastSuccess time.Time `json:"last_success"`
+	LastName    string    `json:"last_name,omitempty"` // of the last successful one
+	LastFailure time.Time `json:"last_failure"`
+	LastError   string    `json:"last_error,omitempty"`
+}
+
+// recordBackup notes the outcome of a scheduled backup in the metrics and the store.
+func (s *store) recordBackup(name string, err error) {
+	st := s.dir.metrics.observeBackup(name, err)
+	b, _ := json.Marshal(st)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := put(backupStatusKey, string(b), s.f, s.w, s.keyDir); err != nil {
+		s.dir.logger.Warn("couldn't save the backup status", "err", err)
+	}
+}
+
+// loadBackupStatus reads the status the last scheduled backup left in the store.
+func (s *store) loadBackupStatus() (BackupStatus, bool) {
+	var st BackupStatus
+	v, err := get(backupStatusKey, s.keyDir)
+	if err != nil || json.Unmarshal([]byte(v), &st) != nil {
+		return st, false
+	}
+	return st, true
+}
+
+// backupStatsLine describes the last scheduled backups for stats.
+func (s *store) backupStatsLine() (string, bool) {
+	st, ok := s.dir.metrics.backupStatus()
+	if !ok {
+		if st, ok = s.loadBackupStatus(); !ok {
+			return "", false
+		}
+	}
+	line := "backups:     "
+	if st.LastSuccess.IsZero() {
+		line += "none succeeded yet"
+	} else {
+		line += fmt.Sprintf("last succeeded %s (%s)", st.LastSuccess.Format(time.RFC3339), st.LastName)
+	}
+	if !st.LastFailure.IsZero() {
+		line += fmt.Sprintf(", last failed %s: %s", st.LastFailure.Format(time.RFC3339), st.LastError)
+	}
+	return line, true
+}
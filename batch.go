@@ -0,0 +1,285 @@
+package gocask
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// A batch is written as a flagBatch record, with an empty key and count(4) | size(8)
+// as its value, followed by the count records of the batch, size bytes together. The
+// scans only hand out the records of a batch once all of them have been read, so a
+// batch torn by a crash is cut off the active file whole, like a torn record is.
+const batchValueSize = 4 + 8
+
+// batchHeaderSize is the size of a batch's flagBatch record.
+const batchHeaderSize = headerSize + batchValueSize
+
+// writeBatchHeader writes the record that opens a batch of count records taking
+// size bytes.
+func writeBatchHeader(w *bufio.Writer, count int, size int64, ts uint64) (int, error) {
+	var v [batchValueSize]byte
+	binary.BigEndian.PutUint32(v[:], uint32(count))
+	binary.BigEndian.PutUint64(v[4:], uint64(size))
+	return writeRecord(w, flagBatch, nil, v[:], ts)
+}
+
+// decodeBatch returns the record count and size of a batch from the value of its
+// flagBatch record; ok is false for values no batch is written with.
+func decodeBatch(value []byte) (count uint32, size int64, ok bool) {
+	if len(value) != batchValueSize {
+		return 0, 0, false
+	}
+	count, size = binary.BigEndian.Uint32(value), int64(binary.BigEndian.Uint64(value[4:]))
+	return count, size, count > 0 && size >= int64(count)*headerSize
+}
+
+// batchReader is how the scans hold back the records of a batch until the last of
+// them has been read. The zero value is reading no batch.
+type batchReader struct {
+	open       bool
+	start, end int64  // where the batch being read starts and ends
+	left       uint32 // how many of its records are still to come
+	header     record // a copy of the record opening it
+	held       []heldRecord
+}
+
+// heldRecord is a copy of a record of the batch being read and its offset.
+type heldRecord struct {
+	off int64
+	r   record
+}
+
+// begin starts reading the batch whose flagBatch record r is at off, dropping any
+// other. It reports false if r's value isn't that of a batch header.
+func (b *batchReader) begin(off int64, r record) bool {
+	count, span, ok := decodeBatch(r.value)
+	if !ok {
+		return false
+	}
+	b.drop()
+	b.open, b.start, b.end, b.left = true, off, off+r.size()+span, count
+	b.header = record{flag: r.flag, ts: r.ts, value: bytes.Clone(r.value)}
+	return true
+}
+
+// add holds a copy of r, the record at off, as the next of the batch being read, and
+// reports whether it was the last one. A record that runs past the end of the batch,
+// or a last one that doesn't end where the batch does, is an error and isn't held.
+func (b *batchReader) add(off int64, r record) (last bool, err error) {
+	if off+r.size() > b.end {
+		return false, fmt.Errorf("record at offset %d runs past the end of its batch", off)
+	}
+	if b.left == 1 && off+r.size() != b.end {
+		return false, fmt.Errorf("batch at offset %d isn't the size it says", b.start)
+	}
+	r.key, r.value = bytes.Clone(r.key), bytes.Clone(r.value)
+	b.held = append(b.held, heldRecord{off, r})
+	b.left--
+	return b.left == 0, nil
+}
+
+// flush hands the records of the batch to fn, in order, and ends it. With headers
+// fn gets the record opening the batch first.
+func (b *batchReader) flush(headers bool, fn func(off int64, r record) error) error {
+	defer b.drop()
+	if headers {
+		if err := fn(b.start, b.header); err != nil {
+			return err
+		}
+	}
+	for _, h := range b.held {
+		if err := fn(h.off, h.r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// drop forgets the batch being read.
+func (b *batchReader) drop() {
+	b.open, b.held = false, b.held[:0]
+}
+
+// Batch collects puts and deletes to apply to a DB all at once. Commit writes them
+// with a single flush and sync, and only then makes them visible, so readers see
+// either none of them or all; after a crash the store likewise holds all of them or
+// none. A Batch is not safe for concurrent use.
+type Batch struct {
+	db  *DB
+	ops []batchOp
+}
+
+type batchOp struct {
+	key, value string
+	del        bool
+}
+
+// NewBatch returns an empty batch for db.
+func (db *DB) NewBatch() *Batch {
+	return &Batch{db: db}
+}
+
+// Put stages setting key to value.
+func (b *Batch) Put(key, value string) {
+	b.ops = append(b.ops, batchOp{key: key, value: value})
+}
+
+// Delete stages removing key.
+func (b *Batch) Delete(key string) {
+	b.ops = append(b.ops, batchOp{key: key, del: true})
+}
+
+// Len is the number of staged operations.
+func (b *Batch) Len() int { return len(b.ops) }
+
+// Reset drops the staged operations, so the batch can be used again.
+func (b *Batch) Reset() { b.ops = b.ops[:0] }
+
+// Commit applies the staged operations, in order, and resets the batch. If writing
+// them fails, none is applied and they stay staged; an error after that, from the
+// audit log or the changefeed say, leaves them applied and the batch reset.
+func (b *Batch) Commit() error {
+	return b.CommitContext(context.Background())
+}
+
+// CommitContext is Commit for the actor ctx names, see ContextWithActor.
+func (b *Batch) CommitContext(ctx context.Context) error {
+	for _, op := range b.ops {
+		if err := checkKey(op.key); err != nil {
+			return err
+		}
+	}
+	defer b.db.lock()()
+	defer b.db.s.dir.actingFor(ctx)()
+	written, err := b.db.s.commitBatch(b.ops)
+	if written {
+		b.Reset()
+		if rerr := b.db.s.rotateIfFull(); err == nil {
+			err = rerr
+		}
+	}
+	return err
+}
+
+// commitBatch writes ops as one batch and then applies them to the index. Puts get
+// the default TTL of their key like any other, but are never split into chunks, and
+// each is checked against the quotas on its own. written reports whether the batch
+// made it to disk. Callers hold the store's mu.
+func (s *store) commitBatch(ops []batchOp) (written bool, err error) {
+	d, keyDir := s.dir, s.keyDir
+	if len(ops) == 0 {
+		return true, nil
+	}
+	if err := d.checkWritable(); err != nil {
+		return false, err
+	}
+	type entry struct {
+		ts, expires uint64
+		fo          FileOffset
+	}
+	recs := make([]entry, len(ops))
+	var size int64
+	for i, op := range ops {
+		r := &recs[i]
+		r.ts = d.newTimestamp()
+		n := len(op.value)
+		if !op.del {
+			r.expires = d.defaultExpiry(op.key)
+			prev, had := keyDir.Get(op.key)
+			if err := checkQuotas(op.key, prev, had, d.putSize(op.key, n, nil, r.expires), keyDir); err != nil {
+				return false, err
+			}
+			if r.expires != 0 {
+				n += expirySize
+			}
+		}
+		r.fo = newFileOffset(d.active, 0, flagNormal, uint32(n))
+		size += r.fo.recordSize(op.key)
+	}
+
+	start, err := s.f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return false, err
+	}
+	w := s.w
+	n, err := writeBatchHeader(w, len(ops), size, d.newTimestamp())
+	off := start + int64(n)
+	for i := 0; i < len(ops) && err == nil; i++ {
+		op, r := ops[i], &recs[i]
+		flag := flagNormal
+		switch {
+		case op.del:
+			flag = flagTombstone
+			n, err = writeTombstone(w, []byte(op.key), r.ts)
+		case r.expires != 0:
+			flag = flagExpiring
+			n, err = writeExpiring(w, []byte(op.key), []byte(op.value), r.ts, r.expires)
+		default:
+			n, err = writeEntry(w, []byte(op.key), []byte(op.value), r.ts)
+		}
+		r.fo = newFileOffset(d.active, off, flag, r.fo.ValueSize())
+		off += int64(n)
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = d.syncActive(s.f)
+	}
+	if err != nil {
+		return false, d.abortAppend(s.f, w, start, err)
+	}
+	d.activeSize += off - start
+	d.metrics.bytesWritten.Add(uint64(off - start))
+
+	// everything is on disk: only now does any of it become visible
+	prevs := make([]FileOffset, len(ops))
+	for i, op := range ops {
+		prevs[i], _ = keyDir.Get(op.key)
+		d.cache.invalidate(op.key)
+		keyDir.set(op.key, recs[i].fo)
+	}
+	for i, op := range ops {
+		r := recs[i]
+		if op.del {
+			d.accesses.forget(op.key)
+			d.metrics.deletes.Add(1)
+			d.fireDelete(op.key)
+			if err := d.auditWrite("del", op.key, 0, r.ts); err != nil {
+				return true, err
+			}
+			if err := d.appendChange(flagTombstone, []byte(op.key), nil, r.ts, 0, nil); err != nil {
+				return true, err
+			}
+		} else {
+			d.accesses.touch(op.key)
+			d.metrics.puts.Add(1)
+			d.firePut(op.key, op.value)
+			if err := d.auditWrite("put", op.key, len(op.value), r.ts); err != nil {
+				return true, err
+			}
+			if err := d.appendChange(r.fo.flag(), []byte(op.key), []byte(op.value), r.ts, r.expires, nil); err != nil {
+				return true, err
+			}
+		}
+		if err := dropChunks(op.key, prevs[i], r.ts, s.f, w, keyDir); err != nil {
+			return true, err
+		}
+	}
+	for _, op := range ops {
+		if op.del {
+			continue
+		}
+		if err := evictOverflow(op.key, s.f, w, keyDir); err != nil {
+			return true, err
+		}
+		if err := evictQuotas(op.key, s.f, w, keyDir); err != nil {
+			return true, err
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,193 @@
+package gocask
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestBatchCommit(t *testing.T) {
+	db, err := Open(t.TempDir(), WithQuotas(Quota{Prefix: "q/", MaxBytes: 100}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Put("gone", "v"); err != nil {
+		t.Fatal(err)
+	}
+	pos := changesEnd(t, db)
+
+	b := db.NewBatch()
+	b.Put("a", "1")
+	b.Put("b", "2")
+	b.Delete("gone")
+	b.Put("a", "3")
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if b.Len() != 0 {
+		t.Errorf("%d operations still staged after the commit", b.Len())
+	}
+	if got := fmt.Sprint(db.Keys()); got != "[a b]" {
+		t.Errorf("keys after the commit: %s", got)
+	}
+	if v, err := db.Get("a"); err != nil || v != "3" {
+		t.Errorf("a = %q, %v; the later put in a batch wins", v, err)
+	}
+	if got := readChanges(t, db, pos); fmt.Sprint(got) != "[a b gone a]" {
+		t.Errorf("changes of the batch: %v", got)
+	}
+
+	// one operation refused refuses them all, and leaves them staged
+	b.Put("c", "4")
+	b.Put("q/big", string(make([]byte, 200)))
+	if err := b.Commit(); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("commit past a quota: %v", err)
+	}
+	if b.Len() != 2 {
+		t.Errorf("%d operations staged after a failed commit, want 2", b.Len())
+	}
+	if _, err := db.Get("c"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("c after a failed commit: %v", err)
+	}
+}
+
+// changesEnd is the position after the last change db journaled.
+func changesEnd(t *testing.T, db *DB) Position {
+	t.Helper()
+	s, err := db.Changes(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for s.Next() {
+	}
+	return s.Pos()
+}
+
+// A reader sees either all of a batch or none of it.
+func TestBatchIsAtomicToReaders(t *testing.T) {
+	db, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	const keys = 5
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(stop)
+		b := db.NewBatch()
+		for i := 0; i < 200; i++ {
+			for k := 0; k < keys; k++ {
+				b.Put(fmt.Sprint("k", k), fmt.Sprint(i))
+			}
+			if err := b.Commit(); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	for {
+		select {
+		case <-stop:
+			wg.Wait()
+			return
+		default:
+		}
+		// all the keys as they are at one moment
+		unlock := db.rlock()
+		var first string
+		for k := 0; k < keys; k++ {
+			v, _, err := db.s.liveGet(fmt.Sprint("k", k))
+			if err != nil {
+				unlock()
+				t.Fatal(err)
+			}
+			if k == 0 {
+				first = v
+			} else if v != first {
+				unlock()
+				t.Fatalf("k0 = %q but k%d = %q: a batch was half applied", first, k, v)
+			}
+		}
+		unlock()
+	}
+}
+
+// A batch torn by a crash is dropped whole when the store is opened again, even
+// the records of it that made it to disk.
+func TestBatchTornTail(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := db.NewBatch()
+	b.Put("a", "1")
+	b.Put("b", "2")
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	active := filepath.Join(dir, activeFile)
+	fi, err := os.Stat(active)
+	if err != nil {
+		t.Fatal(err)
+	}
+	committed := fi.Size()
+	b.Put("c", "3")
+	b.Put("d", "4")
+	b.Put("e", "5")
+	b.Delete("a")
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// tear the last record of the second batch: its first three are whole
+	if fi, err = os.Stat(active); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(active, fi.Size()-3); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := OpenStrict(dir); err == nil {
+		t.Fatal("strict open of a torn batch: no error")
+	}
+	db, err = Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info := db.Recovery(); info.Truncated != fi.Size()-3-committed {
+		t.Errorf("truncated %d bytes, want the %d of the torn batch", info.Truncated, fi.Size()-3-committed)
+	}
+	if got := fmt.Sprint(db.Keys()); got != "[a b]" {
+		t.Errorf("keys after dropping the torn batch: %s", got)
+	}
+
+	// what is written next lands after the first batch and reads back
+	if err := db.Put("f", "6"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if info := db.Recovery(); !info.Clean() {
+		t.Errorf("reopen after the repair: %s", info.String())
+	}
+	if got := fmt.Sprint(db.Keys()); got != "[a b f]" {
+		t.Errorf("keys after the repair: %s", got)
+	}
+}
@@ -0,0 +1,331 @@
+package gocask
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// Benchmarks for the codecs, the store's write and read paths, rebuilding the index
+// on open, merging, and reads from many goroutines; run the last with -cpu 1,2,4,8.
+// Each store or data directory is a temporary one of its own.
+
+// benchSize is a key and value size the store benchmarks are run at.
+type benchSize struct {
+	name       string
+	key, value int
+}
+
+var benchSizes = []benchSize{
+	{"k16v16", 16, 16},
+	{"k32v1k", 32, 1 << 10},
+	{"k64v64k", 64, 64 << 10},
+}
+
+// benchCount names a key count: 10k, 1m.
+func benchCount(n int) string {
+	if n >= 1_000_000 {
+		return strconv.Itoa(n/1_000_000) + "m"
+	}
+	return strconv.Itoa(n/1000) + "k"
+}
+
+var benchValue = bytes.Repeat([]byte("v"), 100)
+
+// benchKey is key i padded to size bytes.
+func benchKey(i, size int) string { return fmt.Sprintf("key%0*d", size-3, i) }
+
+// benchKeys is the first n keys of size bytes.
+func benchKeys(n, size int) []string {
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = benchKey(i, size)
+	}
+	return keys
+}
+
+// benchRecords is a data file of n records with 10-byte keys and 100-byte values.
+func benchRecords(n int) []byte {
+	return benchRecordsSized(n, benchSize{key: 10, value: len(benchValue)})
+}
+
+func benchRecordsSized(n int, sz benchSize) []byte {
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	value := bytes.Repeat([]byte("v"), sz.value)
+	for i := 0; i < n; i++ {
+		writeEntry(w, []byte(benchKey(i, sz.key)), value, uint64(i+1)<<16)
+	}
+	w.Flush()
+	return buf.Bytes()
+}
+
+// benchStore opens a store in a temporary directory, closed when the benchmark ends.
+func benchStore(b *testing.B) *DB {
+	db, err := Open(b.TempDir())
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { db.Close() })
+	return db
+}
+
+// benchDataDir is a data directory laid out in a temporary directory.
+func benchDataDir(b *testing.B) *dataDir {
+	dir := b.TempDir()
+	if err := upgradeLayout(dir, defaultLogger); err != nil {
+		b.Fatal(err)
+	}
+	return newDataDir(dir)
+}
+
+// benchCompact merges the store every so often with the timer stopped, so long runs
+// of writes with big values don't fill the disk.
+func benchCompact(b *testing.B, db *DB, i int) {
+	if i%1000 != 999 {
+		return
+	}
+	b.StopTimer()
+	db.s.mu.Lock()
+	err := db.s.rotate()
+	db.s.mu.Unlock()
+	if err != nil {
+		b.Fatal(err)
+	}
+	db.s.dir.mergeTail.Wait()
+	b.StartTimer()
+}
+
+func BenchmarkWriteRecord(b *testing.B) {
+	w := bufio.NewWriter(io.Discard)
+	key := []byte("key0000001")
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		writeEntry(w, key, benchValue, uint64(i+1)<<16)
+	}
+}
+
+func BenchmarkScanRecords(b *testing.B) {
+	data := benchRecords(1000)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		scanRecords("bench", newScanReader(bytes.NewReader(data), defaultReadAhead), int64(len(data)), func(int64, record) error { return nil })
+	}
+}
+
+func BenchmarkWriteHint(b *testing.B) {
+	w := bufio.NewWriter(io.Discard)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		writeHintEntry(w, "key0000001", int64(i), uint32(len(benchValue)), flagNormal)
+	}
+}
+
+func BenchmarkScanHints(b *testing.B) {
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	for i := 0; i < 1000; i++ {
+		writeHintEntry(w, fmt.Sprintf("key%07d", i), int64(i)*127, uint32(len(benchValue)), flagNormal)
+	}
+	w.Flush()
+	data := buf.Bytes()
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		scanHints("bench", newScanReader(bytes.NewReader(data), defaultReadAhead), int64(len(data)), func(int64, []byte, int64, uint32, byte) error { return nil })
+	}
+}
+
+// BenchmarkPut puts 1000 keys over and over, each flushed like the store does.
+func BenchmarkPut(b *testing.B) {
+	for _, sz := range benchSizes {
+		b.Run(sz.name, func(b *testing.B) {
+			db := benchStore(b)
+			keys := benchKeys(1000, sz.key)
+			value := strings.Repeat("v", sz.value)
+			b.ReportAllocs()
+			b.SetBytes(int64(sz.key + sz.value))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := db.Put(keys[i%len(keys)], value); err != nil {
+					b.Fatal(err)
+				}
+				benchCompact(b, db, i)
+			}
+		})
+	}
+}
+
+// BenchmarkDelete deletes keys that were put just before, with the timer stopped.
+func BenchmarkDelete(b *testing.B) {
+	for _, sz := range benchSizes {
+		b.Run(sz.name, func(b *testing.B) {
+			db := benchStore(b)
+			keys := benchKeys(1000, sz.key)
+			value := strings.Repeat("v", sz.value)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				key := keys[i%len(keys)]
+				b.StopTimer()
+				if err := db.Put(key, value); err != nil {
+					b.Fatal(err)
+				}
+				b.StartTimer()
+				if err := db.Delete(key); err != nil {
+					b.Fatal(err)
+				}
+				benchCompact(b, db, i)
+			}
+		})
+	}
+}
+
+// BenchmarkGet reads 1000 keys of a sealed segment in turn, in each read mode.
+func BenchmarkGet(b *testing.B) {
+	for _, sz := range benchSizes {
+		for m := ReadPread; m <= ReadMmapZeroCopy; m++ {
+			b.Run(sz.name+"/"+m.String(), func(b *testing.B) {
+				keyDir := benchSegment(b, 1000, sz)
+				keyDir.dir.readers.setMode(m)
+				keys := benchKeys(1000, sz.key)
+				b.ReportAllocs()
+				b.SetBytes(int64(sz.value))
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if _, err := getRecord(keys[i%len(keys)], keyDir); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+// BenchmarkGetParallel reads 10000 keys of a sealed segment from GOMAXPROCS
+// goroutines.
+func BenchmarkGetParallel(b *testing.B) {
+	sz := benchSize{key: 16, value: len(benchValue)}
+	keyDir := benchSegment(b, 10_000, sz)
+	keys := benchKeys(10_000, sz.key)
+	var start atomic.Int64
+	b.ReportAllocs()
+	b.SetBytes(int64(sz.value))
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		// goroutines start at different keys so they don't read the same records
+		i := int(start.Add(7919))
+		for pb.Next() {
+			if _, err := getRecord(keys[i%len(keys)], keyDir); err != nil {
+				b.Error(err)
+				return
+			}
+			i++
+		}
+	})
+}
+
+// benchSegment writes segment 1 of a new data directory with n records of size sz
+// and indexes it.
+func benchSegment(b *testing.B, n int, sz benchSize) *KeyDir {
+	d := benchDataDir(b)
+	name := d.file(segmentFile(1))
+	if err := os.WriteFile(name, benchRecordsSized(n, sz), 0644); err != nil {
+		b.Fatal(err)
+	}
+	keyDir := newKeyDir()
+	keyDir.dir = d
+	if _, err := loadSegment(name, keyDir, &RecoveryReport{}, defaultReadAhead); err != nil {
+		b.Fatal(err)
+	}
+	return keyDir
+}
+
+// BenchmarkOpen times rebuilding the index of a store holding keys keys with 32-byte
+// values, in segments of up to 100k records. Without hints every segment is scanned.
+func BenchmarkOpen(b *testing.B) {
+	root := b.TempDir()
+	for _, keys := range []int{10_000, 100_000, 1_000_000} {
+		name := benchCount(keys)
+		b.Run(name, benchOpen(filepath.Join(root, name), keys, true))
+	}
+	b.Run("scan/"+benchCount(100_000), benchOpen(filepath.Join(root, "scan"), 100_000, false))
+}
+
+// benchOpen is the open benchmark of the store in dir, which its first run writes
+// and later runs reuse.
+func benchOpen(dir string, keys int, hints bool) func(b *testing.B) {
+	const perSegment = 100_000
+	sz := benchSize{key: 16, value: 32}
+	return func(b *testing.B) {
+		d := newDataDir(dir)
+		if _, err := os.Stat(dir); err != nil {
+			if err := upgradeLayout(dir, defaultLogger); err != nil {
+				b.Fatal(err)
+			}
+			value := bytes.Repeat([]byte("v"), sz.value)
+			for seg := 1; (seg-1)*perSegment < keys; seg++ {
+				var buf bytes.Buffer
+				w := bufio.NewWriter(&buf)
+				for i := (seg - 1) * perSegment; i < keys && i < seg*perSegment; i++ {
+					writeEntry(w, []byte(benchKey(i, sz.key)), value, uint64(i+1)<<16)
+				}
+				w.Flush()
+				name := d.file(segmentFile(int64(seg)))
+				if err := os.WriteFile(name, buf.Bytes(), 0644); err != nil {
+					b.Fatal(err)
+				}
+				if err := writeHintFor(name, hintFile(name), defaultReadAhead); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if !hints {
+				b.StopTimer()
+				hintFiles, _ := filepath.Glob(d.file(filepath.Join(hintsDir, "data_*.hint")))
+				for _, h := range hintFiles {
+					os.Remove(h)
+				}
+				b.StartTimer()
+			}
+			keyDir, _, err := rebuildKeyDir(d, openRepairs)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if keyDir.Len() != keys {
+				b.Fatalf("rebuilt %d keys, want %d", keyDir.Len(), keys)
+			}
+		}
+		b.ReportMetric(float64(keys)*float64(b.N)/b.Elapsed().Seconds(), "keys/s")
+	}
+}
+
+func BenchmarkMerge(b *testing.B) {
+	d := benchDataDir(b)
+	data := benchRecords(1000)
+	var files []string
+	for i := 1; i <= 4; i++ {
+		name := d.file(segmentFile(int64(i)))
+		if err := os.WriteFile(name, data, 0644); err != nil {
+			b.Fatal(err)
+		}
+		files = append(files, name)
+	}
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data) * len(files)))
+	for i := 0; i < b.N; i++ {
+		if err := mergeFiles(d, append([]string(nil), files...), newKeyDir()); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package gocask
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// bulkTmp and bulkTmpHint are where a bulk load writes its segment and hint until
+// they are complete.
+const (
+	bulkTmp     = segmentsDir + "/bulkload.tmp"
+	bulkTmpHint = hintsDir + "/bulkload.tmp"
+)
+
+// BulkOptions tune BulkLoad.
+type BulkOptions struct {
+	// BufferSize is the write buffer in bytes; 0 means 4 MiB.
+	BufferSize int
+	// Unique promises that no key comes twice. The hint is then written alongside the
+	// segment instead of by reading the segment back once it is done.
+	Unique bool
+}
+
+// BulkLoad writes every pair next returns, until it returns io.EOF, into one new
+// segment, and only then adds them to the index. There is no flush or index update
+// per record, so it is much faster than Put for filling a store, but nothing it
+// writes is visible before it returns. A failure leaves the store as it was; after a
+// crash it holds either none of the records or all of them. The records skip hooks,
+// the audit log and the changefeed, but not default and retention TTLs.
+// Anything already in the active file is sealed and merged first, so the loaded
+// values win over it.
+func (db *DB) BulkLoad(next func() (key, value string, err error), opts BulkOptions) (int, error) {
+	defer db.lock()()
+	return db.s.bulkLoad(next, opts)
+}
+
+// bulkLoad is DB.BulkLoad for callers holding the store's mu.
+func (s *store) bulkLoad(next func() (key, value string, err error), opts BulkOptions) (int, error) {
+	if err := s.dir.checkWritable(); err != nil {
+		return 0, err
+	}
+	if opts.BufferSize <= 0 {
+		opts.BufferSize = 4 << 20
+	}
+	if s.dir.activeSize > 0 {
+		if err := s.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	tmp, tmpHint := s.dir.file(bulkTmp), s.dir.file(bulkTmpHint)
+	os.Remove(tmp)
+	os.Remove(tmpHint)
+	n, written, err := s.dir.writeBulk(tmp, tmpHint, next, opts)
+	if err == nil {
+		err = s.sealBulk(tmp, tmpHint, opts.Unique)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		os.Remove(tmpHint)
+		if isDiskFull(err) {
+			s.dir.metrics.diskFull.Add(1)
+			s.dir.logger.Error("disk full, bulk load failed", "err", err)
+			s.dir.fireDiskFull(err)
+		}
+		return 0, fmt.Errorf("bulk load: %w", err)
+	}
+	s.dir.metrics.puts.Add(uint64(n))
+	s.dir.metrics.bytesWritten.Add(uint64(written))
+	s.dir.logger.Info("bulk load done", "records", n, "bytes", written)
+	return n, nil
+}
+
+// writeBulk writes the records into tmp, and their hint into tmpHint if unique, and
+// syncs both. It returns how many records and bytes it wrote.
+func (d *dataDir) writeBulk(tmp, tmpHint string, next func() (key, value string, err error), opts BulkOptions) (int, int64, error) {
+	f, err := os.Create(tmp)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+	w := bufio.NewWriterSize(f, opts.BufferSize)
+
+	var hf *os.File
+	var hw *bufio.Writer
+	if opts.Unique {
+		if hf, err = os.Create(tmpHint); err != nil {
+			return 0, 0, err
+		}
+		defer hf.Close()
+		hw = bufio.NewWriterSize(hf, opts.BufferSize/4)
+	}
+
+	var n int
+	var off int64
+	for {
+		key, value, err := next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return n, off, fmt.Errorf("record %d: %w", n+1, err)
+		}
+		if err := checkKey(key); err != nil {
+			return n, off, fmt.Errorf("record %d: %w", n+1, err)
+		}
+		flag, valLen := flagNormal, len(value)
+		var size int
+		if expires := d.defaultExpiry(key); expires != 0 {
+			flag, valLen = flagExpiring, expirySize+len(value)
+			size, err = writeExpiring(w, []byte(key), []byte(value), d.newTimestamp(), expires)
+		} else {
+			size, err = writeEntry(w, []byte(key), []byte(value), d.newTimestamp())
+		}
+		if err != nil {
+			return n, off, err
+		}
+		if hw != nil {
+			writeHintEntry(hw, key, off, uint32(valLen), flag)
+		}
+		off += int64(size)
+		n++
+	}
+	if err := w.Flush(); err != nil {
+		return n, off, err
+	}
+	if err := f.Sync(); err != nil {
+		return n, off, err
+	}
+	if hw != nil {
+		if err := hw.Flush(); err != nil {
+			return n, off, err
+		}
+		if err := hf.Sync(); err != nil {
+			return n, off, err
+		}
+	}
+	return n, off, nil
+}
+
+// sealBulk renames the finished tmp into the newest segment, gives it a hint, tmpHint
+// if unique, and indexes it. The segment goes first, as a hint without its segment is
+// quarantined on open; if anything after that fails both are taken out again.
+func (s *store) sealBulk(tmp, tmpHint string, unique bool) error {
+	lock := lockStore(s.path)
+	if err := lock.Lock(); err != nil {
+		return fmt.Errorf("lock store: %w", err)
+	}
+	defer lock.Unlock()
+
+	segment, err := newSegmentName(s.path)
+	if err != nil {
+		return err
+	}
+	hint := hintFile(segment)
+	if err := os.Rename(tmp, segment); err != nil {
+		return err
+	}
+	if unique {
+		err = os.Rename(tmpHint, hint)
+	} else {
+		err = writeHintFor(segment, hint, s.dir.scanSize())
+	}
+	if err == nil {
+		err = syncDataDirs(s.path)
+	}
+	if err == nil {
+		// the hint was checked in full before any of it went into the index
+		err = loadHint(hint, segment, s.keyDir, s.dir.scanSize())
+	}
+	if err != nil {
+		os.Remove(hint)
+		os.Remove(segment)
+		return errors.Join(err, syncDataDirs(s.path))
+	}
+	return nil
+}
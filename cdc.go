@@ -0,0 +1,343 @@
+package gocask
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// the changefeed lives in its own append-only journal. compaction never
+// touches it, so a Position handed out once stays valid forever; TrimChanges
+// drops the changes before one, but the positions of the rest stay what they were.
+const cdcJournal = "cdc.log"
+
+// Position is a byte offset into the cdc journal, counted from the first change
+// ever journaled.
+type Position int64
+
+// journalBaseKey is the key of the record a trimmed journal starts with. Its value is
+// the Position of the change after it, which is where the changes TrimChanges kept
+// start; the base record itself has none.
+const journalBaseKey = internalPrefix + "cdc/base"
+
+// ErrChangesTrimmed is returned by Changes and ReadJournal for a position whose
+// change TrimChanges has dropped.
+var ErrChangesTrimmed = errors.New("changes before this position were trimmed")
+
+// journalStart returns the Position of the first change in the journal f, 0 unless
+// f was trimmed, and the offset that change is at.
+func journalStart(f *os.File) (base Position, off int64, err error) {
+	var hdr [headerSize]byte
+	if _, err := f.ReadAt(hdr[:], 0); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return 0, 0, nil
+	} else if err != nil {
+		return 0, 0, err
+	}
+	keyLen := binary.BigEndian.Uint32(hdr[9:13])
+	valLen := binary.BigEndian.Uint32(hdr[13:17])
+	if hdr[0] != flagNormal || keyLen != uint32(len(journalBaseKey)) || valLen != 8 {
+		return 0, 0, nil
+	}
+	body := make([]byte, keyLen+valLen)
+	if _, err := f.ReadAt(body, headerSize); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return 0, 0, nil
+	} else if err != nil {
+		return 0, 0, err
+	}
+	key, value := body[:keyLen], body[keyLen:]
+	if string(key) != journalBaseKey {
+		return 0, 0, nil
+	}
+	if crc, want := headerChecksum(hdr[:]); bodyChecksum(crc, key, value) != want {
+		return 0, 0, fmt.Errorf("%s: base record: %w", f.Name(), ErrChecksumMismatch)
+	}
+	return Position(binary.BigEndian.Uint64(value)), int64(headerSize + len(body)), nil
+}
+
+// Change is a single put or delete event from the changefeed.
+type Change struct {
+	Key       []byte
+	Value     []byte
+	Deleted   bool
+	Expires   uint64   // unix nanoseconds the value expires at, 0 if it doesn't
+	Meta      Metadata // what the value was put with, see PutWithMeta
+	Timestamp uint64   // record timestamp, the low 16 bits name the originating node
+	Pos       Position // position right after this event; pass it to Changes to resume
+}
+
+// appendChange records a mutation in the cdc journal; expires only counts for
+// flagExpiring and flagMeta, and meta, encoded, only for flagMeta.
+func (d *dataDir) appendChange(flag byte, key, value []byte, ts, expires uint64, meta []byte) error {
+	if isInternalKey(key) {
+		return nil
+	}
+	if d.journal == nil {
+		f, err := os.OpenFile(d.file(cdcJournal), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return fmt.Errorf("open cdc journal: %w", err)
+		}
+		d.journal = f
+	}
+
+	// build the whole record first so it lands in a single write
+	// journal records use the same layout as data records
+	var prefix []byte
+	switch flag {
+	case flagExpiring:
+		prefix = binary.BigEndian.AppendUint64(nil, expires)
+	case flagMeta:
+		prefix = binary.BigEndian.AppendUint64(nil, expires)
+		prefix = binary.BigEndian.AppendUint16(prefix, uint16(len(meta)))
+		prefix = append(prefix, meta...)
+	}
+	buf := make([]byte, 0, headerSize+len(key)+len(prefix)+len(value))
+	buf = appendHeader(buf, flag, ts, key, prefix, value)
+	buf = append(buf, key...)
+	buf = append(buf, prefix...)
+	buf = append(buf, value...)
+	_, err := d.journal.Write(buf)
+	return err
+}
+
+// changeFlag is the flag a change is journaled with for a record written with flag.
+// The changefeed carries chunked values whole, so they are journaled as the record
+// they would have been in one piece.
+func changeFlag(flag byte, expires uint64, meta []byte) byte {
+	switch {
+	case flag != flagChunked:
+		return flag
+	case meta != nil:
+		return flagMeta
+	case expires != 0:
+		return flagExpiring
+	}
+	return flagNormal
+}
+
+// repairJournal cuts a record torn by a crash off the end of the cdc journal, as
+// opening does for the active file, so the changes appended next can be read. Without
+// r.TruncateCorrupt a torn record is an *IntegrityError instead.
+func repairJournal(d *dataDir, r repairs, info *RecoveryInfo) error {
+	path := d.file(cdcJournal)
+	fi, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var report RecoveryReport
+	good, err := scanFileResilient(path, d.scanSize(), &report, func(int64, record) error { return nil })
+	if err != nil || good == fi.Size() {
+		return err
+	}
+	if !r.TruncateCorrupt {
+		return &IntegrityError{File: path, Offset: good, Problem: fmt.Sprintf("%d bytes at the end of the journal hold no readable record", fi.Size()-good)}
+	}
+	d.logger.Warn("truncating partial record at the end of the cdc journal", "offset", good, "bytes", fi.Size()-good, "dry_run", r.DryRun)
+	if !r.DryRun {
+		if err := os.Truncate(path, good); err != nil {
+			return err
+		}
+	}
+	info.Truncated += fi.Size() - good
+	info.Actions = append(info.Actions, RecoveryAction{ActionTruncate, path, good, fi.Size() - good, "a torn record at the end of the journal"})
+	return nil
+}
+
+// trimJournal rewrites the journal without the changes before before, which must be
+// the Pos of a change. Callers hold the store's mu.
+func (d *dataDir) trimJournal(before Position) error {
+	path := d.file(cdcJournal)
+	old, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer old.Close()
+	base, off, err := journalStart(old)
+	if err != nil {
+		return err
+	}
+	fi, err := old.Stat()
+	if err != nil {
+		return err
+	}
+	end := base + Position(fi.Size()-off)
+	switch {
+	case before <= base:
+		return nil
+	case before > end:
+		return fmt.Errorf("trim changes: position %d is past the end of the journal, %d", before, end)
+	}
+	from := off + int64(before-base)
+	if before < end {
+		// anywhere else than at a change would leave a journal nothing can read
+		s := &ChangeStream{f: old, r: bufio.NewReader(io.NewSectionReader(old, from, fi.Size()-from)), pos: before}
+		if !s.Next() {
+			return fmt.Errorf("trim changes: position %d isn't that of a change: %w", before, errors.Join(s.Err(), io.ErrUnexpectedEOF))
+		}
+	}
+
+	tmp := path + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	w := bufio.NewWriter(out)
+	_, err = writeRecord(w, flagNormal, []byte(journalBaseKey), binary.BigEndian.AppendUint64(nil, uint64(before)), 0)
+	if err == nil {
+		_, err = io.Copy(w, io.NewSectionReader(old, from, fi.Size()-from))
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("trim changes: %w", err)
+	}
+	// the next change opens the trimmed journal
+	d.closeJournal()
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("trim changes: %w", err)
+	}
+	return syncDir(d.path)
+}
+
+// closeJournal closes the journal handle.
+func (d *dataDir) closeJournal() {
+	if d.journal != nil {
+		d.journal.Close()
+		d.journal = nil
+	}
+}
+
+// ChangeStream iterates over journal events in the order they were written.
+type ChangeStream struct {
+	f   *os.File
+	r   *bufio.Reader
+	pos Position
+	cur Change
+	err error
+}
+
+// Changes returns a stream of every put/delete recorded in the store at or after
+// since. Use Position(0) to read the feed from the beginning, or from the first change
+// TrimChanges kept; any other position it dropped is ErrChangesTrimmed.
+func (db *DB) Changes(since Position) (*ChangeStream, error) {
+	return ReadJournal(db.s.dir.file(cdcJournal), since)
+}
+
+// TrimChanges drops the changes before before from the changefeed journal, to give
+// back the disk space of those every reader has seen: the journal only ever grows
+// otherwise. before is a position a reader resumes from, the Pos of the last change
+// to drop; the changes after it keep theirs. Streams open already keep reading the
+// journal as it was.
+func (db *DB) TrimChanges(before Position) error {
+	defer db.lock()()
+	if err := db.s.dir.checkWritable(); err != nil {
+		return err
+	}
+	return db.s.dir.trimJournal(before)
+}
+
+// JournalPath is where the store in dir journals its changefeed.
+func JournalPath(dir string) string { return filepath.Join(dir, cdcJournal) }
+
+// ReadJournal is Changes over the journal at path, the changefeed of a store that
+// may be open in another process or the journal of a backup.
+func ReadJournal(path string, since Position) (*ChangeStream, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		// nothing written yet, hand back an empty stream
+		return &ChangeStream{pos: since}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	base, off, err := journalStart(f)
+	if err == nil && since < base && since != 0 {
+		err = fmt.Errorf("%s: position %d: %w, the journal starts at %d", path, since, ErrChangesTrimmed, base)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	since = max(since, base)
+	if _, err := f.Seek(off+int64(since-base), io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &ChangeStream{f: f, r: bufio.NewReader(f), pos: since}, nil
+}
+
+// Next advances to the next event, returning false at the end of the feed or on error.
+// A record that is only partly written yet is treated as the end of the feed, so
+// Pos never moves past it and a later Changes(Pos()) picks it up once complete.
+func (s *ChangeStream) Next() bool {
+	if s.f == nil || s.err != nil {
+		return false
+	}
+
+	var hdr [headerSize]byte
+	if _, err := io.ReadFull(s.r, hdr[:]); err != nil {
+		if err != io.EOF && err != io.ErrUnexpectedEOF {
+			s.err = err
+		}
+		return false
+	}
+	keyLen := binary.BigEndian.Uint32(hdr[9:13])
+	valLen := binary.BigEndian.Uint32(hdr[13:17])
+
+	body := make([]byte, int(keyLen)+int(valLen))
+	if _, err := io.ReadFull(s.r, body); err != nil {
+		if err != io.EOF && err != io.ErrUnexpectedEOF {
+			s.err = err
+		}
+		return false
+	}
+
+	r := record{flag: hdr[0], key: body[:keyLen:keyLen], value: body[keyLen:]}
+	if crc, want := headerChecksum(hdr[:]); bodyChecksum(crc, r.key, r.value) != want {
+		s.err = fmt.Errorf("%s: record at offset %d: %w", s.f.Name(), s.pos, ErrChecksumMismatch)
+		return false
+	}
+	s.pos += Position(len(hdr) + len(body))
+	s.cur = Change{
+		Key:       r.key,
+		Value:     r.data(),
+		Deleted:   r.flag == flagTombstone,
+		Expires:   r.expires(),
+		Meta:      r.meta(),
+		Timestamp: binary.BigEndian.Uint64(hdr[1:9]),
+		Pos:       s.pos,
+	}
+	return true
+}
+
+// Change returns the event Next just read.
+func (s *ChangeStream) Change() Change { return s.cur }
+
+// Pos returns the position to resume from after the last event read.
+func (s *ChangeStream) Pos() Position { return s.pos }
+
+// Err returns the first error hit while reading, if any.
+func (s *ChangeStream) Err() error { return s.err }
+
+// Close releases the journal handle.
+func (s *ChangeStream) Close() error {
+	if s.f == nil {
+		return nil
+	}
+	return s.f.Close()
+}
@@ -0,0 +1,121 @@
+package gocask
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+)
+
+// readChanges returns the keys of the changes at or after since.
+func readChanges(t *testing.T, db *DB, since Position) []string {
+	t.Helper()
+	s, err := db.Changes(since)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	var keys []string
+	for s.Next() {
+		keys = append(keys, string(s.Change().Key))
+	}
+	if err := s.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+func TestTrimChanges(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := db.Put(fmt.Sprintf("k%d", i), "v"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s, err := db.Changes(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pos []Position
+	for s.Next() {
+		pos = append(pos, s.Change().Pos)
+	}
+	s.Close()
+	before, err := os.Stat(JournalPath(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.TrimChanges(pos[3] + 1); err == nil {
+		t.Fatal("trimming in the middle of a change: no error")
+	}
+	if err := db.TrimChanges(pos[3]); err != nil {
+		t.Fatal(err)
+	}
+	after, err := os.Stat(JournalPath(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.Size() >= before.Size() {
+		t.Errorf("journal is %d bytes after the trim, %d before", after.Size(), before.Size())
+	}
+	if _, err := db.Changes(pos[1]); !errors.Is(err, ErrChangesTrimmed) {
+		t.Errorf("changes from a trimmed position: %v, want ErrChangesTrimmed", err)
+	}
+	if got := readChanges(t, db, pos[5]); fmt.Sprint(got) != "[k6 k7 k8 k9]" {
+		t.Errorf("changes after the trim: %v", got)
+	}
+	if got := readChanges(t, db, 0); fmt.Sprint(got) != "[k4 k5 k6 k7 k8 k9]" {
+		t.Errorf("changes from 0 after the trim: %v", got)
+	}
+	// trimming again, or to before the first change kept, is a no-op
+	if err := db.TrimChanges(pos[3]); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.TrimChanges(pos[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Put("k10", "v"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if info := db.Recovery(); !info.Clean() {
+		t.Errorf("reopen after the trim: %s", info.String())
+	}
+	if err := db.Put("k11", "v"); err != nil {
+		t.Fatal(err)
+	}
+	if got := readChanges(t, db, pos[9]); fmt.Sprint(got) != "[k10 k11]" {
+		t.Errorf("changes written after the trim: %v", got)
+	}
+
+	// all of them
+	s, err = db.Changes(pos[9])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for s.Next() {
+	}
+	s.Close()
+	if err := db.TrimChanges(s.Pos()); err != nil {
+		t.Fatal(err)
+	}
+	if got := readChanges(t, db, s.Pos()); len(got) != 0 {
+		t.Errorf("changes after trimming them all: %v", got)
+	}
+	if err := db.TrimChanges(s.Pos() + 1); err == nil {
+		t.Error("trimming past the end: no error")
+	}
+}
@@ -0,0 +1,238 @@
+package gocask
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Values bigger than the chunk size are stored in chunks: each chunk is a record of its own
+// under an internal key, and the key itself points at a flagChunked record, the
+// manifest, laid out like a record with metadata whose value is
+//
+//	size(8) | chunkCount(4) | crc32(4) of each chunk
+//
+// Chunk keys name the key and the timestamp of the manifest they belong to, so the
+// chunks of every version of a value are told apart. Chunks are written before the
+// manifest, so a crash in between leaves the previous value readable, and the chunks
+// of the previous version are deleted once the new manifest is in place. Chunks no
+// manifest points at any more, left behind by a crash, an expiry or an eviction, are
+// dropped by the next merge.
+const (
+	// DefaultChunkSize is the chunk size of a store not given one, see WithChunkSize.
+	DefaultChunkSize = 64 << 20
+	manifestHeader   = 8 + 4
+)
+
+// WithChunkSize sets how big a value may get before it is stored in chunks of that
+// size, 64 MiB without it; 0 or less stores every value in a single record. Values
+// already written stay as they are.
+func WithChunkSize(n int) Option {
+	return withSetting(func(s *store) error {
+		s.setChunkSize(n)
+		return nil
+	})
+}
+
+// setChunkSize sets the chunk size of s, see WithChunkSize. Callers hold s.mu.
+func (s *store) setChunkSize(n int) { s.dir.chunkSize = max(n, 0) }
+
+const chunkPrefix = internalPrefix + "chunk/"
+
+// chunkKey is the key of chunk i of the version of key whose manifest has timestamp ver:
+// the key, a zero byte, then ver and i in fixed-width hex.
+func chunkKey(key string, ver uint64, i int) string {
+	return fmt.Sprintf("%s%s\x00%016x%08x", chunkPrefix, key, ver, i)
+}
+
+// chunkKeySuffix is how many bytes of a chunk key follow the key it belongs to.
+const chunkKeySuffix = 1 + 16 + 8
+
+func isChunkKey(key string) bool { return strings.HasPrefix(key, chunkPrefix) }
+
+// parseChunkKey returns the key and manifest timestamp chunk key k belongs to.
+func parseChunkKey(k string) (key string, ver uint64, ok bool) {
+	if !isChunkKey(k) || len(k) < len(chunkPrefix)+chunkKeySuffix {
+		return "", 0, false
+	}
+	end := len(k) - chunkKeySuffix
+	if k[end] != 0 {
+		return "", 0, false
+	}
+	ver, err := strconv.ParseUint(k[end+1:end+17], 16, 64)
+	return k[len(chunkPrefix):end], ver, err == nil
+}
+
+// putChunks writes value as chunks of the version of key put at ts, and returns the
+// manifest for them.
+func putChunks(key, value string, ts uint64, f *os.File, w *bufio.Writer, keyDir *KeyDir) ([]byte, error) {
+	chunkSize := keyDir.dir.chunkSize
+	count := (len(value) + chunkSize - 1) / chunkSize
+	manifest := make([]byte, 0, manifestHeader+4*count)
+	manifest = binary.BigEndian.AppendUint64(manifest, uint64(len(value)))
+	manifest = binary.BigEndian.AppendUint32(manifest, uint32(count))
+	for i := range count {
+		chunk := value[i*chunkSize : min((i+1)*chunkSize, len(value))]
+		if err := putAt(chunkKey(key, ts, i), chunk, keyDir.dir.newTimestamp(), 0, nil, f, w, keyDir); err != nil {
+			return nil, fmt.Errorf("%q: chunk %d of %d: %w", key, i, count, err)
+		}
+		manifest = binary.BigEndian.AppendUint32(manifest, crc32.ChecksumIEEE([]byte(chunk)))
+	}
+	return manifest, nil
+}
+
+// decodeManifest returns the size of the value a manifest describes and the
+// checksums of its chunks.
+func decodeManifest(m []byte) (size uint64, sums []uint32, err error) {
+	if len(m) < manifestHeader {
+		return 0, nil, fmt.Errorf("chunk manifest cut short")
+	}
+	size, count := binary.BigEndian.Uint64(m), int(binary.BigEndian.Uint32(m[8:]))
+	if len(m) != manifestHeader+4*count {
+		return 0, nil, fmt.Errorf("chunk manifest lists %d chunks in %d bytes", count, len(m))
+	}
+	sums = make([]uint32, count)
+	for i := range sums {
+		sums[i] = binary.BigEndian.Uint32(m[manifestHeader+4*i:])
+	}
+	return size, sums, nil
+}
+
+// readChunks writes the chunks of the version of key whose manifest, with timestamp
+// ver, is manifest to dst one at a time, checking each against its checksum.
+func readChunks(key string, ver uint64, manifest []byte, dst io.Writer, keyDir *KeyDir) (int64, error) {
+	size, sums, err := decodeManifest(manifest)
+	if err != nil {
+		return 0, fmt.Errorf("%q: %w", key, err)
+	}
+	var n int64
+	for i, sum := range sums {
+		chunk, err := readChunk(chunkKey(key, ver, i), keyDir)
+		if err != nil {
+			return n, fmt.Errorf("%q: chunk %d of %d: %w", key, i, len(sums), err)
+		}
+		if crc32.ChecksumIEEE(chunk) != sum {
+			return n, fmt.Errorf("%q: chunk %d of %d doesn't match its checksum", key, i, len(sums))
+		}
+		m, err := dst.Write(chunk)
+		if n += int64(m); err != nil {
+			return n, err
+		}
+	}
+	if uint64(n) != size {
+		return n, fmt.Errorf("%q: chunks hold %d bytes, the manifest says %d", key, n, size)
+	}
+	return n, nil
+}
+
+// readChunk reads the chunk stored under k, bypassing the value cache so big values
+// don't push everything else out of it.
+func readChunk(k string, keyDir *KeyDir) ([]byte, error) {
+	fo, ok := keyDir.Get(k)
+	if !ok || fo.Tombstone() {
+		return nil, fmt.Errorf("missing")
+	}
+	f, err := keyDir.dir.readers.acquire(fo.FileID())
+	if err != nil {
+		return nil, err
+	}
+	defer keyDir.dir.readers.release(f)
+	rec, err := f.readAt(make([]byte, fo.recordSize(k)), fo.Offset())
+	if err != nil {
+		return nil, fmt.Errorf("%s: record at offset %d: %w", fo.FileID(), fo.Offset(), err)
+	}
+	if rec[0] != flagNormal || binary.BigEndian.Uint32(rec[9:13]) != uint32(len(k)) {
+		return nil, fmt.Errorf("%s: record at offset %d isn't the one indexed", fo.FileID(), fo.Offset())
+	}
+	if err := checkRecord(rec, fo.FileID(), fo.Offset()); err != nil {
+		return nil, err
+	}
+	keyDir.dir.metrics.bytesRead.Add(uint64(len(rec)))
+	// a mapped record has to be copied before the mapping is released
+	return append([]byte(nil), rec[headerSize+len(k):]...), nil
+}
+
+// GetStream writes key's value to dst, a chunk at a time if it is stored in chunks,
+// so big values never have to be in memory whole. It returns how many bytes it wrote.
+func (db *DB) GetStream(key string, dst io.Writer) (int64, error) {
+	if err := checkKey(key); err != nil {
+		return 0, err
+	}
+	defer db.rlock()()
+	return getStream(key, dst, db.s.keyDir)
+}
+
+// getStream is DB.GetStream for callers holding the store's mu.
+func getStream(key string, dst io.Writer, keyDir *KeyDir) (int64, error) {
+	fo, ok := keyDir.Get(key)
+	if !ok || fo.Tombstone() || !fo.Chunked() {
+		v, err := get(key, keyDir)
+		if err != nil {
+			return 0, err
+		}
+		n, err := io.WriteString(dst, v)
+		return int64(n), err
+	}
+	ver, expires, manifest, err := keyDir.dir.readManifest(key, fo)
+	if err != nil {
+		return 0, err
+	}
+	if expired(expires) {
+		return 0, expiredError(key)
+	}
+	return readChunks(key, ver, manifest, dst, keyDir)
+}
+
+// readManifest reads the timestamp, expiry (0 for none) and manifest of the
+// flagChunked record fo points at for key.
+func (d *dataDir) readManifest(key string, fo FileOffset) (ver, expires uint64, manifest []byte, err error) {
+	f, err := d.readers.acquire(fo.FileID())
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	defer d.readers.release(f)
+	rec, err := f.readAt(make([]byte, fo.recordSize(key)), fo.Offset())
+	if err != nil {
+		return 0, 0, nil, fmt.Errorf("%s: record at offset %d: %w", fo.FileID(), fo.Offset(), err)
+	}
+	if rec[0] != flagChunked || binary.BigEndian.Uint32(rec[9:13]) != uint32(len(key)) {
+		return 0, 0, nil, fmt.Errorf("%s: record at offset %d isn't the one indexed for %q", fo.FileID(), fo.Offset(), key)
+	}
+	if err := checkRecord(rec, fo.FileID(), fo.Offset()); err != nil {
+		return 0, 0, nil, err
+	}
+	expires, _, manifest = splitValue(flagChunked, rec[headerSize+len(key):])
+	return binary.BigEndian.Uint64(rec[1:9]), expires, append([]byte(nil), manifest...), nil
+}
+
+// dropChunks deletes the chunks of the value prev pointed at for key, now that a
+// record with timestamp ts replaced it. Chunks it can't find are left for the next
+// merge to drop.
+func dropChunks(key string, prev FileOffset, ts uint64, f *os.File, w *bufio.Writer, keyDir *KeyDir) error {
+	if !prev.Chunked() || prev.Tombstone() {
+		return nil
+	}
+	ver, _, manifest, err := keyDir.dir.readManifest(key, prev)
+	if err != nil || ver == ts {
+		// at ts the same version was written again, its chunks are the ones just written
+		return nil
+	}
+	_, sums, err := decodeManifest(manifest)
+	if err != nil {
+		return nil
+	}
+	for i := range sums {
+		k := chunkKey(key, ver, i)
+		if fo, ok := keyDir.Get(k); ok && !fo.Tombstone() {
+			if err := deleteAt(k, keyDir.dir.newTimestamp(), f, w, keyDir); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,213 @@
+package gocask
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// CloneInfo describes a clone CloneTo wrote.
+type CloneInfo struct {
+	Keys    int   // live keys copied, internal ones included
+	Bytes   int64 // size of the clone's segment
+	Dropped int64 // bytes of the source's files the clone left behind
+}
+
+// cloneRecord locates the newest record of a key in the pinned files.
+type cloneRecord struct {
+	src     int // index into the sources
+	off     int64
+	size    int64
+	flag    byte
+	ts      uint64
+	expires uint64
+}
+
+// CloneTo writes a fully compacted copy of the store into dir, which must be empty or
+// not exist yet: one segment holding the newest record of every live key, in key
+// order, with its hint, and an empty active file. Records are copied as stored, so
+// they keep their timestamps, metadata and expiries. Like BackupSince, it only holds
+// the store's mu to cut the active file after the last write and pin the segments;
+// the store keeps serving, and merging, while the clone is written.
+func (db *DB) CloneTo(dir string) (CloneInfo, error) {
+	unlock := db.lock()
+	snap, err := pinBackup(db.s.path, 0, map[string]int64{activeFile: db.s.dir.activeSize}, db.s.dir.logger)
+	unlock()
+	if err != nil {
+		return CloneInfo{}, err
+	}
+	defer snap.release()
+	return snap.clone(dir)
+}
+
+// Clone is CloneTo for the store in src, which may be open in another process.
+func Clone(src, dir string) (CloneInfo, error) {
+	snap, err := pinBackup(src, 0, nil, defaultLogger)
+	if err != nil {
+		return CloneInfo{}, err
+	}
+	defer snap.release()
+	return snap.clone(dir)
+}
+
+// clone compacts the pinned segments and active file into dir. It is written beside
+// dir and renamed into place once complete, so dir is never a partial clone.
+func (b *backupSnapshot) clone(dir string) (CloneInfo, error) {
+	var info CloneInfo
+	if entries, err := os.ReadDir(dir); err == nil && len(entries) > 0 {
+		return info, fmt.Errorf("%s is not empty, a clone needs a fresh directory", dir)
+	}
+	// records are copied as they are, so they have to be in the current format
+	if data, err := os.ReadFile(filepath.Join(b.dir, formatFile)); err == nil {
+		var v int
+		if _, err := fmt.Sscanf(string(data), "gocask format %d", &v); err != nil || v != formatVersion {
+			return info, fmt.Errorf("store is not in format v%d, run gocask migrate first", formatVersion)
+		}
+	}
+
+	sources := append([]string(nil), b.segments...)
+	if _, ok := b.cut[activeFile]; ok {
+		sources = append(sources, activeFile)
+	}
+	latest, err := b.latestRecords(sources, &info)
+	if err != nil {
+		return info, err
+	}
+
+	tmp := filepath.Clean(dir) + ".partial"
+	if err := os.Mkdir(tmp, 0755); err != nil {
+		return info, err
+	}
+	defer os.RemoveAll(tmp)
+	if err := upgradeLayout(tmp, defaultLogger); err != nil {
+		return info, err
+	}
+	if err := writeClone(tmp, b.dir, sources, latest, &info); err != nil {
+		return info, err
+	}
+	if err := os.WriteFile(filepath.Join(tmp, formatFile), []byte(fmt.Sprintf("gocask format %d\n", formatVersion)), 0644); err != nil {
+		return info, err
+	}
+	if err := os.WriteFile(filepath.Join(tmp, activeFile), nil, 0644); err != nil {
+		return info, err
+	}
+	for _, d := range []string{filepath.Join(tmp, segmentsDir), filepath.Join(tmp, hintsDir), tmp} {
+		if err := syncDir(d); err != nil {
+			return info, err
+		}
+	}
+	os.Remove(dir) // empty or missing, checked above
+	if err := os.Rename(tmp, dir); err != nil {
+		return info, err
+	}
+	return info, syncDir(filepath.Dir(filepath.Clean(dir)))
+}
+
+// latestRecords scans sources, oldest first, for the newest record of each key. Of
+// the files still appended to, only what was cut is read. info.Dropped starts out as
+// everything read; writeClone takes off what it keeps.
+func (b *backupSnapshot) latestRecords(sources []string, info *CloneInfo) (map[string]cloneRecord, error) {
+	latest := make(map[string]cloneRecord)
+	for i, name := range sources {
+		path := filepath.Join(b.dir, name)
+		f, size, err := openSized(path)
+		if err != nil {
+			return nil, err
+		}
+		if cut, ok := b.cut[name]; ok {
+			size = min(size, cut)
+		}
+		err = scanRecords(path, newScanReader(f, defaultReadAhead), size, func(off int64, r record) error {
+			// a later record wins a tie, as it does when the files are indexed
+			if prev, seen := latest[string(r.key)]; seen && prev.ts > r.ts {
+				return nil
+			}
+			latest[string(r.key)] = cloneRecord{i, off, r.size(), r.flag, r.ts, r.expires()}
+			return nil
+		})
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		info.Dropped += size
+	}
+	return latest, nil
+}
+
+// writeClone writes the live records of latest into a segment in dir, in key order,
+// and its hint beside it.
+func writeClone(dir, srcDir string, sources []string, latest map[string]cloneRecord, info *CloneInfo) error {
+	live := func(k string, r cloneRecord) bool {
+		if r.flag == flagTombstone || expired(r.expires) {
+			return false
+		}
+		// chunks are only kept for the version of their value the manifest is of
+		if owner, ver, ok := parseChunkKey(k); ok {
+			m, ok := latest[owner]
+			return ok && m.flag == flagChunked && m.ts == ver && !expired(m.expires)
+		}
+		return true
+	}
+	keys := make([]string, 0, len(latest))
+	for k, r := range latest {
+		if live(k, r) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	files := make([]*os.File, len(sources))
+	for i, name := range sources {
+		f, err := os.Open(filepath.Join(srcDir, name))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		files[i] = f
+	}
+
+	segment := segmentFile(time.Now().Unix())
+	out, err := os.Create(filepath.Join(dir, segment))
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	hf, err := os.Create(filepath.Join(dir, hintFile(segment)))
+	if err != nil {
+		return err
+	}
+	defer hf.Close()
+	w, hw := bufio.NewWriterSize(out, 4<<20), bufio.NewWriterSize(hf, 1<<20)
+
+	var buf []byte
+	for _, k := range keys {
+		r := latest[k]
+		buf = grow(buf, int(r.size))
+		if _, err := files[r.src].ReadAt(buf, r.off); err != nil {
+			return fmt.Errorf("%s: record at offset %d: %w", sources[r.src], r.off, err)
+		}
+		if _, err := w.Write(buf); err != nil {
+			return err
+		}
+		writeHintEntry(hw, k, info.Bytes, uint32(r.size-headerSize-int64(len(k))), r.flag)
+		info.Bytes += r.size
+		info.Keys++
+	}
+	info.Dropped -= info.Bytes
+
+	for _, f := range []struct {
+		w *bufio.Writer
+		f *os.File
+	}{{w, out}, {hw, hf}} {
+		if err := f.w.Flush(); err != nil {
+			return err
+		}
+		if err := f.f.Sync(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	rpprof "runtime/pprof"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The admin listener serves what it takes to diagnose a store in production: the
+// pprof profiles, goroutine and lock contention dumps, and the store's internals,
+// and reloads serve's settings on a POST to /-/reload. It answers only requests that
+// carry --admin-token as a bearer token, which it can do without only on a loopback
+// address.
+
+// adminFlags configure serve's admin listener.
+type adminFlags struct {
+	addr, token *string
+}
+
+func addAdminFlags(fs *flag.FlagSet) *adminFlags {
+	return &adminFlags{
+		addr:  fs.String("admin-addr", "", "serve pprof on http://<addr>/debug/pprof/, goroutine and lock contention dumps on /debug/goroutines and /debug/contention, and the segment map, index shards and cache on /debug/store, and reload the settings on a POST to /-/reload, e.g. localhost:6060"),
+		token: fs.String("admin-token", "", "bearer token requests to --admin-addr and --backup-addr must carry in an Authorization header, needed unless they are loopback addresses"),
+	}
+}
+
+// check refuses to serve the admin endpoints to the network without a token.
+func (af *adminFlags) check() error {
+	return checkTokenAddr("admin", *af.addr, "admin", *af.token)
+}
+
+// checkTokenAddr refuses to listen on addr, the value of --<name>-addr, anywhere
+// but a loopback address without a token, that of --<tokenName>-token.
+func checkTokenAddr(name, addr, tokenName, token string) error {
+	if addr == "" || token != "" {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("--%s-addr %q: %w", name, addr, err)
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return fmt.Errorf("--%s-addr %q isn't a loopback address, it needs --%s-token", name, addr, tokenName)
+	}
+	return nil
+}
+
+// bearerToken is the token a listener checks, which a reload of serve's settings
+// can change while it runs. "" lets everyone in.
+type bearerToken struct {
+	v atomic.Pointer[string]
+}
+
+func newBearerToken(token string) *bearerToken {
+	t := &bearerToken{}
+	t.set(token)
+	return t
+}
+
+func (t *bearerToken) get() string { return *t.v.Load() }
+
+func (t *bearerToken) set(token string) { t.v.Store(&token) }
+
+// matches reports whether got is the token, in constant time.
+func (t *bearerToken) matches(got string) bool {
+	return subtle.ConstantTimeCompare([]byte(got), []byte(t.get())) == 1
+}
+
+// withToken serves h only to requests that carry token as a bearer token, or to
+// all of them while it is "". realm names the listener in the challenge.
+func withToken(h http.Handler, token *bearerToken, realm string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		auth, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+		if token.get() != "" && (!ok || !token.matches(auth)) {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf("Bearer realm=%q", realm))
+			http.Error(w, "missing or wrong token", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, req)
+	})
+}
+
+// adminHandler serves the admin endpoints for stores and reloads serve's settings
+// with r, to requests with token if it isn't "".
+func adminHandler(stores []*store, r *reloader, token *bearerToken) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("/debug/goroutines", serveGoroutines)
+	mux.HandleFunc("/debug/contention", serveContention)
+	mux.HandleFunc("/-/reload", r.serveReload)
+	for _, s := range stores {
+		mux.HandleFunc(s.route("/debug/store"), s.serveDebugStore)
+	}
+	return withToken(mux, token, "gocask admin")
+}
+
+// serveDebugStore prints the store's internals, see DB.WriteDebug.
+func (s *store) serveDebugStore(w http.ResponseWriter, req *http.Request) {
+	var b bytes.Buffer
+	if err := s.WriteDebug(&b); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write(b.Bytes())
+}
+
+// serveGoroutines dumps the stack of every goroutine, as a panic would.
+func serveGoroutines(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	rpprof.Lookup("goroutine").WriteTo(w, 2)
+}
+
+// contentionMu lets one contention dump sample at a time.
+var contentionMu sync.Mutex
+
+// serveContention samples lock contention and blocking for ?seconds=N (10 by
+// default, at most 300) and dumps where goroutines waited on mutexes and blocked.
+// Sampling is off otherwise, as it costs on every contended lock.
+func serveContention(w http.ResponseWriter, req *http.Request) {
+	seconds := 10
+	if v := req.URL.Query().Get("seconds"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > 300 {
+			http.Error(w, "seconds must be between 1 and 300", http.StatusBadRequest)
+			return
+		}
+		seconds = n
+	}
+	if !contentionMu.TryLock() {
+		http.Error(w, "a contention dump is already sampling", http.StatusConflict)
+		return
+	}
+	defer contentionMu.Unlock()
+
+	prev := runtime.SetMutexProfileFraction(5)
+	runtime.SetBlockProfileRate(int(time.Millisecond))
+	defer runtime.SetBlockProfileRate(0)
+	defer runtime.SetMutexProfileFraction(prev)
+	select {
+	case <-time.After(time.Duration(seconds) * time.Second):
+	case <-req.Context().Done():
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintf(w, "# mutex contention, sampled for %ds\n", seconds)
+	rpprof.Lookup("mutex").WriteTo(w, 1)
+	fmt.Fprintf(w, "\n# blocking, sampled for %ds\n", seconds)
+	rpprof.Lookup("block").WriteTo(w, 1)
+}
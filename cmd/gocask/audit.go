@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/itsknk/gocask"
+)
+
+// cmdAudit turns the audit log on or off, or prints the entries matching a filter.
+func cmdAudit(args []string) error {
+	c := newCommand("audit", "")
+	enable := c.fs.Bool("enable", false, "start recording an audit log for this store")
+	disable := c.fs.Bool("disable", false, "stop recording; existing audit files are kept")
+	key := c.fs.String("key", "", "only entries for this key")
+	prefix := c.fs.String("prefix", "", "only entries for keys starting with this")
+	actor := c.fs.String("by", "", "only entries by this actor")
+	since := c.fs.String("since", "", "only entries at or after this RFC 3339 time")
+	if err := c.parse(args, 0, 0); err != nil {
+		return err
+	}
+	if *enable && *disable {
+		return fmt.Errorf("give --enable or --disable, not both")
+	}
+	if *enable {
+		return os.MkdirAll(gocask.AuditDir(*c.dir), 0755)
+	}
+	dir := gocask.AuditDir(*c.dir)
+	if *disable {
+		// keep the history, just move it aside so the store stops appending
+		return os.Rename(dir, fmt.Sprintf("%s.disabled-%d", dir, time.Now().Unix()))
+	}
+
+	var from time.Time
+	if *since != "" {
+		t, err := time.Parse(time.RFC3339, *since)
+		if err != nil {
+			return fmt.Errorf("bad --since: %w", err)
+		}
+		from = t
+	}
+	files, err := gocask.AuditFiles(*c.dir)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		if _, err := os.Stat(dir); os.IsNotExist(err) {
+			return fmt.Errorf("auditing is not enabled for this store, see gocask audit --enable")
+		}
+	}
+
+	for _, name := range files {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		scanner := bufio.NewScanner(f)
+		for n := 1; scanner.Scan(); n++ {
+			var e gocask.AuditEntry
+			if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+				f.Close()
+				return fmt.Errorf("%s:%d: %w", name, n, err)
+			}
+			switch {
+			case *key != "" && e.Key != *key:
+			case !strings.HasPrefix(e.Key, *prefix):
+			case *actor != "" && e.Actor != *actor:
+			case e.Time.Before(from):
+			default:
+				fmt.Printf("%s %-24s %-3s %q\n", e.Time.Format(time.RFC3339Nano), e.Actor, e.Op, e.Key)
+			}
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/itsknk/gocask"
+)
+
+// serveBackup streams a Backup of the running store. Once the archive has started
+// an error can't change the status any more; the archive just ends without its
+// manifest.
+func (s *store) serveBackup(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "use GET", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-tar")
+	if err := s.Backup(w); err != nil {
+		logger.Error("backup failed", "err", err)
+	}
+}
+
+func cmdBackup(args []string) error {
+	c := newCommand("backup", "")
+	out := c.fs.String("out", "", "archive to write: .tar.zst, .tar.gz or .tar")
+	to := c.fs.String("to", "", "object to upload the archive to instead, e.g. s3://bucket/path/backup.tar.zst or gs://bucket/...")
+	since := c.fs.Int64("since", 0, "only back up segments after this sequence number, as printed by an earlier backup, 0 for a full backup")
+	objectOptions := objectStoreFlags(c.fs, true)
+	if err := c.parse(args, 0, 0); err != nil {
+		return err
+	}
+	if (*out == "") == (*to == "") {
+		return fmt.Errorf("backup needs one of --out and --to")
+	}
+
+	if *to != "" {
+		o, err := objectOptions()
+		if err != nil {
+			return err
+		}
+		s, name, err := openObjectStore(*to, o)
+		if err != nil {
+			return err
+		}
+		seq, err := gocask.UploadBackup(context.Background(), s, name, func(w io.Writer) (int64, error) {
+			return gocask.BackupDir(*c.dir, *since, w)
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Printf("backed up segments through sequence number %d, pass --since %d for an incremental backup after this one\n", seq, seq)
+		return nil
+	}
+
+	// write next to the target and rename, so a failed backup never looks like a good one
+	tmp := *out + ".partial"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	defer f.Close()
+
+	cw, err := gocask.CompressWriter(*out, f)
+	if err != nil {
+		return err
+	}
+	seq, err := gocask.BackupDir(*c.dir, *since, cw)
+	if err != nil {
+		return err
+	}
+	if err := cw.Close(); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, *out); err != nil {
+		return err
+	}
+	fmt.Printf("backed up segments through sequence number %d, pass --since %d for an incremental backup after this one\n", seq, seq)
+	return nil
+}
+
+func cmdRestore(args []string) error {
+	c := newCommand("restore", "<archive> [incremental...]")
+	objectOptions := objectStoreFlags(c.fs, false)
+	onConflict := c.fs.String("on-conflict", "", "restore into the existing store in --dir key by key, doing this with keys it already has: overwrite, skip, fail (restore nothing if any exist) or newest (keep whichever was written last)")
+	at := c.fs.String("at", "", `restore the store as it was at this time, e.g. "2024-05-01T12:00" (local) or "2024-05-01T12:00:00Z", by replaying the changefeed over the newest backup taken before it`)
+	changefeed := c.fs.String("changefeed", "", "with --at, the changefeed to replay: the store's cdc.log, or its directory (default the journal of the backup taken after --at)")
+	if err := c.parse(args, 1, -1); err != nil {
+		return err
+	}
+	o := gocask.RestoreOptions{Changefeed: *changefeed, Strict: *c.strict, Open: archiveOpener(objectOptions), Progress: os.Stdout}
+	if *at != "" {
+		t, err := parseRestoreTime(*at)
+		if err != nil {
+			return err
+		}
+		o.At = t
+	} else if *changefeed != "" {
+		return fmt.Errorf("--changefeed needs --at")
+	}
+	if *onConflict != "" {
+		if err := checkConflictFlag(*onConflict); err != nil {
+			return err
+		}
+		return restoreInto(c, c.fs.Args(), o, *onConflict)
+	}
+	if o.At.IsZero() {
+		return gocask.RestoreChain(c.fs.Args(), *c.dir, o)
+	}
+	// staged beside --dir, which only gets the store once the replay is done
+	dir := filepath.Clean(*c.dir)
+	if entries, err := os.ReadDir(dir); err == nil && len(entries) > 0 {
+		return fmt.Errorf("%s is not empty, restore needs a fresh directory", dir)
+	}
+	staging := dir + ".at"
+	defer os.RemoveAll(staging)
+	if err := gocask.RestoreChain(c.fs.Args(), staging, o); err != nil {
+		return err
+	}
+	os.Remove(dir)
+	return os.Rename(staging, dir)
+}
+
+// restoreInto restores archives into a scratch directory beside the store in --dir,
+// and imports the live keys of the result into the store, resolving conflicts with
+// the keys it has according to onConflict. Internal keys, such as changefeed
+// checkpoints, stay as the store has them.
+func restoreInto(c *command, archives []string, o gocask.RestoreOptions, onConflict string) error {
+	dir, err := filepath.Abs(*c.dir)
+	if err != nil {
+		return err
+	}
+	incoming, snapDir := dir+".incoming", dir+".incoming.sst"
+	defer os.RemoveAll(snapDir)
+	defer os.RemoveAll(incoming)
+	if err := gocask.RestoreChain(archives, incoming, o); err != nil {
+		return err
+	}
+
+	// the restored keys go through a snapshot, which imports them with their metadata
+	opts := []gocask.Option{gocask.WithLogger(logger)}
+	if *c.strict {
+		opts = append(opts, gocask.WithStrict())
+	}
+	db, err := gocask.Open(incoming, opts...)
+	if err != nil {
+		return err
+	}
+	_, err = db.WriteSnapshot(snapDir, gocask.SnapshotOptions{})
+	if cerr := db.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	snap, err := gocask.OpenSnapshot(snapDir)
+	if err != nil {
+		return err
+	}
+	defer snap.Close()
+
+	*c.dir = dir
+	s, err := c.open()
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	im := &importer{s: s, onConflict: onConflict}
+	if err := im.run(snapshotSource(snap)); err != nil {
+		return err
+	}
+	im.report()
+	return nil
+}
+
+// archiveOpener returns what opens an archive to restore: a file, or an object for
+// an object url, reached with the options objectOptions parses.
+func archiveOpener(objectOptions func() (objectStoreOptions, error)) func(string) (io.ReadCloser, error) {
+	return func(archive string) (io.ReadCloser, error) {
+		if !isObjectURL(archive) {
+			return os.Open(archive)
+		}
+		o, err := objectOptions()
+		if err != nil {
+			return nil, err
+		}
+		s, name, err := openObjectStore(archive, o)
+		if err != nil {
+			return nil, err
+		}
+		return gocask.OpenBackupObject(context.Background(), s, name)
+	}
+}
+
+// backupFlags configure the backup scheduler of serve.
+type backupFlags struct {
+	schedule, dest, format, keep *string
+	objectOptions                func() (objectStoreOptions, error)
+}
+
+func addBackupFlags(fs *flag.FlagSet) *backupFlags {
+	return &backupFlags{
+		schedule:      fs.String("backup-schedule", "", `take a full backup this often, e.g. "6h", or on a cron schedule in local time, e.g. "30 2 * * *" or "@daily"`),
+		dest:          fs.String("backup-dest", "", "directory, or s3://bucket/path/ or gs://bucket/path/, to put scheduled backups in"),
+		format:        fs.String("backup-format", "tar.zst", "archive format of scheduled backups: tar.zst, tar.gz or tar"),
+		keep:          fs.String("backup-keep", "", `which scheduled backups to keep, e.g. "last=3 daily=7 weekly=4 monthly=12" (default all)`),
+		objectOptions: objectStoreFlags(fs, true),
+	}
+}
+
+// scheduler returns the BackupScheduler the flags configure, nil if there is none.
+func (bf *backupFlags) scheduler() (*gocask.BackupScheduler, error) {
+	bs, o, err := bf.parse()
+	if bs == nil || err != nil {
+		return nil, err
+	}
+	if bs.Dest, bs.Prefix, err = openBackupDest(*bf.dest, o); err != nil {
+		return nil, err
+	}
+	return bs, nil
+}
+
+// parse checks the flags and returns the scheduler they configure, without its
+// destination, and the options to reach that with.
+func (bf *backupFlags) parse() (*gocask.BackupScheduler, objectStoreOptions, error) {
+	var o objectStoreOptions
+	if *bf.schedule == "" {
+		if *bf.dest != "" {
+			return nil, o, fmt.Errorf("--backup-dest needs --backup-schedule")
+		}
+		return nil, o, nil
+	}
+	if *bf.dest == "" {
+		return nil, o, fmt.Errorf("--backup-schedule needs --backup-dest")
+	}
+	sched, err := gocask.ParseSchedule(*bf.schedule)
+	if err != nil {
+		return nil, o, err
+	}
+	switch *bf.format {
+	case "tar.zst", "tar.gz", "tar":
+	default:
+		return nil, o, fmt.Errorf("unknown --backup-format %q, want tar.zst, tar.gz or tar", *bf.format)
+	}
+	keep, err := gocask.ParseBackupRetention(*bf.keep)
+	if err != nil {
+		return nil, o, err
+	}
+	if o, err = bf.objectOptions(); err != nil {
+		return nil, o, err
+	}
+	return &gocask.BackupScheduler{Schedule: sched, Format: *bf.format, Keep: keep}, o, nil
+}
+
+// startBackups runs bs over s, unless it is nil, and returns a func that stops it.
+func startBackups(s *store, bs *gocask.BackupScheduler) func() {
+	if bs == nil {
+		return func() {}
+	}
+	bs.DB = s.DB
+	stop, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		bs.Run(stop)
+	}()
+	return func() {
+		close(stop)
+		<-done
+	}
+}
+
+// restoreTimeLayouts are what restore --at takes, in local time unless the time
+// has a zone.
+var restoreTimeLayouts = []string{time.RFC3339Nano, "2006-01-02T15:04:05", "2006-01-02T15:04", "2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02"}
+
+func parseRestoreTime(s string) (time.Time, error) {
+	for _, layout := range restoreTimeLayouts {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("--at %q: want a time like 2024-05-01T12:00 or 2024-05-01T12:00:00Z", s)
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/itsknk/gocask"
+)
+
+// cmdClone writes a compacted copy of the store into a new directory, see gocask.Clone.
+// Like backup, it can run next to a process serving the store.
+func cmdClone(args []string) error {
+	c := newCommand("clone", "<dir>")
+	if err := c.parse(args, 1, 1); err != nil {
+		return err
+	}
+	info, err := gocask.Clone(*c.dir, c.fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "cloned %d keys in %d bytes, leaving %d bytes of dead and expired records behind\n",
+		info.Keys, info.Bytes, info.Dropped)
+	return nil
+}
@@ -0,0 +1,581 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/itsknk/gocask"
+)
+
+// changeLines lists the changefeed from since onwards, one line per event, and
+// returns the position to resume from.
+func changeLines(db *gocask.DB, since gocask.Position) ([]string, gocask.Position, error) {
+	cs, err := db.Changes(since)
+	if err != nil {
+		return nil, since, err
+	}
+	defer cs.Close()
+
+	var lines []string
+	for cs.Next() {
+		c := cs.Change()
+		if c.Deleted {
+			lines = append(lines, fmt.Sprintf("%d DEL %q", c.Pos, c.Key))
+		} else {
+			lines = append(lines, fmt.Sprintf("%d PUT %q %q", c.Pos, c.Key, c.Value))
+		}
+	}
+	return lines, cs.Pos(), cs.Err()
+}
+
+// usageError is returned for malformed commands, its message is the usage line.
+type usageError string
+
+func (e usageError) Error() string { return string(e) }
+
+// reply is what a command produced. The repl and exec print it differently.
+type reply struct {
+	lines    []string // listing output, one entry per line
+	label    string   // what value is, e.g. "Value"
+	value    string
+	hasValue bool
+}
+
+func valueReply(label, v string) reply { return reply{label: label, value: v, hasValue: true} }
+
+// runCommand executes one tokenized command against db.
+func runCommand(db *gocask.DB, parts []string) (reply, error) {
+	switch strings.ToUpper(parts[0]) {
+	case "PUT":
+		if len(parts) < 3 {
+			return reply{}, usageError("Usage: PUT <key> <value>")
+		}
+		return reply{}, db.Put(parts[1], strings.Join(parts[2:], " "))
+
+	case "PUTTTL":
+		if len(parts) < 4 {
+			return reply{}, usageError("Usage: PUTTTL <key> <ttl> <value>")
+		}
+		ttl, err := time.ParseDuration(parts[2])
+		if err != nil {
+			return reply{}, usageError("Usage: PUTTTL <key> <ttl> <value>, ttl like 30s or 1h")
+		}
+		return reply{}, db.PutWithTTL(parts[1], strings.Join(parts[3:], " "), ttl)
+
+	case "PUTMETA":
+		if len(parts) < 4 {
+			return reply{}, usageError("Usage: PUTMETA <key> <name=value[,name=value...]> <value>")
+		}
+		meta, err := gocask.ParseMetadata(strings.Split(parts[2], ","))
+		if err != nil {
+			return reply{}, err
+		}
+		return reply{}, db.PutWithMeta(parts[1], strings.Join(parts[3:], " "), meta, 0)
+
+	case "GETMETA":
+		if len(parts) != 2 {
+			return reply{}, usageError("Usage: GETMETA <key>")
+		}
+		meta, err := db.GetMeta(parts[1])
+		if err != nil {
+			return reply{}, err
+		}
+		return valueReply("Meta", meta.String()), nil
+
+	case "TTL":
+		if len(parts) != 2 {
+			return reply{}, usageError("Usage: TTL <key>")
+		}
+		ttl, ok, err := db.TTL(parts[1])
+		if err != nil {
+			return reply{}, err
+		}
+		if !ok {
+			return valueReply("TTL", "none"), nil
+		}
+		return valueReply("TTL", ttl.Round(time.Millisecond).String()), nil
+
+	case "EXPIRE":
+		if len(parts) != 3 {
+			return reply{}, usageError("Usage: EXPIRE <key> <ttl>")
+		}
+		ttl, err := time.ParseDuration(parts[2])
+		if err != nil {
+			return reply{}, usageError("Usage: EXPIRE <key> <ttl>, ttl like 30s or 1h")
+		}
+		return reply{}, db.Expire(parts[1], ttl)
+
+	case "EXPIREAT":
+		if len(parts) != 3 {
+			return reply{}, usageError("Usage: EXPIREAT <key> <time>")
+		}
+		t, err := time.Parse(time.RFC3339, parts[2])
+		if err != nil {
+			return reply{}, usageError("Usage: EXPIREAT <key> <time>, time like 2030-01-02T15:04:05Z")
+		}
+		return reply{}, db.ExpireAt(parts[1], t)
+
+	case "PERSIST":
+		if len(parts) != 2 {
+			return reply{}, usageError("Usage: PERSIST <key>")
+		}
+		return reply{}, db.Persist(parts[1])
+
+	case "TSADD":
+		const tsaddUsage = usageError("Usage: TSADD <metric> <time|*> <value>, time like 2030-01-02T15:04:05Z")
+		if len(parts) < 4 {
+			return reply{}, tsaddUsage
+		}
+		t := time.Now()
+		if parts[2] != "*" {
+			var err error
+			if t, err = time.Parse(time.RFC3339Nano, parts[2]); err != nil {
+				return reply{}, tsaddUsage
+			}
+		}
+		ts := &gocask.TimeSeries{Metric: parts[1]}
+		return reply{}, ts.Add(db, t, strings.Join(parts[3:], " "))
+
+	case "TSRANGE":
+		const tsrangeUsage = usageError("Usage: TSRANGE <metric> <from|-> <to|+>, times like 2030-01-02T15:04:05Z")
+		if len(parts) != 4 {
+			return reply{}, tsrangeUsage
+		}
+		var from, to time.Time
+		var err error
+		if parts[2] != "-" {
+			if from, err = time.Parse(time.RFC3339Nano, parts[2]); err != nil {
+				return reply{}, tsrangeUsage
+			}
+		}
+		if parts[3] != "+" {
+			if to, err = time.Parse(time.RFC3339Nano, parts[3]); err != nil {
+				return reply{}, tsrangeUsage
+			}
+		}
+		points, err := db.RangeTime(parts[1], from, to)
+		if err != nil {
+			return reply{}, err
+		}
+		var r reply
+		for _, p := range points {
+			r.lines = append(r.lines, p.Time.UTC().Format(time.RFC3339Nano)+" "+p.Value)
+		}
+		return r, nil
+
+	case "DEL":
+		if len(parts) != 2 {
+			return reply{}, usageError("Usage: DEL <key>")
+		}
+		return reply{}, db.Delete(parts[1])
+
+	case "GET":
+		if len(parts) != 2 {
+			return reply{}, usageError("Usage: GET <key>")
+		}
+		v, err := db.Get(parts[1])
+		if err != nil {
+			return reply{}, err
+		}
+		return valueReply("Value", v), nil
+
+	case "GETFIELD":
+		if len(parts) != 3 {
+			return reply{}, usageError("Usage: GETFIELD <key> <path>, path like a.b[2]")
+		}
+		v, err := db.GetField(parts[1], parts[2])
+		if err != nil {
+			return reply{}, err
+		}
+		return valueReply("Field", v), nil
+
+	case "SETFIELD":
+		if len(parts) < 4 {
+			return reply{}, usageError("Usage: SETFIELD <key> <path> <json>, path like a.b[2]")
+		}
+		return reply{}, db.SetField(parts[1], parts[2], strings.Join(parts[3:], " "))
+
+	case "HSET":
+		if len(parts) != 4 {
+			return reply{}, usageError("Usage: HSET <hash> <field> <value>")
+		}
+		return reply{}, db.HSet(parts[1], parts[2], parts[3])
+
+	case "HGET":
+		if len(parts) != 3 {
+			return reply{}, usageError("Usage: HGET <hash> <field>")
+		}
+		v, err := db.HGet(parts[1], parts[2])
+		if err != nil {
+			return reply{}, err
+		}
+		return valueReply("Value", v), nil
+
+	case "HDEL":
+		if len(parts) < 3 {
+			return reply{}, usageError("Usage: HDEL <hash> <field>...")
+		}
+		n := 0
+		for _, field := range parts[2:] {
+			deleted, err := db.HDel(parts[1], field)
+			if err != nil {
+				return reply{}, err
+			}
+			if deleted {
+				n++
+			}
+		}
+		return valueReply("Deleted", strconv.Itoa(n)), nil
+
+	case "HGETALL":
+		if len(parts) != 2 {
+			return reply{}, usageError("Usage: HGETALL <hash>")
+		}
+		fields, err := db.HGetAll(parts[1])
+		if err != nil {
+			return reply{}, err
+		}
+		var r reply
+		for name, v := range fields {
+			r.lines = append(r.lines, name+" "+v)
+		}
+		sort.Strings(r.lines)
+		return r, nil
+
+	case "SADD", "SREM":
+		if len(parts) < 3 {
+			return reply{}, usageError("Usage: " + strings.ToUpper(parts[0]) + " <set> <member>...")
+		}
+		change, label := db.SAdd, "Added"
+		if strings.ToUpper(parts[0]) == "SREM" {
+			change, label = db.SRem, "Removed"
+		}
+		n := 0
+		for _, member := range parts[2:] {
+			changed, err := change(parts[1], member)
+			if err != nil {
+				return reply{}, err
+			}
+			if changed {
+				n++
+			}
+		}
+		return valueReply(label, strconv.Itoa(n)), nil
+
+	case "SISMEMBER":
+		if len(parts) != 3 {
+			return reply{}, usageError("Usage: SISMEMBER <set> <member>")
+		}
+		return valueReply("Member", strconv.FormatBool(db.SIsMember(parts[1], parts[2]))), nil
+
+	case "SMEMBERS":
+		if len(parts) != 2 {
+			return reply{}, usageError("Usage: SMEMBERS <set>")
+		}
+		return reply{lines: db.SMembers(parts[1])}, nil
+
+	case "LPUSH", "RPUSH":
+		if len(parts) < 3 {
+			return reply{}, usageError("Usage: " + strings.ToUpper(parts[0]) + " <list> <value>...")
+		}
+		push := db.RPush
+		if strings.ToUpper(parts[0]) == "LPUSH" {
+			push = db.LPush
+		}
+		var n int64
+		for _, v := range parts[2:] {
+			var err error
+			if n, err = push(parts[1], v); err != nil {
+				return reply{}, err
+			}
+		}
+		return valueReply("Length", strconv.FormatInt(n, 10)), nil
+
+	case "LPOP", "RPOP":
+		if len(parts) != 2 {
+			return reply{}, usageError("Usage: " + strings.ToUpper(parts[0]) + " <list>")
+		}
+		pop := db.RPop
+		if strings.ToUpper(parts[0]) == "LPOP" {
+			pop = db.LPop
+		}
+		v, ok, err := pop(parts[1])
+		if err != nil {
+			return reply{}, err
+		} else if !ok {
+			return reply{}, fmt.Errorf("list %q is empty", parts[1])
+		}
+		return valueReply("Value", v), nil
+
+	case "LLEN":
+		if len(parts) != 2 {
+			return reply{}, usageError("Usage: LLEN <list>")
+		}
+		n, err := db.LLen(parts[1])
+		if err != nil {
+			return reply{}, err
+		}
+		return valueReply("Length", strconv.FormatInt(n, 10)), nil
+
+	case "LRANGE":
+		const lrangeUsage = usageError("Usage: LRANGE <list> <start> <stop>, -1 for the last element")
+		if len(parts) != 4 {
+			return reply{}, lrangeUsage
+		}
+		start, err1 := strconv.ParseInt(parts[2], 10, 64)
+		stop, err2 := strconv.ParseInt(parts[3], 10, 64)
+		if err1 != nil || err2 != nil {
+			return reply{}, lrangeUsage
+		}
+		values, err := db.LRange(parts[1], start, stop)
+		if err != nil {
+			return reply{}, err
+		}
+		return reply{lines: values}, nil
+
+	case "CHANGES":
+		if len(parts) > 2 {
+			return reply{}, usageError("Usage: CHANGES [position]")
+		}
+		var since int64
+		if len(parts) == 2 {
+			n, err := strconv.ParseInt(parts[1], 10, 64)
+			if err != nil || n < 0 {
+				return reply{}, usageError("Usage: CHANGES [position]")
+			}
+			since = n
+		}
+		lines, pos, err := changeLines(db, gocask.Position(since))
+		r := valueReply("Position", strconv.FormatInt(int64(pos), 10))
+		r.lines = lines
+		return r, err
+
+	case "KEYS":
+		if len(parts) > 2 {
+			return reply{}, usageError("Usage: KEYS [prefix|glob]")
+		}
+		m, err := keyMatcher(parts[1:])
+		if err != nil {
+			return reply{}, err
+		}
+		return reply{lines: keys(db, m)}, nil
+
+	case "COUNT":
+		if len(parts) > 2 {
+			return reply{}, usageError("Usage: COUNT [prefix|glob]")
+		}
+		m, err := keyMatcher(parts[1:])
+		if err != nil {
+			return reply{}, err
+		}
+		return valueReply("Count", strconv.Itoa(len(keys(db, m)))), nil
+
+	case "SCAN":
+		return scan(db, parts[1:])
+
+	case "STATS":
+		if len(parts) != 1 {
+			return reply{}, usageError("Usage: STATS")
+		}
+		lines, err := db.StatsReport()
+		return reply{lines: lines}, err
+
+	default:
+		return reply{}, usageError("Commands: PUT, PUTTTL, PUTMETA, GET, GETMETA, GETFIELD, SETFIELD, HSET, HGET, HDEL, HGETALL, SADD, SREM, SISMEMBER, SMEMBERS, LPUSH, RPUSH, LPOP, RPOP, LLEN, LRANGE, DEL, TTL, EXPIRE, EXPIREAT, PERSIST, TSADD, TSRANGE, KEYS, SCAN, COUNT, STATS, CHANGES, MULTI, EXEC, DISCARD, EXIT")
+	}
+}
+
+// session is one repl or exec client. Between MULTI and EXEC its commands are queued,
+// then EXEC runs them back to back in a single Exclusive call on the store, so nothing
+// else (feeds, replication, rotation) interleaves with them. The records are still written
+// one by one: a crash in the middle of an EXEC can leave part of it applied.
+type session struct {
+	queue  [][]string
+	queued bool // inside MULTI
+}
+
+// run executes or queues one command against db, which the caller holds
+// exclusively.
+func (se *session) run(db *gocask.DB, parts []string) (reply, error) {
+	switch strings.ToUpper(parts[0]) {
+	case "MULTI":
+		if len(parts) != 1 {
+			return reply{}, usageError("Usage: MULTI")
+		}
+		if se.queued {
+			return reply{}, fmt.Errorf("MULTI calls can't be nested")
+		}
+		se.queued = true
+		return reply{}, nil
+
+	case "DISCARD":
+		if !se.queued {
+			return reply{}, fmt.Errorf("DISCARD without MULTI")
+		}
+		se.queue, se.queued = nil, false
+		return reply{}, nil
+
+	case "EXEC":
+		if !se.queued {
+			return reply{}, fmt.Errorf("EXEC without MULTI")
+		}
+		queue := se.queue
+		se.queue, se.queued = nil, false
+		return se.exec(db, queue)
+	}
+
+	if se.queued {
+		se.queue = append(se.queue, parts)
+		return reply{lines: []string{"QUEUED"}}, nil
+	}
+	return runCommand(db, parts)
+}
+
+// exec runs queued commands in order. Like redis, a failing command doesn't stop the
+// ones after it; each gets a numbered result line after its own listing output, and
+// the EXEC as a whole fails if any of them did.
+func (se *session) exec(db *gocask.DB, queue [][]string) (reply, error) {
+	r := valueReply("Executed", strconv.Itoa(len(queue)))
+	failed := 0
+	for i, parts := range queue {
+		res, err := runCommand(db, parts)
+		r.lines = append(r.lines, res.lines...)
+		switch {
+		case err != nil:
+			r.lines = append(r.lines, fmt.Sprintf("%d) ERR %v", i+1, err))
+			failed++
+		case res.hasValue:
+			r.lines = append(r.lines, fmt.Sprintf("%d) %s: %s", i+1, res.label, res.value))
+		default:
+			r.lines = append(r.lines, fmt.Sprintf("%d) OK", i+1))
+		}
+	}
+	if failed > 0 {
+		return r, fmt.Errorf("%d of %d queued commands failed", failed, len(queue))
+	}
+	return r, nil
+}
+
+// keyMatcher turns an optional KEYS/COUNT argument into a filter. A pattern with
+// glob characters (* ? [) is matched against the whole key, anything else is a prefix.
+// nil means every key.
+func keyMatcher(args []string) (func(string) bool, error) {
+	if len(args) == 0 {
+		return nil, nil
+	}
+	pattern := args[0]
+	if !strings.ContainsAny(pattern, "*?[") {
+		return func(k string) bool { return strings.HasPrefix(k, pattern) }, nil
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, fmt.Errorf("bad pattern %q: %w", pattern, err)
+	}
+	// path.Match stops * at slashes, keys like user/1 should still match user*
+	re, err := globRegexp(pattern)
+	if err != nil {
+		return nil, err
+	}
+	return re.MatchString, nil
+}
+
+// globRegexp translates a glob into an anchored regexp where * and ? cross slashes.
+func globRegexp(pattern string) (*regexp.Regexp, error) {
+	var b strings.Builder
+	b.WriteString(`^(?s:`)
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '*':
+			b.WriteString(`.*`)
+		case '?':
+			b.WriteString(`.`)
+		case '[':
+			end := strings.IndexByte(pattern[i+1:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("bad pattern %q: unclosed [", pattern)
+			}
+			class := pattern[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + class + "]")
+			i += end + 1
+		case '\\':
+			if i+1 < len(pattern) {
+				i++
+				b.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+			}
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString(`)$`)
+	return regexp.Compile(b.String())
+}
+
+// keys returns the live keys of db accepted by match (all of them if match is
+// nil), sorted.
+func keys(db *gocask.DB, match func(string) bool) []string {
+	keys := db.Keys()
+	if match == nil {
+		return keys
+	}
+	live := keys[:0]
+	for _, k := range keys {
+		if match(k) {
+			live = append(live, k)
+		}
+	}
+	return live
+}
+
+// scan implements SCAN <cursor> [MATCH pattern] [COUNT n]. Like redis, the cursor
+// is opaque: start at 0 and feed back what each call returns until it is 0 again.
+// Here it counts the matching keys already returned, in sorted order.
+func scan(db *gocask.DB, args []string) (reply, error) {
+	const scanUsage = usageError("Usage: SCAN <cursor> [MATCH pattern] [COUNT n]")
+	if len(args) == 0 {
+		return reply{}, scanUsage
+	}
+	cursor, err := strconv.Atoi(args[0])
+	if err != nil || cursor < 0 {
+		return reply{}, scanUsage
+	}
+
+	var match func(string) bool
+	count := 10
+	for rest := args[1:]; len(rest) > 0; rest = rest[2:] {
+		if len(rest) < 2 {
+			return reply{}, scanUsage
+		}
+		switch strings.ToUpper(rest[0]) {
+		case "MATCH":
+			if match, err = keyMatcher(rest[1:2]); err != nil {
+				return reply{}, err
+			}
+		case "COUNT":
+			if count, err = strconv.Atoi(rest[1]); err != nil || count <= 0 {
+				return reply{}, scanUsage
+			}
+		default:
+			return reply{}, scanUsage
+		}
+	}
+
+	matched := keys(db, match)
+	if cursor >= len(matched) {
+		return valueReply("Cursor", "0"), nil
+	}
+	end := cursor + count
+	next := strconv.Itoa(end)
+	if end >= len(matched) {
+		end, next = len(matched), "0"
+	}
+	r := valueReply("Cursor", next)
+	r.lines = matched[cursor:end]
+	return r, nil
+}
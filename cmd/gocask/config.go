@@ -0,0 +1,228 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// configEnv names the config file when --config isn't given.
+const configEnv = "GOCASK_CONFIG"
+
+// envPrefix starts the environment variables that override settings, e.g.
+// GOCASK_MERGE_POLICY for --merge-policy.
+const envPrefix = "GOCASK_"
+
+// configFile holds the settings of a config file by the flag they set, each with the
+// values to set it to: more than one for a repeatable flag like --retention.
+//
+// A config file is TOML or YAML, told apart by its extension. Its keys are flag
+// names, and tables nest them, so these all set --merge-policy:
+//
+//	merge-policy = "active-size=1048576"
+//	merge_policy = "active-size=1048576"
+//	[merge]
+//	policy = "active-size=1048576"
+//
+// One file serves every command; settings a command has no flag for are left to
+// the others, see "gocask config validate".
+type configFile map[string][]string
+
+// loadConfig reads the config file at path.
+func loadConfig(path string) (configFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]any
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".toml":
+		_, err = toml.Decode(string(data), &raw)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &raw)
+	default:
+		return nil, fmt.Errorf("%s: want a .toml, .yaml or .yml config file", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	cfg := make(configFile)
+	if err := cfg.add("", raw); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// add flattens the table m, whose keys go after prefix, into cfg.
+func (cfg configFile) add(prefix string, m map[string]any) error {
+	for k, v := range m {
+		name := strings.ReplaceAll(strings.ToLower(k), "_", "-")
+		if prefix != "" {
+			name = prefix + "-" + name
+		}
+		switch v := v.(type) {
+		case map[string]any:
+			if err := cfg.add(name, v); err != nil {
+				return err
+			}
+		case []any:
+			for _, e := range v {
+				s, err := configValue(name, e)
+				if err != nil {
+					return err
+				}
+				cfg[name] = append(cfg[name], s)
+			}
+		default:
+			s, err := configValue(name, v)
+			if err != nil {
+				return err
+			}
+			cfg[name] = append(cfg[name], s)
+		}
+	}
+	return nil
+}
+
+// configValue is v as it would be written on the command line.
+func configValue(name string, v any) (string, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case int, int64, uint64:
+		return fmt.Sprint(v), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	}
+	return "", fmt.Errorf("%s: %v isn't a string, number or boolean", name, v)
+}
+
+// envName is the environment variable that overrides flag name.
+func envName(name string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// settingSource says where a flag's value came from: the command line, an
+// environment variable or the config file. Flags left at their default have none.
+type settingSource string
+
+// applyConfig sets the flags of fs the command line left alone, from the
+// environment if it has them and else from cfg, and returns where each flag's
+// value came from. Flags override the environment, which overrides the file.
+func applyConfig(fs *flag.FlagSet, cfg configFile, path string) (map[string]settingSource, error) {
+	from := make(map[string]settingSource)
+	fs.Visit(func(f *flag.Flag) { from[f.Name] = "command line" })
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || from[f.Name] != "" || f.Name == "config" {
+			return
+		}
+		if v, ok := os.LookupEnv(envName(f.Name)); ok {
+			if serr := fs.Set(f.Name, v); serr != nil {
+				err = fmt.Errorf("$%s: invalid value %q: %w", envName(f.Name), v, serr)
+			}
+			from[f.Name] = settingSource("$" + envName(f.Name))
+			return
+		}
+		if vs, ok := cfg[f.Name]; ok {
+			for _, v := range vs {
+				if serr := fs.Set(f.Name, v); serr != nil {
+					err = fmt.Errorf("%s: invalid value %q for %s: %w", path, v, f.Name, serr)
+					return
+				}
+			}
+			from[f.Name] = settingSource(path)
+		}
+	})
+	return from, err
+}
+
+// configure applies the config file, --config or $GOCASK_CONFIG, and the
+// environment to the flags the command line didn't set.
+func (c *command) configure() (map[string]settingSource, error) {
+	path := *c.config
+	if path == "" {
+		path = os.Getenv(configEnv)
+	}
+	var cfg configFile
+	if path != "" {
+		var err error
+		if cfg, err = loadConfig(path); err != nil {
+			return nil, err
+		}
+	}
+	return applyConfig(c.fs, cfg, path)
+}
+
+// cmdConfig checks a config file: that it parses, that every setting is one serve
+// or every command has, and that the values are valid, together with the
+// environment's overrides. It then prints the settings that aren't defaults and
+// where each came from.
+func cmdConfig(args []string) error {
+	c := newCommand("config", "validate [file]")
+	// not c.parse: the file to check may not be $GOCASK_CONFIG, which may not parse
+	c.fs.Parse(args)
+	if n := c.fs.NArg(); n < 1 || n > 2 || c.fs.Arg(0) != "validate" {
+		c.fs.Usage()
+		os.Exit(2)
+	}
+	path := c.fs.Arg(1)
+	if path == "" {
+		path = *c.config
+	}
+	if path == "" {
+		path = os.Getenv(configEnv)
+	}
+	if path == "" {
+		return fmt.Errorf("no config file to validate, pass one or set $%s", configEnv)
+	}
+	cfg, err := loadConfig(path)
+	if err != nil {
+		return err
+	}
+
+	sc := newServeCommand()
+	var unknown []string
+	for name := range cfg {
+		if sc.fs.Lookup(name) == nil || name == "config" {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("%s: unknown settings %s, see \"gocask serve -h\"", path, strings.Join(unknown, ", "))
+	}
+	*sc.config = path
+	if err := sc.parse(nil, 0, 0); err != nil {
+		return err
+	}
+	if err := sc.check(); err != nil {
+		return err
+	}
+
+	fmt.Printf("%s is valid\n", path)
+	sc.fs.VisitAll(func(f *flag.Flag) {
+		src, ok := sc.from[f.Name]
+		if !ok {
+			return
+		}
+		// repeatable flags don't print their values
+		v := f.Value.String()
+		if v == "" && src == settingSource(path) {
+			v = strings.Join(cfg[f.Name], "; ")
+		} else if v == "" {
+			v = os.Getenv(envName(f.Name))
+		}
+		fmt.Printf("  %-22s %-36q %s\n", f.Name, v, src)
+	})
+	return nil
+}
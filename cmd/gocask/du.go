@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/itsknk/gocask"
+)
+
+// cmdDu prints per-file live, dead and expired bytes, so operators can tell whether a merge is worth it.
+func cmdDu(args []string) error {
+	c := newCommand("du", "")
+	if err := c.parse(args, 0, 0); err != nil {
+		return err
+	}
+	usage, err := gocask.DiskUsage(*c.dir)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%-20s %12s %12s %12s %6s %12s %8s %10s %s\n", "FILE", "SIZE", "LIVE", "DEAD", "DEAD%", "EXPIRED", "RECORDS", "TOMBSTONES", "AGE")
+	var total gocask.SegmentUsage
+	for _, u := range usage {
+		age := "active"
+		if !u.Sealed.IsZero() {
+			age = time.Since(u.Sealed).Round(time.Second).String()
+		}
+		fmt.Printf("%-20s %12d %12d %12d %6s %12d %8d %10d %s\n",
+			u.Name, u.Size, u.Live, u.Dead(), deadRatio(*u), u.Expired, u.Records, u.Deleted, age)
+
+		total.Size += u.Size
+		total.Live += u.Live
+		total.Expired += u.Expired
+		total.Records += u.Records
+		total.Deleted += u.Deleted
+	}
+	fmt.Printf("%-20s %12d %12d %12d %6s %12d %8d %10d\n",
+		"total", total.Size, total.Live, total.Dead(), deadRatio(total), total.Expired, total.Records, total.Deleted)
+	fmt.Printf("after merge: %d bytes of data, %d bytes reclaimed, %d of them expired\n", total.Live, total.Dead(), total.Expired)
+	return nil
+}
+
+func deadRatio(u gocask.SegmentUsage) string {
+	if u.Size == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.1f", float64(u.Dead())*100/float64(u.Size))
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/itsknk/gocask"
+)
+
+// cmdDump prints every live key and value or, given a file, that file's raw records.
+func cmdDump(args []string) error {
+	c := newCommand("dump", "[file]")
+	hint := c.fs.Bool("hint", false, "the file is a .hint file rather than a data segment")
+	output := addOutputFlag(c.fs)
+	if err := c.parse(args, 0, 1); err != nil {
+		return err
+	}
+	if err := checkOutputFlag(*output); err != nil {
+		return err
+	}
+	if c.fs.NArg() == 1 {
+		path := c.fs.Arg(0)
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(*c.dir, path)
+		}
+		if *hint {
+			return dumpHint(path, *output)
+		}
+		return dumpSegment(path, *output)
+	}
+
+	s, err := c.open()
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	for _, k := range s.Keys() {
+		line, err := keyOutput(*output, k, s.DB, true)
+		if err != nil {
+			return err
+		}
+		fmt.Println(line)
+	}
+	return nil
+}
+
+// dumpSegment prints one line per record of a data file, stopping at the first bad one.
+// The json output has the whole record, value included, instead of the table.
+func dumpSegment(path, output string) error {
+	if output == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		return gocask.ScanSegment(path, func(r gocask.Record) error {
+			rec := newOutputRecord(string(r.Key), string(r.Value), r.Timestamp, filepath.Base(path), r.Offset)
+			rec.Flag = r.Kind
+			rec.setExpires(r.Expires)
+			rec.Meta = r.Meta
+			return enc.Encode(rec)
+		})
+	}
+
+	fmt.Printf("%-10s %-4s %-30s %-5s %-10s %s\n", "OFFSET", "FLAG", "TIMESTAMP", "NODE", "VALUE", "KEY")
+	n := 0
+	err := gocask.ScanSegment(path, func(r gocask.Record) error {
+		ts := time.Unix(0, int64(r.Timestamp)).UTC().Format(time.RFC3339Nano)
+		fmt.Printf("%-10d %-4s %-30s %-5d %-10d %s\n", r.Offset, r.Kind, ts, gocask.TimestampNode(r.Timestamp), r.Size, dumpKey(output, r.Key))
+		n++
+		return nil
+	})
+	fmt.Printf("%d records\n", n)
+	return err
+}
+
+// dumpKey renders the KEY column: quoted for raw, encoded for hex and base64.
+func dumpKey(output string, key []byte) string {
+	if output == "raw" {
+		return strconv.Quote(string(key))
+	}
+	return encodeOutput(output, string(key))
+}
+
+// dumpHint prints the entries of a hint file and the record offset each points at.
+func dumpHint(path, output string) error {
+	if output == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		return gocask.ScanHints(path, func(e gocask.HintEntry) error {
+			k := encodeRecord(string(e.Key), "")
+			return enc.Encode(struct {
+				Pos       int64  `json:"pos"`
+				Key       string `json:"key"`
+				Enc       string `json:"enc,omitempty"`
+				Offset    int64  `json:"offset"`
+				ValueSize uint32 `json:"value_size"`
+				Tombstone bool   `json:"tombstone,omitempty"`
+				Expiring  bool   `json:"expiring,omitempty"`
+				Meta      bool   `json:"meta,omitempty"`
+				Chunked   bool   `json:"chunked,omitempty"`
+			}{e.Pos, k.Key, k.Enc, e.Offset, e.ValueSize, e.Kind == "del", e.Kind == "ttl", e.Kind == "meta", e.Kind == "chnk"})
+		})
+	}
+
+	fmt.Printf("%-10s %-10s %-4s %-10s %s\n", "POS", "OFFSET", "FLAG", "VALUE", "KEY")
+	n := 0
+	err := gocask.ScanHints(path, func(e gocask.HintEntry) error {
+		fmt.Printf("%-10d %-10d %-4s %-10d %s\n", e.Pos, e.Offset, e.Kind, e.ValueSize, dumpKey(output, e.Key))
+		n++
+		return nil
+	})
+	fmt.Printf("%d entries\n", n)
+	return err
+}
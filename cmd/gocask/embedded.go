@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	bolt "go.etcd.io/bbolt"
+)
+
+// embeddedBatch is how many keys go into one bolt transaction or leveldb batch on export.
+const embeddedBatch = 10000
+
+// cmdImportBolt copies the keys of one bolt bucket. Nested buckets are skipped.
+func cmdImportBolt(args []string) error {
+	c := newCommand("import-bolt", "<file>")
+	bucket := c.fs.String("bucket", "", "bucket to import (required)")
+	onConflict := addConflictFlag(c.fs)
+	if err := c.parse(args, 1, 1); err != nil {
+		return err
+	}
+	if err := checkConflictFlag(*onConflict); err != nil {
+		return err
+	}
+	if *bucket == "" {
+		return fmt.Errorf("import-bolt needs --bucket")
+	}
+
+	db, err := bolt.Open(c.fs.Arg(0), 0600, &bolt.Options{ReadOnly: true, Timeout: time.Second})
+	if err != nil {
+		return fmt.Errorf("open %s: %w", c.fs.Arg(0), err)
+	}
+	defer db.Close()
+
+	s, err := c.open()
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	im := &importer{s: s, onConflict: *onConflict}
+	nested := 0
+	err = im.run(func(fn func(importRecord) error) error {
+		nested = 0
+		return db.View(func(tx *bolt.Tx) error {
+			b := tx.Bucket([]byte(*bucket))
+			if b == nil {
+				return fmt.Errorf("no bucket %q", *bucket)
+			}
+			return b.ForEach(func(k, v []byte) error {
+				if v == nil {
+					nested++
+					return nil
+				}
+				return fn(importRecord{key: string(k), value: string(v)})
+			})
+		})
+	})
+	if err != nil {
+		return err
+	}
+	im.report()
+	if nested > 0 {
+		fmt.Fprintf(os.Stderr, "skipped %d nested buckets\n", nested)
+	}
+	return nil
+}
+
+// cmdExportBolt writes every live key into a bolt bucket, creating the file and bucket if needed.
+func cmdExportBolt(args []string) error {
+	c := newCommand("export-bolt", "<file>")
+	bucket := c.fs.String("bucket", "", "bucket to write into (required)")
+	if err := c.parse(args, 1, 1); err != nil {
+		return err
+	}
+	if *bucket == "" {
+		return fmt.Errorf("export-bolt needs --bucket")
+	}
+
+	db, err := bolt.Open(c.fs.Arg(0), 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return fmt.Errorf("open %s: %w", c.fs.Arg(0), err)
+	}
+	defer db.Close()
+
+	s, err := c.open()
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	keys := s.Keys()
+	for len(keys) > 0 {
+		n := min(len(keys), embeddedBatch)
+		err := db.Update(func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucketIfNotExists([]byte(*bucket))
+			if err != nil {
+				return err
+			}
+			for _, k := range keys[:n] {
+				v, err := s.Get(k)
+				if err != nil {
+					return fmt.Errorf("read %q: %w", k, err)
+				}
+				if err := b.Put([]byte(k), []byte(v)); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		keys = keys[n:]
+	}
+	return nil
+}
+
+// openLevelDB opens a leveldb directory by absolute path: leveldb opens table files
+// as it needs them, after the store has changed directory.
+func openLevelDB(dir string, o *opt.Options) (*leveldb.DB, error) {
+	path, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	db, err := leveldb.OpenFile(path, o)
+	if err != nil {
+		return nil, fmt.Errorf("open %s: %w", dir, err)
+	}
+	return db, nil
+}
+
+// cmdImportLevelDB copies every key of a leveldb database directory.
+func cmdImportLevelDB(args []string) error {
+	c := newCommand("import-leveldb", "<dir>")
+	onConflict := addConflictFlag(c.fs)
+	if err := c.parse(args, 1, 1); err != nil {
+		return err
+	}
+	if err := checkConflictFlag(*onConflict); err != nil {
+		return err
+	}
+
+	db, err := openLevelDB(c.fs.Arg(0), &opt.Options{ReadOnly: true, ErrorIfMissing: true})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	s, err := c.open()
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	im := &importer{s: s, onConflict: *onConflict}
+	err = im.run(func(fn func(importRecord) error) error {
+		it := db.NewIterator(nil, nil)
+		defer it.Release()
+		for it.Next() {
+			if err := fn(importRecord{key: string(it.Key()), value: string(it.Value())}); err != nil {
+				return err
+			}
+		}
+		return it.Error()
+	})
+	if err != nil {
+		return err
+	}
+	im.report()
+	return nil
+}
+
+// cmdExportLevelDB writes every live key into a leveldb database, creating it if needed.
+func cmdExportLevelDB(args []string) error {
+	c := newCommand("export-leveldb", "<dir>")
+	if err := c.parse(args, 1, 1); err != nil {
+		return err
+	}
+
+	db, err := openLevelDB(c.fs.Arg(0), nil)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	s, err := c.open()
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	batch := new(leveldb.Batch)
+	for _, k := range s.Keys() {
+		v, err := s.Get(k)
+		if err != nil {
+			return fmt.Errorf("read %q: %w", k, err)
+		}
+		batch.Put([]byte(k), []byte(v))
+		if batch.Len() >= embeddedBatch {
+			if err := db.Write(batch, nil); err != nil {
+				return err
+			}
+			batch.Reset()
+		}
+	}
+	return db.Write(batch, &opt.WriteOptions{Sync: true})
+}
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/itsknk/gocask"
+)
+
+// exportRecord is one key/value in an export. Enc is "base64" when the key or the
+// value isn't valid utf-8, in which case both are base64-encoded; otherwise it's empty
+// and both are plain text so exports stay readable and diffable. Metadata and the
+// timestamp the value was written at are only exported as json; csv exports leave
+// them out.
+type exportRecord struct {
+	Key       string          `json:"key"`
+	Value     string          `json:"value"`
+	Enc       string          `json:"enc,omitempty"`
+	Meta      gocask.Metadata `json:"meta,omitempty"`
+	Timestamp uint64          `json:"ts,omitempty"`
+}
+
+func encodeRecord(key, value string) exportRecord {
+	if utf8.ValidString(key) && utf8.ValidString(value) {
+		return exportRecord{Key: key, Value: value}
+	}
+	return exportRecord{
+		Key:   base64.StdEncoding.EncodeToString([]byte(key)),
+		Value: base64.StdEncoding.EncodeToString([]byte(value)),
+		Enc:   "base64",
+	}
+}
+
+func (r exportRecord) decode() (string, string, error) {
+	switch r.Enc {
+	case "":
+		return r.Key, r.Value, nil
+	case "base64":
+		k, err := base64.StdEncoding.DecodeString(r.Key)
+		if err != nil {
+			return "", "", fmt.Errorf("key: %w", err)
+		}
+		v, err := base64.StdEncoding.DecodeString(r.Value)
+		if err != nil {
+			return "", "", fmt.Errorf("value: %w", err)
+		}
+		return string(k), string(v), nil
+	default:
+		return "", "", fmt.Errorf("unknown encoding %q", r.Enc)
+	}
+}
+
+// recordWriter and recordReader are the two halves of an export format.
+type recordWriter interface {
+	Write(r exportRecord) error
+	Flush() error
+}
+
+type recordReader interface {
+	// Read returns io.EOF after the last record.
+	Read() (exportRecord, error)
+}
+
+// json exports are json lines: one object per line.
+type jsonRecordWriter struct {
+	w   *bufio.Writer
+	enc *json.Encoder
+}
+
+func (j *jsonRecordWriter) Write(r exportRecord) error { return j.enc.Encode(r) }
+
+func (j *jsonRecordWriter) Flush() error { return j.w.Flush() }
+
+type jsonRecordReader struct{ dec *json.Decoder }
+
+func (j *jsonRecordReader) Read() (exportRecord, error) {
+	var r exportRecord
+	err := j.dec.Decode(&r)
+	return r, err
+}
+
+// csv exports have a key,value,enc header row.
+type csvRecordWriter struct {
+	w      *csv.Writer
+	header bool
+}
+
+func (c *csvRecordWriter) Write(r exportRecord) error {
+	if !c.header {
+		if err := c.w.Write([]string{"key", "value", "enc"}); err != nil {
+			return err
+		}
+		c.header = true
+	}
+	return c.w.Write([]string{r.Key, r.Value, r.Enc})
+}
+
+func (c *csvRecordWriter) Flush() error {
+	if !c.header {
+		// an empty store still gets a header, so the file round-trips
+		if err := c.w.Write([]string{"key", "value", "enc"}); err != nil {
+			return err
+		}
+		c.header = true
+	}
+	c.w.Flush()
+	return c.w.Error()
+}
+
+type csvRecordReader struct {
+	r      *csv.Reader
+	header bool
+}
+
+func (c *csvRecordReader) Read() (exportRecord, error) {
+	if !c.header {
+		row, err := c.r.Read()
+		if err != nil {
+			return exportRecord{}, err
+		}
+		if len(row) != 3 || row[0] != "key" || row[1] != "value" || row[2] != "enc" {
+			return exportRecord{}, fmt.Errorf("csv: want a key,value,enc header, got %q", row)
+		}
+		c.header = true
+	}
+	row, err := c.r.Read()
+	if err != nil {
+		return exportRecord{}, err
+	}
+	return exportRecord{Key: row[0], Value: row[1], Enc: row[2]}, nil
+}
+
+func newRecordWriter(format string, w io.Writer) (recordWriter, error) {
+	switch format {
+	case "json":
+		bw := bufio.NewWriter(w)
+		return &jsonRecordWriter{w: bw, enc: json.NewEncoder(bw)}, nil
+	case "csv":
+		return &csvRecordWriter{w: csv.NewWriter(w)}, nil
+	default:
+		return nil, fmt.Errorf("unknown format %q (want json or csv)", format)
+	}
+}
+
+func newRecordReader(format string, r io.Reader) (recordReader, error) {
+	switch format {
+	case "json":
+		return &jsonRecordReader{dec: json.NewDecoder(bufio.NewReader(r))}, nil
+	case "csv":
+		cr := csv.NewReader(bufio.NewReader(r))
+		cr.FieldsPerRecord = 3
+		return &csvRecordReader{r: cr}, nil
+	default:
+		return nil, fmt.Errorf("unknown format %q (want json or csv)", format)
+	}
+}
+
+// cmdExport writes every live key, sorted, so two exports of the same data are identical.
+func cmdExport(args []string) error {
+	c := newCommand("export", "")
+	c.addSnapshotFlags()
+	format := c.fs.String("format", "json", "output format: json (one object per line) or csv")
+	out := c.fs.String("out", "", "write to this file instead of stdout")
+	if err := c.parse(args, 0, 0); err != nil {
+		return err
+	}
+
+	var dst io.Writer = os.Stdout
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		dst = f
+	}
+	rw, err := newRecordWriter(*format, dst)
+	if err != nil {
+		return err
+	}
+
+	s, err := c.open()
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	for _, k := range s.Keys() {
+		e, err := s.GetEntry(k)
+		if err != nil {
+			return fmt.Errorf("read %q: %w", k, err)
+		}
+		rec := encodeRecord(k, e.Value)
+		rec.Meta, rec.Timestamp = e.Meta, e.Timestamp
+		if err := rw.Write(rec); err != nil {
+			return err
+		}
+	}
+	return rw.Flush()
+}
+
+// cmdImport loads an export produced by cmdExport.
+func cmdImport(args []string) error {
+	c := newCommand("import", "[file]")
+	format := c.fs.String("format", "json", "input format: json or csv")
+	onConflict := addConflictFlag(c.fs)
+	bulk := c.fs.Bool("bulk", false, "write everything into one new segment at once, see BulkLoad (needs --on-conflict overwrite, drops metadata)")
+	unique := c.fs.Bool("unique", false, "with --bulk, promise the input has no repeated keys")
+	if err := c.parse(args, 0, 1); err != nil {
+		return err
+	}
+	if err := checkConflictFlag(*onConflict); err != nil {
+		return err
+	}
+	if *bulk && *onConflict != conflictOverwrite {
+		return fmt.Errorf("--bulk only overwrites, it can't be combined with --on-conflict %s", *onConflict)
+	}
+	if _, err := newRecordReader(*format, nil); err != nil {
+		return err
+	}
+
+	src := os.Stdin
+	if c.fs.NArg() == 1 {
+		f, err := os.Open(c.fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		src = f
+	} else if *onConflict == conflictFail {
+		// fail reads the input twice, so stdin is kept in a file
+		f, err := os.CreateTemp("", "gocask-import-")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(f.Name())
+		defer f.Close()
+		if _, err := io.Copy(f, os.Stdin); err != nil {
+			return err
+		}
+		src = f
+	}
+
+	s, err := c.open()
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	if *bulk {
+		rr, _ := newRecordReader(*format, src)
+		loaded, err := s.BulkLoad(func() (string, string, error) {
+			rec, err := rr.Read()
+			if err != nil {
+				return "", "", err
+			}
+			return rec.decode()
+		}, gocask.BulkOptions{Unique: *unique})
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "imported %d keys\n", loaded)
+		return nil
+	}
+
+	im := &importer{s: s, onConflict: *onConflict}
+	err = im.run(func(fn func(importRecord) error) error {
+		if src != os.Stdin {
+			if _, err := src.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+		}
+		rr, _ := newRecordReader(*format, src)
+		for n := 1; ; n++ {
+			rec, err := rr.Read()
+			if err == io.EOF {
+				return nil
+			} else if err != nil {
+				return fmt.Errorf("record %d: %w", n, err)
+			}
+			key, value, err := rec.decode()
+			if err != nil {
+				return fmt.Errorf("record %d: %w", n, err)
+			}
+			if err := fn(importRecord{key: key, value: value, meta: rec.Meta, ts: rec.Timestamp}); err != nil {
+				return fmt.Errorf("record %d: %w", n, err)
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	im.report()
+	return nil
+}
+
+// Import conflict policies: what an import does with a key the store already has a
+// live value for.
+const (
+	conflictOverwrite = "overwrite" // replace the value
+	conflictSkip      = "skip"      // keep it
+	conflictFail      = "fail"      // import nothing if the store has any of the keys
+	conflictNewest    = "newest"    // keep whichever value was written last
+)
+
+func addConflictFlag(fs *flag.FlagSet) *string {
+	return fs.String("on-conflict", conflictOverwrite, "what to do with keys that already exist: overwrite, skip, fail (import nothing if any do) or newest (keep whichever was written last, needs an input with timestamps)")
+}
+
+func checkConflictFlag(v string) error {
+	switch v {
+	case conflictOverwrite, conflictSkip, conflictFail, conflictNewest:
+		return nil
+	}
+	return fmt.Errorf("unknown --on-conflict %q (want overwrite, skip, fail or newest)", v)
+}
+
+// importRecord is one key an import brings in. expires is 0 for a value that gets
+// the default TTL, and ts, when the value was written, is 0 if the input doesn't say.
+type importRecord struct {
+	key, value  string
+	meta        gocask.Metadata
+	expires, ts uint64
+}
+
+// importSource calls fn with every record of an input, in order, until fn returns an
+// error. It may be called again to go over the input once more.
+type importSource func(fn func(importRecord) error) error
+
+// importer writes imported keys into a store, resolving conflicts with the keys it
+// already has according to --on-conflict, and counts what happened to each.
+type importer struct {
+	s          *store
+	onConflict string
+
+	added, overwritten      int
+	skipped, older, expired int
+}
+
+// run imports every record src yields. With --on-conflict fail it first goes over
+// src looking for keys the store has, and imports nothing if there are any; keys
+// repeated in src then overwrite each other.
+func (im *importer) run(src importSource) error {
+	if im.onConflict == conflictFail {
+		var found []string
+		n := 0
+		err := src(func(r importRecord) error {
+			if _, ok, err := im.existing(r.key); err != nil {
+				return err
+			} else if ok {
+				if n++; len(found) < 3 {
+					found = append(found, strconv.Quote(r.key))
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			return fmt.Errorf("%d of the keys already exist, such as %s; nothing was imported", n, strings.Join(found, ", "))
+		}
+	}
+	return src(im.put)
+}
+
+// existing returns the timestamp of the live value the store has for key, if any.
+func (im *importer) existing(key string) (uint64, bool, error) {
+	e, err := im.s.GetEntry(key)
+	if errors.Is(err, gocask.ErrNotFound) {
+		return 0, false, nil
+	}
+	return e.Timestamp, err == nil, err
+}
+
+func (im *importer) put(r importRecord) error {
+	if r.expires != 0 && expired(r.expires) {
+		im.expired++
+		return nil
+	}
+	local, exists, err := im.existing(r.key)
+	if err != nil {
+		return err
+	}
+	if exists {
+		switch im.onConflict {
+		case conflictSkip:
+			im.skipped++
+			return nil
+		case conflictNewest:
+			if r.ts == 0 {
+				return fmt.Errorf("%q exists and the input doesn't say when it was written, so --on-conflict newest can't compare them", r.key)
+			}
+			if r.ts <= local {
+				im.older++
+				return nil
+			}
+		}
+	}
+
+	if err := im.s.PutEntry(gocask.SSTEntry{Key: r.key, Value: r.value, Meta: r.meta, Expires: r.expires}); err != nil {
+		return err
+	}
+	if exists {
+		im.overwritten++
+	} else {
+		im.added++
+	}
+	return nil
+}
+
+func (im *importer) report() {
+	fmt.Fprintf(os.Stderr, "imported %d keys: %d new, %d overwritten; skipped %d existing, %d older than the store's, %d expired\n",
+		im.added+im.overwritten, im.added, im.overwritten, im.skipped, im.older, im.expired)
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"cmp"
+	"flag"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/itsknk/gocask"
+)
+
+// Serve can mount several stores, each under a name, so one process takes the place
+// of a few small single-purpose ones. A mounted store's health checks, backups and
+// debug dump are served under /<name>/ and its gauges carry store="<name>". It is
+// opened with the store settings of serve's flags, such as the merge policy, TTLs,
+// quotas and value cache, unless its mount sets them for it; the mount can make it
+// read-only too.
+
+// mountSettings are the settings a mount can set for its store, which otherwise has
+// serve's: the flags command.options and command.applyTo give each store.
+var mountSettings = map[string]bool{
+	"actor":         true,
+	"strict":        true,
+	"read-mode":     true,
+	"cache-size":    true,
+	"read-ahead":    true,
+	"default-ttl":   true,
+	"max-keys":      true,
+	"max-data-size": true,
+	"eviction":      true,
+	"retention":     true,
+	"quota":         true,
+	"merge-policy":  true,
+	"merge-window":  true,
+	"chunk-size":    true,
+}
+
+// repeatable are the mountSettings that can be given more than once. A mount that
+// sets one replaces serve's values of it rather than adding to them.
+var repeatable = map[string]bool{"retention": true, "quota": true, "merge-window": true}
+
+// mountSpec is a store serve mounts, from --mount.
+type mountSpec struct {
+	name     string
+	dir      string
+	config   string     // the mount's settings file, "" if it has none
+	settings configFile // those on the flag, which the file's go on top of
+	readOnly bool       // refuse writes to it as --read-only does
+	store    *command   // the store settings it is opened with, once loaded
+}
+
+// mountName is what a mount may be called: one path segment without surprises.
+var mountName = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// parseMount parses a --mount flag: a name followed by dir=<dir> and optionally
+// config=<file> and any of mountSettings or read-only as <setting>=<value>. The
+// config file is read, and the values checked, by loadMounts.
+func parseMount(s string) (mountSpec, error) {
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return mountSpec{}, fmt.Errorf("mount %q: want a name and dir=<dir>", s)
+	}
+	m := mountSpec{name: fields[0], settings: make(configFile)}
+	if !mountName.MatchString(m.name) || m.name == "debug" {
+		return mountSpec{}, fmt.Errorf("mount %q: name %q must be lower case letters, digits, - and _, and not debug", s, m.name)
+	}
+	for _, f := range fields[1:] {
+		name, value, _ := strings.Cut(f, "=")
+		switch {
+		case name == "dir":
+			m.dir = value
+		case name == "config":
+			m.config = value
+		case name == "read-only" || mountSettings[name]:
+			m.settings[name] = append(m.settings[name], value)
+		default:
+			return mountSpec{}, fmt.Errorf("mount %q: %s: unknown setting", s, f)
+		}
+	}
+	if m.dir == "" {
+		return mountSpec{}, fmt.Errorf("mount %q: want dir=<dir>", s)
+	}
+	return m, nil
+}
+
+// loadMounts reads the config files of mounts and works out the settings of their
+// stores on top of those of c. It is left until the flags are parsed, since a file
+// that went bad must fail a reload rather than end serve.
+func loadMounts(c *command, mounts []mountSpec) error {
+	for i := range mounts {
+		if err := mounts[i].load(c); err != nil {
+			return fmt.Errorf("mount %s: %w", mounts[i].name, err)
+		}
+	}
+	return nil
+}
+
+// load works out the mount's store settings: c's, with those on the flag and then
+// those in its config file, if it has one, on top. The file is written as a serve
+// config file would be, and is where settings with spaces in them, like quotas, go.
+func (m *mountSpec) load(c *command) error {
+	store := newCommand("serve --mount "+m.name, "")
+	var err error
+	c.fs.VisitAll(func(f *flag.Flag) {
+		// repeatable flags don't print their values
+		if err == nil && mountSettings[f.Name] && !repeatable[f.Name] {
+			err = store.fs.Set(f.Name, f.Value.String())
+		}
+	})
+	if err != nil {
+		return err
+	}
+	store.retention, store.quotas, store.windows = c.retention, c.quotas, c.windows
+	m.readOnly = false
+	if err := m.apply(store, m.settings, "--mount"); err != nil {
+		return err
+	}
+	if m.config != "" {
+		cfg, err := loadConfig(m.config)
+		if err != nil {
+			return err
+		}
+		if err := m.apply(store, cfg, m.config); err != nil {
+			return err
+		}
+	}
+	if err := store.parseStoreSettings(); err != nil {
+		return fmt.Errorf("%s: %w", cmp.Or(m.config, "--mount"), err)
+	}
+	m.store = store
+	return nil
+}
+
+// apply sets the settings of cfg, which came from source, on the mount and store.
+func (m *mountSpec) apply(store *command, cfg configFile, source string) error {
+	for name, values := range cfg {
+		var err error
+		switch {
+		case name == "read-only":
+			m.readOnly, err = strconv.ParseBool(values[len(values)-1])
+		case mountSettings[name]:
+			switch name {
+			case "retention":
+				store.retention = nil
+			case "quota":
+				store.quotas = nil
+			case "merge-window":
+				store.windows = nil
+			}
+			for _, v := range values {
+				if err = store.fs.Set(name, v); err != nil {
+					err = fmt.Errorf("invalid value %q: %w", v, err)
+					break
+				}
+			}
+		default:
+			err = fmt.Errorf("unknown setting, see \"gocask serve -h\" for those a mount can have")
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %s: %w", source, name, err)
+		}
+	}
+	return nil
+}
+
+// checkMounts makes sure no two mounts share a name or a directory, nor a directory
+// with the store in dir if that is served too.
+func checkMounts(mounts []mountSpec, dir string) error {
+	names, dirs := make(map[string]bool), make(map[string]string)
+	if dir != "" {
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			return err
+		}
+		dirs[abs] = "--dir"
+	}
+	for _, m := range mounts {
+		if names[m.name] {
+			return fmt.Errorf("two mounts are called %s", m.name)
+		}
+		names[m.name] = true
+		abs, err := filepath.Abs(m.dir)
+		if err != nil {
+			return err
+		}
+		if other, ok := dirs[abs]; ok {
+			return fmt.Errorf("mount %s serves %s, which %s serves already", m.name, m.dir, other)
+		}
+		dirs[abs] = "mount " + m.name
+	}
+	return nil
+}
+
+// openMounts opens the stores of c's mounts with their settings and any more
+// options, or none if one fails to open.
+func (c *serveCommand) openMounts(more []gocask.Option) ([]*store, error) {
+	var stores []*store
+	for _, m := range c.mounts {
+		opts := append(m.store.options(), gocask.WithName(m.name))
+		if m.readOnly {
+			opts = append(opts, gocask.WithReadOnly())
+		}
+		db, err := gocask.Open(m.dir, append(opts, more...)...)
+		if err != nil {
+			closeStores(stores)
+			return nil, fmt.Errorf("mount %s: %w", m.name, err)
+		}
+		stores = append(stores, &store{DB: db, name: m.name})
+	}
+	return stores, nil
+}
+
+func closeStores(stores []*store) {
+	for _, s := range stores {
+		s.Close()
+	}
+}
+
+// route is where serve's listeners serve path for s: under /<name> for a mounted
+// store, as it is for the one in --dir.
+func (s *store) route(path string) string {
+	if s.name == "" {
+		return path
+	}
+	return "/" + s.name + path
+}
+
+// applyTo gives s the settings of c, or those of its mount if it is mounted.
+func (c *serveCommand) applyTo(s *store) error {
+	for _, m := range c.mounts {
+		if m.name == s.name && s.name != "" {
+			return m.store.applyTo(s)
+		}
+	}
+	return c.command.applyTo(s)
+}
+
+// mountsDiffer reports whether a and b mount different stores or open them
+// differently, which needs a restart, and returns the store settings that differ
+// between the mounts they share, see command.differs.
+func mountsDiffer(a, b []mountSpec) (restart bool, settings map[string]bool) {
+	settings = make(map[string]bool)
+	if len(a) != len(b) {
+		return true, settings
+	}
+	for i := range a {
+		x, y := a[i], b[i]
+		if x.name != y.name || x.dir != y.dir || x.config != y.config || x.readOnly != y.readOnly {
+			return true, settings
+		}
+		for name := range x.store.differs(y.store) {
+			if mountSettings[name] {
+				settings[name] = true
+			}
+		}
+	}
+	return false, settings
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/itsknk/gocask"
+	"github.com/itsknk/gocask/gocaskpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// serve --grpc-addr serves the stores over gRPC, with the service defined in
+// gocaskpb/gocask.proto, so programs in any language protoc generates code for can
+// use them: Get, Put, Delete and Batch, and Scan, which streams a prefix or a range
+// of keys with their values one at a time rather than as one reply. Requests name
+// their store, "" for the one in --dir or the name of a mount. Keys under __gocask/
+// are gocask's own, requests naming one are refused and scans leave them out. With
+// --grpc-token every call must carry it as a bearer token in its authorization
+// metadata, which --grpc-addr can do without only on a loopback address. The audit
+// log attributes the writes of a call to "grpc:" and the address it came from. Each
+// call locks its store like any other read or write, and a scan only while it reads
+// each value.
+
+// grpcServer answers the Gocask service for the stores serve has.
+type grpcServer struct {
+	gocaskpb.UnimplementedGocaskServer
+	stores map[string]*store
+}
+
+// listenGRPC serves stores over gRPC on addr until the returned server is stopped,
+// to calls with token if it isn't "".
+func listenGRPC(addr string, stores []*store, token *bearerToken) (*grpc.Server, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	gs := &grpcServer{stores: make(map[string]*store, len(stores))}
+	for _, s := range stores {
+		gs.stores[s.name] = s
+	}
+	srv := grpc.NewServer(grpcAuth(token)...)
+	gocaskpb.RegisterGocaskServer(srv, gs)
+	go func() {
+		if err := srv.Serve(ln); err != nil {
+			logger.Error("grpc server stopped", "err", err)
+		}
+	}()
+	return srv, nil
+}
+
+// grpcAuth returns the interceptors that refuse calls without token as a bearer
+// token while it isn't "", and attribute the writes of the others, see grpcActor.
+func grpcAuth(token *bearerToken) []grpc.ServerOption {
+	check := func(ctx context.Context) error {
+		if token.get() == "" {
+			return nil
+		}
+		md, _ := metadata.FromIncomingContext(ctx)
+		if got := md.Get("authorization"); len(got) == 1 {
+			if auth, ok := strings.CutPrefix(got[0], "Bearer "); ok && token.matches(auth) {
+				return nil
+			}
+		}
+		return status.Error(codes.Unauthenticated, "missing or wrong token")
+	}
+	return []grpc.ServerOption{
+		grpc.UnaryInterceptor(func(ctx context.Context, req any, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+			if err := check(ctx); err != nil {
+				return nil, err
+			}
+			return handler(grpcActor(ctx), req)
+		}),
+		grpc.StreamInterceptor(func(srv any, ss grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			if err := check(ss.Context()); err != nil {
+				return err
+			}
+			return handler(srv, ss)
+		}),
+	}
+}
+
+// grpcActor has the writes of the call ctx is of attributed to "grpc:" and the
+// address it came from, see gocask.ContextWithActor.
+func grpcActor(ctx context.Context) context.Context {
+	actor := "grpc:"
+	if p, ok := peer.FromContext(ctx); ok {
+		actor += p.Addr.String()
+	}
+	return gocask.ContextWithActor(ctx, actor)
+}
+
+// checkKey refuses a missing key.
+func checkKey(key []byte) error {
+	if len(key) == 0 {
+		return status.Error(codes.InvalidArgument, "no key")
+	}
+	return nil
+}
+
+// store is the store a request names.
+func (gs *grpcServer) store(name string) (*store, error) {
+	s, ok := gs.stores[name]
+	if !ok {
+		return nil, status.Errorf(codes.InvalidArgument, "no store %q is served", name)
+	}
+	return s, nil
+}
+
+func (gs *grpcServer) Get(ctx context.Context, req *gocaskpb.GetRequest) (*gocaskpb.GetResponse, error) {
+	s, err := gs.store(req.GetStore())
+	if err != nil {
+		return nil, err
+	}
+	if err := checkKey(req.GetKey()); err != nil {
+		return nil, err
+	}
+	v, err := s.GetContext(ctx, string(req.GetKey()))
+	if errors.Is(err, gocask.ErrNotFound) {
+		return nil, status.Error(codes.NotFound, "key not found")
+	} else if err != nil {
+		return nil, grpcError(err)
+	}
+	return &gocaskpb.GetResponse{Value: []byte(v)}, nil
+}
+
+func (gs *grpcServer) Put(ctx context.Context, req *gocaskpb.PutRequest) (*gocaskpb.PutResponse, error) {
+	s, err := gs.store(req.GetStore())
+	if err != nil {
+		return nil, err
+	}
+	if err := checkKey(req.GetKey()); err != nil {
+		return nil, err
+	}
+	key, value := string(req.GetKey()), string(req.GetValue())
+	if req.GetTtlMs() < 0 {
+		return nil, status.Error(codes.InvalidArgument, "ttl_ms can't be negative")
+	}
+	ttl := time.Duration(req.GetTtlMs()) * time.Millisecond
+	if ttl > 0 {
+		err = s.PutWithTTLContext(ctx, key, value, ttl)
+	} else {
+		err = s.PutContext(ctx, key, value)
+	}
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &gocaskpb.PutResponse{}, nil
+}
+
+func (gs *grpcServer) Delete(ctx context.Context, req *gocaskpb.DeleteRequest) (*gocaskpb.DeleteResponse, error) {
+	s, err := gs.store(req.GetStore())
+	if err != nil {
+		return nil, err
+	}
+	if err := checkKey(req.GetKey()); err != nil {
+		return nil, err
+	}
+	if err := s.DeleteContext(ctx, string(req.GetKey())); err != nil {
+		return nil, grpcError(err)
+	}
+	return &gocaskpb.DeleteResponse{}, nil
+}
+
+// Batch applies the ops of a request like serve's POST /bulk: all of them or, if
+// writing fails, none.
+func (gs *grpcServer) Batch(ctx context.Context, req *gocaskpb.BatchRequest) (*gocaskpb.BatchResponse, error) {
+	s, err := gs.store(req.GetStore())
+	if err != nil {
+		return nil, err
+	}
+	b := s.NewBatch()
+	for i, op := range req.GetOps() {
+		if err := checkKey(op.GetKey()); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "op %d: %s", i, status.Convert(err).Message())
+		}
+		if op.GetDelete() {
+			b.Delete(string(op.GetKey()))
+		} else {
+			b.Put(string(op.GetKey()), string(op.GetValue()))
+		}
+	}
+	err = b.CommitContext(ctx)
+	if err != nil && b.Len() > 0 { // still staged, so nothing was written
+		return nil, grpcError(err)
+	}
+	if err != nil {
+		// applied, but something after it, such as the changefeed, failed
+		logger.Error("grpc batch", "dir", s.Path(), "err", err)
+	}
+	return &gocaskpb.BatchResponse{}, nil
+}
+
+// Scan sends the live keys of a prefix or range in order. It iterates with
+// DB.Range, so the stream holds the lock only for one read at a time and no more of
+// the values than the one in flight.
+func (gs *grpcServer) Scan(req *gocaskpb.ScanRequest, stream grpc.ServerStreamingServer[gocaskpb.KeyValue]) error {
+	s, err := gs.store(req.GetStore())
+	if err != nil {
+		return err
+	}
+	start, end := string(req.GetStart()), string(req.GetEnd())
+	var it *gocask.Iterator
+	if prefix := string(req.GetPrefix()); prefix != "" {
+		if start != "" || end != "" {
+			return status.Error(codes.InvalidArgument, "pass a prefix or start and end, not both")
+		}
+		it = s.PrefixScan(prefix)
+	} else {
+		it = s.Range(start, end)
+	}
+	for it.Next() {
+		if err := stream.Send(&gocaskpb.KeyValue{Key: []byte(it.Key()), Value: []byte(it.Value())}); err != nil {
+			return err
+		}
+	}
+	if err := it.Err(); err != nil {
+		return grpcError(err)
+	}
+	return nil
+}
+
+// grpcError is the status a failed store operation returns, with the codes
+// gocask.proto lists.
+func grpcError(err error) error {
+	code := codes.Internal
+	switch {
+	case errors.Is(err, gocask.ErrReservedKey):
+		code = codes.InvalidArgument
+	case errors.Is(err, gocask.ErrOpenedReadOnly):
+		code = codes.FailedPrecondition
+	case errors.Is(err, gocask.ErrReadOnly), gocask.IsDiskFull(err), errors.Is(err, gocask.ErrQuotaExceeded):
+		code = codes.ResourceExhausted
+	case errors.Is(err, context.Canceled):
+		code = codes.Canceled
+	case errors.Is(err, context.DeadlineExceeded):
+		code = codes.DeadlineExceeded
+	}
+	return status.Error(code, err.Error())
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/itsknk/gocask"
+)
+
+// healthFlags configure serve's health checks.
+type healthFlags struct {
+	minFree       *string
+	mergeFailures *int
+	maxLag        *time.Duration
+}
+
+func addHealthFlags(fs *flag.FlagSet) *healthFlags {
+	return &healthFlags{
+		minFree:       fs.String("health-min-free", "5%", "free disk space, in bytes or a percentage of the disk, below which /readyz fails"),
+		mergeFailures: fs.Int("health-max-merge-failures", 3, "merges that may fail in a row before /readyz fails, 0 for no limit"),
+		maxLag:        fs.Duration("health-max-replication-lag", time.Minute, "replication lag beyond which /readyz fails, 0 for no limit"),
+	}
+}
+
+func (hf *healthFlags) parse() (gocask.HealthOptions, error) {
+	o := gocask.HealthOptions{MaxMergeFailures: *hf.mergeFailures, MaxReplicationLag: *hf.maxLag}
+	var err error
+	if pct, ok := strings.CutSuffix(*hf.minFree, "%"); ok {
+		if o.MinFreeRatio, err = strconv.ParseFloat(pct, 64); err == nil && (o.MinFreeRatio < 0 || o.MinFreeRatio > 100) {
+			err = fmt.Errorf("must be between 0%% and 100%%")
+		}
+		o.MinFreeRatio /= 100
+	} else {
+		o.MinFreeBytes, err = strconv.ParseUint(*hf.minFree, 10, 64)
+	}
+	if err != nil {
+		return gocask.HealthOptions{}, fmt.Errorf("--health-min-free %q: %w", *hf.minFree, err)
+	}
+	return o, nil
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+)
+
+// logger is where the command line's diagnostics go, and those of the stores it
+// opens, see gocask.WithLogger: slog text on stderr, so command output on stdout
+// stays clean.
+var logger = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: &logLevel}))
+
+// logLevel is the least severe level logger prints, which a reload of serve's
+// settings can change while it is in use.
+var logLevel slog.LevelVar
+
+// parseLogLevel maps a --log-level value to a slog level.
+func parseLogLevel(v string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(v)); err != nil {
+		return 0, fmt.Errorf("unknown log level %q (want debug, info, warn or error)", v)
+	}
+	return level, nil
+}
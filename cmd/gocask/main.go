@@ -0,0 +1,962 @@
+// Command gocask is the command line for gocask stores: a shell, one-shot commands
+// like get, put and merge, and serve. Run without arguments it starts the shell; an
+// unknown command prints the list of commands.
+package main
+
+import (
+	"bufio"
+	"errors"
+	"expvar"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/itsknk/gocask"
+)
+
+const usage = `usage: gocask <command> [flags] [args]
+
+commands:
+  repl                 interactive shell (the default)
+  exec [file]          run repl commands from file (or stdin) without a prompt
+  get <key>            print the value stored under key
+  scan [prefix|glob]   print matching keys and their values
+  put <key> <value>    store value under key, for --ttl if given
+  del <key>            delete key
+  watch                print puts and deletes as they happen
+  serve                run the changefeed sink, replication, metrics and/or backups until
+                       interrupted; --backup-schedule takes backups to --backup-dest;
+                       SIGHUP or a POST to /-/reload on --admin-addr rereads the log
+                       level, merge, ttl, retention, quota, eviction and cache settings
+                       and the listeners' tokens;
+                       /healthz and /readyz there check the store for orchestrators;
+                       --admin-addr serves pprof and debug dumps; --mount serves more
+                       stores, each under /<name>/ with settings of its own
+  merge                rotate the active file and compact all segments
+  stats                print key and file counts
+  du                   show live and dead bytes per data file and what a merge would reclaim
+  dump [file]          print every live key and its value, or the records of one
+                       segment or hint file
+  export               write every key/value as json lines or csv
+  import [file]        load keys from an export (file or stdin)
+  import-bolt <file>   copy one --bucket of a bolt database (export-bolt writes one)
+  import-leveldb <dir> copy a leveldb database (export-leveldb writes one)
+  import-redis         copy string keys from a redis --rdb dump or a live --addr
+  export-sst <dir>     write a snapshot of every live key as sorted, block-indexed tables
+  import-sst <dir>     load a snapshot export-sst wrote, keeping metadata and expiries
+  clone <dir>          write a compacted copy of the store into a new directory, while it
+                       keeps serving
+  backup --out <file>  write a consistent snapshot archive of the store, or only the
+                       segments sealed --since an earlier one; --to s3://bucket/path
+                       uploads it to an object store instead
+  restore <archive>... unpack and verify a backup and any incremental ones after it,
+                       in order, into a fresh --dir, or key by key into an existing
+                       one with --on-conflict; archives may be s3:// or gs:// urls;
+                       --at <time> replays the changefeed up to then over them
+  audit                enable the audit log, or print who changed which keys
+  migrate [dir]        rewrite a store written by an older gocask in the current format
+  recover              open a damaged store making only the repairs asked for
+                       (--rebuild-index, --truncate-corrupt, --skip-bad-segments) and
+                       print each step taken; --dry-run only prints them
+  config validate [file]
+                       check a config file, --config or $GOCASK_CONFIG, and print the
+                       settings it and the environment give
+
+every command accepts --dir, --node-id, --log-level, --strict, --read-mode, --cache-size, --read-ahead,
+--default-ttl, --retention, --quota, --max-keys, --max-data-size, --eviction, --merge-policy,
+--merge-window and --chunk-size; see "gocask <command> -h".
+Every command also takes --config <file.toml|file.yaml>, whose keys are flag names, nested
+as tables or not ("merge-policy" or "[merge] policy"). GOCASK_<FLAG> variables, e.g.
+GOCASK_MERGE_POLICY, override it, and flags override both.
+get, scan and dump take --output raw|hex|base64|json for binary values or jq.
+get, scan, export, export-sst, stats, repl, exec and serve take --read-only, and
+--snapshot <archive|dir> to open a backup or export-sst snapshot read-only instead of --dir.
+`
+
+// command holds the flags shared by every subcommand.
+type command struct {
+	fs        *flag.FlagSet
+	dir       *string
+	node      *uint
+	logLevel  *string
+	actor     *string
+	strict    *bool
+	readMode  *string
+	mode      gocask.ReadMode // readMode, once parsed
+	cacheSize *int64
+	readAhead *int
+	ttl       *time.Duration
+	maxKeys   *int
+	maxData   *int64
+	evict     *string
+	eviction  gocask.EvictionOptions // max-keys, max-data-size and eviction, once parsed
+	retention []gocask.RetentionPolicy
+	quotas    []gocask.Quota
+	merge     *string
+	windows   []gocask.MergeWindow
+	compact   gocask.CompactionPolicy // merge and windows, once parsed
+	chunkSize *int
+	snapshot  *string // nil unless addSnapshotFlags was called, like readOnly
+	readOnly  *bool
+	config    *string
+	from      map[string]settingSource // where the flags' values came from, once parsed
+}
+
+// nodeID is --node-id, once parsed.
+var nodeID uint16
+
+func newCommand(name, args string) *command {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: gocask %s [flags] %s\n", name, args)
+		fs.PrintDefaults()
+	}
+	c := &command{
+		fs:        fs,
+		dir:       fs.String("dir", ".", "data directory of the store"),
+		node:      fs.Uint("node-id", 0, "id of this site, must be unique among replicating sites (0-65535)"),
+		logLevel:  fs.String("log-level", "info", "least severe log messages to print on stderr: debug, info, warn or error"),
+		actor:     fs.String("actor", "", "who to attribute writes to in the audit log (default: the OS user); serve attributes its clients' to their addresses"),
+		strict:    fs.Bool("strict", false, "refuse to open a damaged store instead of repairing it"),
+		readMode:  fs.String("read-mode", "pread", "how to read sealed segments: pread, mmap or mmap-zero-copy"),
+		cacheSize: fs.Int64("cache-size", 0, "bytes of recently read values to keep in memory, 0 for no cache"),
+		readAhead: fs.Int("read-ahead", 1<<20, "bytes to read at a time when scanning, merging or indexing a file"),
+		ttl:       fs.Duration("default-ttl", 0, "how long values written without a ttl of their own last, 0 for forever"),
+		maxKeys:   fs.Int("max-keys", 0, "evict keys beyond this many live ones, 0 for no limit"),
+		maxData:   fs.Int64("max-data-size", 0, "evict keys beyond this many bytes of live records, 0 for no limit"),
+		evict:     fs.String("eviction", "lru", "which keys --max-keys and --max-data-size evict first: lru or lfu"),
+		chunkSize: fs.Int("chunk-size", gocask.DefaultChunkSize, "store values bigger than this many bytes in chunks of that size, 0 to never"),
+		config:    fs.String("config", "", "read settings from this TOML or YAML file; flags and GOCASK_<SETTING> variables override it (default $GOCASK_CONFIG)"),
+		merge:     fs.String("merge-policy", "", `when to merge, e.g. "active-size=1048576 fragmentation=50% dead-bytes=1073741824 segment-age=24h expired-bytes=104857600 tombstone-age=72h"; serve and repl check all but active-size in the background (default "active-size=67108864")`),
+	}
+	fs.Func("retention", `limits for keys under a prefix, e.g. "sessions/ ttl=24h max-keys=100000 max-bytes=1073741824" or "config/ ttl=forever"; repeatable`, func(s string) error {
+		p, err := gocask.ParseRetention(s)
+		c.retention = append(c.retention, p)
+		return err
+	})
+	fs.Func("quota", `bytes of live records to allow under a prefix, or the whole store if it is left out, and what a put past them does, e.g. "tenants/acme/ max-bytes=1073741824 policy=evict" or "max-bytes=10737418240" (policy reject or evict, default reject); repeatable`, func(s string) error {
+		q, err := gocask.ParseQuota(s)
+		c.quotas = append(c.quotas, q)
+		return err
+	})
+	fs.Func("merge-window", `local times merges may start in, e.g. "mon-fri 01:00-05:00" or "22:00-06:00"; repeatable (default any time)`, func(s string) error {
+		w, err := gocask.ParseMergeWindow(s)
+		c.windows = append(c.windows, w)
+		return err
+	})
+	return c
+}
+
+// parse parses args and checks the number of positional arguments is within [min, max].
+// Flags args leaves alone are then taken from the environment or the config file.
+func (c *command) parse(args []string, min, max int) error {
+	c.fs.Parse(args)
+	if n := c.fs.NArg(); n < min || (max >= 0 && n > max) {
+		c.fs.Usage()
+		os.Exit(2)
+	}
+	from, err := c.configure()
+	if err != nil {
+		return err
+	}
+	c.from = from
+	if *c.node > 0xffff {
+		return fmt.Errorf("node-id must fit in 16 bits")
+	}
+	nodeID = uint16(*c.node)
+	level, err := parseLogLevel(*c.logLevel)
+	if err != nil {
+		return err
+	}
+	logLevel.Set(level)
+	return c.parseStoreSettings()
+}
+
+// open opens the store in --dir, or the one --snapshot holds, with the settings of c
+// and any more options, such as the background work of repl and serve.
+func (c *command) open(more ...gocask.Option) (*store, error) {
+	opts := append(c.options(), more...)
+	readOnly := c.readOnly != nil && *c.readOnly
+	if readOnly {
+		opts = append(opts, gocask.WithReadOnly())
+	}
+	if c.snapshot != nil && *c.snapshot != "" {
+		if !readOnly {
+			return nil, fmt.Errorf("--snapshot needs --read-only, a snapshot can't be written to")
+		}
+		return mountSnapshot(*c.snapshot, opts)
+	}
+	db, err := gocask.Open(*c.dir, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &store{DB: db}, nil
+}
+
+// options are what opens a store with the settings of c that each store has its own
+// of.
+func (c *command) options() []gocask.Option {
+	opts := []gocask.Option{
+		gocask.WithCompaction(c.compact),
+		gocask.WithDefaultTTL(*c.ttl),
+		gocask.WithRetention(c.retention...),
+		gocask.WithEviction(c.eviction),
+		gocask.WithQuotas(c.quotas...),
+		gocask.WithChunkSize(*c.chunkSize),
+		gocask.WithReadMode(c.mode),
+		gocask.WithValueCache(*c.cacheSize),
+		gocask.WithNodeID(nodeID),
+		gocask.WithLogger(logger),
+		gocask.WithReadAhead(*c.readAhead),
+	}
+	if *c.strict {
+		opts = append(opts, gocask.WithStrict())
+	}
+	if *c.actor != "" {
+		opts = append(opts, gocask.WithAuditActor(*c.actor))
+	}
+	return opts
+}
+
+// parseStoreSettings parses and checks the flags options and applyTo give each
+// store, so that applying them can't fail.
+func (c *command) parseStoreSettings() error {
+	var err error
+	if c.mode, err = gocask.ParseReadMode(*c.readMode); err != nil {
+		return err
+	}
+	policy, err := gocask.ParseEvictionPolicy(*c.evict)
+	if err != nil {
+		return err
+	}
+	c.eviction = gocask.EvictionOptions{MaxKeys: *c.maxKeys, MaxDataSize: *c.maxData, Policy: policy}
+	if p, ok := duplicatePrefix(c.retention, func(r gocask.RetentionPolicy) string { return r.Prefix }); ok {
+		return fmt.Errorf("two retention policies for prefix %q", p)
+	}
+	if p, ok := duplicatePrefix(c.quotas, func(q gocask.Quota) string { return q.Prefix }); ok {
+		return fmt.Errorf("two quotas for prefix %q", p)
+	}
+	if c.compact, err = gocask.ParseCompactionPolicy(*c.merge); err != nil {
+		return err
+	}
+	c.compact.Windows = c.windows
+	return nil
+}
+
+// applyTo gives the open store s the settings of c a reload changes, see reloadable.
+func (c *command) applyTo(s *store) error {
+	if err := s.SetRetention(c.retention...); err != nil {
+		return err
+	}
+	if err := s.SetQuotas(c.quotas...); err != nil {
+		return err
+	}
+	s.SetCompactionPolicy(c.compact)
+	s.SetDefaultTTL(*c.ttl)
+	s.SetEviction(c.eviction)
+	s.SetValueCache(*c.cacheSize)
+	s.SetReadAhead(*c.readAhead)
+	return nil
+}
+
+// duplicatePrefix returns the first prefix two of items have, which a store refuses
+// for retention policies and quotas.
+func duplicatePrefix[T any](items []T, prefix func(T) string) (string, bool) {
+	seen := make(map[string]bool)
+	for _, it := range items {
+		p := prefix(it)
+		if seen[p] {
+			return p, true
+		}
+		seen[p] = true
+	}
+	return "", false
+}
+
+// feedFlags configure the background changefeed sink and replication.
+type feedFlags struct {
+	sink, sinkFormat, sinkName, replicate *string
+}
+
+func addFeedFlags(fs *flag.FlagSet) *feedFlags {
+	return &feedFlags{
+		sink:       fs.String("sink", "", "publish the changefeed to nats://host:port/subject or kafka://broker1,broker2/topic"),
+		sinkFormat: fs.String("sink-format", "json", "changefeed serialization for -sink: json or avro"),
+		sinkName:   fs.String("sink-name", "default", "connector name, its checkpoint is stored under this name"),
+		replicate:  fs.String("replicate", "", "replicate with other sites through nats://host:port/subject or kafka://broker1,broker2/topic"),
+	}
+}
+
+func (ff *feedFlags) enabled() bool { return *ff.sink != "" || *ff.replicate != "" }
+
+// startFeeds launches the configured connectors and returns a func that stops them,
+// and with --replicate one that measures the replication lag: the longer of how far
+// publishing this site's writes is behind and how late the others' last arrived.
+func startFeeds(s *store, ff *feedFlags) (stopFeeds func(), lag func() time.Duration, err error) {
+	stop := make(chan struct{})
+	var closers []func() error
+
+	load, save := s.LoadCheckpoint, s.SaveCheckpoint
+
+	if *ff.sink != "" {
+		sink, err := openSink(*ff.sink)
+		if err != nil {
+			return nil, nil, err
+		}
+		encode, err := changeEncoder(*ff.sinkFormat)
+		if err != nil {
+			sink.Close()
+			return nil, nil, err
+		}
+		conn := &gocask.Connector{
+			Name:     *ff.sinkName,
+			Sink:     sink,
+			Encode:   encode,
+			Interval: time.Second,
+			Journal:  gocask.JournalPath(s.Path()),
+			Load:     load,
+			Save:     save,
+			Logger:   logger,
+		}
+		go func() {
+			if err := conn.Run(stop); err != nil {
+				logger.Error("sink stopped", "err", err)
+			}
+		}()
+	}
+
+	if *ff.replicate != "" {
+		sink, err := openSink(*ff.replicate)
+		if err != nil {
+			close(stop)
+			return nil, nil, err
+		}
+		source, err := openSource(*ff.replicate, fmt.Sprintf("gocask-node-%d", nodeID), false)
+		if err != nil {
+			close(stop)
+			sink.Close()
+			return nil, nil, err
+		}
+		// publish only the writes this node originated, remote ones are already out there
+		pub := &gocask.Connector{
+			Name:     "replication",
+			Sink:     sink,
+			Encode:   gocask.EncodeChangeJSON,
+			Interval: time.Second,
+			Filter:   func(c gocask.Change) bool { return gocask.TimestampNode(c.Timestamp) == s.NodeID() },
+			Journal:  gocask.JournalPath(s.Path()),
+			Load:     load,
+			Save:     save,
+			Logger:   logger,
+		}
+		sub := &gocask.Replicator{
+			Source: source,
+			Apply:  s.ApplyRemote,
+			Node:   s.NodeID(),
+			Logger: logger,
+			OnConflict: func(c gocask.Conflict) {
+				logger.Warn("replication conflict, kept the local write", "key", c.Key,
+					"local_node", gocask.TimestampNode(c.LocalTimestamp), "remote_node", gocask.TimestampNode(c.RemoteTimestamp))
+			},
+		}
+		closers = append(closers, source.Close)
+		lag = func() time.Duration { return max(pub.Lag(), sub.Lag()) }
+		go func() {
+			if err := pub.Run(stop); err != nil {
+				logger.Error("replication publisher stopped", "err", err)
+			}
+		}()
+		go func() {
+			if err := sub.Run(); err != nil {
+				logger.Error("replication subscriber stopped", "err", err)
+			}
+		}()
+	}
+
+	return func() {
+		close(stop)
+		for _, c := range closers {
+			c()
+		}
+	}, lag, nil
+}
+
+// main exits with status 1 if the command fails and 2 if there is no such command.
+func main() {
+	args := os.Args[1:]
+	commands := map[string]func(args []string) error{
+		"repl":           cmdRepl,
+		"exec":           cmdExec,
+		"get":            cmdGet,
+		"scan":           cmdScan,
+		"put":            cmdPut,
+		"del":            cmdDel,
+		"serve":          cmdServe,
+		"watch":          cmdWatch,
+		"merge":          cmdMerge,
+		"stats":          cmdStats,
+		"du":             cmdDu,
+		"dump":           cmdDump,
+		"export":         cmdExport,
+		"import":         cmdImport,
+		"import-redis":   cmdImportRedis,
+		"import-bolt":    cmdImportBolt,
+		"export-bolt":    cmdExportBolt,
+		"import-leveldb": cmdImportLevelDB,
+		"export-leveldb": cmdExportLevelDB,
+		"import-sst":     cmdImportSST,
+		"export-sst":     cmdExportSST,
+		"clone":          cmdClone,
+		"config":         cmdConfig,
+		"backup":         cmdBackup,
+		"restore":        cmdRestore,
+		"migrate":        cmdMigrate,
+		"recover":        cmdRecover,
+		"audit":          cmdAudit,
+	}
+
+	// no command (or only flags) means the repl, like before subcommands existed
+	name := "repl"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	run, ok := commands[name]
+	if !ok {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	if err := run(args); err != nil {
+		fmt.Fprintln(os.Stderr, "gocask:", err)
+		os.Exit(1)
+	}
+}
+
+func cmdGet(args []string) error {
+	c := newCommand("get", "<key>")
+	c.addSnapshotFlags()
+	output := addOutputFlag(c.fs)
+	if err := c.parse(args, 1, 1); err != nil {
+		return err
+	}
+	if err := checkOutputFlag(*output); err != nil {
+		return err
+	}
+	s, err := c.open()
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	line, err := keyOutput(*output, c.fs.Arg(0), s.DB, false)
+	if err != nil {
+		return err
+	}
+	fmt.Println(line)
+	return nil
+}
+
+// cmdScan prints every live key matching an optional prefix or glob, with its value.
+func cmdScan(args []string) error {
+	c := newCommand("scan", "[prefix|glob]")
+	c.addSnapshotFlags()
+	output := addOutputFlag(c.fs)
+	if err := c.parse(args, 0, 1); err != nil {
+		return err
+	}
+	if err := checkOutputFlag(*output); err != nil {
+		return err
+	}
+	match, err := keyMatcher(c.fs.Args())
+	if err != nil {
+		return err
+	}
+	s, err := c.open()
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	for _, k := range keys(s.DB, match) {
+		line, err := keyOutput(*output, k, s.DB, true)
+		if err != nil {
+			return fmt.Errorf("read %q: %w", k, err)
+		}
+		fmt.Println(line)
+	}
+	return nil
+}
+
+func cmdPut(args []string) error {
+	c := newCommand("put", "<key> <value>")
+	ttl := c.fs.Duration("ttl", 0, "how long the value lasts, e.g. 30s or 24h; 0 means --default-ttl")
+	var fields []string
+	c.fs.Func("meta", "metadata to store with the value, e.g. content-type=application/json; repeatable", func(s string) error {
+		fields = append(fields, s)
+		return nil
+	})
+	if err := c.parse(args, 2, -1); err != nil {
+		return err
+	}
+	meta, err := gocask.ParseMetadata(fields)
+	if err != nil {
+		return err
+	}
+	s, err := c.open()
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	key, value := c.fs.Arg(0), strings.Join(c.fs.Args()[1:], " ")
+	return s.PutWithMeta(key, value, meta, *ttl)
+}
+
+func cmdDel(args []string) error {
+	c := newCommand("del", "<key>")
+	if err := c.parse(args, 1, 1); err != nil {
+		return err
+	}
+	s, err := c.open()
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	return s.Delete(c.fs.Arg(0))
+}
+
+// serveCommand is serve's flags, which are every setting a config file can have.
+type serveCommand struct {
+	*command
+	feeds       *feedFlags
+	metricsAddr *string
+	backupAddr  *string
+	httpAddr    *string
+	httpToken   *string
+	redisAddr   *string
+	redisToken  *string
+	grpcAddr    *string
+	grpcToken   *string
+	backups     *backupFlags
+	health      *healthFlags
+	admin       *adminFlags
+	sweep       *time.Duration
+	sync        *gocask.SyncPolicy
+	plan        *time.Duration
+	mounts      []mountSpec
+}
+
+func newServeCommand() *serveCommand {
+	c := newCommand("serve", "")
+	c.addSnapshotFlags()
+	sc := &serveCommand{
+		command:     c,
+		feeds:       addFeedFlags(c.fs),
+		metricsAddr: c.fs.String("metrics-addr", "", "serve prometheus metrics on http://<addr>/metrics, expvar on /debug/vars and health checks on /healthz and /readyz, e.g. :9100"),
+		backupAddr:  c.fs.String("backup-addr", "", "serve backups of the running store as a tar on http://<addr>/backup, for gocask restore; anywhere but a loopback address it needs --admin-token, which requests must then carry as a bearer token"),
+		httpAddr:    c.fs.String("http-addr", "", "serve the keys over http on <addr>: GET, PUT and DELETE /keys/<key>, GET /keys/?prefix=<p> to list them, POST /bulk for a batch and GET /stats, e.g. localhost:8080; anywhere but a loopback address it needs --http-token"),
+		httpToken:   c.fs.String("http-token", "", "bearer token requests to --http-addr must carry in an Authorization header, needed unless it is a loopback address"),
+		redisAddr:   c.fs.String("redis-addr", "", "speak the redis protocol on <addr>, for redis-cli and redis clients: GET, SET, DEL, EXISTS, KEYS, TTL and the like, with SELECT <n> for the nth store served, e.g. localhost:6379; anywhere but a loopback address it needs --redis-token"),
+		redisToken:  c.fs.String("redis-token", "", "password redis clients of --redis-addr must AUTH with before any other command, needed unless it is a loopback address"),
+		grpcAddr:    c.fs.String("grpc-addr", "", "serve the keys over grpc on <addr>, with the Gocask service of gocaskpb/gocask.proto: Get, Put, Delete, Batch and a streaming Scan, e.g. localhost:9090; anywhere but a loopback address it needs --grpc-token"),
+		grpcToken:   c.fs.String("grpc-token", "", "bearer token calls to --grpc-addr must carry in their authorization metadata, needed unless it is a loopback address"),
+		backups:     addBackupFlags(c.fs),
+		health:      addHealthFlags(c.fs),
+		admin:       addAdminFlags(c.fs),
+		sweep:       addSweepFlag(c.fs),
+		sync:        addSyncFlag(c.fs),
+		plan:        addPlanFlag(c.fs),
+	}
+	c.fs.Func("mount", `serve another store under a name, e.g. "users dir=/var/lib/gocask/users config=users.toml", whose health checks, backups and debug dump are then under /users/ and whose gauges carry store="users"; it has the store settings of serve's flags unless the mount gives it its own: any of --actor, --strict, --read-mode, --cache-size, --read-ahead, --default-ttl, --max-keys, --max-data-size, --eviction, --retention, --quota, --merge-policy, --merge-window and --chunk-size, and read-only, as <setting>=<value> on the flag or in its config file, which goes on top; with --mount, the store in --dir is only served if --dir is given; repeatable`, func(s string) error {
+		m, err := parseMount(s)
+		sc.mounts = append(sc.mounts, m)
+		return err
+	})
+	return sc
+}
+
+// servesDir reports whether serve serves the store in --dir, which it does unless
+// it only mounts others.
+func (c *serveCommand) servesDir() bool {
+	return len(c.mounts) == 0 || c.from["dir"] != ""
+}
+
+// check checks the flags that go together do, once parsed.
+func (c *serveCommand) check() error {
+	if *c.readOnly && (c.feeds.enabled() || *c.backups.schedule != "") {
+		return fmt.Errorf("--sink, --replicate and --backup-schedule write to the store, they can't be used with --read-only")
+	}
+	dir := *c.dir
+	if !c.servesDir() {
+		if c.feeds.enabled() || *c.backups.schedule != "" || *c.snapshot != "" || *c.readOnly {
+			return fmt.Errorf("--sink, --replicate, --backup-schedule, --snapshot and --read-only are for the store in --dir, pass --dir along with --mount")
+		}
+		dir = ""
+	}
+	if err := loadMounts(c.command, c.mounts); err != nil {
+		return err
+	}
+	if err := checkMounts(c.mounts, dir); err != nil {
+		return err
+	}
+	if _, _, err := c.backups.parse(); err != nil {
+		return err
+	}
+	if err := c.checkTokens(); err != nil {
+		return err
+	}
+	_, err := c.health.parse()
+	return err
+}
+
+// checkTokens refuses to serve anything but a loopback address without a token.
+func (c *serveCommand) checkTokens() error {
+	if err := c.admin.check(); err != nil {
+		return err
+	}
+	if err := checkTokenAddr("http", *c.httpAddr, "http", *c.httpToken); err != nil {
+		return err
+	}
+	// a backup is the whole store, so it takes the admin token
+	if err := checkTokenAddr("backup", *c.backupAddr, "admin", *c.admin.token); err != nil {
+		return err
+	}
+	if err := checkTokenAddr("redis", *c.redisAddr, "redis", *c.redisToken); err != nil {
+		return err
+	}
+	return checkTokenAddr("grpc", *c.grpcAddr, "grpc", *c.grpcToken)
+}
+
+func cmdServe(args []string) error {
+	c := newServeCommand()
+	if err := c.parse(args, 0, 0); err != nil {
+		return err
+	}
+	if err := c.check(); err != nil {
+		return err
+	}
+	sched, err := c.backups.scheduler()
+	if err != nil {
+		return err
+	}
+	if !c.feeds.enabled() && *c.metricsAddr == "" && *c.backupAddr == "" && *c.httpAddr == "" && *c.redisAddr == "" && *c.grpcAddr == "" && *c.admin.addr == "" && sched == nil {
+		return fmt.Errorf("nothing to serve, pass --sink, --replicate, --metrics-addr, --backup-addr, --http-addr, --redis-addr, --grpc-addr, --admin-addr and/or --backup-schedule")
+	}
+	reload, err := newReloader(c, args)
+	if err != nil {
+		return err
+	}
+	// the background work every served store gets; the planner is serve's own
+	background := []gocask.Option{gocask.WithExpirySweep(*c.sweep), gocask.WithSync(*c.sync)}
+	var stores []*store
+	if c.servesDir() {
+		s, err := c.open(background...)
+		if err != nil {
+			return err
+		}
+		defer s.Close()
+		stopFeeds, feedLag, err := startFeeds(s, c.feeds)
+		if err != nil {
+			return err
+		}
+		defer stopFeeds()
+		defer startBackups(s, sched)()
+		s.lag = feedLag
+		stores = append(stores, s)
+	}
+	mounted, err := c.openMounts(background)
+	if err != nil {
+		return err
+	}
+	defer closeStores(mounted)
+	stores = append(stores, mounted...)
+	reload.stores = stores
+	for _, s := range stores {
+		defer startPlanner(s, *c.plan)()
+	}
+
+	if *c.metricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metricsHandler())
+		mux.Handle("/debug/vars", expvar.Handler())
+		opts, _ := c.health.parse() // checked above
+		for _, s := range stores {
+			h, err := gocask.NewHealth(s.DB, opts, s.lag)
+			if err != nil {
+				return err
+			}
+			mux.Handle(s.route("/healthz"), h.Live())
+			mux.Handle(s.route("/readyz"), h.Ready())
+		}
+		srv := &http.Server{Addr: *c.metricsAddr, Handler: mux}
+		go func() {
+			if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				logger.Error("metrics server stopped", "err", err)
+			}
+		}()
+		defer srv.Close()
+	}
+	if *c.backupAddr != "" {
+		mux := http.NewServeMux()
+		for _, s := range stores {
+			mux.HandleFunc(s.route("/backup"), s.serveBackup)
+		}
+		srv := &http.Server{Addr: *c.backupAddr, Handler: withToken(mux, reload.tokens.admin, "gocask backup")}
+		go func() {
+			if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				logger.Error("backup server stopped", "err", err)
+			}
+		}()
+		defer srv.Close()
+	}
+	if *c.httpAddr != "" {
+		srv := &http.Server{Addr: *c.httpAddr, Handler: restHandler(stores, reload.tokens.http)}
+		go func() {
+			if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				logger.Error("http server stopped", "err", err)
+			}
+		}()
+		defer srv.Close()
+	}
+	if *c.redisAddr != "" {
+		srv, err := listenRESP(*c.redisAddr, stores, reload.tokens.redis)
+		if err != nil {
+			return err
+		}
+		defer srv.Close()
+	}
+	if *c.grpcAddr != "" {
+		srv, err := listenGRPC(*c.grpcAddr, stores, reload.tokens.grpc)
+		if err != nil {
+			return err
+		}
+		defer srv.Stop()
+	}
+	if *c.admin.addr != "" {
+		srv := &http.Server{Addr: *c.admin.addr, Handler: adminHandler(stores, reload, reload.tokens.admin)}
+		go func() {
+			if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				logger.Error("admin server stopped", "err", err)
+			}
+		}()
+		defer srv.Close()
+	}
+
+	sig, hup := make(chan os.Signal, 1), make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	signal.Notify(hup, syscall.SIGHUP)
+	for {
+		select {
+		case <-sig:
+			return nil
+		case <-hup:
+			if _, err := reload.reload(); err != nil {
+				logger.Error("reload failed, keeping the settings", "err", err)
+			}
+		}
+	}
+}
+
+func cmdMerge(args []string) error {
+	c := newCommand("merge", "")
+	if err := c.parse(args, 0, 0); err != nil {
+		return err
+	}
+	s, err := c.open()
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	return s.Merge()
+}
+
+func cmdStats(args []string) error {
+	c := newCommand("stats", "")
+	c.addSnapshotFlags()
+	index := c.fs.Bool("index", false, "break the index's memory use down by key prefix instead")
+	if err := c.parse(args, 0, 0); err != nil {
+		return err
+	}
+	s, err := c.open()
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	if *index {
+		for _, l := range s.IndexReport(20) {
+			fmt.Println(l)
+		}
+		return nil
+	}
+
+	lines, err := s.StatsReport()
+	if err != nil {
+		return err
+	}
+	for _, l := range lines {
+		fmt.Println(l)
+	}
+	return nil
+}
+
+func cmdRepl(args []string) error {
+	c := newCommand("repl", "")
+	c.addSnapshotFlags()
+	feeds := addFeedFlags(c.fs)
+	sweep := addSweepFlag(c.fs)
+	syncPolicy := addSyncFlag(c.fs)
+	plan := addPlanFlag(c.fs)
+	if err := c.parse(args, 0, 0); err != nil {
+		return err
+	}
+	s, err := c.open(gocask.WithExpirySweep(*sweep), gocask.WithSync(*syncPolicy))
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	defer startPlanner(s, *plan)()
+
+	if feeds.enabled() {
+		stopFeeds, _, err := startFeeds(s, feeds)
+		if err != nil {
+			return err
+		}
+		defer stopFeeds()
+	}
+
+	sess := &session{}
+	reader := bufio.NewReader(os.Stdin)
+	for {
+		fmt.Print("> ")
+		line, err := reader.ReadString('\n')
+		if err != nil && line == "" {
+			return nil // stdin closed
+		}
+		parts, err := tokenize(line)
+		if err != nil {
+			fmt.Println("Parse error:", err)
+			continue
+		}
+		if len(parts) == 0 {
+			continue
+		}
+		if strings.ToUpper(parts[0]) == "EXIT" {
+			return nil
+		}
+
+		var r reply
+		err = s.Exclusive(func(tx *gocask.DB) (err error) {
+			r, err = sess.run(tx, parts)
+			return err
+		})
+
+		for _, l := range r.lines {
+			fmt.Println(l)
+		}
+		var usage usageError
+		switch {
+		case errors.As(err, &usage):
+			fmt.Println(err)
+		case err != nil:
+			fmt.Println("Error:", err)
+		case r.hasValue:
+			fmt.Printf("%s: %s\n", r.label, r.value)
+		}
+	}
+}
+
+// stringsFlag collects every occurrence of a repeatable flag.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string { return strings.Join(*f, "; ") }
+
+func (f *stringsFlag) Set(v string) error { *f = append(*f, v); return nil }
+
+// cmdExec runs commands non-interactively. Every command prints its listing lines,
+// if any, then one status line: OK, OK "<value>" or ERR <message>. The first failing
+// command stops the run with a non-zero exit status.
+func cmdExec(args []string) error {
+	c := newCommand("exec", "[file]")
+	c.addSnapshotFlags()
+	var commands stringsFlag
+	c.fs.Var(&commands, "command", "command to run instead of reading a file, may be repeated")
+	if err := c.parse(args, 0, 1); err != nil {
+		return err
+	}
+
+	var in io.Reader = os.Stdin
+	if c.fs.NArg() == 1 {
+		if len(commands) > 0 {
+			return fmt.Errorf("give either --command or a file, not both")
+		}
+		f, err := os.Open(c.fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	if len(commands) > 0 {
+		in = strings.NewReader(strings.Join(commands, "\n"))
+	}
+
+	s, err := c.open()
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	sess := &session{}
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(nil, 64<<20)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts, err := tokenize(line)
+		if err != nil {
+			fmt.Println("ERR", err)
+			return fmt.Errorf("line %d: %w", lineNo, err)
+		}
+		if strings.ToUpper(parts[0]) == "EXIT" {
+			break
+		}
+
+		var r reply
+		err = s.Exclusive(func(tx *gocask.DB) (err error) {
+			r, err = sess.run(tx, parts)
+			return err
+		})
+
+		for _, l := range r.lines {
+			fmt.Println(l)
+		}
+		switch {
+		case err != nil:
+			fmt.Println("ERR", err)
+			return fmt.Errorf("line %d: %w", lineNo, err)
+		case r.hasValue:
+			fmt.Println("OK", strconv.Quote(r.value))
+		default:
+			fmt.Println("OK")
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if sess.queued {
+		fmt.Println("ERR MULTI without EXEC")
+		return fmt.Errorf("%d queued commands were never run", len(sess.queue))
+	}
+	return nil
+}
@@ -0,0 +1,16 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/itsknk/gocask/gocaskprom"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metricsHandler serves the metrics of the stores serve has open to prometheus.
+func metricsHandler() http.Handler {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(gocaskprom.NewCollector())
+	return promhttp.HandlerFor(reg, promhttp.HandlerOpts{})
+}
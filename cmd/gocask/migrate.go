@@ -0,0 +1,32 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/itsknk/gocask"
+)
+
+func cmdMigrate(args []string) error {
+	c := newCommand("migrate", "[dir]")
+	from := c.fs.String("from", "", fmt.Sprintf("format the store is written in, v0 to v%d (required)", gocask.FormatVersion-1))
+	to := c.fs.String("to", fmt.Sprintf("v%d", gocask.FormatVersion), "format to convert to, only the current one is supported")
+	if err := c.parse(args, 0, 1); err != nil {
+		return err
+	}
+	if *to != fmt.Sprintf("v%d", gocask.FormatVersion) {
+		return fmt.Errorf("can only migrate to the current format v%d", gocask.FormatVersion)
+	}
+	var v int
+	if _, err := fmt.Sscanf(*from, "v%d", &v); err != nil && *from != "" {
+		return fmt.Errorf("bad --from %q, want v0 to v%d", *from, gocask.FormatVersion-1)
+	} else if *from == "" {
+		v = -1 // only valid when resuming
+	}
+
+	dir := *c.dir
+	if c.fs.NArg() == 1 {
+		dir = c.fs.Arg(0)
+	}
+	return gocask.Migrate(dir, v, os.Stdout)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/itsknk/gocask"
+)
+
+// mountSnapshot opens the store a backup archive, a file or an object url, or a
+// snapshot directory export-sst wrote holds, read-only. The store is unpacked into
+// a directory of its own under the system's temporary one, which goes when it is
+// closed; the archive or snapshot itself is only read. An object url is reached
+// with the endpoint and credentials the environment gives.
+func mountSnapshot(src string, opts []gocask.Option) (*store, error) {
+	root, err := os.MkdirTemp("", "gocask-snapshot-")
+	if err != nil {
+		return nil, err
+	}
+	db, err := unpackSnapshot(src, filepath.Join(root, "store"), append(opts, gocask.WithReadOnly()))
+	if err != nil {
+		os.RemoveAll(root)
+		return nil, fmt.Errorf("mount %s: %w", src, err)
+	}
+	return &store{DB: db, mount: root}, nil
+}
+
+// unpackSnapshot fills dir with the store in src and opens it with opts.
+func unpackSnapshot(src, dir string, opts []gocask.Option) (*gocask.DB, error) {
+	if fi, err := os.Stat(src); err == nil && fi.IsDir() {
+		snap, err := gocask.OpenSnapshot(src)
+		if err != nil {
+			return nil, err
+		}
+		defer snap.Close()
+		db, err := gocask.Open(dir, gocask.WithLogger(logger))
+		if err != nil {
+			return nil, err
+		}
+		// the records keep the timestamps they had, so the store looks like the one
+		// the snapshot was taken of
+		err = snap.Range(func(e gocask.SSTEntry) error {
+			if expired(e.Expires) {
+				return nil
+			}
+			return db.PutEntry(e)
+		})
+		if cerr := db.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		o := gocask.RestoreOptions{Open: archiveOpener(func() (objectStoreOptions, error) { return objectStoreOptions{}, nil })}
+		if err := gocask.RestoreChain([]string{src}, dir, o); err != nil {
+			return nil, err
+		}
+	}
+	return gocask.Open(dir, opts...)
+}
+
+// unmount removes the directory a mounted snapshot was unpacked into.
+func (s *store) unmount() {
+	if err := os.RemoveAll(s.mount); err != nil {
+		logger.Warn("couldn't remove unpacked snapshot", "dir", s.mount, "err", err)
+	}
+}
+
+// addSnapshotFlags lets the command look at a backup or snapshot instead of the
+// store in --dir, and open either read-only.
+func (c *command) addSnapshotFlags() {
+	c.snapshot = c.fs.String("snapshot", "", "open a backup archive (file or s3:// or gs:// url) or an export-sst snapshot directory instead of --dir, unpacked into a temporary directory; needs --read-only")
+	c.readOnly = c.fs.Bool("read-only", false, "refuse writes and merges, and don't sweep expired keys")
+}
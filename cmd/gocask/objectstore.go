@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/itsknk/gocask"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/minio/minio-go/v7/pkg/encrypt"
+)
+
+// objectStoreOptions configure the connection to an object store. Credentials come
+// from the environment as the AWS and MinIO tools take them: AWS_ACCESS_KEY_ID and
+// AWS_SECRET_ACCESS_KEY (HMAC keys for GCS), MINIO_ACCESS_KEY and MINIO_SECRET_KEY,
+// ~/.aws/credentials, or the instance's IAM role.
+type objectStoreOptions struct {
+	Endpoint string // host[:port], http:// in front for no TLS; by default AWS_ENDPOINT_URL or the scheme's
+	Region   string
+	PartSize uint64 // bytes per part of an upload, buffered in memory
+	// SSE asks the store to encrypt what it is sent: "s3" with keys it manages, "kms"
+	// with the KMS key SSEKMSKey, or "c" with SSECKey, which it doesn't keep, so the
+	// same key has to be passed to read the object back.
+	SSE       string
+	SSEKMSKey string
+	SSECKey   []byte
+}
+
+const defaultPartSize = 16 << 20
+
+var defaultEndpoints = map[string]string{
+	"s3": "s3.amazonaws.com",
+	"gs": "storage.googleapis.com", // the interoperability api
+}
+
+// isObjectURL reports whether target names an object rather than a local file.
+func isObjectURL(target string) bool {
+	scheme, _, ok := strings.Cut(target, "://")
+	return ok && defaultEndpoints[scheme] != ""
+}
+
+// openObjectStore parses an object url, s3://bucket/path/name or gs://bucket/path/name,
+// and returns the store holding its bucket and the name of the object in it.
+func openObjectStore(target string, o objectStoreOptions) (gocask.ObjectStore, string, error) {
+	scheme, rest, ok := strings.Cut(target, "://")
+	if !ok || defaultEndpoints[scheme] == "" {
+		return nil, "", fmt.Errorf("object url %q: want s3:// or gs://", target)
+	}
+	bucket, name, _ := strings.Cut(rest, "/")
+	if bucket == "" || name == "" || strings.HasSuffix(name, "/") {
+		return nil, "", fmt.Errorf("object url %q: want %s://bucket/path/name", target, scheme)
+	}
+	s, err := dialObjectStore(scheme, bucket, o)
+	if err != nil {
+		return nil, "", fmt.Errorf("object url %q: %w", target, err)
+	}
+	return s, name, nil
+}
+
+// openBackupDest opens where scheduled backups go: a directory, or a path in a
+// bucket given as s3://bucket/path/ or gs://bucket/path/. It returns the store and
+// the prefix of the names backups get in it.
+func openBackupDest(target string, o objectStoreOptions) (gocask.ObjectStore, string, error) {
+	if !isObjectURL(target) {
+		dir, err := filepath.Abs(target)
+		if err != nil {
+			return nil, "", err
+		}
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, "", err
+		}
+		return gocask.DirObjectStore(dir), "", nil
+	}
+	scheme, rest, _ := strings.Cut(target, "://")
+	bucket, prefix, _ := strings.Cut(rest, "/")
+	if bucket == "" {
+		return nil, "", fmt.Errorf("backup destination %q: want %s://bucket/path/", target, scheme)
+	}
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	s, err := dialObjectStore(scheme, bucket, o)
+	if err != nil {
+		return nil, "", fmt.Errorf("backup destination %q: %w", target, err)
+	}
+	return s, prefix, nil
+}
+
+// dialObjectStore returns the store holding bucket, found by the defaults for scheme
+// unless o names an endpoint.
+func dialObjectStore(scheme, bucket string, o objectStoreOptions) (gocask.ObjectStore, error) {
+	endpoint := o.Endpoint
+	if endpoint == "" && scheme == "s3" {
+		endpoint = os.Getenv("AWS_ENDPOINT_URL")
+	}
+	if endpoint == "" {
+		endpoint = defaultEndpoints[scheme]
+	}
+	secure := !strings.HasPrefix(endpoint, "http://")
+	endpoint = strings.TrimSuffix(strings.TrimPrefix(strings.TrimPrefix(endpoint, "http://"), "https://"), "/")
+	region := o.Region
+	if region == "" {
+		region = os.Getenv("AWS_REGION")
+	}
+
+	c, err := minio.New(endpoint, &minio.Options{
+		Creds: credentials.NewChainCredentials([]credentials.Provider{
+			&credentials.EnvAWS{},
+			&credentials.EnvMinio{},
+			&credentials.FileAWSCredentials{},
+			&credentials.IAM{},
+		}),
+		Secure: secure,
+		Region: region,
+	})
+	if err != nil {
+		return nil, err
+	}
+	s := &s3Store{c: c, bucket: bucket, partSize: o.PartSize}
+	if s.partSize == 0 {
+		s.partSize = defaultPartSize
+	}
+	switch o.SSE {
+	case "":
+	case "s3":
+		s.sse = encrypt.NewSSE()
+	case "kms":
+		if s.sse, err = encrypt.NewSSEKMS(o.SSEKMSKey, nil); err != nil {
+			return nil, err
+		}
+	case "c":
+		if s.sse, err = encrypt.NewSSEC(o.SSECKey); err != nil {
+			return nil, err
+		}
+		s.readSSE = s.sse
+	default:
+		return nil, fmt.Errorf("unknown server-side encryption %q, want s3, kms or c", o.SSE)
+	}
+	return s, nil
+}
+
+// s3Store is an ObjectStore speaking the S3 protocol.
+type s3Store struct {
+	c        *minio.Client
+	bucket   string
+	partSize uint64
+	sse      encrypt.ServerSide // for uploads
+	readSSE  encrypt.ServerSide // for downloads: only a customer key has to be sent again
+}
+
+func (s *s3Store) Put(ctx context.Context, name string, r io.Reader) error {
+	_, err := s.c.PutObject(ctx, s.bucket, name, r, -1, minio.PutObjectOptions{
+		ContentType:          "application/octet-stream",
+		PartSize:             s.partSize,
+		SendContentMd5:       true, // the store checks every part arrived as it was sent
+		ServerSideEncryption: s.sse,
+	})
+	if err != nil {
+		return fmt.Errorf("upload %s/%s: %w", s.bucket, name, err)
+	}
+	return nil
+}
+
+func (s *s3Store) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	obj, err := s.c.GetObject(ctx, s.bucket, name, minio.GetObjectOptions{ServerSideEncryption: s.readSSE})
+	if err != nil {
+		return nil, fmt.Errorf("download %s/%s: %w", s.bucket, name, err)
+	}
+	return obj, nil
+}
+
+func (s *s3Store) List(ctx context.Context, prefix string) ([]string, error) {
+	var names []string
+	for obj := range s.c.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
+		if obj.Err != nil {
+			return nil, fmt.Errorf("list %s/%s: %w", s.bucket, prefix, obj.Err)
+		}
+		names = append(names, obj.Key)
+	}
+	return names, nil
+}
+
+func (s *s3Store) Delete(ctx context.Context, name string) error {
+	if err := s.c.RemoveObject(ctx, s.bucket, name, minio.RemoveObjectOptions{}); err != nil {
+		return fmt.Errorf("delete %s/%s: %w", s.bucket, name, err)
+	}
+	return nil
+}
+
+// objectStoreFlags adds the flags configuring an object store to fs, those choosing
+// how to encrypt what is stored too if upload is set, and returns a func building the
+// options from them once fs is parsed.
+func objectStoreFlags(fs *flag.FlagSet, upload bool) func() (objectStoreOptions, error) {
+	endpoint := fs.String("endpoint", "", `object store to talk to, e.g. "http://localhost:9000" for a local MinIO (default $AWS_ENDPOINT_URL, else AWS or GCS by the url's scheme)`)
+	region := fs.String("region", "", "region of the bucket (default $AWS_REGION)")
+	partSize, sse, kmsKey := new(uint64), new(string), new(string)
+	if upload {
+		partSize = fs.Uint64("part-size", defaultPartSize, "bytes per part of the multipart upload, each buffered in memory")
+		sse = fs.String("sse", "", "have the store encrypt the backup: s3 with keys it manages, kms with --sse-kms-key, or c with --sse-c-key-file")
+		kmsKey = fs.String("sse-kms-key", "", "id of the KMS key of --sse kms")
+	}
+	keyFile := fs.String("sse-c-key-file", "", "file holding the 32-byte key the object is encrypted with, for --sse c")
+	return func() (objectStoreOptions, error) {
+		o := objectStoreOptions{Endpoint: *endpoint, Region: *region, PartSize: *partSize, SSE: *sse, SSEKMSKey: *kmsKey}
+		if !upload && *keyFile != "" {
+			o.SSE = "c"
+		}
+		switch {
+		case o.SSE == "kms" && o.SSEKMSKey == "":
+			return o, fmt.Errorf("--sse kms needs --sse-kms-key")
+		case o.SSE == "c" && *keyFile == "":
+			return o, fmt.Errorf("--sse c needs --sse-c-key-file")
+		case o.SSE == "c":
+			key, err := os.ReadFile(*keyFile)
+			if err != nil {
+				return o, err
+			}
+			if len(key) != 32 {
+				return o, fmt.Errorf("%s holds %d bytes, an sse-c key is 32", *keyFile, len(key))
+			}
+			o.SSECKey = key
+		}
+		return o, nil
+	}
+}
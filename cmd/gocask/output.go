@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/itsknk/gocask"
+)
+
+// outputRecord is the json form of a key read by get, scan or dump. Key and value
+// follow the export rules (plain text, or base64 with enc set); the rest locates
+// the record on disk.
+type outputRecord struct {
+	exportRecord
+	Timestamp time.Time  `json:"timestamp"`
+	Node      uint16     `json:"node"`
+	File      string     `json:"file"`
+	Offset    int64      `json:"offset"`
+	Flag      string     `json:"flag,omitempty"` // only for raw segment dumps
+	Expires   *time.Time `json:"expires,omitempty"`
+}
+
+// setExpires fills in Expires from a stored expiry, leaving it out for 0.
+func (o *outputRecord) setExpires(expires uint64) {
+	if expires != 0 {
+		t := time.Unix(0, int64(expires)).UTC()
+		o.Expires = &t
+	}
+}
+
+func addOutputFlag(fs *flag.FlagSet) *string {
+	return fs.String("output", "raw", "how to print keys and values: raw, hex, base64 or json")
+}
+
+func checkOutputFlag(v string) error {
+	switch v {
+	case "raw", "hex", "base64", "json":
+		return nil
+	}
+	return fmt.Errorf("unknown --output %q (want raw, hex, base64 or json)", v)
+}
+
+// encodeOutput renders a key or value for the non-json outputs.
+func encodeOutput(format, s string) string {
+	switch format {
+	case "hex":
+		return hex.EncodeToString([]byte(s))
+	case "base64":
+		return base64.StdEncoding.EncodeToString([]byte(s))
+	default:
+		return s
+	}
+}
+
+func newOutputRecord(key, value string, ts uint64, file string, off int64) outputRecord {
+	return outputRecord{
+		exportRecord: encodeRecord(key, value),
+		Timestamp:    time.Unix(0, int64(ts)).UTC(),
+		Node:         gocask.TimestampNode(ts),
+		File:         file,
+		Offset:       off,
+	}
+}
+
+// keyOutput formats a live key for get (value only) or scan and dump (key and value).
+func keyOutput(format, key string, db *gocask.DB, withKey bool) (string, error) {
+	if format != "json" {
+		v, err := db.Get(key)
+		if err != nil {
+			return "", err
+		}
+		if !withKey {
+			return encodeOutput(format, v), nil
+		}
+		return encodeOutput(format, key) + "\t" + encodeOutput(format, v), nil
+	}
+
+	e, err := db.GetEntry(key)
+	if err != nil {
+		return "", err
+	}
+	fo, _ := db.Locate(key)
+	rec := newOutputRecord(key, e.Value, e.Timestamp, fo.FileID(), fo.Offset())
+	rec.setExpires(e.Expires)
+	rec.Meta = e.Meta
+	b, err := json.Marshal(rec)
+	return string(b), err
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/itsknk/gocask"
+)
+
+func cmdRecover(args []string) error {
+	c := newCommand("recover", "")
+	var opts gocask.RecoveryOptions
+	c.fs.BoolVar(&opts.RebuildIndexFromLogs, "rebuild-index", false, "ignore the hints and index every segment by scanning it, writing fresh hints")
+	c.fs.BoolVar(&opts.TruncateCorrupt, "truncate-corrupt", false, "drop records that don't decode and cut a torn record off the end of the active file")
+	c.fs.BoolVar(&opts.SkipBadSegments, "skip-bad-segments", false, "quarantine segments that hold no readable record or can't be read")
+	c.fs.BoolVar(&opts.DryRun, "dry-run", false, "change nothing, only print what would be done")
+	if err := c.parse(args, 0, 0); err != nil {
+		return err
+	}
+	db, info, err := gocask.OpenWithRecovery(*c.dir, opts, gocask.WithLogger(logger))
+	// what was done before a repair that isn't allowed stopped it stays done
+	for _, a := range info.Actions {
+		fmt.Println(a)
+	}
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	fmt.Println(info.String())
+	return nil
+}
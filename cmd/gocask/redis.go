@@ -0,0 +1,646 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// redisString is one string key found in redis. expireAt is zero when the key has no TTL.
+type redisString struct {
+	key, value string
+	expireAt   time.Time
+}
+
+// rdb opcodes and value types, see rdb.h in the redis source
+const (
+	rdbOpSlotInfo     = 0xf4
+	rdbOpFunction2    = 0xf5
+	rdbOpModuleAux    = 0xf7
+	rdbOpIdle         = 0xf8
+	rdbOpFreq         = 0xf9
+	rdbOpAux          = 0xfa
+	rdbOpResizeDB     = 0xfb
+	rdbOpExpireTimeMs = 0xfc
+	rdbOpExpireTime   = 0xfd
+	rdbOpSelectDB     = 0xfe
+	rdbOpEOF          = 0xff
+
+	rdbTypeString            = 0
+	rdbTypeList              = 1
+	rdbTypeSet               = 2
+	rdbTypeZset              = 3
+	rdbTypeHash              = 4
+	rdbTypeZset2             = 5
+	rdbTypeQuicklist         = 14
+	rdbTypeQuicklist2        = 18
+	rdbEncInt8               = 0
+	rdbEncInt16              = 1
+	rdbEncInt32              = 2
+	rdbEncLZF                = 3
+	rdbLenSpecial     uint64 = 1 << 63 // marks a length that is really a string encoding
+)
+
+// rdbReader reads an rdb file, left bytes of which are still to be read.
+type rdbReader struct {
+	r    *bufio.Reader
+	left int64
+}
+
+func (d *rdbReader) byte() (byte, error) {
+	b, err := d.r.ReadByte()
+	if err == nil {
+		d.left--
+	}
+	return b, err
+}
+
+// full reads the next n bytes. n is mostly a length read from the file, so it is
+// checked against what is left of the file before anything is allocated for it.
+func (d *rdbReader) full(n uint64) ([]byte, error) {
+	if n > uint64(max(d.left, 0)) {
+		return nil, fmt.Errorf("%d bytes run past the end of the file: %w", n, io.ErrUnexpectedEOF)
+	}
+	buf := make([]byte, n)
+	_, err := io.ReadFull(d.r, buf)
+	d.left -= int64(n)
+	return buf, eofIsUnexpected(err)
+}
+
+// length reads a length-encoded integer. Special string encodings come back with
+// rdbLenSpecial set and the encoding in the low bits.
+func (d *rdbReader) length() (uint64, error) {
+	b, err := d.byte()
+	if err != nil {
+		return 0, eofIsUnexpected(err)
+	}
+	switch b >> 6 {
+	case 0:
+		return uint64(b & 0x3f), nil
+	case 1:
+		next, err := d.byte()
+		return uint64(b&0x3f)<<8 | uint64(next), eofIsUnexpected(err)
+	case 2:
+		switch b {
+		case 0x80:
+			buf, err := d.full(4)
+			if err != nil {
+				return 0, err
+			}
+			return uint64(binary.BigEndian.Uint32(buf)), nil
+		case 0x81:
+			buf, err := d.full(8)
+			if err != nil {
+				return 0, err
+			}
+			return binary.BigEndian.Uint64(buf), nil
+		}
+		return 0, fmt.Errorf("bad length byte %#x", b)
+	default:
+		return rdbLenSpecial | uint64(b&0x3f), nil
+	}
+}
+
+func (d *rdbReader) string() (string, error) {
+	n, err := d.length()
+	if err != nil {
+		return "", err
+	}
+	if n&rdbLenSpecial == 0 {
+		buf, err := d.full(n)
+		return string(buf), err
+	}
+
+	switch n &^ rdbLenSpecial {
+	case rdbEncInt8:
+		buf, err := d.full(1)
+		if err != nil {
+			return "", err
+		}
+		return strconv.Itoa(int(int8(buf[0]))), nil
+	case rdbEncInt16:
+		buf, err := d.full(2)
+		if err != nil {
+			return "", err
+		}
+		return strconv.Itoa(int(int16(binary.LittleEndian.Uint16(buf)))), nil
+	case rdbEncInt32:
+		buf, err := d.full(4)
+		if err != nil {
+			return "", err
+		}
+		return strconv.Itoa(int(int32(binary.LittleEndian.Uint32(buf)))), nil
+	case rdbEncLZF:
+		clen, err := d.length()
+		if err != nil {
+			return "", err
+		}
+		ulen, err := d.length()
+		if err != nil {
+			return "", err
+		}
+		in, err := d.full(clen)
+		if err != nil {
+			return "", err
+		}
+		if ulen > uint64(len(in))*lzfMaxExpansion {
+			return "", fmt.Errorf("lzf: %d bytes can't expand to %d", len(in), ulen)
+		}
+		out, err := lzfDecompress(in, int(ulen))
+		return string(out), err
+	default:
+		return "", fmt.Errorf("unknown string encoding %d", n&^rdbLenSpecial)
+	}
+}
+
+// lzfMaxExpansion is the most an LZF input byte expands to: a 3-byte back reference
+// copies at most 264 bytes.
+const lzfMaxExpansion = 88
+
+// lzfDecompress expands redis' LZF-compressed strings.
+func lzfDecompress(in []byte, size int) ([]byte, error) {
+	out := make([]byte, 0, size)
+	for ip := 0; ip < len(in); {
+		ctrl := int(in[ip])
+		ip++
+		if ctrl < 32 {
+			// literal run of ctrl+1 bytes
+			n := ctrl + 1
+			if ip+n > len(in) {
+				return nil, errors.New("lzf: literal runs past input")
+			}
+			out = append(out, in[ip:ip+n]...)
+			ip += n
+			continue
+		}
+
+		// back reference
+		n := ctrl >> 5
+		if n == 7 {
+			if ip >= len(in) {
+				return nil, errors.New("lzf: truncated length")
+			}
+			n += int(in[ip])
+			ip++
+		}
+		if ip >= len(in) {
+			return nil, errors.New("lzf: truncated reference")
+		}
+		ref := len(out) - (ctrl&0x1f)<<8 - int(in[ip]) - 1
+		ip++
+		if ref < 0 {
+			return nil, errors.New("lzf: reference before start of output")
+		}
+		for i := 0; i < n+2; i++ {
+			out = append(out, out[ref+i])
+		}
+	}
+	if len(out) != size {
+		return nil, fmt.Errorf("lzf: got %d bytes, want %d", len(out), size)
+	}
+	return out, nil
+}
+
+// skipValue reads past a value of a type gocask doesn't import.
+func (d *rdbReader) skipValue(typ byte) error {
+	strings := func(per uint64) error {
+		n, err := d.length()
+		if err != nil {
+			return err
+		}
+		for i := uint64(0); i < n*per; i++ {
+			if _, err := d.string(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	switch typ {
+	case rdbTypeList, rdbTypeSet, rdbTypeQuicklist:
+		return strings(1)
+	case rdbTypeHash:
+		return strings(2)
+	case rdbTypeZset:
+		n, err := d.length()
+		if err != nil {
+			return err
+		}
+		for i := uint64(0); i < n; i++ {
+			if _, err := d.string(); err != nil {
+				return err
+			}
+			// scores are a 1-byte length then text, 253-255 mean nan/+inf/-inf
+			l, err := d.byte()
+			if err != nil {
+				return eofIsUnexpected(err)
+			}
+			if l < 253 {
+				if _, err := d.full(uint64(l)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	case rdbTypeZset2:
+		n, err := d.length()
+		if err != nil {
+			return err
+		}
+		for i := uint64(0); i < n; i++ {
+			if _, err := d.string(); err != nil {
+				return err
+			}
+			if _, err := d.full(8); err != nil {
+				return err
+			}
+		}
+		return nil
+	case rdbTypeQuicklist2:
+		n, err := d.length()
+		if err != nil {
+			return err
+		}
+		for i := uint64(0); i < n; i++ {
+			if _, err := d.length(); err != nil { // container kind
+				return err
+			}
+			if _, err := d.string(); err != nil {
+				return err
+			}
+		}
+		return nil
+	case 9, 10, 11, 12, 13, 16, 17, 20:
+		// zipmap, ziplist, intset and listpack encodings are a single blob
+		_, err := d.string()
+		return err
+	default:
+		return fmt.Errorf("unsupported value type %d (streams and modules can't be skipped)", typ)
+	}
+}
+
+// readRDB calls fn for every string key stored in database db of an rdb file of
+// size bytes. Other value types are skipped and counted.
+func readRDB(r io.Reader, size int64, db uint64, fn func(redisString) error) (skipped int, err error) {
+	d := &rdbReader{r: bufio.NewReaderSize(r, 1<<16), left: size}
+	magic, err := d.full(9)
+	if err != nil {
+		return 0, err
+	}
+	if string(magic[:5]) != "REDIS" {
+		return 0, fmt.Errorf("not an rdb file")
+	}
+	if v, err := strconv.Atoi(string(magic[5:])); err != nil || v < 1 || v > 12 {
+		return 0, fmt.Errorf("unsupported rdb version %q", magic[5:])
+	}
+
+	var curDB uint64
+	var expireAt time.Time
+	for {
+		op, err := d.byte()
+		if err != nil {
+			return skipped, eofIsUnexpected(err)
+		}
+
+		switch op {
+		case rdbOpEOF:
+			return skipped, nil // the checksum that follows isn't verified
+		case rdbOpSelectDB:
+			if curDB, err = d.length(); err != nil {
+				return skipped, err
+			}
+			continue
+		case rdbOpResizeDB:
+			if _, err := d.length(); err != nil {
+				return skipped, err
+			}
+			if _, err := d.length(); err != nil {
+				return skipped, err
+			}
+			continue
+		case rdbOpSlotInfo:
+			for i := 0; i < 3; i++ {
+				if _, err := d.length(); err != nil {
+					return skipped, err
+				}
+			}
+			continue
+		case rdbOpAux:
+			if _, err := d.string(); err != nil {
+				return skipped, err
+			}
+			if _, err := d.string(); err != nil {
+				return skipped, err
+			}
+			continue
+		case rdbOpFunction2:
+			if _, err := d.string(); err != nil {
+				return skipped, err
+			}
+			continue
+		case rdbOpModuleAux:
+			return skipped, fmt.Errorf("rdb contains module data, which can't be skipped")
+		case rdbOpExpireTime:
+			buf, err := d.full(4)
+			if err != nil {
+				return skipped, err
+			}
+			expireAt = time.Unix(int64(binary.LittleEndian.Uint32(buf)), 0)
+			continue
+		case rdbOpExpireTimeMs:
+			buf, err := d.full(8)
+			if err != nil {
+				return skipped, err
+			}
+			expireAt = time.UnixMilli(int64(binary.LittleEndian.Uint64(buf)))
+			continue
+		case rdbOpFreq:
+			if _, err := d.full(1); err != nil {
+				return skipped, err
+			}
+			continue
+		case rdbOpIdle:
+			if _, err := d.length(); err != nil {
+				return skipped, err
+			}
+			continue
+		}
+
+		// anything else is a value type followed by the key
+		key, err := d.string()
+		if err != nil {
+			return skipped, err
+		}
+		exp := expireAt
+		expireAt = time.Time{}
+
+		if op != rdbTypeString {
+			if err := d.skipValue(op); err != nil {
+				return skipped, fmt.Errorf("key %q: %w", key, err)
+			}
+			if curDB == db {
+				skipped++
+			}
+			continue
+		}
+		value, err := d.string()
+		if err != nil {
+			return skipped, fmt.Errorf("key %q: %w", key, err)
+		}
+		if curDB != db {
+			continue
+		}
+		if err := fn(redisString{key, value, exp}); err != nil {
+			return skipped, err
+		}
+	}
+}
+
+// respConn is just enough of a redis client to SCAN a live server.
+type respConn struct {
+	c net.Conn
+	r *bufio.Reader
+	w *bufio.Writer
+
+	ctx context.Context // what serve makes the writes of a client with, see serveConn
+}
+
+func dialRedis(addr string) (*respConn, error) {
+	c, err := net.DialTimeout("tcp", addr, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	return &respConn{c: c, r: bufio.NewReader(c), w: bufio.NewWriter(c)}, nil
+}
+
+// send queues a command; replies are read back with reply, in order.
+func (rc *respConn) send(args ...string) {
+	fmt.Fprintf(rc.w, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(rc.w, "$%d\r\n%s\r\n", len(a), a)
+	}
+}
+
+// errRedisNil is a nil bulk or array reply, e.g. GET of a key that vanished.
+var errRedisNil = errors.New("redis: nil")
+
+// the biggest bulk string and array reply and readRequest will read, as redis caps
+// requests, so a bad length can't make them allocate without bound
+const (
+	respMaxBulk  = 512 << 20
+	respMaxArray = 1 << 20
+)
+
+// reply reads one reply: a string, an int64, or a []interface{} for arrays.
+func (rc *respConn) reply() (interface{}, error) {
+	if err := rc.w.Flush(); err != nil {
+		return nil, err
+	}
+	line, err := rc.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 {
+		return nil, fmt.Errorf("redis: short reply %q", line)
+	}
+	kind, body := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return body, nil
+	case '-':
+		return nil, fmt.Errorf("redis: %s", body)
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, errRedisNil
+		}
+		if n > respMaxBulk {
+			return nil, fmt.Errorf("redis: bulk string of %d bytes is too long", n)
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(rc.r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, errRedisNil
+		}
+		if n > respMaxArray {
+			return nil, fmt.Errorf("redis: array of %d items is too long", n)
+		}
+		items := make([]interface{}, 0, n)
+		for i := 0; i < n; i++ {
+			item, err := rc.reply()
+			if err != nil && err != errRedisNil {
+				return nil, err
+			}
+			items = append(items, item)
+		}
+		return items, nil
+	default:
+		return nil, fmt.Errorf("redis: unexpected reply %q", line)
+	}
+}
+
+func (rc *respConn) do(args ...string) (interface{}, error) {
+	rc.send(args...)
+	return rc.reply()
+}
+
+// scanRedis walks every string key of a live server with SCAN, fetching values and
+// TTLs in one pipelined round trip per batch.
+func scanRedis(rc *respConn, match string, fn func(redisString) error) error {
+	cursor := "0"
+	for {
+		res, err := rc.do("SCAN", cursor, "MATCH", match, "COUNT", "1000", "TYPE", "string")
+		if err != nil {
+			return err
+		}
+		parts, ok := res.([]interface{})
+		if !ok || len(parts) != 2 {
+			return fmt.Errorf("redis: unexpected SCAN reply %v", res)
+		}
+		cursor, _ = parts[0].(string)
+		keys, _ := parts[1].([]interface{})
+
+		for _, k := range keys {
+			rc.send("GET", k.(string))
+			rc.send("PTTL", k.(string))
+		}
+		for _, k := range keys {
+			v, getErr := rc.reply()
+			ttl, err := rc.reply()
+			if err != nil {
+				return err
+			}
+			if getErr == errRedisNil {
+				continue // expired or deleted since SCAN saw it
+			} else if getErr != nil {
+				return getErr
+			}
+
+			s := redisString{key: k.(string), value: v.(string)}
+			if ms, _ := ttl.(int64); ms > 0 {
+				s.expireAt = time.Now().Add(time.Duration(ms) * time.Millisecond)
+			}
+			if err := fn(s); err != nil {
+				return err
+			}
+		}
+
+		if cursor == "0" {
+			return nil
+		}
+	}
+}
+
+// cmdImportRedis copies string keys from an rdb file or a running redis. gocask has
+// no expiry of its own, so keys already expired are skipped and other TTLs are dropped.
+func cmdImportRedis(args []string) error {
+	c := newCommand("import-redis", "")
+	rdb := c.fs.String("rdb", "", "read this rdb dump file")
+	addr := c.fs.String("addr", "", "SCAN a running redis at host:port instead")
+	password := c.fs.String("password", "", "AUTH password for --addr")
+	db := c.fs.Uint("db", 0, "redis database number to import")
+	match := c.fs.String("match", "*", "only import keys matching this redis glob (--addr only)")
+	onConflict := addConflictFlag(c.fs)
+	if err := c.parse(args, 0, 0); err != nil {
+		return err
+	}
+	if err := checkConflictFlag(*onConflict); err != nil {
+		return err
+	}
+	if (*rdb == "") == (*addr == "") {
+		return fmt.Errorf("give exactly one of --rdb or --addr")
+	}
+
+	var rdbFile *os.File
+	var rc *respConn
+	if *rdb != "" {
+		f, err := os.Open(*rdb)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		rdbFile = f
+	} else {
+		conn, err := dialRedis(*addr)
+		if err != nil {
+			return err
+		}
+		defer conn.c.Close()
+		rc = conn
+		if *password != "" {
+			if _, err := rc.do("AUTH", *password); err != nil {
+				return err
+			}
+		}
+		if _, err := rc.do("SELECT", strconv.FormatUint(uint64(*db), 10)); err != nil {
+			return err
+		}
+	}
+
+	s, err := c.open()
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	im := &importer{s: s, onConflict: *onConflict}
+	expired, droppedTTL, skipped := 0, 0, 0
+	err = im.run(func(fn func(importRecord) error) error {
+		expired, droppedTTL = 0, 0
+		put := func(rs redisString) error {
+			if !rs.expireAt.IsZero() {
+				if rs.expireAt.Before(time.Now()) {
+					expired++
+					return nil
+				}
+				droppedTTL++
+			}
+			return fn(importRecord{key: rs.key, value: rs.value})
+		}
+		if rdbFile == nil {
+			return scanRedis(rc, *match, put)
+		}
+		if _, err := rdbFile.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		fi, err := rdbFile.Stat()
+		if err != nil {
+			return err
+		}
+		skipped, err = readRDB(rdbFile, fi.Size(), uint64(*db), put)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if skipped > 0 {
+		fmt.Fprintf(os.Stderr, "skipped %d keys that aren't strings\n", skipped)
+	}
+
+	im.report()
+	if expired > 0 || droppedTTL > 0 {
+		fmt.Fprintf(os.Stderr, "skipped %d expired keys, imported %d keys without their TTL\n", expired, droppedTTL)
+	}
+	return nil
+}
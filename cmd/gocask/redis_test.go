@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// rdbString encodes s as an rdb string of up to 63 bytes.
+func rdbString(s string) []byte {
+	return append([]byte{byte(len(s))}, s...)
+}
+
+// rdbFile is an rdb file of database 0 holding body, records following one another.
+func rdbFile(body ...[]byte) []byte {
+	b := []byte("REDIS0011")
+	b = append(b, rdbOpAux)
+	b = append(b, rdbString("redis-ver")...)
+	b = append(b, rdbString("7.2.0")...)
+	b = append(b, rdbOpSelectDB, 0, rdbOpResizeDB, 3, 1)
+	for _, p := range body {
+		b = append(b, p...)
+	}
+	b = append(b, rdbOpEOF)
+	return append(b, make([]byte, 8)...) // the checksum, which isn't verified
+}
+
+// testRDB holds a string with a ttl, an int-encoded and an LZF-compressed one, and
+// a set to skip.
+func testRDB() []byte {
+	expire := binary.LittleEndian.AppendUint64([]byte{rdbOpExpireTimeMs}, uint64(time.Date(2100, 1, 1, 0, 0, 0, 0, time.UTC).UnixMilli()))
+	return rdbFile(
+		expire, []byte{rdbTypeString}, rdbString("k1"), rdbString("v1"),
+		[]byte{rdbTypeString}, rdbString("k2"), []byte{0xc0 | rdbEncInt8, 42},
+		// "a" and then a back reference copying it 9 times
+		[]byte{rdbTypeString}, rdbString("k3"), []byte{0xc0 | rdbEncLZF, 5, 10, 0x00, 'a', 0xe0, 0x00, 0x00},
+		[]byte{rdbTypeSet}, rdbString("s"), []byte{1}, rdbString("m"),
+	)
+}
+
+func readTestRDB(data []byte) (got []string, skipped int, err error) {
+	skipped, err = readRDB(bytes.NewReader(data), int64(len(data)), 0, func(rs redisString) error {
+		got = append(got, fmt.Sprintf("%s=%s", rs.key, rs.value))
+		return nil
+	})
+	return got, skipped, err
+}
+
+func TestReadRDB(t *testing.T) {
+	got, skipped, err := readTestRDB(testRDB())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(got) != "[k1=v1 k2=42 k3=aaaaaaaaaa]" || skipped != 1 {
+		t.Errorf("read %v and skipped %d", got, skipped)
+	}
+}
+
+func TestReadRDBCorrupt(t *testing.T) {
+	key := func(typ byte, k string) []byte { return append([]byte{typ}, rdbString(k)...) }
+	for _, tc := range []struct {
+		name string
+		data []byte
+	}{
+		{"truncated", testRDB()[:40]},
+		{"string past the end", rdbFile(key(rdbTypeString, "k"), []byte{5, 'a', 'b'})},
+		{"32-bit length past the end", rdbFile(key(rdbTypeString, "k"), []byte{0x80, 0xff, 0xff, 0xff, 0xff})},
+		{"64-bit length past the end", rdbFile(key(rdbTypeString, "k"), []byte{0x81, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff})},
+		{"lzf input past the end", rdbFile(key(rdbTypeString, "k"), []byte{0xc0 | rdbEncLZF, 0x80, 0x7f, 0xff, 0xff, 0xff, 10})},
+		{"lzf output too big for its input", rdbFile(key(rdbTypeString, "k"), []byte{0xc0 | rdbEncLZF, 2, 0x80, 0x7f, 0xff, 0xff, 0xff, 0x00, 'a'})},
+		{"zset score past the end", rdbFile(key(rdbTypeZset, "z"), []byte{1}, rdbString("m"), []byte{200, '1'})},
+		{"many members", rdbFile(key(rdbTypeList, "l"), []byte{0x81, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, rdbString("m"))},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, _, err := readTestRDB(tc.data); err == nil {
+				t.Error("no error")
+			}
+		})
+	}
+
+	// a length the file can't hold is refused before anything is allocated for it
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_, _, err := readTestRDB(rdbFile(key(rdbTypeString, "k"), []byte{0x80, 0x7f, 0xff, 0xff, 0xff}))
+	runtime.ReadMemStats(&after)
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("got %v, want io.ErrUnexpectedEOF", err)
+	}
+	if n := after.TotalAlloc - before.TotalAlloc; n > 1<<20 {
+		t.Errorf("allocated %d bytes for a 2GB string", n)
+	}
+}
+
+// FuzzReadRDB reads data as an rdb file, which must neither panic nor allocate more
+// than the file could hold.
+func FuzzReadRDB(f *testing.F) {
+	f.Add(testRDB())
+	f.Add(rdbFile([]byte{rdbTypeString}, rdbString("k"), []byte{0x81, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		got, _, err := readTestRDB(data)
+		size := 0
+		for _, kv := range got {
+			size += len(kv)
+		}
+		if err == nil && size > len(data)*lzfMaxExpansion {
+			t.Fatalf("read %d bytes of keys and values out of %d", size, len(data))
+		}
+	})
+}
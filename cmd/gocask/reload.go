@@ -0,0 +1,204 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// reloadable are the settings serve applies again, from its config file and the
+// environment, on SIGHUP or a POST to /-/reload on the admin listener. They only
+// change how the open stores are tuned and the tokens the listeners check; the rest,
+// such as --dir, the feeds and the listeners' addresses, need a restart. Mounted
+// stores have theirs reloaded with their config files, but mounting or unmounting a
+// store is a restart too.
+var reloadable = map[string]bool{
+	"log-level":     true,
+	"merge-policy":  true,
+	"merge-window":  true,
+	"default-ttl":   true,
+	"retention":     true,
+	"quota":         true,
+	"max-keys":      true,
+	"max-data-size": true,
+	"eviction":      true,
+	"cache-size":    true,
+	"read-ahead":    true,
+	"http-token":    true,
+	"admin-token":   true,
+	"redis-token":   true,
+	"grpc-token":    true,
+}
+
+// listenerTokens are the tokens serve's listeners check; the admin one also guards
+// --backup-addr.
+type listenerTokens struct {
+	http, admin, redis, grpc *bearerToken
+}
+
+// set makes the tokens those of c.
+func (t listenerTokens) set(c *serveCommand) {
+	t.http.set(*c.httpToken)
+	t.admin.set(*c.admin.token)
+	t.redis.set(*c.redisToken)
+	t.grpc.set(*c.grpcToken)
+}
+
+// reloader reloads serve's settings.
+type reloader struct {
+	mu      sync.Mutex
+	args    []string      // the command line, whose flags keep overriding the file
+	config  string        // absolute path of the config file, "" if there is none
+	started *serveCommand // the settings serve started with
+	current *serveCommand // those it runs with now
+	stores  []*store      // the stores serve has open
+	tokens  listenerTokens
+}
+
+// newReloader returns a reloader for the settings c was parsed from args with.
+func newReloader(c *serveCommand, args []string) (*reloader, error) {
+	r := &reloader{args: args, started: c, current: c, tokens: listenerTokens{
+		http:  newBearerToken(*c.httpToken),
+		admin: newBearerToken(*c.admin.token),
+		redis: newBearerToken(*c.redisToken),
+		grpc:  newBearerToken(*c.grpcToken),
+	}}
+	if r.config = *c.config; r.config == "" {
+		r.config = os.Getenv(configEnv)
+	}
+	if r.config != "" {
+		var err error
+		if r.config, err = filepath.Abs(r.config); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// reload reads the settings again and applies the reloadable ones that changed,
+// which it returns. If any setting is invalid, none is applied. Changes to the
+// others are logged and left for a restart.
+func (r *reloader) reload() ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	n := newServeCommand()
+	n.fs.Parse(r.args)
+	*n.config = r.config
+	if _, err := n.configure(); err != nil {
+		return nil, err
+	}
+	level, err := parseLogLevel(*n.logLevel)
+	if err != nil {
+		return nil, err
+	}
+	if err := n.parseStoreSettings(); err != nil {
+		return nil, err
+	}
+	if err := loadMounts(n.command, n.mounts); err != nil {
+		return nil, err
+	}
+	if err := n.checkTokens(); err != nil {
+		return nil, err
+	}
+
+	var changed, restart []string
+	for name := range r.differs(r.current, n) {
+		if reloadable[name] {
+			changed = append(changed, name)
+		}
+	}
+	for name := range r.differs(r.started, n) {
+		if !reloadable[name] {
+			restart = append(restart, name)
+		}
+	}
+	if len(restart) > 0 {
+		sort.Strings(restart)
+		logger.Warn("changed settings need a restart", "settings", strings.Join(restart, ","))
+	}
+	if len(changed) == 0 {
+		return nil, nil
+	}
+	sort.Strings(changed)
+
+	// the store settings that need a restart stay as serve started with them
+	*n.chunkSize, n.mode = *r.started.chunkSize, r.started.mode
+	logLevel.Set(level)
+	for _, s := range r.stores {
+		if err := n.applyTo(s); err != nil {
+			// parseStoreSettings and loadMounts checked them already
+			logger.Error("reload settings", "dir", s.Path(), "err", err)
+		}
+	}
+	r.tokens.set(n)
+	r.current = n
+	logger.Info("reloaded settings", "changed", strings.Join(changed, ","))
+	return changed, nil
+}
+
+// differs returns the settings whose values differ between a and b, those of the
+// stores they mount included.
+func (r *reloader) differs(a, b *serveCommand) map[string]bool {
+	names := a.command.differs(b.command)
+	restart, settings := mountsDiffer(a.mounts, b.mounts)
+	for name := range settings {
+		names[name] = true
+	}
+	if restart {
+		names["mount"] = true
+	}
+	return names
+}
+
+// differs returns the flags whose values differ between a and b, which have the
+// same flags.
+func (a *command) differs(b *command) map[string]bool {
+	names := make(map[string]bool)
+	a.fs.VisitAll(func(f *flag.Flag) {
+		// the same file, made absolute
+		if f.Name == "config" {
+			return
+		}
+		if f.Value.String() != b.fs.Lookup(f.Name).Value.String() {
+			names[f.Name] = true
+		}
+	})
+	// repeatable flags don't print their values
+	if !reflect.DeepEqual(a.retention, b.retention) {
+		names["retention"] = true
+	}
+	if !reflect.DeepEqual(a.quotas, b.quotas) {
+		names["quota"] = true
+	}
+	if !reflect.DeepEqual(a.windows, b.windows) {
+		names["merge-window"] = true
+	}
+	return names
+}
+
+// serveReload reloads the settings on a POST and lists those that changed.
+func (r *reloader) serveReload(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "reload with a POST", http.StatusMethodNotAllowed)
+		return
+	}
+	changed, err := r.reload()
+	if err != nil {
+		logger.Error("reload failed, keeping the settings", "err", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(changed) == 0 {
+		fmt.Fprintln(w, "no settings changed")
+		return
+	}
+	fmt.Fprintf(w, "changed %s\n", strings.Join(changed, ", "))
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/itsknk/gocask"
+	"github.com/nats-io/nats.go"
+	"github.com/segmentio/kafka-go"
+)
+
+type natsSource struct {
+	nc      *nats.Conn
+	subject string
+	done    chan struct{}
+}
+
+func (s *natsSource) Run(handle func(payload []byte) error) error {
+	sub, err := s.nc.Subscribe(s.subject, func(m *nats.Msg) {
+		if err := handle(m.Data); err != nil {
+			logger.Error("replication apply failed", "err", err)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	<-s.done
+	return sub.Unsubscribe()
+}
+
+func (s *natsSource) Close() error {
+	close(s.done)
+	s.nc.Close()
+	return nil
+}
+
+// kafkaSource reads with a per-node consumer group and commits only what was applied.
+type kafkaSource struct {
+	r      *kafka.Reader
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func (s *kafkaSource) Run(handle func(payload []byte) error) error {
+	for {
+		m, err := s.r.FetchMessage(s.ctx)
+		if err != nil {
+			if s.ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		for {
+			err := handle(m.Value)
+			if err == nil {
+				break
+			}
+			logger.Warn("replication apply failed, retrying", "err", err)
+			select {
+			case <-s.ctx.Done():
+				return nil
+			case <-time.After(time.Second):
+			}
+		}
+		if err := s.r.CommitMessages(s.ctx, m); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *kafkaSource) Close() error {
+	s.cancel()
+	return s.r.Close()
+}
+
+// openSource takes the same urls as openSink. Kafka sources read as consumer group
+// group, from the start of the topic or, with latest, only what is published from now on.
+func openSource(target, group string, latest bool) (gocask.Source, error) {
+	scheme, rest, ok := strings.Cut(target, "://")
+	if !ok {
+		return nil, fmt.Errorf("source %q: missing scheme", target)
+	}
+	hosts, name, _ := strings.Cut(rest, "/")
+	if hosts == "" || name == "" {
+		return nil, fmt.Errorf("source %q: want %s://host/name", target, scheme)
+	}
+
+	switch scheme {
+	case "nats":
+		nc, err := nats.Connect("nats://"+hosts, nats.Name("gocask-replication"))
+		if err != nil {
+			return nil, fmt.Errorf("connect nats: %w", err)
+		}
+		return &natsSource{nc: nc, subject: name, done: make(chan struct{})}, nil
+	case "kafka":
+		ctx, cancel := context.WithCancel(context.Background())
+		cfg := kafka.ReaderConfig{
+			Brokers: strings.Split(hosts, ","),
+			Topic:   name,
+			GroupID: group,
+		}
+		if latest {
+			cfg.StartOffset = kafka.LastOffset
+		}
+		r := kafka.NewReader(cfg)
+		return &kafkaSource{r: r, ctx: ctx, cancel: cancel}, nil
+	default:
+		return nil, fmt.Errorf("source %q: unknown scheme %q", target, scheme)
+	}
+}
@@ -0,0 +1,500 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/itsknk/gocask"
+)
+
+// serve --redis-addr speaks the redis protocol, RESP, so redis-cli and redis client
+// libraries can use a store: GET, SET (with EX, PX, NX and XX), DEL, EXISTS, KEYS,
+// TTL, PTTL and DBSIZE, plus PING, ECHO, SELECT and QUIT. SELECT n picks the nth of
+// the stores serve has, the one in --dir first and then the mounts in order. Keys
+// under __gocask/ are gocask's own: commands naming one get an error, and KEYS
+// leaves them out. With --redis-token a client must AUTH with it before anything but
+// QUIT, which --redis-addr can do without only on a loopback address. The audit log
+// attributes the writes of a client to "redis:" and its address. Each
+// connection runs on its own goroutine and each command locks the store like any
+// other read or write, so clients, the library and the other listeners can share a
+// store.
+
+// respServer accepts redis connections until it is closed.
+type respServer struct {
+	ln     net.Listener
+	stores []*store
+	token  *bearerToken // what clients AUTH with, "" if they needn't
+	wg     sync.WaitGroup
+
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+}
+
+// listenRESP serves stores to redis clients on addr, to those that AUTH with token
+// if it isn't "".
+func listenRESP(addr string, stores []*store, token *bearerToken) (*respServer, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	srv := &respServer{ln: ln, stores: stores, token: token, conns: make(map[net.Conn]struct{})}
+	srv.wg.Add(1)
+	go srv.accept()
+	return srv, nil
+}
+
+func (srv *respServer) accept() {
+	defer srv.wg.Done()
+	for {
+		c, err := srv.ln.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				logger.Error("redis server stopped", "err", err)
+			}
+			return
+		}
+		srv.mu.Lock()
+		srv.conns[c] = struct{}{}
+		srv.mu.Unlock()
+		srv.wg.Add(1)
+		go func() {
+			defer srv.wg.Done()
+			defer func() {
+				srv.mu.Lock()
+				delete(srv.conns, c)
+				srv.mu.Unlock()
+				c.Close()
+			}()
+			// a bug one client runs into drops that client, not the process
+			defer func() {
+				if p := recover(); p != nil {
+					logger.Error("redis connection failed", "remote", c.RemoteAddr().String(), "panic", p)
+				}
+			}()
+			srv.serveConn(c)
+		}()
+	}
+}
+
+// Close stops accepting, drops the open connections and waits for their commands
+// to finish.
+func (srv *respServer) Close() error {
+	err := srv.ln.Close()
+	srv.mu.Lock()
+	for c := range srv.conns {
+		c.Close()
+	}
+	srv.mu.Unlock()
+	srv.wg.Wait()
+	return err
+}
+
+// serveConn runs the commands of one client until it quits, goes away or breaks
+// the protocol, after which the rest of what it sent can't be made sense of.
+func (srv *respServer) serveConn(c net.Conn) {
+	rc := &respConn{c: c, r: bufio.NewReader(c), w: bufio.NewWriter(c)}
+	rc.ctx = gocask.ContextWithActor(context.Background(), "redis:"+c.RemoteAddr().String())
+	s := srv.stores[0]
+	authed := srv.token.get() == ""
+	for {
+		// pipelined commands are answered together, once none are left to read
+		if rc.r.Buffered() == 0 {
+			if err := rc.w.Flush(); err != nil {
+				return
+			}
+		}
+		args, err := readRequest(rc.r)
+		var perr respProtocolError
+		if errors.As(err, &perr) {
+			rc.writeError("ERR Protocol error: " + perr.Error())
+			rc.w.Flush()
+			return
+		} else if err != nil {
+			return
+		}
+		if len(args) == 0 {
+			continue // redis skips empty arrays too
+		}
+		cmd := strings.ToUpper(args[0])
+		if !authed && cmd != "AUTH" && cmd != "QUIT" {
+			rc.writeError("NOAUTH Authentication required.")
+			continue
+		}
+		switch cmd {
+		case "QUIT":
+			rc.writeSimple("OK")
+			rc.w.Flush()
+			return
+		case "AUTH":
+			authed = srv.auth(rc, args) || authed
+		case "SELECT":
+			n, err := strconv.Atoi(argAt(args, 1))
+			switch {
+			case len(args) != 2:
+				rc.writeError("ERR wrong number of arguments for 'select' command")
+			case err != nil || n < 0 || n >= len(srv.stores):
+				rc.writeError(fmt.Sprintf("ERR DB index is out of range, there are %d stores", len(srv.stores)))
+			default:
+				s = srv.stores[n]
+				rc.writeSimple("OK")
+			}
+		default:
+			s.runRESP(rc, args)
+		}
+	}
+}
+
+// auth runs AUTH [username] password, where the password is the token and the only
+// user is redis's default one, and reports whether it was the right one.
+func (srv *respServer) auth(rc *respConn, args []string) bool {
+	switch {
+	case len(args) < 2 || len(args) > 3:
+		rc.writeError("ERR wrong number of arguments for 'auth' command")
+	case srv.token.get() == "":
+		rc.writeError("ERR AUTH <password> called without any password configured for the default user. Are you sure your configuration is correct?")
+	case len(args) == 3 && args[1] != "default", !srv.token.matches(args[len(args)-1]):
+		rc.writeError("WRONGPASS invalid username-password pair or user is disabled.")
+	default:
+		rc.writeSimple("OK")
+		return true
+	}
+	return false
+}
+
+// respMaxLine bounds the lines of a request, the array and bulk string lengths,
+// which need a handful of bytes. It is bufio's default buffer size, so a longer
+// line is one ReadSlice can't return.
+const respMaxLine = 4096
+
+// respProtocolError is a request that doesn't follow the protocol.
+type respProtocolError string
+
+func (e respProtocolError) Error() string { return string(e) }
+
+// readRequest reads the arguments of one command. Clients send commands as arrays
+// of bulk strings, and nothing else is taken: not nested arrays, not negative or
+// oversized lengths, not lines longer than respMaxLine. The client's lengths aren't
+// trusted to size buffers up front either, a bulk string only grows as its bytes
+// arrive. respConn.reply parses replies, from a server the user picked; requests
+// come from anyone who can connect.
+func readRequest(r *bufio.Reader) ([]string, error) {
+	line, err := readRESPLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if line[0] != '*' {
+		return nil, respProtocolError(fmt.Sprintf("expected '*', got '%c'", line[0]))
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n > respMaxArray {
+		return nil, respProtocolError("invalid multibulk length")
+	}
+	if n <= 0 {
+		return nil, nil
+	}
+	args := make([]string, 0, min(n, 64))
+	for i := 0; i < n; i++ {
+		line, err := readRESPLine(r)
+		if err != nil {
+			return nil, eofIsUnexpected(err)
+		}
+		if line[0] != '$' {
+			return nil, respProtocolError(fmt.Sprintf("expected '$', got '%c'", line[0]))
+		}
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 || size > respMaxBulk {
+			return nil, respProtocolError("invalid bulk length")
+		}
+		var b strings.Builder
+		if _, err := io.CopyN(&b, r, int64(size)); err != nil {
+			return nil, eofIsUnexpected(err)
+		}
+		var crlf [2]byte
+		if _, err := io.ReadFull(r, crlf[:]); err != nil {
+			return nil, eofIsUnexpected(err)
+		}
+		if crlf != [2]byte{'\r', '\n'} {
+			return nil, respProtocolError("bulk string doesn't end in CRLF")
+		}
+		args = append(args, b.String())
+	}
+	return args, nil
+}
+
+// readRESPLine reads a line of a request, without its CRLF.
+func readRESPLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return "", respProtocolError("too big line")
+	} else if err != nil {
+		return "", err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return "", respProtocolError("line doesn't end in CRLF")
+	}
+	return string(line[:len(line)-2]), nil
+}
+
+// eofIsUnexpected turns the io.EOF of a read that stopped part way into
+// io.ErrUnexpectedEOF.
+func eofIsUnexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// argAt is args[i], or "" if there are fewer.
+func argAt(args []string, i int) string {
+	if i < len(args) {
+		return args[i]
+	}
+	return ""
+}
+
+// runRESP runs one command against s and writes its reply.
+func (s *store) runRESP(rc *respConn, args []string) {
+	name := strings.ToLower(args[0])
+	arity := func(min, max int) bool {
+		if len(args) < min || (max > 0 && len(args) > max) {
+			rc.writeError(fmt.Sprintf("ERR wrong number of arguments for '%s' command", name))
+			return false
+		}
+		return true
+	}
+	switch name {
+	case "ping":
+		if !arity(1, 2) {
+			return
+		}
+		if len(args) == 2 {
+			rc.writeBulk(args[1])
+		} else {
+			rc.writeSimple("PONG")
+		}
+
+	case "echo":
+		if arity(2, 2) {
+			rc.writeBulk(args[1])
+		}
+
+	case "command":
+		// redis-cli asks for the command docs on connect; it copes without them
+		rc.writeArray(0)
+
+	case "get":
+		if !arity(2, 2) {
+			return
+		}
+		v, err := s.Get(args[1])
+		switch {
+		case errors.Is(err, gocask.ErrNotFound):
+			rc.writeNil()
+		case err != nil:
+			rc.writeStoreError(err)
+		default:
+			rc.writeBulk(v)
+		}
+
+	case "set":
+		if !arity(3, 0) {
+			return
+		}
+		s.respSet(rc, args[1], args[2], args[3:])
+
+	case "exists":
+		if !arity(2, 0) {
+			return
+		}
+		n := 0
+		var err error
+		for _, k := range args[1:] {
+			var found bool
+			if found, err = respExists(s.DB, k); err != nil {
+				break
+			} else if found {
+				n++
+			}
+		}
+		if err != nil {
+			rc.writeStoreError(err)
+		} else {
+			rc.writeInt(int64(n))
+		}
+
+	case "del":
+		if !arity(2, 0) {
+			return
+		}
+		n := 0
+		err := s.Exclusive(func(tx *gocask.DB) error {
+			for _, k := range args[1:] {
+				if found, err := respExists(tx, k); err != nil {
+					return err
+				} else if !found {
+					continue
+				}
+				if err := tx.DeleteContext(rc.ctx, k); err != nil {
+					return err
+				}
+				n++
+			}
+			return nil
+		})
+		if err != nil {
+			rc.writeStoreError(err)
+		} else {
+			rc.writeInt(int64(n))
+		}
+
+	case "keys":
+		if !arity(2, 2) {
+			return
+		}
+		match := func(k string) bool { return k == args[1] }
+		if strings.ContainsAny(args[1], "*?[") {
+			m, err := keyMatcher(args[1:])
+			if err != nil {
+				rc.writeError("ERR " + err.Error())
+				return
+			}
+			match = m
+		}
+		keys := keys(s.DB, match)
+		rc.writeArray(len(keys))
+		for _, k := range keys {
+			rc.writeBulk(k)
+		}
+
+	case "dbsize":
+		if !arity(1, 1) {
+			return
+		}
+		rc.writeInt(int64(len(s.Keys())))
+
+	case "ttl", "pttl":
+		if !arity(2, 2) {
+			return
+		}
+		ttl, has, err := s.TTL(args[1])
+		switch {
+		case errors.Is(err, gocask.ErrNotFound):
+			rc.writeInt(-2)
+		case err != nil:
+			rc.writeStoreError(err)
+		case !has:
+			rc.writeInt(-1)
+		case name == "ttl":
+			rc.writeInt(int64((ttl + time.Second/2) / time.Second))
+		default:
+			rc.writeInt(ttl.Milliseconds())
+		}
+
+	default:
+		rc.writeError(fmt.Sprintf("ERR unknown command '%s'", args[0]))
+	}
+}
+
+// respSet is SET key value [EX seconds|PX milliseconds] [NX|XX].
+func (s *store) respSet(rc *respConn, key, value string, opts []string) {
+	var ttl time.Duration
+	var nx, xx bool
+	for i := 0; i < len(opts); i++ {
+		switch o := strings.ToUpper(opts[i]); o {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "EX", "PX":
+			if i+1 == len(opts) || ttl != 0 {
+				rc.writeError("ERR syntax error")
+				return
+			}
+			i++
+			n, err := strconv.ParseInt(opts[i], 10, 64)
+			if err != nil || n <= 0 {
+				rc.writeError("ERR invalid expire time in 'set' command")
+				return
+			}
+			ttl = time.Duration(n) * time.Millisecond
+			if o == "EX" {
+				ttl = time.Duration(n) * time.Second
+			}
+		default:
+			rc.writeError("ERR syntax error")
+			return
+		}
+	}
+	if nx && xx {
+		rc.writeError("ERR syntax error")
+		return
+	}
+
+	skipped := false
+	err := s.Exclusive(func(tx *gocask.DB) error {
+		if nx || xx {
+			found, err := respExists(tx, key)
+			if err != nil {
+				return err
+			}
+			if found == nx {
+				skipped = true
+				return nil
+			}
+		}
+		if ttl > 0 {
+			return tx.PutWithTTLContext(rc.ctx, key, value, ttl)
+		}
+		return tx.PutContext(rc.ctx, key, value)
+	})
+	switch {
+	case err != nil:
+		rc.writeStoreError(err)
+	case skipped:
+		rc.writeNil()
+	default:
+		rc.writeSimple("OK")
+	}
+}
+
+// respExists reports whether key is set in db and hasn't expired.
+func respExists(db *gocask.DB, key string) (bool, error) {
+	_, _, err := db.TTL(key)
+	if errors.Is(err, gocask.ErrNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (rc *respConn) writeSimple(s string) { fmt.Fprintf(rc.w, "+%s\r\n", s) }
+
+// writeError writes msg, which starts with an error code like ERR, as an error reply.
+func (rc *respConn) writeError(msg string) {
+	fmt.Fprintf(rc.w, "-%s\r\n", strings.NewReplacer("\r", " ", "\n", " ").Replace(msg))
+}
+
+// writeStoreError reports a failed store operation, writes refused because the store
+// is read-only as READONLY like a redis replica does.
+func (rc *respConn) writeStoreError(err error) {
+	if errors.Is(err, gocask.ErrOpenedReadOnly) || errors.Is(err, gocask.ErrReadOnly) {
+		rc.writeError("READONLY " + err.Error())
+		return
+	}
+	rc.writeError("ERR " + err.Error())
+}
+
+func (rc *respConn) writeInt(n int64) { fmt.Fprintf(rc.w, ":%d\r\n", n) }
+
+func (rc *respConn) writeBulk(s string) { fmt.Fprintf(rc.w, "$%d\r\n%s\r\n", len(s), s) }
+
+func (rc *respConn) writeNil() { rc.w.WriteString("$-1\r\n") }
+
+func (rc *respConn) writeArray(n int) { fmt.Fprintf(rc.w, "*%d\r\n", n) }
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/itsknk/gocask"
+)
+
+func TestReadRequest(t *testing.T) {
+	for _, tc := range []struct {
+		name, in string
+		want     []string
+	}{
+		{"command", "*2\r\n$3\r\nGET\r\n$1\r\nk\r\n", []string{"GET", "k"}},
+		{"empty bulk string", "*2\r\n$3\r\nSET\r\n$0\r\n\r\n", []string{"SET", ""}},
+		{"CRLF in a bulk string", "*1\r\n$4\r\na\r\nb\r\n", []string{"a\r\nb"}},
+		{"empty array", "*0\r\n", nil},
+		{"null array", "*-1\r\n", nil},
+	} {
+		got, err := readRequest(bufio.NewReader(strings.NewReader(tc.in)))
+		if err != nil || !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %q, %v, want %q", tc.name, got, err, tc.want)
+		}
+	}
+
+	// pipelined requests are read one at a time
+	r := bufio.NewReader(strings.NewReader("*1\r\n$4\r\nPING\r\n*2\r\n$4\r\nECHO\r\n$2\r\nhi\r\n"))
+	for _, want := range [][]string{{"PING"}, {"ECHO", "hi"}} {
+		if got, err := readRequest(r); err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("pipelined: got %q, %v, want %q", got, err, want)
+		}
+	}
+	if _, err := readRequest(r); err != io.EOF {
+		t.Errorf("after the last request: %v, want io.EOF", err)
+	}
+}
+
+func TestReadRequestBad(t *testing.T) {
+	for _, tc := range []struct {
+		name, in string
+		err      string // the protocol error, "" for io.ErrUnexpectedEOF
+	}{
+		// redis takes inline commands too, serve doesn't
+		{"inline command", "PING\r\n", "expected '*', got 'P'"},
+		{"inline command with arguments", "GET k\r\n", "expected '*', got 'G'"},
+		{"nested array", "*1\r\n*1\r\n$1\r\nk\r\n", "expected '$', got '*'"},
+		{"integer argument", "*1\r\n:1\r\n", "expected '$', got ':'"},
+		{"bad array length", "*x\r\n", "invalid multibulk length"},
+		{"array too long", "*1048577\r\n", "invalid multibulk length"},
+		{"negative bulk length", "*1\r\n$-1\r\n", "invalid bulk length"},
+		{"bad bulk length", "*1\r\n$1x\r\nk\r\n", "invalid bulk length"},
+		{"bulk string too long", "*1\r\n$536870913\r\n", "invalid bulk length"},
+		{"bulk string longer than it says", "*1\r\n$1\r\nkk\r\n", "bulk string doesn't end in CRLF"},
+		{"line without CR", "*1\n", "line doesn't end in CRLF"},
+		{"empty line", "\r\n", "line doesn't end in CRLF"},
+		{"line too long", "*" + strings.Repeat("1", respMaxLine) + "\r\n", "too big line"},
+		{"truncated array", "*2\r\n$3\r\nGET\r\n", ""},
+		{"truncated bulk length", "*1\r\n$3", ""},
+		{"truncated bulk string", "*1\r\n$5\r\nab", ""},
+		{"bulk string without its CRLF", "*1\r\n$2\r\nab", ""},
+	} {
+		got, err := readRequest(bufio.NewReader(strings.NewReader(tc.in)))
+		var perr respProtocolError
+		switch {
+		case tc.err == "" && !errors.Is(err, io.ErrUnexpectedEOF):
+			t.Errorf("%s: got %q, %v, want io.ErrUnexpectedEOF", tc.name, got, err)
+		case tc.err != "" && (!errors.As(err, &perr) || perr.Error() != tc.err):
+			t.Errorf("%s: got %q, %v, want protocol error %q", tc.name, got, err, tc.err)
+		}
+	}
+
+	// a bulk string's length doesn't get anything allocated before its bytes arrive
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_, err := readRequest(bufio.NewReader(strings.NewReader("*1\r\n$536870912\r\nab")))
+	runtime.ReadMemStats(&after)
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("truncated 512MB bulk string: %v", err)
+	}
+	if n := after.TotalAlloc - before.TotalAlloc; n > 1<<20 {
+		t.Errorf("allocated %d bytes for a truncated 512MB bulk string", n)
+	}
+}
+
+// An inline command gets a protocol error, after which the connection is closed.
+func TestInlineCommandRefused(t *testing.T) {
+	db, err := gocask.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	srv := &respServer{stores: []*store{{DB: db}}, token: newBearerToken("")}
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer server.Close()
+		srv.serveConn(server)
+	}()
+	go client.Write([]byte("PING\r\n"))
+	reply, err := io.ReadAll(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-done
+	if string(reply) != "-ERR Protocol error: expected '*', got 'P'\r\n" {
+		t.Errorf("reply to an inline command: %q", reply)
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/itsknk/gocask"
+	"github.com/itsknk/gocask/gocaskclient"
+)
+
+// serve --http-addr answers a small REST API for each store, under its mount name
+// like the other listeners:
+//
+//	GET    /keys/<key>            the value, 404 if the key isn't set
+//	PUT    /keys/<key>[?ttl=1h]   set the value to the request body
+//	DELETE /keys/<key>            delete the key
+//	GET    /keys/[?prefix=p]      the live keys, one per line, sorted
+//	POST   /bulk                  apply a batch of puts and deletes, see serveBulk
+//	GET    /stats                 what gocask stats prints
+//	GET    /status                whether it takes writes and how far behind its
+//	                              replication is, as json, see gocaskclient.Status
+//
+// Keys are the rest of the path, slashes included, so they need escaping only
+// where a URL does; those under __gocask/ are gocask's own and refused. With
+// --http-token every request must carry it as a bearer token, which --http-addr
+// can only do without on a loopback address. The audit log attributes the writes
+// of a request to "http:" and the address it came from.
+
+// maxRESTBody bounds the body of a PUT or a bulk request.
+const maxRESTBody = 64 << 20
+
+// restHandler serves the REST API of stores, to requests with token if it isn't "".
+func restHandler(stores []*store, token *bearerToken) http.Handler {
+	mux := http.NewServeMux()
+	for _, s := range stores {
+		mux.HandleFunc(s.route("/keys/"), s.serveKey)
+		mux.HandleFunc(s.route("/bulk"), s.serveBulk)
+		mux.HandleFunc(s.route("/stats"), s.serveStats)
+		mux.HandleFunc(s.route("/status"), s.serveStatus)
+	}
+	return withToken(withActor(mux, "http"), token, "gocask")
+}
+
+// withActor has the writes of each request h serves attributed to proto and the
+// address the request came from, see gocask.ContextWithActor.
+func withActor(h http.Handler, proto string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(w, r.WithContext(gocask.ContextWithActor(r.Context(), proto+":"+r.RemoteAddr)))
+	})
+}
+
+// serveKey gets, sets and deletes the key the path ends in, or lists the keys.
+func (s *store) serveKey(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, s.route("/keys/"))
+	if key == "" {
+		if r.Method != http.MethodGet {
+			http.Error(w, "use GET", http.StatusMethodNotAllowed)
+			return
+		}
+		s.serveKeys(w, r.URL.Query().Get("prefix"))
+		return
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		v, err := s.GetContext(r.Context(), key)
+		if errors.Is(err, gocask.ErrNotFound) {
+			http.Error(w, "key not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), writeErrorStatus(err))
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		io.WriteString(w, v)
+	case http.MethodPut:
+		var ttl time.Duration
+		if t := r.URL.Query().Get("ttl"); t != "" {
+			var err error
+			if ttl, err = time.ParseDuration(t); err != nil || ttl <= 0 {
+				http.Error(w, "ttl must be a positive duration like 90s", http.StatusBadRequest)
+				return
+			}
+		}
+		value, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxRESTBody))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if ttl > 0 {
+			err = s.PutWithTTLContext(r.Context(), key, string(value), ttl)
+		} else {
+			err = s.PutContext(r.Context(), key, string(value))
+		}
+		if err != nil {
+			http.Error(w, err.Error(), writeErrorStatus(err))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		err := s.DeleteContext(r.Context(), key)
+		if err != nil {
+			http.Error(w, err.Error(), writeErrorStatus(err))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "use GET, PUT or DELETE", http.StatusMethodNotAllowed)
+	}
+}
+
+// serveKeys lists the live keys starting with prefix.
+func (s *store) serveKeys(w http.ResponseWriter, prefix string) {
+	keys := keys(s.DB, func(k string) bool { return strings.HasPrefix(k, prefix) })
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, k := range keys {
+		fmt.Fprintln(w, k)
+	}
+}
+
+// bulkOp is one line of a bulk request: a record as gocask export writes it, or a
+// delete of its key.
+type bulkOp struct {
+	exportRecord
+	Delete bool `json:"delete,omitempty"`
+}
+
+// serveBulk applies the json lines of a POST body as one batch: all of them or,
+// if one is malformed or writing fails, none. Lines are records as gocask export
+// writes them, {"key":"k","value":"v"}, or deletes, {"key":"k","delete":true}, so
+// an export can be posted as it is. Metadata and timestamps are ignored.
+func (s *store) serveBulk(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRESTBody))
+	b := s.NewBatch()
+	for n := 1; ; n++ {
+		var op bulkOp
+		if err := dec.Decode(&op); err == io.EOF {
+			break
+		} else if err != nil {
+			http.Error(w, fmt.Sprintf("line %d: %v", n, err), http.StatusBadRequest)
+			return
+		}
+		key, value, err := op.decode()
+		if err == nil && key == "" {
+			err = errors.New("no key")
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("line %d: %v", n, err), http.StatusBadRequest)
+			return
+		}
+		if op.Delete {
+			b.Delete(key)
+		} else {
+			b.Put(key, value)
+		}
+	}
+	n := b.Len()
+	err := b.CommitContext(r.Context())
+	if err != nil && b.Len() > 0 { // still staged, so nothing was written
+		http.Error(w, err.Error(), writeErrorStatus(err))
+		return
+	}
+	if err != nil {
+		// applied, but something after it, such as the changefeed, failed
+		logger.Error("bulk write", "dir", s.Path(), "err", err)
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintf(w, "%d applied\n", n)
+}
+
+// serveStats prints what gocask stats does.
+func (s *store) serveStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "use GET", http.StatusMethodNotAllowed)
+		return
+	}
+	lines, err := s.StatsReport()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, l := range lines {
+		fmt.Fprintln(w, l)
+	}
+}
+
+// serveStatus answers what gocaskclient routes requests by: whether the store
+// takes writes, which makes it a primary, and how far behind its replication is.
+func (s *store) serveStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "use GET", http.StatusMethodNotAllowed)
+		return
+	}
+	st := gocaskclient.Status{Node: s.NodeID(), ReadOnly: s.ReadOnly(), Replicating: s.lag != nil}
+	if s.lag != nil {
+		st.ReplicationLag = s.lag()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(st)
+}
+
+// writeErrorStatus is the status for a read or write that failed with err.
+func writeErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, gocask.ErrOpenedReadOnly), errors.Is(err, gocask.ErrReservedKey):
+		return http.StatusForbidden
+	case errors.Is(err, gocask.ErrReadOnly), gocask.IsDiskFull(err):
+		return http.StatusInsufficientStorage
+	case errors.Is(err, gocask.ErrQuotaExceeded):
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"flag"
+	"time"
+
+	"github.com/itsknk/gocask"
+)
+
+func addPlanFlag(fs *flag.FlagSet) *time.Duration {
+	return fs.Duration("merge-check-interval", time.Minute, "how often to check the --merge-policy triggers, 0 to only merge on active-size")
+}
+
+// startPlanner runs a CompactionPlanner over s every interval, unless that is 0, and
+// returns a func that stops it. It runs even if the policy has no triggers for it, as
+// a reload of serve's settings may add some.
+func startPlanner(s *store, interval time.Duration) func() {
+	if interval <= 0 {
+		return func() {}
+	}
+	stop, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		(&gocask.CompactionPlanner{DB: s.DB, Interval: interval}).Run(stop)
+	}()
+	return func() {
+		close(stop)
+		<-done
+	}
+}
+
+func addSyncFlag(fs *flag.FlagSet) *gocask.SyncPolicy {
+	p := gocask.SyncNever
+	fs.Var(&p, "sync", "when to fsync the active file: always, before each write returns, never, leaving it to the OS, or an interval like 100ms")
+	return &p
+}
+
+func addSweepFlag(fs *flag.FlagSet) *time.Duration {
+	return fs.Duration("sweep-interval", time.Second, "how often to delete a sample of expired keys, 0 to leave them to reads and merges")
+}
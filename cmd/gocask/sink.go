@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/itsknk/gocask"
+	"github.com/nats-io/nats.go"
+	"github.com/segmentio/kafka-go"
+)
+
+// natsSink publishes every event to a single subject.
+type natsSink struct {
+	nc      *nats.Conn
+	subject string
+}
+
+func newNatsSink(url, subject string) (*natsSink, error) {
+	nc, err := nats.Connect(url, nats.Name("gocask-cdc"))
+	if err != nil {
+		return nil, fmt.Errorf("connect nats: %w", err)
+	}
+	return &natsSink{nc: nc, subject: subject}, nil
+}
+
+func (s *natsSink) Publish(key, payload []byte) error { return s.nc.Publish(s.subject, payload) }
+
+func (s *natsSink) Flush() error { return s.nc.Flush() }
+
+func (s *natsSink) Close() error { s.nc.Close(); return nil }
+
+// kafkaSink batches events and writes them in one acknowledged request per Flush.
+// messages are keyed by record key so all events for a key land on one partition, in order.
+type kafkaSink struct {
+	w       *kafka.Writer
+	pending []kafka.Message
+}
+
+func newKafkaSink(brokers []string, topic string) *kafkaSink {
+	return &kafkaSink{w: &kafka.Writer{
+		Addr:         kafka.TCP(brokers...),
+		Topic:        topic,
+		Balancer:     &kafka.Hash{},
+		RequiredAcks: kafka.RequireAll,
+	}}
+}
+
+func (s *kafkaSink) Publish(key, payload []byte) error {
+	s.pending = append(s.pending, kafka.Message{Key: key, Value: payload})
+	return nil
+}
+
+func (s *kafkaSink) Flush() error {
+	if len(s.pending) == 0 {
+		return nil
+	}
+	// on failure the caller republishes from its checkpoint, so drop the batch either way
+	msgs := s.pending
+	s.pending = nil
+	return s.w.WriteMessages(context.Background(), msgs...)
+}
+
+func (s *kafkaSink) Close() error { return s.w.Close() }
+
+// openSink parses a sink url: nats://host:4222/subject or kafka://broker1:9092,broker2:9092/topic
+func openSink(target string) (gocask.Sink, error) {
+	scheme, rest, ok := strings.Cut(target, "://")
+	if !ok {
+		return nil, fmt.Errorf("sink %q: missing scheme", target)
+	}
+	hosts, name, _ := strings.Cut(rest, "/")
+	if hosts == "" || name == "" {
+		return nil, fmt.Errorf("sink %q: want %s://host/name", target, scheme)
+	}
+
+	switch scheme {
+	case "nats":
+		return newNatsSink("nats://"+hosts, name)
+	case "kafka":
+		return newKafkaSink(strings.Split(hosts, ","), name), nil
+	default:
+		return nil, fmt.Errorf("sink %q: unknown scheme %q", target, scheme)
+	}
+}
+
+func changeEncoder(format string) (func(gocask.Change) []byte, error) {
+	switch format {
+	case "json":
+		return gocask.EncodeChangeJSON, nil
+	case "avro":
+		return gocask.EncodeChangeAvro, nil
+	default:
+		return nil, fmt.Errorf("unknown sink format %q (want json or avro)", format)
+	}
+}
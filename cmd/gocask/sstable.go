@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/itsknk/gocask"
+)
+
+// cmdExportSST writes every live key into a new snapshot directory.
+func cmdExportSST(args []string) error {
+	c := newCommand("export-sst", "<dir>")
+	c.addSnapshotFlags()
+	blockSize := c.fs.Int("block-size", gocask.DefaultBlockSize, "bytes of entries per block, the unit a lookup reads")
+	tableSize := c.fs.Int64("table-size", gocask.DefaultTableSize, "bytes per table file")
+	if err := c.parse(args, 1, 1); err != nil {
+		return err
+	}
+	s, err := c.open()
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	n, err := s.WriteSnapshot(c.fs.Arg(0), gocask.SnapshotOptions{BlockSize: *blockSize, TableSize: *tableSize})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "exported %d keys\n", n)
+	return nil
+}
+
+// cmdImportSST loads a snapshot export-sst wrote. Values keep their metadata and
+// expiry; those that expired since the snapshot was taken are skipped.
+func cmdImportSST(args []string) error {
+	c := newCommand("import-sst", "<dir>")
+	onConflict := addConflictFlag(c.fs)
+	bulk := c.fs.Bool("bulk", false, "write everything into one new segment at once, see BulkLoad (needs --on-conflict overwrite, drops metadata and expiries)")
+	if err := c.parse(args, 1, 1); err != nil {
+		return err
+	}
+	if err := checkConflictFlag(*onConflict); err != nil {
+		return err
+	}
+	if *bulk && *onConflict != conflictOverwrite {
+		return fmt.Errorf("--bulk only overwrites, it can't be combined with --on-conflict %s", *onConflict)
+	}
+
+	snap, err := gocask.OpenSnapshot(c.fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer snap.Close()
+
+	s, err := c.open()
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	if *bulk {
+		expiredKeys := 0
+		entries := make(chan gocask.SSTEntry)
+		done := make(chan error, 1)
+		go func() {
+			done <- snap.Range(func(e gocask.SSTEntry) error {
+				entries <- e
+				return nil
+			})
+			close(entries)
+		}()
+		loaded, err := s.BulkLoad(func() (string, string, error) {
+			for e := range entries {
+				if e.Expires != 0 && expired(e.Expires) {
+					expiredKeys++
+					continue
+				}
+				return e.Key, e.Value, nil
+			}
+			if err := <-done; err != nil {
+				return "", "", err
+			}
+			return "", "", io.EOF
+		}, gocask.BulkOptions{Unique: true})
+		for range entries {
+			// let Range finish if the load stopped early
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "imported %d keys, skipped %d expired\n", loaded, expiredKeys)
+		return nil
+	}
+
+	im := &importer{s: s, onConflict: *onConflict}
+	if err := im.run(snapshotSource(snap)); err != nil {
+		return err
+	}
+	im.report()
+	return nil
+}
+
+// snapshotSource is an importSource yielding every entry of snap.
+func snapshotSource(snap *gocask.Snapshot) importSource {
+	return func(fn func(importRecord) error) error {
+		return snap.Range(func(e gocask.SSTEntry) error {
+			err := fn(importRecord{key: e.Key, value: e.Value, meta: e.Meta, expires: e.Expires, ts: e.Timestamp})
+			if err != nil {
+				return fmt.Errorf("%q: %w", e.Key, err)
+			}
+			return nil
+		})
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"time"
+
+	"github.com/itsknk/gocask"
+)
+
+// store is a store a command works on or serve serves.
+type store struct {
+	*gocask.DB
+	name  string               // what serve mounts it as, "" for the store in --dir
+	mount string               // where a --snapshot was unpacked, removed on Close; "" if it wasn't
+	lag   func() time.Duration // how far behind its replication is, nil unless it replicates
+}
+
+// Close closes the store and removes the directory a snapshot was unpacked into.
+func (s *store) Close() error {
+	err := s.DB.Close()
+	if s.mount != "" {
+		s.unmount()
+	}
+	return err
+}
+
+// expired reports whether a value that expires at expires, in unix nanoseconds and
+// 0 for never, has.
+func expired(expires uint64) bool {
+	return expires != 0 && expires <= uint64(time.Now().UnixNano())
+}
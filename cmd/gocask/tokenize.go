@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// tokenize splits a repl line into words. Whitespace separates words unless it is
+// inside double quotes, and both quoted and bare words understand backslash escapes:
+// \\ \" \' \<space> \n \r \t \0 and \xNN for an arbitrary byte. "" is an empty word.
+func tokenize(line string) ([]string, error) {
+	var tokens []string
+	var cur strings.Builder
+	inWord, inQuotes := false, false
+
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case c == '\\':
+			if i+1 >= len(line) {
+				return nil, fmt.Errorf("trailing backslash")
+			}
+			i++
+			switch e := line[i]; e {
+			case '\\', '"', '\'', ' ':
+				cur.WriteByte(e)
+			case 'n':
+				cur.WriteByte('\n')
+			case 'r':
+				cur.WriteByte('\r')
+			case 't':
+				cur.WriteByte('\t')
+			case '0':
+				cur.WriteByte(0)
+			case 'x':
+				if i+2 >= len(line) {
+					return nil, fmt.Errorf("short \\x escape at column %d", i)
+				}
+				b, err := strconv.ParseUint(line[i+1:i+3], 16, 8)
+				if err != nil {
+					return nil, fmt.Errorf("bad \\x escape %q at column %d", line[i-1:i+3], i)
+				}
+				cur.WriteByte(byte(b))
+				i += 2
+			default:
+				return nil, fmt.Errorf("unknown escape \\%c at column %d", e, i)
+			}
+			inWord = true
+		case c == '"':
+			inQuotes = !inQuotes
+			inWord = true
+		case !inQuotes && (c == ' ' || c == '\t' || c == '\n' || c == '\r'):
+			if inWord {
+				tokens = append(tokens, cur.String())
+				cur.Reset()
+				inWord = false
+			}
+		default:
+			cur.WriteByte(c)
+			inWord = true
+		}
+	}
+
+	if inQuotes {
+		return nil, fmt.Errorf("unterminated quote")
+	}
+	if inWord {
+		tokens = append(tokens, cur.String())
+	}
+	return tokens, nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTokenize(t *testing.T) {
+	for _, tc := range []struct {
+		line string
+		want []string
+		err  string // part of the error, "" for none
+	}{
+		{line: "", want: nil},
+		{line: "   ", want: nil},
+		{line: "get foo", want: []string{"get", "foo"}},
+		{line: " \tput  k\r\n v ", want: []string{"put", "k", "v"}},
+		{line: `put "hello world" x`, want: []string{"put", "hello world", "x"}},
+		{line: `put a"b c"d`, want: []string{"put", "ab cd"}},
+		{line: `""`, want: []string{""}},
+		{line: `put k ""`, want: []string{"put", "k", ""}},
+		{line: `'single quotes' stay`, want: []string{"'single", "quotes'", "stay"}},
+		{line: `"a\"b"`, want: []string{`a"b`}},
+		{line: `a\ b c`, want: []string{"a b", "c"}},
+		{line: `\\ \' \"`, want: []string{`\`, "'", `"`}},
+		{line: `"\n\r\t\0"`, want: []string{"\n\r\t\x00"}},
+		{line: `\x41\x7a\xff\x00`, want: []string{"Az\xff\x00"}},
+		{line: `"\x20"`, want: []string{" "}},
+		{line: `"unterminated`, err: "unterminated quote"},
+		{line: `say "a b" "c`, err: "unterminated quote"},
+		{line: `trailing\`, err: "trailing backslash"},
+		{line: `"trailing\`, err: "trailing backslash"},
+		{line: `\x4`, err: "short \\x escape"},
+		{line: `\x`, err: "short \\x escape"},
+		{line: `\xzz`, err: `bad \x escape "\\xzz"`},
+		{line: `\q`, err: `unknown escape \q`},
+	} {
+		got, err := tokenize(tc.line)
+		switch {
+		case tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)):
+			t.Errorf("tokenize(%q) = %q, %v; want an error with %q", tc.line, got, err, tc.err)
+		case tc.err == "" && err != nil:
+			t.Errorf("tokenize(%q): %v", tc.line, err)
+		case tc.err == "" && !reflect.DeepEqual(got, tc.want):
+			t.Errorf("tokenize(%q) = %q, want %q", tc.line, got, tc.want)
+		}
+	}
+}
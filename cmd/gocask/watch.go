@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/itsknk/gocask"
+)
+
+// watchLine formats one change as it is printed by gocask watch.
+func watchLine(c gocask.Change) string {
+	ts := time.Unix(0, int64(c.Timestamp)).UTC().Format(time.RFC3339Nano)
+	if c.Deleted {
+		return fmt.Sprintf("%s node=%d DEL %q", ts, gocask.TimestampNode(c.Timestamp), c.Key)
+	}
+	line := fmt.Sprintf("%s node=%d PUT %q %q", ts, gocask.TimestampNode(c.Timestamp), c.Key, c.Value)
+	if c.Expires != 0 {
+		line += " expires=" + time.Unix(0, int64(c.Expires)).UTC().Format(time.RFC3339)
+	}
+	if len(c.Meta) > 0 {
+		line += fmt.Sprintf(" meta=%q", c.Meta.String())
+	}
+	return line
+}
+
+// cmdWatch prints puts and deletes as they happen, either by following the changefeed
+// journal of a local store or by subscribing to the url a server publishes to.
+func cmdWatch(args []string) error {
+	c := newCommand("watch", "")
+	prefix := c.fs.String("prefix", "", "only show keys starting with this")
+	source := c.fs.String("source", "", "subscribe to a json changefeed at nats://host/subject or kafka://brokers/topic instead of the local journal")
+	since := c.fs.Int64("since", -1, "local journal position to start from, 0 for the beginning (default: only new changes)")
+	if err := c.parse(args, 0, 0); err != nil {
+		return err
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	show := func(ch gocask.Change) {
+		if strings.HasPrefix(string(ch.Key), *prefix) {
+			fmt.Println(watchLine(ch))
+		}
+	}
+
+	if *source != "" {
+		group := fmt.Sprintf("gocask-watch-%d-%d", nodeID, os.Getpid())
+		src, err := openSource(*source, group, true)
+		if err != nil {
+			return err
+		}
+		go func() {
+			<-sig
+			src.Close()
+		}()
+		return src.Run(func(payload []byte) error {
+			ch, err := gocask.DecodeChangeJSON(payload)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "skipped bad event:", err)
+				return nil
+			}
+			show(ch)
+			return nil
+		})
+	}
+
+	// the journal is only ever appended to, following it needs no lock on the store
+	journal := gocask.JournalPath(*c.dir)
+	pos := gocask.Position(*since)
+	if pos < 0 {
+		pos = 0
+		if fi, err := os.Stat(journal); err == nil {
+			pos = gocask.Position(fi.Size())
+		}
+	}
+
+	ticker := time.NewTicker(200 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		// reopen each round: a record still being written ends the stream without
+		// being consumed, and Pos picks it up whole next time
+		stream, err := gocask.ReadJournal(journal, pos)
+		if err != nil {
+			return err
+		}
+		for stream.Next() {
+			show(stream.Change())
+		}
+		pos = stream.Pos()
+		err = stream.Err()
+		stream.Close()
+		if err != nil {
+			return err
+		}
+
+		select {
+		case <-sig:
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
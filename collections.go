@@ -0,0 +1,392 @@
+package gocask
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Hashes, sets and lists are stored as one key per field, member or element, under
+// keys that start with a zero byte, the kind of collection and its name:
+//
+//	hash field   \x00H<name>\x00<field>    → value
+//	set member   \x00S<name>\x00<member>   → ""
+//	list element \x00L<name>\x00<position> → value
+//	list ends    \x00L<name>               → "<head> <tail>"
+//
+// so each kind has its own names, and user keys only collide with them if they start
+// with a zero byte. Keys, Fold and the iterators leave these keys out, collections
+// are read through their own methods; reading a whole hash or set takes its prefix
+// from the sorted key order. Changes are read-modify-writes under the store's mu, and
+// replicate, merge and go into snapshots like any other key. Collections don't take TTLs, but eviction and retention limits can
+// drop parts of them.
+const (
+	collHash = 'H'
+	collSet  = 'S'
+	collList = 'L'
+)
+
+// listMid is where the first element of a list goes, so it can grow either way.
+const listMid = 1 << 62
+
+// collPrefix is what the keys of the members of a collection start with.
+func collPrefix(kind byte, name string) string {
+	return "\x00" + string(kind) + name + "\x00"
+}
+
+func checkCollName(name string) error {
+	if name == "" || strings.IndexByte(name, 0) >= 0 {
+		return fmt.Errorf("collection name %q must be non-empty and free of zero bytes", name)
+	}
+	return nil
+}
+
+// isCollKey reports whether key is one of those collections are stored under.
+func isCollKey(key string) bool {
+	return len(key) >= 2 && key[0] == 0 && (key[1] == collHash || key[1] == collSet || key[1] == collList)
+}
+
+// liveKey reports whether key holds a value, expired or not.
+func liveKey(key string, keyDir *KeyDir) bool {
+	fo, ok := keyDir.Get(key)
+	return ok && !fo.Tombstone()
+}
+
+// collMembers returns the members of a collection, sorted.
+func collMembers(kind byte, name string, keyDir *KeyDir) []string {
+	prefix := collPrefix(kind, name)
+	var members []string
+	for _, key := range keyDir.order.between(prefix, prefixEnd(prefix)) {
+		if liveKey(key, keyDir) {
+			members = append(members, key[len(prefix):])
+		}
+	}
+	return members
+}
+
+// HSet sets field of hash name to value.
+func (db *DB) HSet(name, field, value string) error {
+	defer db.lock()()
+	if err := hset(name, field, value, db.s.f, db.s.w, db.s.keyDir); err != nil {
+		return err
+	}
+	return db.s.rotateIfFull()
+}
+
+// hset is DB.HSet for callers holding the store's mu.
+func hset(name, field, value string, f *os.File, w *bufio.Writer, keyDir *KeyDir) error {
+	if err := checkCollName(name); err != nil {
+		return err
+	}
+	return putAt(collPrefix(collHash, name)+field, value, keyDir.dir.newTimestamp(), 0, nil, f, w, keyDir)
+}
+
+// HGet returns field of hash name.
+func (db *DB) HGet(name, field string) (string, error) {
+	defer db.rlock()()
+	return hget(name, field, db.s.keyDir)
+}
+
+// hget is DB.HGet for callers holding the store's mu.
+func hget(name, field string, keyDir *KeyDir) (string, error) {
+	key := collPrefix(collHash, name) + field
+	if !liveKey(key, keyDir) {
+		return "", fmt.Errorf("%w: hash %q has no field %q", ErrNotFound, name, field)
+	}
+	return get(key, keyDir)
+}
+
+// HDel removes field from hash name, and reports whether it was there.
+func (db *DB) HDel(name, field string) (bool, error) {
+	defer db.lock()()
+	ok, err := hdel(name, field, db.s.f, db.s.w, db.s.keyDir)
+	if err != nil {
+		return ok, err
+	}
+	return ok, db.s.rotateIfFull()
+}
+
+// hdel is DB.HDel for callers holding the store's mu.
+func hdel(name, field string, f *os.File, w *bufio.Writer, keyDir *KeyDir) (bool, error) {
+	key := collPrefix(collHash, name) + field
+	if !liveKey(key, keyDir) {
+		return false, nil
+	}
+	return true, deleteAt(key, keyDir.dir.newTimestamp(), f, w, keyDir)
+}
+
+// HGetAll returns every field of hash name; a hash without fields is empty.
+func (db *DB) HGetAll(name string) (map[string]string, error) {
+	defer db.rlock()()
+	return hgetall(name, db.s.keyDir)
+}
+
+// hgetall is DB.HGetAll for callers holding the store's mu.
+func hgetall(name string, keyDir *KeyDir) (map[string]string, error) {
+	fields := make(map[string]string)
+	for _, field := range collMembers(collHash, name, keyDir) {
+		v, err := get(collPrefix(collHash, name)+field, keyDir)
+		if err != nil {
+			return nil, fmt.Errorf("hash %q field %q: %w", name, field, err)
+		}
+		fields[field] = v
+	}
+	return fields, nil
+}
+
+// SAdd adds member to set name, and reports whether it wasn't there yet.
+func (db *DB) SAdd(name, member string) (bool, error) {
+	defer db.lock()()
+	ok, err := sadd(name, member, db.s.f, db.s.w, db.s.keyDir)
+	if err != nil {
+		return ok, err
+	}
+	return ok, db.s.rotateIfFull()
+}
+
+// sadd is DB.SAdd for callers holding the store's mu.
+func sadd(name, member string, f *os.File, w *bufio.Writer, keyDir *KeyDir) (bool, error) {
+	if err := checkCollName(name); err != nil {
+		return false, err
+	}
+	key := collPrefix(collSet, name) + member
+	if liveKey(key, keyDir) {
+		return false, nil
+	}
+	return true, putAt(key, "", keyDir.dir.newTimestamp(), 0, nil, f, w, keyDir)
+}
+
+// SRem removes member from set name, and reports whether it was there.
+func (db *DB) SRem(name, member string) (bool, error) {
+	defer db.lock()()
+	ok, err := srem(name, member, db.s.f, db.s.w, db.s.keyDir)
+	if err != nil {
+		return ok, err
+	}
+	return ok, db.s.rotateIfFull()
+}
+
+// srem is DB.SRem for callers holding the store's mu.
+func srem(name, member string, f *os.File, w *bufio.Writer, keyDir *KeyDir) (bool, error) {
+	key := collPrefix(collSet, name) + member
+	if !liveKey(key, keyDir) {
+		return false, nil
+	}
+	return true, deleteAt(key, keyDir.dir.newTimestamp(), f, w, keyDir)
+}
+
+// SIsMember reports whether member is in set name.
+func (db *DB) SIsMember(name, member string) bool {
+	defer db.rlock()()
+	return sismember(name, member, db.s.keyDir)
+}
+
+// sismember is DB.SIsMember for callers holding the store's mu.
+func sismember(name, member string, keyDir *KeyDir) bool {
+	return liveKey(collPrefix(collSet, name)+member, keyDir)
+}
+
+// SMembers returns the members of set name, sorted.
+func (db *DB) SMembers(name string) []string {
+	defer db.rlock()()
+	return smembers(name, db.s.keyDir)
+}
+
+// smembers is DB.SMembers for callers holding the store's mu.
+func smembers(name string, keyDir *KeyDir) []string {
+	return collMembers(collSet, name, keyDir)
+}
+
+// listEnds returns the positions of the first and last element of list name, and
+// false if the list is empty.
+func listEnds(name string, keyDir *KeyDir) (head, tail int64, ok bool, err error) {
+	key := listEndsKey(name)
+	if !liveKey(key, keyDir) {
+		return 0, 0, false, nil
+	}
+	v, err := get(key, keyDir)
+	if err != nil {
+		return 0, 0, false, err
+	}
+	if _, err := fmt.Sscanf(v, "%d %d", &head, &tail); err != nil || head > tail {
+		return 0, 0, false, fmt.Errorf("list %q: bad ends %q", name, v)
+	}
+	return head, tail, true, nil
+}
+
+func listEndsKey(name string) string { return "\x00" + string(collList) + name }
+
+func listElement(name string, pos int64) string {
+	return collPrefix(collList, name) + fmt.Sprintf("%020d", pos)
+}
+
+// setListEnds records the ends of list name, deleting the record once it is empty.
+func setListEnds(name string, head, tail int64, f *os.File, w *bufio.Writer, keyDir *KeyDir) error {
+	key := listEndsKey(name)
+	if head > tail {
+		return deleteAt(key, keyDir.dir.newTimestamp(), f, w, keyDir)
+	}
+	return putAt(key, strconv.FormatInt(head, 10)+" "+strconv.FormatInt(tail, 10), keyDir.dir.newTimestamp(), 0, nil, f, w, keyDir)
+}
+
+// LPush adds value to the front of list name, and returns the new length. The element
+// is written before the ends, so a crash in between loses the push but nothing else.
+func (db *DB) LPush(name, value string) (int64, error) {
+	defer db.lock()()
+	n, err := lpush(name, value, db.s.f, db.s.w, db.s.keyDir)
+	if err != nil {
+		return n, err
+	}
+	return n, db.s.rotateIfFull()
+}
+
+// lpush is DB.LPush for callers holding the store's mu.
+func lpush(name, value string, f *os.File, w *bufio.Writer, keyDir *KeyDir) (int64, error) {
+	return listPush(name, value, true, f, w, keyDir)
+}
+
+// RPush adds value to the back of list name, and returns the new length.
+func (db *DB) RPush(name, value string) (int64, error) {
+	defer db.lock()()
+	n, err := rpush(name, value, db.s.f, db.s.w, db.s.keyDir)
+	if err != nil {
+		return n, err
+	}
+	return n, db.s.rotateIfFull()
+}
+
+// rpush is DB.RPush for callers holding the store's mu.
+func rpush(name, value string, f *os.File, w *bufio.Writer, keyDir *KeyDir) (int64, error) {
+	return listPush(name, value, false, f, w, keyDir)
+}
+
+func listPush(name, value string, front bool, f *os.File, w *bufio.Writer, keyDir *KeyDir) (int64, error) {
+	if err := checkCollName(name); err != nil {
+		return 0, err
+	}
+	head, tail, ok, err := listEnds(name, keyDir)
+	if err != nil {
+		return 0, err
+	}
+	pos := int64(listMid)
+	switch {
+	case !ok:
+		head, tail = pos, pos
+	case front:
+		head--
+		pos = head
+	default:
+		tail++
+		pos = tail
+	}
+	if err := putAt(listElement(name, pos), value, keyDir.dir.newTimestamp(), 0, nil, f, w, keyDir); err != nil {
+		return 0, err
+	}
+	return tail - head + 1, setListEnds(name, head, tail, f, w, keyDir)
+}
+
+// LPop removes and returns the first element of list name, and false if it is empty.
+func (db *DB) LPop(name string) (string, bool, error) {
+	defer db.lock()()
+	v, ok, err := lpop(name, db.s.f, db.s.w, db.s.keyDir)
+	if err != nil {
+		return v, ok, err
+	}
+	return v, ok, db.s.rotateIfFull()
+}
+
+// lpop is DB.LPop for callers holding the store's mu.
+func lpop(name string, f *os.File, w *bufio.Writer, keyDir *KeyDir) (string, bool, error) {
+	return listPop(name, true, f, w, keyDir)
+}
+
+// RPop removes and returns the last element of list name, and false if it is empty.
+func (db *DB) RPop(name string) (string, bool, error) {
+	defer db.lock()()
+	v, ok, err := rpop(name, db.s.f, db.s.w, db.s.keyDir)
+	if err != nil {
+		return v, ok, err
+	}
+	return v, ok, db.s.rotateIfFull()
+}
+
+// rpop is DB.RPop for callers holding the store's mu.
+func rpop(name string, f *os.File, w *bufio.Writer, keyDir *KeyDir) (string, bool, error) {
+	return listPop(name, false, f, w, keyDir)
+}
+
+func listPop(name string, front bool, f *os.File, w *bufio.Writer, keyDir *KeyDir) (string, bool, error) {
+	head, tail, ok, err := listEnds(name, keyDir)
+	if err != nil || !ok {
+		return "", false, err
+	}
+	pos := tail
+	if front {
+		pos = head
+	}
+	key := listElement(name, pos)
+	v, err := get(key, keyDir)
+	if err != nil {
+		return "", false, fmt.Errorf("list %q: %w", name, err)
+	}
+	if front {
+		head++
+	} else {
+		tail--
+	}
+	// the ends move first, so a crash in between leaves an unreachable element
+	// rather than popping the same one twice
+	if err := setListEnds(name, head, tail, f, w, keyDir); err != nil {
+		return "", false, err
+	}
+	return v, true, deleteAt(key, keyDir.dir.newTimestamp(), f, w, keyDir)
+}
+
+// LLen returns the length of list name.
+func (db *DB) LLen(name string) (int64, error) {
+	defer db.rlock()()
+	return llen(name, db.s.keyDir)
+}
+
+// llen is DB.LLen for callers holding the store's mu.
+func llen(name string, keyDir *KeyDir) (int64, error) {
+	head, tail, ok, err := listEnds(name, keyDir)
+	if err != nil || !ok {
+		return 0, err
+	}
+	return tail - head + 1, nil
+}
+
+// LRange returns the elements of list name from start to stop, both included and
+// counted from 0; negative ones count back from the end, -1 being the last element.
+func (db *DB) LRange(name string, start, stop int64) ([]string, error) {
+	defer db.rlock()()
+	return lrange(name, start, stop, db.s.keyDir)
+}
+
+// lrange is DB.LRange for callers holding the store's mu.
+func lrange(name string, start, stop int64, keyDir *KeyDir) ([]string, error) {
+	head, tail, ok, err := listEnds(name, keyDir)
+	if err != nil || !ok {
+		return nil, err
+	}
+	n := tail - head + 1
+	if start < 0 {
+		start = max(n+start, 0)
+	}
+	if stop < 0 {
+		stop = n + stop
+	}
+	stop = min(stop, n-1)
+	var values []string
+	for i := start; i <= stop; i++ {
+		v, err := get(listElement(name, head+i), keyDir)
+		if err != nil {
+			return nil, fmt.Errorf("list %q: %w", name, err)
+		}
+		values = append(values, v)
+	}
+	return values, nil
+}
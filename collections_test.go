@@ -0,0 +1,107 @@
+package gocask
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+// The collections work through a DB, and a rotation between writes doesn't lose them.
+func TestCollections(t *testing.T) {
+	db, err := Open(t.TempDir(), WithCompaction(CompactionPolicy{ActiveSize: 100}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := db.HSet("h", "a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := db.SAdd("s", "x"); !ok || err != nil {
+		t.Fatalf("sadd x: %v, %v", ok, err)
+	}
+	for _, v := range []string{"b", "c"} {
+		if _, err := db.RPush("l", v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n, err := db.LPush("l", "a"); n != 3 || err != nil {
+		t.Fatalf("lpush a: %d, %v", n, err)
+	}
+
+	if v, err := db.HGet("h", "a"); v != "1" || err != nil {
+		t.Errorf("hget a = %q, %v", v, err)
+	}
+	if !db.SIsMember("s", "x") {
+		t.Error("x isn't in s")
+	}
+	if vs, err := db.LRange("l", 0, -1); !slices.Equal(vs, []string{"a", "b", "c"}) || err != nil {
+		t.Errorf("lrange = %q, %v", vs, err)
+	}
+	if v, ok, err := db.LPop("l"); v != "a" || !ok || err != nil {
+		t.Errorf("lpop = %q, %v, %v", v, ok, err)
+	}
+	if ok, err := db.HDel("h", "a"); !ok || err != nil {
+		t.Errorf("hdel a: %v, %v", ok, err)
+	}
+	if fields, err := db.HGetAll("h"); len(fields) != 0 || err != nil {
+		t.Errorf("hgetall after hdel = %v, %v", fields, err)
+	}
+}
+
+// The keys collections are stored under stay out of Keys, Fold and the iterators, and
+// reading a set doesn't pick up the members of another whose name it starts.
+func TestCollectionKeysHidden(t *testing.T) {
+	db, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := db.Put("plain", "v"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.HSet("h", "a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.RPush("l", "x"); err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range []string{"c", "a", "b"} {
+		if _, err := db.SAdd("s", m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.SAdd("s2", "z"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.SRem("s", "b"); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"plain"}
+	if keys := db.Keys(); !slices.Equal(keys, want) {
+		t.Errorf("keys = %q, want %q", keys, want)
+	}
+	var folded []string
+	if err := db.Fold(func(k, _ []byte) error {
+		folded = append(folded, string(k))
+		return nil
+	}); err != nil || !slices.Equal(folded, want) {
+		t.Errorf("fold = %q, %v; want %q", folded, err, want)
+	}
+	var scanned []string
+	for it := db.Scan(""); it.Next(); {
+		scanned = append(scanned, it.Key())
+	}
+	if !slices.Equal(scanned, want) {
+		t.Errorf("scan = %q, want %q", scanned, want)
+	}
+
+	if ms := db.SMembers("s"); !slices.Equal(ms, []string{"a", "c"}) {
+		t.Errorf("smembers s = %q, want [a c]", ms)
+	}
+	if _, err := db.HGet("h", "missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("hget missing: %v, want ErrNotFound", err)
+	}
+}
@@ -0,0 +1,348 @@
+package gocask
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultActiveSize is how big the active file gets before it is rotated and merged,
+// unless the compaction policy says otherwise. Every rotation merges all the segments,
+// so it is big enough for merges to be rare next to the writes.
+const defaultActiveSize = 64 << 20
+
+// defaultTombstoneAge is how long merges keep a delete unless the compaction policy
+// says otherwise.
+const defaultTombstoneAge = 24 * time.Hour
+
+// CompactionPolicy decides when the store rotates and merges. The active file size is
+// checked after every write; the other triggers are estimated from the index and the
+// file sizes by a CompactionPlanner. Each merge rotates the active file too, so
+// outside every window the active file keeps growing until one opens.
+type CompactionPolicy struct {
+	ActiveSize    int64   // rotate and merge once the active file is bigger, 64 MiB if 0
+	Fragmentation float64 // merge once this fraction of data file bytes is dead, 0 to not
+	DeadBytes     int64   // merge once this many data file bytes are dead, 0 to not
+	// SegmentAge merges once the oldest segment is older and anything at all is dead,
+	// so no garbage outlives it for long; 0 to not.
+	SegmentAge   time.Duration
+	ExpiredBytes int64         // merge once records whose TTL ran out take this many bytes, 0 to not
+	Windows      []MergeWindow // when merges may start; any time if empty
+	// TombstoneAge is how long merges keep the record of a delete, or of a value
+	// that expired, rather than dropping it with the values it hides. A replicated
+	// write older than the delete that arrives while it is kept still loses to it;
+	// one arriving later brings the key back. 24h if 0, negative to drop them at once.
+	TombstoneAge time.Duration
+}
+
+// WithCompaction makes p the store's compaction policy. Without it the store rotates
+// and merges once the active file passes 64 MiB.
+func WithCompaction(p CompactionPolicy) Option {
+	return withSetting(func(s *store) error {
+		s.setCompaction(p)
+		return nil
+	})
+}
+
+// SetCompactionPolicy replaces the store's compaction policy, for the next write or
+// planned merge to go by.
+func (db *DB) SetCompactionPolicy(p CompactionPolicy) {
+	defer db.lock()()
+	db.s.setCompaction(p)
+}
+
+// setCompaction replaces the compaction policy of s. Callers hold the store's mu.
+func (s *store) setCompaction(p CompactionPolicy) {
+	if p.ActiveSize <= 0 {
+		p.ActiveSize = defaultActiveSize
+	}
+	s.dir.compaction = p
+}
+
+// allowed reports whether t is inside one of the windows, if there are any.
+func (p *CompactionPolicy) allowed(t time.Time) bool {
+	if len(p.Windows) == 0 {
+		return true
+	}
+	for _, w := range p.Windows {
+		if w.contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// keepTombstone reports whether a merge at now keeps a tombstone written at ts.
+func (p *CompactionPolicy) keepTombstone(ts uint64, now time.Time) bool {
+	age := p.TombstoneAge
+	if age == 0 {
+		age = defaultTombstoneAge
+	}
+	return age > 0 && now.Sub(time.Unix(0, int64(ts&^0xffff))) < age
+}
+
+// planned reports whether any trigger but the active file size holds.
+func (p *CompactionPolicy) planned() bool {
+	return p.Fragmentation > 0 || p.DeadBytes > 0 || p.SegmentAge > 0 || p.ExpiredBytes > 0
+}
+
+// MergeWindow is a daily stretch of local time, on some weekdays or all of them,
+// like "mon-fri 01:00-05:00" or "22:00-06:00". A window whose end isn't after its
+// start runs past midnight into the next day, so 00:00-00:00 is all day.
+type MergeWindow struct {
+	Days       [7]bool // by time.Weekday; all false means every day
+	Start, End time.Duration
+}
+
+var weekdays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// ParseMergeWindow parses "[days] HH:MM-HH:MM", days being a comma-separated list of
+// weekdays and ranges of them, e.g. "sat,sun" or "mon-fri".
+func ParseMergeWindow(s string) (MergeWindow, error) {
+	var w MergeWindow
+	fields := strings.Fields(s)
+	if len(fields) == 0 || len(fields) > 2 {
+		return w, fmt.Errorf("merge window %q: want [days] HH:MM-HH:MM", s)
+	}
+	if len(fields) == 2 {
+		for _, part := range strings.Split(fields[0], ",") {
+			from, to, isRange := strings.Cut(part, "-")
+			first, last := weekdayIndex(from), weekdayIndex(to)
+			if !isRange {
+				last = first
+			}
+			if first < 0 || last < 0 {
+				return w, fmt.Errorf("merge window %q: unknown days %q", s, part)
+			}
+			for d := first; ; d = (d + 1) % 7 {
+				w.Days[d] = true
+				if d == last {
+					break
+				}
+			}
+		}
+	}
+	start, end, ok := strings.Cut(fields[len(fields)-1], "-")
+	var err1, err2 error
+	w.Start, err1 = parseClock(start)
+	w.End, err2 = parseClock(end)
+	if !ok || err1 != nil || err2 != nil {
+		return w, fmt.Errorf("merge window %q: want times like 01:00-05:00", s)
+	}
+	return w, nil
+}
+
+func weekdayIndex(s string) int {
+	for i, d := range weekdays {
+		if strings.EqualFold(s, d) {
+			return i
+		}
+	}
+	return -1
+}
+
+// parseClock parses HH:MM into the time since midnight; 24:00 is the end of the day.
+func parseClock(s string) (time.Duration, error) {
+	h, m, ok := strings.Cut(s, ":")
+	hours, err1 := strconv.Atoi(h)
+	mins, err2 := strconv.Atoi(m)
+	if !ok || err1 != nil || err2 != nil || hours < 0 || mins < 0 || mins > 59 || hours*60+mins > 24*60 {
+		return 0, fmt.Errorf("bad time of day %q", s)
+	}
+	return time.Duration(hours)*time.Hour + time.Duration(mins)*time.Minute, nil
+}
+
+// contains reports whether t is inside w. The days are those the window starts on.
+func (w MergeWindow) contains(t time.Time) bool {
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	clock, day := t.Sub(midnight), t.Weekday()
+	if w.End <= w.Start {
+		// past midnight, the window started yesterday
+		if clock < w.End {
+			return w.onDay((day + 6) % 7)
+		}
+		return clock >= w.Start && w.onDay(day)
+	}
+	return clock >= w.Start && clock < w.End && w.onDay(day)
+}
+
+func (w MergeWindow) onDay(d time.Weekday) bool {
+	return w.Days == [7]bool{} || w.Days[d]
+}
+
+// StoreUsage is an estimate of how much of the data files a merge would reclaim,
+// worked out from the index and the file sizes without reading the files.
+type StoreUsage struct {
+	DataBytes    int64     // segments and the active file
+	LiveBytes    int64     // the records the index points at, expired ones and tombstones included
+	ExpiredBytes int64     // the live records whose TTL ran out
+	Oldest       time.Time // when the oldest segment was sealed, zero if there is none
+}
+
+// DeadBytes is what a merge would reclaim.
+func (u StoreUsage) DeadBytes() int64 { return max(u.DataBytes-u.LiveBytes, 0) + u.ExpiredBytes }
+
+// Fragmentation is the fraction of the data files a merge would reclaim.
+func (u StoreUsage) Fragmentation() float64 {
+	if u.DataBytes == 0 {
+		return 0
+	}
+	return float64(u.DeadBytes()) / float64(u.DataBytes)
+}
+
+// usage estimates the store's StoreUsage. Expired bytes take reading the expiry of
+// every key that has a TTL, so they are only worked out if withExpired is set.
+func (s *store) usage(withExpired bool) (StoreUsage, error) {
+	u := StoreUsage{DataBytes: s.dir.activeSize, LiveBytes: s.keyDir.LiveBytes() + s.keyDir.tombstoneBytes()}
+	logs, _, err := segmentFiles(s.path)
+	if err != nil {
+		return u, err
+	}
+	for _, l := range logs {
+		if fi, err := os.Stat(l); err == nil {
+			u.DataBytes += fi.Size()
+		}
+	}
+	if len(logs) > 0 {
+		u.Oldest = time.Unix(extractTimestamp(logs[0]), 0)
+	}
+	if withExpired {
+		u.ExpiredBytes, err = expiredBytes(s.keyDir)
+	}
+	return u, err
+}
+
+// expiredBytes adds up the records of keyDir whose TTL ran out.
+func expiredBytes(keyDir *KeyDir) (int64, error) {
+	bySegment, _, err := expiredBySegment(keyDir)
+	var n int64
+	for _, b := range bySegment {
+		n += b
+	}
+	return n, err
+}
+
+// expiredBySegment returns the bytes of records keyDir points at whose TTL ran out,
+// by the data file holding them, and how many such keys there are. It reads the
+// expiry of every key that has a TTL.
+func expiredBySegment(keyDir *KeyDir) (map[string]int64, int, error) {
+	type entry struct {
+		key string
+		fo  FileOffset
+	}
+	var expiring []entry
+	keyDir.Range(func(key string, fo FileOffset) bool {
+		if fo.Expiring() {
+			expiring = append(expiring, entry{key, fo})
+		}
+		return true
+	})
+	bySegment := make(map[string]int64)
+	keys := 0
+	for _, e := range expiring {
+		gone, err := keyDir.dir.hasExpired(e.key, e.fo)
+		if err != nil {
+			return bySegment, keys, err
+		}
+		if gone {
+			bySegment[e.fo.FileID()] += e.fo.recordSize(e.key)
+			keys++
+		}
+	}
+	return bySegment, keys, nil
+}
+
+// mergeReason returns why the policy wants a merge now, or "" if it doesn't.
+func (s *store) mergeReason(now time.Time) (string, error) {
+	p := &s.dir.compaction
+	if !p.planned() || !p.allowed(now) {
+		return "", nil
+	}
+	u, err := s.usage(p.ExpiredBytes > 0)
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case p.Fragmentation > 0 && u.DeadBytes() > 0 && u.Fragmentation() >= p.Fragmentation:
+		return fmt.Sprintf("%.0f%% of %d bytes dead", u.Fragmentation()*100, u.DataBytes), nil
+	case p.DeadBytes > 0 && u.DeadBytes() >= p.DeadBytes:
+		return fmt.Sprintf("%d bytes dead", u.DeadBytes()), nil
+	case p.ExpiredBytes > 0 && u.ExpiredBytes >= p.ExpiredBytes:
+		return fmt.Sprintf("%d bytes expired", u.ExpiredBytes), nil
+	case p.SegmentAge > 0 && u.DeadBytes() > 0 && !u.Oldest.IsZero() && now.Sub(u.Oldest) >= p.SegmentAge:
+		return fmt.Sprintf("oldest segment sealed %s ago", now.Sub(u.Oldest).Round(time.Second)), nil
+	}
+	return "", nil
+}
+
+// CompactionPlanner merges the store whenever the compaction policy's triggers say so.
+type CompactionPlanner struct {
+	DB       *DB
+	Interval time.Duration // how often the triggers are checked, 1m if 0
+}
+
+// Run checks the policy until stop is closed. Each check holds the store's mu.
+func (cp *CompactionPlanner) Run(stop <-chan struct{}) {
+	interval := cp.Interval
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		// the inputs of the last merge count as dead until they are removed
+		cp.DB.s.dir.mergeTail.Wait()
+		cp.DB.s.mu.Lock()
+		reason, err := cp.DB.s.mergeReason(time.Now())
+		if err == nil && reason != "" {
+			cp.DB.s.dir.logger.Info("merge planned", "dir", cp.DB.s.path, "reason", reason)
+			err = cp.DB.s.rotate()
+		}
+		cp.DB.s.mu.Unlock()
+		if err != nil {
+			cp.DB.s.dir.logger.Error("planned merge failed", "err", err)
+		}
+	}
+}
+
+// ParseCompactionPolicy parses a policy as the command line's --merge-policy takes
+// it: space-separated active-size=<n>, fragmentation=<percent>, dead-bytes=<n>,
+// segment-age=<duration>, expired-bytes=<n> and tombstone-age=<duration> settings.
+func ParseCompactionPolicy(s string) (CompactionPolicy, error) {
+	var p CompactionPolicy
+	for _, f := range strings.Fields(s) {
+		name, value, _ := strings.Cut(f, "=")
+		var err error
+		switch name {
+		case "active-size":
+			p.ActiveSize, err = strconv.ParseInt(value, 10, 64)
+		case "fragmentation":
+			var pct float64
+			if pct, err = strconv.ParseFloat(strings.TrimSuffix(value, "%"), 64); err == nil && (pct <= 0 || pct > 100) {
+				err = fmt.Errorf("want a percentage")
+			}
+			p.Fragmentation = pct / 100
+		case "dead-bytes":
+			p.DeadBytes, err = strconv.ParseInt(value, 10, 64)
+		case "segment-age":
+			p.SegmentAge, err = time.ParseDuration(value)
+		case "expired-bytes":
+			p.ExpiredBytes, err = strconv.ParseInt(value, 10, 64)
+		case "tombstone-age":
+			p.TombstoneAge, err = time.ParseDuration(value)
+		default:
+			err = fmt.Errorf("unknown setting")
+		}
+		if err != nil {
+			return p, fmt.Errorf("merge policy %q: %s: %w", s, f, err)
+		}
+	}
+	return p, nil
+}
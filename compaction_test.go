@@ -0,0 +1,51 @@
+package gocask
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestWithCompactionActiveSize(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		opts     []Option
+		segments bool
+	}{
+		{"default", nil, false},
+		{"small", []Option{WithCompaction(CompactionPolicy{ActiveSize: 100})}, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			db, err := Open(t.TempDir(), tc.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			for i := range 20 {
+				if err := db.Put(fmt.Sprint("k", i), "a value of some length"); err != nil {
+					t.Fatal(err)
+				}
+			}
+			logs, _, err := segmentFiles(db.Path())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := len(logs) > 0; got != tc.segments {
+				t.Errorf("%d segments after 20 puts", len(logs))
+			}
+		})
+	}
+}
+
+func TestParseCompactionPolicy(t *testing.T) {
+	p, err := ParseCompactionPolicy("active-size=1048576 fragmentation=50% tombstone-age=72h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.ActiveSize != 1<<20 || p.Fragmentation != 0.5 || p.TombstoneAge != 72*time.Hour {
+		t.Errorf("parsed %+v", p)
+	}
+	if _, err := ParseCompactionPolicy("tombstone-age=soon"); err == nil {
+		t.Error("parsed a bad tombstone-age")
+	}
+}
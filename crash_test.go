@@ -0,0 +1,235 @@
+//go:build gocask_failpoints
+
+package gocask
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/itsknk/gocask/internal/failpoint"
+)
+
+// crashFailpoints are the failpoints in rotation and merge, in the order they're reached.
+var crashFailpoints = []string{
+	"rotate.rename", "rotate.open", "merge.read", "merge.write",
+	"merge.install", "merge.reindex", "merge.hint", "merge.cleanup",
+}
+
+// crashChildDir names the store TestCrashChild writes to; it only runs when it is set.
+const crashChildDir = "GOCASK_CRASHTEST_DIR"
+
+// crashOps is how many writes each child makes.
+const crashOps = 200
+
+// Rotation and merge must never lose an acknowledged write. For every failpoint, once
+// failing and once crashing there, this runs the test binary again as a child (see
+// TestCrashChild) that puts and deletes keys in a fresh store, some of them with a
+// TTL, rotating every hundred bytes or so. Then it opens what the child left behind
+// and checks that every key holds its last acknowledged value with its TTL, or one
+// of the writes after it that failed or were cut short, that no expired key came
+// back, and that every index entry points at a real file.
+// Run it with -tags gocask_failpoints.
+func TestCrash(t *testing.T) {
+	if os.Getenv(crashChildDir) != "" {
+		t.Skip("running as a crash test child")
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fp := range crashFailpoints {
+		for _, action := range []string{"error", "crash"} {
+			t.Run(fp+"="+action, func(t *testing.T) {
+				dir := t.TempDir()
+				note, problems := crashRun(exe, dir, fp, action)
+				t.Log(note)
+				for _, p := range problems {
+					t.Error(p)
+				}
+			})
+		}
+	}
+}
+
+// TestCrashChild is the writing half of TestCrash, which runs it in a child process.
+// It prints every write twice: once before making it, after "try", and then again
+// once it is acknowledged, or after "fail" if the failpoint made it return an error.
+// A write can rotate and merge before it returns, so one that failed or that a crash
+// cut short may or may not have been made.
+func TestCrashChild(t *testing.T) {
+	dir := os.Getenv(crashChildDir)
+	if dir == "" {
+		t.Skip("only run by TestCrash")
+	}
+	db, err := Open(dir, WithCompaction(CompactionPolicy{ActiveSize: 100}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 0; i < crashOps; i++ {
+		key := fmt.Sprintf("k%d", i%13)
+		value := strings.Repeat(strconv.Itoa(i), 1+i%7)
+		var op string
+		var write func() error
+		switch {
+		case i%5 == 4:
+			op, write = "del "+key, func() error { return db.Delete(key) }
+		case i%11 == 3: // expired before anything reads it
+			op, write = "exp "+key, func() error { return db.PutWithTTL(key, value, time.Nanosecond) }
+		case i%3 == 0:
+			op, write = "put "+key+" "+value+" ttl", func() error { return db.PutWithTTL(key, value, time.Hour) }
+		default:
+			op, write = "put "+key+" "+value, func() error { return db.Put(key, value) }
+		}
+		fmt.Println("try", op)
+		if err := write(); err != nil {
+			if !strings.Contains(err.Error(), "failpoint ") {
+				t.Fatalf("%s: %v", op, err)
+			}
+			fmt.Println("fail", op)
+			continue
+		}
+		fmt.Println(op)
+	}
+}
+
+// crashWrite is a write TestCrashChild printed: value is nil for a delete or a value
+// that expired at once.
+type crashWrite struct {
+	key   string
+	value *string
+	ttl   bool
+}
+
+// parseCrashWrite parses the fields of a write TestCrashChild printed.
+func parseCrashWrite(f []string) (crashWrite, bool) {
+	switch {
+	case (len(f) == 3 || len(f) == 4) && f[0] == "put":
+		return crashWrite{key: f[1], value: &f[2], ttl: len(f) == 4}, true
+	case len(f) == 2 && (f[0] == "del" || f[0] == "exp"):
+		return crashWrite{key: f[1]}, true
+	}
+	return crashWrite{}, false
+}
+
+// check returns what is wrong with how db holds the key of w if w was its last write,
+// "" if nothing is.
+func (w crashWrite) check(db *DB) string {
+	got, err := db.Get(w.key)
+	switch {
+	case w.value == nil && err == nil:
+		return fmt.Sprintf("%s was deleted but reads %q", w.key, got)
+	case w.value != nil && err != nil:
+		return fmt.Sprintf("%s lost %q: %v", w.key, *w.value, err)
+	case w.value != nil && got != *w.value:
+		return fmt.Sprintf("%s reads %q, last acknowledged %q", w.key, got, *w.value)
+	case w.value != nil:
+		if fo, _ := db.Locate(w.key); fo.Expiring() != w.ttl {
+			return fmt.Sprintf("%s was written with ttl %v, the index says %v", w.key, w.ttl, fo.Expiring())
+		}
+	}
+	return ""
+}
+
+// crashRun runs one child with fp armed to act, then checks what it left in dir.
+func crashRun(exe, dir, fp, action string) (string, []string) {
+	cmd := exec.Command(exe, "-test.run=^TestCrashChild$", "-test.count=1")
+	cmd.Env = append(os.Environ(), crashChildDir+"="+dir, "GOCASK_FAILPOINTS="+fp+"="+action)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+
+	err := cmd.Run()
+	var exit *exec.ExitError
+	switch {
+	case err == nil:
+	case errors.As(err, &exit) && exit.ExitCode() == failpoint.CrashCode:
+	default:
+		return "child failed", []string{fmt.Sprintf("%v: %s%s", err, stdout.Bytes(), stderr.Bytes())}
+	}
+
+	// what each key may hold: its last acknowledged write, or a delete if it has
+	// none, followed by the writes after it that failed or were cut short
+	outcomes := make(map[string][]crashWrite)
+	maybe := func(w crashWrite) {
+		if _, ok := outcomes[w.key]; !ok {
+			outcomes[w.key] = []crashWrite{{key: w.key}}
+		}
+		outcomes[w.key] = append(outcomes[w.key], w)
+	}
+	var inFlight *crashWrite
+	acked, failed := 0, 0
+	scanner := bufio.NewScanner(&stdout)
+	for scanner.Scan() {
+		f := strings.Fields(scanner.Text())
+		if len(f) == 0 {
+			continue
+		}
+		switch f[0] {
+		case "try":
+			if w, ok := parseCrashWrite(f[1:]); ok {
+				inFlight = &w
+			}
+		case "fail":
+			if w, ok := parseCrashWrite(f[1:]); ok {
+				maybe(w)
+				inFlight = nil
+				failed++
+			}
+		default:
+			if w, ok := parseCrashWrite(f); ok {
+				outcomes[w.key] = []crashWrite{w}
+				inFlight = nil
+				acked++
+			}
+		}
+	}
+	if inFlight != nil {
+		maybe(*inFlight)
+	}
+	note := fmt.Sprintf("%d writes acknowledged, %d failed", acked, failed)
+
+	db, err := Open(dir)
+	if err != nil {
+		return note, []string{fmt.Sprintf("reopen: %v", err)}
+	}
+	defer db.Close()
+	if info := db.Recovery(); !info.Clean() {
+		note += "; on open: " + info.String()
+	}
+
+	var problems []string
+	for _, ws := range outcomes {
+		p := ws[0].check(db)
+		for _, w := range ws[1:] {
+			if p != "" && w.check(db) == "" {
+				p = ""
+			}
+		}
+		if p != "" {
+			problems = append(problems, p)
+		}
+	}
+	for _, key := range db.Keys() {
+		if _, ok := outcomes[key]; !ok {
+			problems = append(problems, fmt.Sprintf("index has %q, which was never written", key))
+		}
+	}
+	for key := range outcomes {
+		fo, ok := db.Locate(key)
+		if !ok {
+			continue
+		}
+		if _, err := os.Stat(fo.FileID()); err != nil {
+			problems = append(problems, fmt.Sprintf("index entry for %q points at missing %s", key, fo.FileID()))
+		}
+	}
+	return note, problems
+}
@@ -0,0 +1,82 @@
+package gocask
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// dataDir is the data directory of an open store, with what reading and writing the
+// store keeps track of between calls. Each store has its own, which its KeyDir points
+// at, so stores in different directories can be open in one process side by side,
+// each tuned by settings of its own. The file names the index holds, and that are passed
+// around, are paths under path; only the files written to disk that name others,
+// such as the merge marker, keep them relative to it.
+type dataDir struct {
+	path   string // absolute
+	active string // the active file under path
+
+	activeSize    int64  // size of the active file
+	lastTimestamp uint64 // last value handed out by newTimestamp
+	evictedBytes  int64  // size of the records evicted since the last merge
+	accesses      accessTable
+	readers       *handlePool // open for reads, in the store's ReadMode, see WithReadMode
+	cache         *valueCache // nil while caching is off, see WithValueCache
+	metrics       opStats
+	hooks         atomic.Pointer[Hooks] // nil until some are installed, see WithHooks
+	hookQueue     chan func()           // the Async hooks pending, started by hookOnce
+	hookOnce      sync.Once
+	syncPolicy    SyncPolicy
+	unsynced      bool // writes since the active file was last fsynced, see appended
+
+	// the store's settings, each set by an Option and a DB method of its own
+	compaction      CompactionPolicy  // when to rotate and merge, see (*store).setCompaction
+	defaultTTL      time.Duration     // see WithDefaultTTL
+	retention       []RetentionPolicy // longest prefix first, see WithRetention
+	retentionLimits bool              // any of retention limits keys or bytes
+	eviction        EvictionOptions   // see WithEviction
+	quotas          []Quota           // see WithQuotas; KeyDir shards count by their index
+	quotaEvicts     bool              // any of quotas evicts keys
+	chunkSize       int               // see WithChunkSize
+	readOnlyOnFull  bool              // see WithReadOnlyOnDiskFull
+	node            uint16            // stamped on the records written, see WithNodeID
+	tracer          Tracer            // see WithTracer
+	schema          schemaSet         // see WithSchema
+	auditActor      string            // see WithAuditActor
+	actor           string            // whom the write in progress is for, see ContextWithActor
+
+	logger    Logger       // see WithLogger; opening the store logs already
+	readAhead atomic.Int64 // see WithReadAhead; scans run while it changes
+
+	journal *os.File // the changefeed journal, opened by the first change
+	audit   auditLog
+
+	readOnly       atomic.Bool // a full disk made writes fail, see WithReadOnlyOnDiskFull
+	openedReadOnly atomic.Bool
+
+	mergeTail     sync.WaitGroup // the background half of the last merge, see finishMergeAsync
+	mergeMu       sync.Mutex
+	mergeProgress *MergeProgress // nil until the first merge starts
+	mergeFailures int            // merges that failed in a row, guarded by mergeMu
+	mergeErr      error          // why the last of them failed
+}
+
+func newDataDir(path string) *dataDir {
+	d := &dataDir{
+		path:       path,
+		active:     filepath.Join(path, activeFile),
+		readers:    newHandlePool(maxReadHandles),
+		compaction: CompactionPolicy{ActiveSize: defaultActiveSize},
+		eviction:   EvictionOptions{Samples: defaultEvictionSamples},
+		chunkSize:  DefaultChunkSize,
+		tracer:     noopTracer{},
+		logger:     defaultLogger,
+	}
+	d.readAhead.Store(defaultReadAhead)
+	return d
+}
+
+// file is the path of name, relative to the data directory.
+func (d *dataDir) file(name string) string { return filepath.Join(d.path, name) }
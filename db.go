@@ -0,0 +1,287 @@
+package gocask
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// DB is an open store, for programs that use gocask as a library rather than through
+// the gocask command. Its methods are safe to call from any number of goroutines:
+// Gets run side by side, while writes run one at a time, with each other and with the
+// commands and background writers of this process.
+type DB struct {
+	s         *store
+	stopSweep func()
+	stopSync  func()
+	closed    bool
+	held      bool // the handle Exclusive passes, whose caller holds the store's mu
+}
+
+// Option changes how Open opens a store.
+type Option func(*dbOptions)
+
+type dbOptions struct {
+	repairs  repairs
+	readOnly bool
+	name     string
+	sweep    time.Duration
+	sync     SyncPolicy
+	settings []setting // in the order the options were given
+
+	// what opening the store goes by already, before the settings apply
+	logger    Logger
+	readAhead int
+}
+
+// setting changes a setting of an open store, failing if the value is no good.
+// Callers hold the store's mu.
+type setting func(s *store) error
+
+// withSetting is the Option for a setting, applied once the store is open.
+func withSetting(set setting) Option {
+	return func(o *dbOptions) { o.settings = append(o.settings, set) }
+}
+
+// WithStrict fails the open with an *IntegrityError on the first integrity problem
+// instead of repairing it, and changes nothing on disk, for callers who would rather
+// have a human look at damage.
+func WithStrict() Option {
+	return func(o *dbOptions) { o.repairs = strictRepairs }
+}
+
+// WithRecovery makes only the repairs opts allow, listing every step taken in the
+// Actions of the handle's Recovery. See OpenWithRecovery.
+func WithRecovery(opts RecoveryOptions) Option {
+	return func(o *dbOptions) { o.repairs = repairs{RecoveryOptions: opts} }
+}
+
+// WithReadOnly refuses writes and merges with ErrOpenedReadOnly.
+func WithReadOnly() Option {
+	return func(o *dbOptions) { o.readOnly = true }
+}
+
+// WithName labels the store's metrics with name, as serve does with the stores it
+// mounts, so those of stores open side by side can be told apart; see MetricsByName.
+// The metrics of stores without a name are added up.
+func WithName(name string) Option {
+	return func(o *dbOptions) { o.name = name }
+}
+
+// WithExpirySweep deletes a sample of expired keys every interval for as long as the
+// store is open, as serve's --sweep-interval does, so keys nobody reads again don't
+// hold memory and disk space until a merge.
+func WithExpirySweep(interval time.Duration) Option {
+	return func(o *dbOptions) { o.sweep = interval }
+}
+
+// WithSync makes p the store's sync policy, see SyncPolicy. Without it the store
+// is SyncNever.
+func WithSync(p SyncPolicy) Option {
+	return func(o *dbOptions) { o.sync = p }
+}
+
+// Open opens (or creates) the store in dir, working around damage it finds:
+// damaged records are skipped, a torn record at the end of the active file is cut
+// off, and unusable hints are replaced. What it found is logged, and kept for
+// Recovery. dir is created if need be, and every file of the store, the lock
+// included, stays under it (see layout.go), so stores in different directories can
+// be open side by side. A store can only be open once in a process; see OpenShared.
+func Open(dir string, opts ...Option) (*DB, error) {
+	o := dbOptions{repairs: openRepairs}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	db, _, err := openDB(dir, o, false)
+	return db, err
+}
+
+// OpenStrict is Open with WithStrict that also returns what the open found.
+func OpenStrict(dir string, opts ...Option) (*DB, RecoveryInfo, error) {
+	return openDB(dir, withRepairs(strictRepairs, opts), false)
+}
+
+// OpenShared is Open for code that may run alongside other users of the same store
+// in this process: if the store is open already, it returns that handle instead of
+// ErrAlreadyOpen, and opts are ignored. The store closes when the last handle does.
+func OpenShared(dir string, opts ...Option) (*DB, RecoveryInfo, error) {
+	return openDB(dir, withRepairs(openRepairs, opts), true)
+}
+
+// OpenWithRecovery is Open for an operator bringing back a damaged store: it makes
+// only the repairs opts allow, and the returned info lists every step it took in
+// Actions, also when a repair that isn't allowed stopped it. With opts.DryRun nothing
+// on disk changes and the store opens read-only, so the report can be looked over
+// before opening it again for real. More options, such as WithLogger, go in more;
+// WithStrict and WithRecovery among them are ignored.
+func OpenWithRecovery(dir string, opts RecoveryOptions, more ...Option) (*DB, RecoveryInfo, error) {
+	return openDB(dir, withRepairs(repairs{RecoveryOptions: opts}, more), false)
+}
+
+// withRepairs is the options opts give, making only the repairs r allows.
+func withRepairs(r repairs, opts []Option) dbOptions {
+	var o dbOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	o.repairs = r
+	return o
+}
+
+func openDB(dir string, o dbOptions, shared bool) (*DB, RecoveryInfo, error) {
+	if o.repairs.DryRun {
+		// nor may a dry run create a store
+		if _, err := os.Stat(filepath.Join(dir, formatFile)); err != nil {
+			return nil, RecoveryInfo{DryRun: true}, fmt.Errorf("no store in the current format in %s: %w", dir, err)
+		}
+	}
+	s, info, err := registerOpen(dir, o, shared)
+	if err != nil {
+		return nil, info, err
+	}
+	if o.readOnly {
+		s.dir.openedReadOnly.Store(true)
+	}
+	s.mu.Lock()
+	for _, set := range o.settings {
+		if err = set(s); err != nil {
+			break
+		}
+	}
+	s.mu.Unlock()
+	if err != nil {
+		s.Close()
+		return nil, info, err
+	}
+	db := &DB{s: s, stopSync: startSyncer(s, o.sync)}
+	db.stopSweep = startSweeper(db, o.sweep)
+	return db, info, nil
+}
+
+// Exclusive runs fn with the store to itself: no other write, read, merge or
+// background writer of the process runs until fn returns. fn makes its calls
+// through tx, the handle it is passed, which is only good until then and does
+// nothing when closed; calls through any other handle to the store would wait for
+// fn forever.
+// Exclusive returns what fn does.
+func (db *DB) Exclusive(fn func(tx *DB) error) error {
+	defer db.lock()()
+	return fn(&DB{s: db.s, closed: true, held: true})
+}
+
+// lock takes the store's mu for a write, unless db is an Exclusive handle, and
+// returns what releases it.
+func (db *DB) lock() func() {
+	if db.held {
+		return func() {}
+	}
+	db.s.mu.Lock()
+	return db.s.mu.Unlock
+}
+
+// rlock is lock for a read.
+func (db *DB) rlock() func() {
+	if db.held {
+		return func() {}
+	}
+	db.s.mu.RLock()
+	return db.s.mu.RUnlock
+}
+
+// Get returns the value of key, or an error wrapping ErrNotFound if it isn't set, was
+// deleted or its TTL has run out; the last also wraps ErrExpired.
+func (db *DB) Get(key string) (string, error) {
+	if err := checkKey(key); err != nil {
+		return "", err
+	}
+	defer db.rlock()()
+	return get(key, db.s.keyDir)
+}
+
+// Put sets key to value, rotating the active file once it is full. If that rotation
+// fails, the error comes back with the put made.
+func (db *DB) Put(key, value string) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	defer db.lock()()
+	if err := put(key, value, db.s.f, db.s.w, db.s.keyDir); err != nil {
+		return err
+	}
+	return db.s.rotateIfFull()
+}
+
+// PutWithTTL sets key to value until ttl has passed, after which Get treats it as
+// gone and merges drop it.
+func (db *DB) PutWithTTL(key, value string, ttl time.Duration) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	defer db.lock()()
+	if err := putWithTTL(key, value, ttl, db.s.f, db.s.w, db.s.keyDir); err != nil {
+		return err
+	}
+	return db.s.rotateIfFull()
+}
+
+// Delete removes key by writing a tombstone for it, rotating like Put.
+func (db *DB) Delete(key string) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	defer db.lock()()
+	if err := del(key, db.s.f, db.s.w, db.s.keyDir); err != nil {
+		return err
+	}
+	return db.s.rotateIfFull()
+}
+
+// Merge seals the active file and compacts every segment, whatever the compaction
+// policy says.
+func (db *DB) Merge() error {
+	defer db.lock()()
+	return db.s.rotate()
+}
+
+// Locate returns where the newest record of key is, which may be a tombstone; ok
+// is false if the store holds none.
+func (db *DB) Locate(key string) (fo FileOffset, ok bool) {
+	defer db.rlock()()
+	return db.s.keyDir.Get(key)
+}
+
+// Sync flushes the writes made so far and fsyncs the active file, so they survive
+// an OS crash or a power cut whatever the sync policy.
+func (db *DB) Sync() error {
+	defer db.lock()()
+	return db.s.sync()
+}
+
+// Path is the absolute path of the store's data directory, with symlinks resolved.
+func (db *DB) Path() string {
+	return db.s.path
+}
+
+// Recovery is what opening the store found and did about it.
+func (db *DB) Recovery() RecoveryInfo {
+	return db.s.recovery
+}
+
+// Close flushes and closes the store, unless other OpenShared handles to it are
+// still open. Closing db again does nothing.
+func (db *DB) Close() error {
+	if db.closed {
+		return nil
+	}
+	db.closed = true
+	if db.stopSweep != nil {
+		db.stopSweep()
+		db.stopSweep = nil
+	}
+	if db.stopSync != nil {
+		db.stopSync()
+		db.stopSync = nil
+	}
+	return db.s.Close()
+}
@@ -0,0 +1,381 @@
+package gocask
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestGetNotFound(t *testing.T) {
+	db, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Put("deleted", "v"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete("deleted"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutWithTTL("expired", "v", time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	for _, key := range []string{"missing", "deleted", "expired"} {
+		if _, err := db.Get(key); !errors.Is(err, ErrNotFound) {
+			t.Errorf("get %s: %v, want ErrNotFound", key, err)
+		}
+	}
+	if _, err := db.Get("expired"); !errors.Is(err, ErrExpired) {
+		t.Errorf("get expired: %v, want ErrExpired too", err)
+	}
+	if _, err := db.Get("deleted"); errors.Is(err, ErrExpired) {
+		t.Errorf("get deleted: %v, which isn't ErrExpired", err)
+	}
+}
+
+func TestMergeKeepsWhitespaceInKeys(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"a":      "plain",
+		" a ":    "padded",
+		"a\n":    "newline",
+		"\ta":    "tab",
+		" ":      "space",
+		"b\r\n ": "crlf",
+	}
+	for k, v := range want {
+		if err := db.Put(k, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Merge(); err != nil {
+		t.Fatal(err)
+	}
+	check := func(when string) {
+		t.Helper()
+		for k, v := range want {
+			if got, err := db.Get(k); err != nil || got != v {
+				t.Errorf("%s: get %q = %q, %v; want %q", when, k, got, err, v)
+			}
+		}
+	}
+	check("after merge")
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = Open(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	check("after reopen")
+}
+
+func TestReservedKeys(t *testing.T) {
+	db, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	const key = internalPrefix + "cdc/default"
+	if err := db.SaveCheckpoint(key, "42"); err != nil {
+		t.Fatal(err)
+	}
+
+	b := db.NewBatch()
+	b.Put("ok", "v")
+	b.Delete(key)
+	for name, err := range map[string]error{
+		"put":    db.Put(key, "v"),
+		"ttl":    db.PutWithTTL(key, "v", time.Hour),
+		"delete": db.Delete(key),
+		"batch":  b.Commit(),
+	} {
+		if !errors.Is(err, ErrReservedKey) {
+			t.Errorf("%s: %v, want ErrReservedKey", name, err)
+		}
+	}
+	if _, err := db.Get(key); !errors.Is(err, ErrReservedKey) {
+		t.Errorf("get: %v, want ErrReservedKey", err)
+	}
+	if b.Len() != 2 {
+		t.Errorf("refused batch has %d ops staged, want 2", b.Len())
+	}
+	if _, err := db.Get("ok"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("get ok: %v, want the refused batch not applied", err)
+	}
+	if v, err := db.LoadCheckpoint(key); err != nil || v != "42" {
+		t.Errorf("checkpoint = %q, %v; want 42", v, err)
+	}
+}
+
+func TestOptionsArePerStore(t *testing.T) {
+	var stores [2]*DB
+	var logs [2]bytes.Buffer
+	for i := range stores {
+		dir := t.TempDir()
+		if err := os.Mkdir(AuditDir(dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+		db, err := Open(dir,
+			WithNodeID(uint16(i+1)),
+			WithAuditActor(fmt.Sprintf("actor-%d", i+1)),
+			WithLogger(slog.New(slog.NewTextHandler(&logs[i], &slog.HandlerOptions{Level: slog.LevelDebug}))))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		stores[i] = db
+	}
+	var wg sync.WaitGroup
+	for _, db := range stores {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				if err := db.Put(fmt.Sprintf("k%d", j), "v"); err != nil {
+					t.Error(err)
+				}
+			}
+			if err := db.Merge(); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	for i, db := range stores {
+		if got := db.NodeID(); got != uint16(i+1) {
+			t.Errorf("store %d: node id %d", i, got)
+		}
+		s, err := db.Changes(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for s.Next() {
+			if node := TimestampNode(s.Change().Timestamp); node != uint16(i+1) {
+				t.Fatalf("store %d: change stamped by node %d", i, node)
+			}
+		}
+		s.Close()
+		files, err := AuditFiles(db.Path())
+		if err != nil || len(files) == 0 {
+			t.Fatalf("store %d: audit files %v, %v", i, files, err)
+		}
+		data, err := os.ReadFile(files[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		var e AuditEntry
+		if err := json.Unmarshal(bytes.SplitN(data, []byte("\n"), 2)[0], &e); err != nil {
+			t.Fatal(err)
+		}
+		if want := fmt.Sprintf("actor-%d", i+1); e.Actor != want {
+			t.Errorf("store %d: audit actor %q, want %q", i, e.Actor, want)
+		}
+		if !strings.Contains(logs[i].String(), db.Path()) {
+			t.Errorf("store %d: its logger didn't get its merge:\n%s", i, logs[i].String())
+		}
+		if strings.Contains(logs[i].String(), stores[1-i].Path()) {
+			t.Errorf("store %d: its logger got the other store's diagnostics:\n%s", i, logs[i].String())
+		}
+	}
+}
+
+func TestAuditActorPerWrite(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(AuditDir(dir), 0755); err != nil {
+		t.Fatal(err)
+	}
+	db, err := Open(dir, WithAuditActor("store"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx := ContextWithActor(context.Background(), fmt.Sprintf("client-%d", i))
+			for j := 0; j < 20; j++ {
+				if err := db.PutContext(ctx, fmt.Sprintf("c%d/%d", i, j), "v"); err != nil {
+					t.Error(err)
+				}
+			}
+			if err := db.DeleteContext(ctx, fmt.Sprintf("c%d/0", i)); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	if err := db.Put("plain", "v"); err != nil {
+		t.Fatal(err)
+	}
+	b := db.NewBatch()
+	b.Put("batched", "v")
+	if err := b.CommitContext(ContextWithActor(context.Background(), "batcher")); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+
+	files, err := AuditFiles(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for _, name := range files {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, line := range bytes.Split(bytes.TrimSpace(data), []byte("\n")) {
+			var e AuditEntry
+			if err := json.Unmarshal(line, &e); err != nil {
+				t.Fatal(err)
+			}
+			want := "store"
+			switch {
+			case e.Key == "batched":
+				want = "batcher"
+			case strings.HasPrefix(e.Key, "c"):
+				want = "client-" + strings.TrimPrefix(strings.Split(e.Key, "/")[0], "c")
+			}
+			if e.Actor != want {
+				t.Errorf("%s of %q attributed to %q, want %q", e.Op, e.Key, e.Actor, want)
+			}
+			n++
+		}
+	}
+	if want := 8*21 + 2; n != want {
+		t.Errorf("%d audit entries, want %d", n, want)
+	}
+}
+
+func TestWithLogger(t *testing.T) {
+	dir := t.TempDir()
+	var buf bytes.Buffer
+	l := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	db, err := Open(dir, WithLogger(l))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("k", "v"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Merge(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("k", "v2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "level=DEBUG msg=\"sealed active file\"") {
+		t.Errorf("the merge wasn't logged at debug level:\n%s", buf.String())
+	}
+
+	// what an open repairs goes to the logger it is given too
+	f, err := os.OpenFile(filepath.Join(dir, activeFile), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{flagNormal, 1, 2, 3})
+	f.Close()
+	buf.Reset()
+	db, _, err = OpenWithRecovery(dir, RecoveryOptions{TruncateCorrupt: true}, WithLogger(l))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if !strings.Contains(buf.String(), "level=WARN msg=\"truncating partial record at the end of the active file\"") {
+		t.Errorf("the repair wasn't logged:\n%s", buf.String())
+	}
+	if v, err := db.Get("k"); err != nil || v != "v2" {
+		t.Errorf("after the repair k = %q, %v", v, err)
+	}
+}
+
+// flipByte flips the last bit of the first occurrence of s in the first of paths
+// that has it.
+func flipByte(t *testing.T, s string, paths ...string) {
+	t.Helper()
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i := bytes.Index(data, []byte(s)); i >= 0 {
+			data[i] ^= 1
+			if err := os.WriteFile(path, data, 0644); err != nil {
+				t.Fatal(err)
+			}
+			return
+		}
+	}
+	t.Fatalf("%q isn't in %v", s, paths)
+}
+
+func TestChecksumMismatch(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Put("sealed", "sealed-value"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Merge(); err != nil {
+		t.Fatal(err)
+	}
+	db.s.dir.mergeTail.Wait() // so the merged segments are gone
+	if err := db.Put("active", "active-value"); err != nil {
+		t.Fatal(err)
+	}
+	segments, err := filepath.Glob(filepath.Join(dir, segmentsDir, "data_*.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	flipByte(t, "sealed-value", segments...)
+	flipByte(t, "active-value", filepath.Join(dir, activeFile))
+	for _, k := range []string{"sealed", "active"} {
+		if v, err := db.Get(k); !errors.Is(err, ErrChecksumMismatch) {
+			t.Errorf("get %s: %q, %v, want ErrChecksumMismatch", k, v, err)
+		}
+	}
+
+	flipByte(t, "active-value", JournalPath(dir))
+	s, err := db.Changes(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	var keys []string
+	for s.Next() {
+		keys = append(keys, string(s.Change().Key))
+	}
+	if !errors.Is(s.Err(), ErrChecksumMismatch) {
+		t.Errorf("changefeed: %v, want ErrChecksumMismatch", s.Err())
+	}
+	if fmt.Sprint(keys) != "[sealed]" {
+		t.Errorf("changes before the damaged one: %v", keys)
+	}
+}
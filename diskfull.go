@@ -0,0 +1,76 @@
+package gocask
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// ErrReadOnly is returned for writes after a full disk switched the store to
+// read-only, see WithReadOnlyOnDiskFull.
+var ErrReadOnly = errors.New("store is read-only after the disk filled up")
+
+// WithReadOnlyOnDiskFull makes a write that fails for lack of space switch the store
+// to read-only, so later writes fail fast with ErrReadOnly instead of each trying its
+// luck. Reads keep working. ResumeWrites switches back once space has been freed.
+func WithReadOnlyOnDiskFull() Option {
+	return withSetting(func(s *store) error {
+		s.dir.readOnlyOnFull = true
+		return nil
+	})
+}
+
+// IsDiskFull reports whether err is from a write that failed for lack of space.
+func IsDiskFull(err error) bool { return isDiskFull(err) }
+
+// ResumeWrites lets writes through again after a full disk made the store read-only.
+func (db *DB) ResumeWrites() { db.s.ResumeWrites() }
+
+// ResumeWrites lets writes through again after the store went read-only.
+func (s *store) ResumeWrites() {
+	if s.dir.readOnly.Swap(false) {
+		s.dir.logger.Info("writes resumed", "dir", s.path)
+	}
+}
+
+// ReadOnly reports whether the store refuses writes: it was opened with WithReadOnly,
+// or a full disk switched it to read-only.
+func (db *DB) ReadOnly() bool { return db.s.dir.checkWritable() != nil }
+
+// checkWritable fails writes while the store is read-only, or was opened that way.
+func (d *dataDir) checkWritable() error {
+	if d.readOnly.Load() {
+		return ErrReadOnly
+	}
+	if d.openedReadOnly.Load() {
+		return ErrOpenedReadOnly
+	}
+	return nil
+}
+
+// abortAppend undoes a record append that failed part way: whatever reached the file
+// is cut off again, so the log never holds half a record, and the writer drops its
+// buffered rest and its sticky error. A full disk is counted, reported to the hook
+// and, if configured, makes the store read-only.
+func (d *dataDir) abortAppend(f *os.File, w *bufio.Writer, offset int64, cause error) error {
+	err := fmt.Errorf("append record: %w", cause)
+	if terr := f.Truncate(offset); terr != nil {
+		// the next open cuts off the partial record instead
+		err = errors.Join(err, fmt.Errorf("cut off partial record: %w", terr))
+	} else if _, serr := f.Seek(offset, io.SeekStart); serr != nil {
+		err = errors.Join(err, serr)
+	}
+	w.Reset(f)
+
+	if isDiskFull(cause) {
+		d.metrics.diskFull.Add(1)
+		d.logger.Error("disk full, write failed", "dir", d.path, "err", cause, "read_only", d.readOnlyOnFull)
+		if d.readOnlyOnFull {
+			d.readOnly.Store(true)
+		}
+		d.fireDiskFull(cause)
+	}
+	return err
+}
@@ -0,0 +1,92 @@
+package gocask
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// SegmentUsage is how the bytes of one data file divide up, see DiskUsage.
+type SegmentUsage struct {
+	Name             string
+	Size, Live       int64
+	Expired          int64 // of the dead bytes, those of newest records whose TTL ran out
+	Records, Deleted int
+	Sealed           time.Time // zero for the active file
+}
+
+// Dead is how many bytes of the file a merge would reclaim.
+func (u SegmentUsage) Dead() int64 { return u.Size - u.Live }
+
+// DiskUsage works out how many bytes of each data file a merge would keep: the newest
+// record of every key, unless that record is a tombstone or has expired. Everything
+// else is dead, and expired newest records are also counted on their own. The files
+// are listed oldest first, the active file last.
+func DiskUsage(dir string) ([]*SegmentUsage, error) {
+	// the store may not have been opened since it was written with every file at the top
+	if err := upgradeLayout(dir, defaultLogger); err != nil {
+		return nil, err
+	}
+	lock := lockStore(dir)
+	if err := lock.RLock(); err != nil {
+		return nil, fmt.Errorf("lock store: %w", err)
+	}
+	defer lock.Unlock()
+
+	logs, _, err := segmentFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(filepath.Join(dir, activeFile)); err == nil {
+		logs = append(logs, filepath.Join(dir, activeFile))
+	}
+
+	type newest struct {
+		seg     *SegmentUsage
+		size    int64
+		deleted bool // a tombstone, which merges drop
+		expired bool // merges drop these too
+	}
+	latest := make(map[string]newest)
+	var usage []*SegmentUsage
+
+	for _, path := range logs {
+		u := &SegmentUsage{Name: filepath.Base(path)}
+		if ts := extractTimestamp(path); ts > 0 {
+			u.Sealed = time.Unix(ts, 0)
+		}
+		fi, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		u.Size = fi.Size()
+
+		// oldest file first, so a later record of a key always supersedes an earlier one
+		err = scanFile(path, defaultReadAhead, func(off int64, r record) error {
+			u.Records++
+			if r.flag == flagTombstone {
+				u.Deleted++
+			}
+			latest[string(r.key)] = newest{u, r.size(), r.flag == flagTombstone, expired(r.expires())}
+			return nil
+		})
+		// the active file may end in a record that is still being written
+		if err != nil && !(u.Sealed.IsZero() && errors.Is(err, io.ErrUnexpectedEOF)) {
+			return nil, err
+		}
+		usage = append(usage, u)
+	}
+
+	for _, n := range latest {
+		switch {
+		case n.expired:
+			n.seg.Expired += n.size
+		case !n.deleted:
+			n.seg.Live += n.size
+		}
+	}
+	return usage, nil
+}
@@ -0,0 +1,128 @@
+package gocask
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// SyncPolicy is when a store fsyncs its active file, which is how much an OS crash
+// or a power cut can take with it. Writes reach the OS before they return whatever
+// the policy, so a crash of the process alone loses nothing. Batches are synced as
+// they commit under every policy.
+type SyncPolicy time.Duration
+
+const (
+	// SyncNever leaves syncing to the OS, to merges and to Sync. It is the fastest
+	// and the default.
+	SyncNever SyncPolicy = 0
+	// SyncAlways syncs every write before it returns.
+	SyncAlways SyncPolicy = -1
+)
+
+// SyncInterval syncs in the background every d, when anything was written since the
+// last time, so about d worth of writes is the most a crash can lose. d of 0 or less
+// is SyncAlways.
+func SyncInterval(d time.Duration) SyncPolicy {
+	if d <= 0 {
+		return SyncAlways
+	}
+	return SyncPolicy(d)
+}
+
+// String is the policy as --sync takes it: always, never or the interval.
+func (p SyncPolicy) String() string {
+	switch p {
+	case SyncNever:
+		return "never"
+	case SyncAlways:
+		return "always"
+	}
+	return time.Duration(p).String()
+}
+
+// Set parses always, never or an interval like 100ms, for --sync.
+func (p *SyncPolicy) Set(s string) error {
+	switch s {
+	case "never":
+		*p = SyncNever
+	case "always":
+		*p = SyncAlways
+	default:
+		d, err := time.ParseDuration(s)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("want always, never or an interval like 100ms")
+		}
+		*p = SyncInterval(d)
+	}
+	return nil
+}
+
+// appended is called once a write has reached f, the active file: under SyncAlways
+// it syncs f, under the other policies it leaves that to the next sync.
+func (d *dataDir) appended(f *os.File) error {
+	if d.syncPolicy == SyncAlways {
+		return d.syncActive(f)
+	}
+	d.unsynced = true
+	return nil
+}
+
+// syncActive fsyncs f, the active file.
+func (d *dataDir) syncActive(f *os.File) error {
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("sync %s: %w", f.Name(), err)
+	}
+	d.unsynced = false
+	return nil
+}
+
+// sync flushes the active file and fsyncs it if anything was written to it since
+// it last was. Callers hold the store's mu.
+func (s *store) sync() error {
+	if err := s.w.Flush(); err != nil {
+		return err
+	}
+	if !s.dir.unsynced {
+		return nil
+	}
+	return s.dir.syncActive(s.f)
+}
+
+// startSyncer makes p the sync policy of s and, for an interval, syncs s at that
+// interval in the background. It returns a func that stops it. SyncNever leaves
+// the policy s has, so handles that don't ask for one don't undo another's.
+func startSyncer(s *store, p SyncPolicy) func() {
+	if p == SyncNever {
+		return func() {}
+	}
+	s.mu.Lock()
+	s.dir.syncPolicy = p
+	s.mu.Unlock()
+	if p == SyncAlways {
+		return func() {}
+	}
+	stop, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(time.Duration(p))
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			s.mu.Lock()
+			err := s.sync()
+			s.mu.Unlock()
+			if err != nil {
+				s.dir.logger.Error("sync failed", "dir", s.path, "err", err)
+			}
+		}
+	}()
+	return func() {
+		close(stop)
+		<-done
+	}
+}
@@ -0,0 +1,194 @@
+package gocask
+
+import (
+	"bufio"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EvictionPolicy is which keys a bounded store gives up first, see WithEviction.
+type EvictionPolicy int
+
+const (
+	EvictLRU EvictionPolicy = iota // least recently read or written
+	EvictLFU                       // least often read or written, halved per idle minute
+)
+
+// ParseEvictionPolicy parses lru or lfu.
+func ParseEvictionPolicy(s string) (EvictionPolicy, error) {
+	switch s {
+	case "lru":
+		return EvictLRU, nil
+	case "lfu":
+		return EvictLFU, nil
+	}
+	return 0, fmt.Errorf("unknown eviction policy %q (want lru or lfu)", s)
+}
+
+// EvictionOptions bound the store, see WithEviction.
+type EvictionOptions struct {
+	MaxKeys     int   // live keys to keep at most, 0 for no limit
+	MaxDataSize int64 // bytes of live records to keep at most, 0 for no limit
+	Policy      EvictionPolicy
+	Samples     int // keys compared per eviction, 16 if 0
+}
+
+func (o EvictionOptions) enabled() bool { return o.MaxKeys > 0 || o.MaxDataSize > 0 }
+
+// over reports whether keyDir holds more than the options allow.
+func (o EvictionOptions) over(keyDir *KeyDir) bool {
+	return (o.MaxKeys > 0 && keyDir.Live() > o.MaxKeys) ||
+		(o.MaxDataSize > 0 && keyDir.LiveBytes() > o.MaxDataSize)
+}
+
+// defaultEvictionSamples is how many keys each eviction compares unless told otherwise.
+const defaultEvictionSamples = 16
+
+// WithEviction turns the store into a bounded cache: once a put takes it past MaxKeys
+// live keys or MaxDataSize bytes of live records, keys are deleted until it is back
+// within both. Like redis it approximates the policy: each eviction compares a random
+// sample of keys and deletes the worst. Keys not read or written since the store was
+// opened count as the oldest and least used. The evictions are ordinary tombstones;
+// once they add up to a full active file, rotateIfFull merges them away. Internal keys
+// and bulk loads are left alone. Zero options turn eviction off.
+func WithEviction(opts EvictionOptions) Option {
+	return withSetting(func(s *store) error {
+		s.setEviction(opts)
+		return nil
+	})
+}
+
+// SetEviction replaces the store's eviction options, see WithEviction.
+func (db *DB) SetEviction(opts EvictionOptions) {
+	defer db.lock()()
+	db.s.setEviction(opts)
+}
+
+// setEviction replaces the eviction options of s. Callers hold the store's mu.
+func (s *store) setEviction(opts EvictionOptions) {
+	if opts.Samples <= 0 {
+		opts.Samples = defaultEvictionSamples
+	}
+	s.dir.eviction = opts
+	s.dir.updateTracking()
+}
+
+// updateTracking starts tracking how the keys of d are used once eviction, a
+// retention limit or a quota that evicts needs to know, and stops and forgets what
+// was tracked once none does. Callers hold the store's mu.
+func (d *dataDir) updateTracking() {
+	d.accesses.on = d.eviction.enabled() || d.retentionLimits || d.quotaEvicts
+	if !d.accesses.on {
+		d.accesses.clear()
+	}
+}
+
+// access is what eviction knows about the use of a key.
+type access struct {
+	last int64  // unix nanoseconds of the latest read or write
+	hits uint32 // reads and writes
+}
+
+// score ranks a key for policy: the lowest is evicted first.
+func (a access) score(policy EvictionPolicy, now int64) int64 {
+	if policy == EvictLRU {
+		return a.last
+	}
+	idle := (now - a.last) / int64(time.Minute)
+	return int64(a.hits) >> min(idle, 31)
+}
+
+// accessTable tracks reads and writes per key of a store while eviction, a retention
+// limit or a quota that evicts is on, sharded like KeyDir.
+type accessTable struct {
+	on     bool // set by updateTracking, and read under the store's mu like it
+	shards [keyDirShards]struct {
+		sync.Mutex
+		m map[string]access
+	}
+}
+
+// touch records a read or write of key.
+func (t *accessTable) touch(key string) {
+	if !t.on {
+		return
+	}
+	s := &t.shards[shardOf(key)]
+	s.Lock()
+	if s.m == nil {
+		s.m = make(map[string]access)
+	}
+	a := s.m[key]
+	s.m[key] = access{time.Now().UnixNano(), a.hits + 1}
+	s.Unlock()
+}
+
+func (t *accessTable) get(key string) access {
+	s := &t.shards[shardOf(key)]
+	s.Lock()
+	defer s.Unlock()
+	return s.m[key]
+}
+
+func (t *accessTable) forget(key string) {
+	if !t.on {
+		return
+	}
+	s := &t.shards[shardOf(key)]
+	s.Lock()
+	delete(s.m, key)
+	s.Unlock()
+}
+
+func (t *accessTable) clear() {
+	for i := range t.shards {
+		s := &t.shards[i]
+		s.Lock()
+		s.m = nil
+		s.Unlock()
+	}
+}
+
+// evictOverflow deletes keys until keyDir is within the eviction limits again. kept,
+// the key just written, is never picked.
+func evictOverflow(kept string, f *os.File, w *bufio.Writer, keyDir *KeyDir) error {
+	for keyDir.dir.eviction.over(keyDir) {
+		victim, fo, ok := pickVictim(kept, "", keyDir)
+		if !ok {
+			return nil // nothing left that may go
+		}
+		if err := deleteAt(victim, keyDir.dir.newTimestamp(), f, w, keyDir); err != nil {
+			return fmt.Errorf("evict %q: %w", victim, err)
+		}
+		keyDir.dir.metrics.evicted.Add(1)
+		keyDir.dir.evictedBytes += fo.recordSize(victim)
+		keyDir.dir.logger.Debug("evicted", "key", victim)
+	}
+	return nil
+}
+
+// pickVictim samples live keys under prefix from a random shard and returns the one
+// the policy ranks lowest.
+func pickVictim(kept, prefix string, keyDir *KeyDir) (string, FileOffset, bool) {
+	var victim string
+	var victimFO FileOffset
+	var best int64
+	now := time.Now().UnixNano()
+	opts := &keyDir.dir.eviction
+	sampled, visited := 0, 0
+	keyDir.rangeFrom(rand.IntN(keyDirShards), func(key string, fo FileOffset) bool {
+		visited++
+		if !fo.Tombstone() && key != kept && !isInternalKey([]byte(key)) && strings.HasPrefix(key, prefix) {
+			if score := keyDir.dir.accesses.get(key).score(opts.Policy, now); sampled == 0 || score < best {
+				victim, victimFO, best = key, fo, score
+			}
+			sampled++
+		}
+		return sampled < opts.Samples && visited < opts.Samples*sweepScanLimit
+	})
+	return victim, victimFO, sampled > 0
+}
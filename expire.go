@@ -0,0 +1,126 @@
+package gocask
+
+import (
+	"math/rand/v2"
+	"time"
+)
+
+// sweepScanLimit bounds how many index entries one sweep round walks past per
+// expiring key it wants, so stores where few keys have a TTL aren't scanned whole.
+const sweepScanLimit = 100
+
+// ExpirySweeper deletes keys whose TTL has run out, so ones nobody reads again don't
+// hold index memory and disk space until a merge. Like redis it samples: each round
+// looks at up to Sample expiring keys from a random spot in the index, deletes the
+// expired ones, and goes again right away while more than a quarter of them had
+// expired. Each round also enforces the retention limits, see WithRetention. The
+// deletes are ordinary tombstones, so merges reclaim the space and the changefeed and
+// replicas see them.
+type ExpirySweeper struct {
+	DB       *DB
+	Interval time.Duration // between rounds, 1s if 0
+	Sample   int           // expiring keys looked at per round, 20 if 0
+}
+
+// Run sweeps until stop is closed. Each round holds the store's mu.
+func (sw *ExpirySweeper) Run(stop <-chan struct{}) {
+	interval, sample := sw.Interval, sw.Sample
+	if interval <= 0 {
+		interval = time.Second
+	}
+	if sample <= 0 {
+		sample = 20
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		sw.DB.s.mu.Lock()
+		if _, err := sw.DB.s.enforceRetention(); err != nil {
+			sw.DB.s.dir.logger.Error("retention failed", "err", err)
+		}
+		sw.DB.s.mu.Unlock()
+		for {
+			sw.DB.s.mu.Lock()
+			checked, deleted, err := sw.DB.s.sweepExpired(sample)
+			if err == nil {
+				err = sw.DB.s.rotateIfFull()
+			}
+			sw.DB.s.mu.Unlock()
+			if err != nil {
+				sw.DB.s.dir.logger.Error("expiry sweep failed", "err", err)
+				break
+			}
+			if deleted > 0 {
+				sw.DB.s.dir.logger.Debug("expired keys deleted", "checked", checked, "deleted", deleted)
+			}
+			if deleted*4 <= checked {
+				break
+			}
+			select {
+			case <-stop:
+				return
+			default:
+			}
+		}
+	}
+}
+
+// sweepExpired deletes the expired keys among up to sample expiring ones and returns
+// how many it looked at and deleted. A store that went read-only keeps its expired
+// keys until it can write again. Callers hold the store's mu.
+func (s *store) sweepExpired(sample int) (checked, deleted int, err error) {
+	if s.dir.checkWritable() != nil {
+		return 0, 0, nil
+	}
+	type entry struct {
+		key string
+		fo  FileOffset
+	}
+	var found []entry
+	visited := 0
+	s.keyDir.rangeFrom(rand.IntN(keyDirShards), func(key string, fo FileOffset) bool {
+		visited++
+		if fo.Expiring() {
+			found = append(found, entry{key, fo})
+		}
+		return len(found) < sample && visited < sample*sweepScanLimit
+	})
+
+	for _, e := range found {
+		gone, err := s.dir.hasExpired(e.key, e.fo)
+		if err != nil {
+			return len(found), deleted, err
+		}
+		if !gone {
+			continue
+		}
+		if err := deleteAt(e.key, s.dir.newTimestamp(), s.f, s.w, s.keyDir); err != nil {
+			return len(found), deleted, err
+		}
+		s.dir.metrics.expired.Add(1)
+		deleted++
+	}
+	return len(found), deleted, nil
+}
+
+// startSweeper runs an ExpirySweeper over db every interval, unless that is 0, and
+// returns a func that stops it.
+func startSweeper(db *DB, interval time.Duration) func() {
+	if interval <= 0 {
+		return func() {}
+	}
+	stop, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		(&ExpirySweeper{DB: db, Interval: interval}).Run(stop)
+	}()
+	return func() {
+		close(stop)
+		<-done
+	}
+}
@@ -0,0 +1,103 @@
+package gocask
+
+import (
+	"expvar"
+	"time"
+)
+
+// The same counters as the prometheus collector, published as the "gocask" expvar.
+// Importing expvar registers /debug/vars on http.DefaultServeMux, so an application
+// that embeds the store and serves the default mux gets them with no setup. The
+// counters and gauges add up every store open in the process.
+func init() {
+	expvar.Publish("gocask", expvar.Func(expvarStats))
+}
+
+func expvarStats() any {
+	g, m := openGauges(), openStats()
+	count, sum, _ := m.mergeHistogram()
+
+	var lastMerge string
+	if t := m.lastMergeTime(); !t.IsZero() {
+		lastMerge = t.UTC().Format(time.RFC3339)
+	}
+	writeAmp, readAmp := m.amplification()
+	latency := make(map[string]any)
+	for _, op := range m.latencyOps() {
+		s := op.h.summary()
+		latency[op.name] = map[string]any{
+			"count":  s.Count,
+			"p50_us": s.P50.Microseconds(),
+			"p95_us": s.P95.Microseconds(),
+			"p99_us": s.P99.Microseconds(),
+			"max_us": s.Max.Microseconds(),
+		}
+	}
+	return map[string]any{
+		"puts":                m.puts.Load(),
+		"gets":                m.gets.Load(),
+		"deletes":             m.deletes.Load(),
+		"get_misses":          m.getMisses.Load(),
+		"bytes_written":       m.bytesWritten.Load(),
+		"bytes_read":          m.bytesRead.Load(),
+		"bytes_returned":      m.bytesReturned.Load(),
+		"compaction_written":  m.compactionWritten.Load(),
+		"compaction_read":     m.compactionRead.Load(),
+		"write_amplification": writeAmp,
+		"read_amplification":  readAmp,
+		"keys":                g.keys,
+		"disk_full_errors":    m.diskFull.Load(),
+		"read_only":           g.readOnly,
+		"cache_hits":          m.cacheHits.Load(),
+		"cache_misses":        m.cacheMisses.Load(),
+		"expired":             m.expired.Load(),
+		"evicted":             m.evicted.Load(),
+		"segments":            g.segments,
+		"disk_bytes":          g.diskBytes,
+		"merges":              count,
+		"merge_seconds":       sum,
+		"last_merge":          lastMerge,
+		"latency":             latency,
+		"merge":               mergeVar(g.merge),
+		"backup":              backupVar(m),
+	}
+}
+
+func backupVar(m *opStats) any {
+	st, ok := m.backupStatus()
+	if !ok {
+		return nil
+	}
+	okCount, failed := m.backupCounts()
+	v := map[string]any{"succeeded": okCount, "failed": failed}
+	if !st.LastSuccess.IsZero() {
+		v["last_success"] = st.LastSuccess.UTC().Format(time.RFC3339)
+		v["last_name"] = st.LastName
+	}
+	if !st.LastFailure.IsZero() {
+		v["last_failure"] = st.LastFailure.UTC().Format(time.RFC3339)
+		v["last_error"] = st.LastError
+	}
+	return v
+}
+
+func mergeVar(p *MergeProgress) any {
+	if p == nil {
+		return nil
+	}
+	v := map[string]any{
+		"state":             p.State,
+		"segments_done":     p.SegmentsDone,
+		"segments_total":    p.SegmentsTotal,
+		"bytes_processed":   p.BytesProcessed,
+		"bytes_total":       p.BytesTotal,
+		"records_copied":    p.RecordsCopied,
+		"started":           p.Started.UTC().Format(time.RFC3339),
+		"elapsed_seconds":   p.Elapsed.Seconds(),
+		"remaining_seconds": p.Remaining.Seconds(),
+	}
+	if p.Err != nil {
+		v["error"] = p.Err.Error()
+	}
+	return v
+}
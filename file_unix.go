@@ -0,0 +1,40 @@
+//go:build !windows
+
+package gocask
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// closeBeforeRename is whether a file has to be closed before it can be renamed.
+const closeBeforeRename = false
+
+// syncDir flushes dir's entries, so renames and removals in it survive a power cut.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// isDiskFull reports whether err means the filesystem ran out of space or quota.
+func isDiskFull(err error) bool {
+	return errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EDQUOT)
+}
+
+// diskSpace returns the bytes free to unprivileged users and the size of the
+// filesystem dir is on.
+func diskSpace(dir string) (free, total uint64, err error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, 0, err
+	}
+	return uint64(st.Bavail) * uint64(st.Bsize), uint64(st.Blocks) * uint64(st.Bsize), nil
+}
+
+// removeFile deletes name. Open handles elsewhere don't stop it on unix.
+func removeFile(name string) error { return os.Remove(name) }
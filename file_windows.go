@@ -0,0 +1,63 @@
+//go:build windows
+
+package gocask
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// Windows won't rename or delete a file something has open: gocask itself while it
+// appends to data.txt, or another gocask process reading a segment.
+const closeBeforeRename = true
+
+// errSharingViolation is ERROR_SHARING_VIOLATION, which syscall doesn't name.
+const errSharingViolation = syscall.Errno(32)
+
+// ERROR_HANDLE_DISK_FULL and ERROR_DISK_FULL, which syscall doesn't name either.
+const (
+	errHandleDiskFull = syscall.Errno(39)
+	errDiskFull       = syscall.Errno(112)
+)
+
+// isDiskFull reports whether err means the volume ran out of space.
+func isDiskFull(err error) bool {
+	return errors.Is(err, errHandleDiskFull) || errors.Is(err, errDiskFull)
+}
+
+var getDiskFreeSpaceEx = syscall.NewLazyDLL("kernel32.dll").NewProc("GetDiskFreeSpaceExW")
+
+// diskSpace returns the bytes free to the calling user and the size of the volume dir
+// is on.
+func diskSpace(dir string) (free, total uint64, err error) {
+	p, err := syscall.UTF16PtrFromString(dir)
+	if err != nil {
+		return 0, 0, err
+	}
+	r, _, err := getDiskFreeSpaceEx.Call(uintptr(unsafe.Pointer(p)),
+		uintptr(unsafe.Pointer(&free)), uintptr(unsafe.Pointer(&total)), 0)
+	if r == 0 {
+		return 0, 0, err
+	}
+	return free, total, nil
+}
+
+// syncDir is a no-op: Windows can't open a directory for flushing, and NTFS journals
+// renames and removals by itself.
+func syncDir(dir string) error { return nil }
+
+// removeFile deletes name, waiting a little for readers in other processes to close it.
+func removeFile(name string) error {
+	var err error
+	for wait := 10 * time.Millisecond; wait < 2*time.Second; wait *= 2 {
+		err = os.Remove(name)
+		if !errors.Is(err, errSharingViolation) && !errors.Is(err, syscall.ERROR_ACCESS_DENIED) {
+			return err
+		}
+		time.Sleep(wait)
+	}
+	return err
+}
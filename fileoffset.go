@@ -0,0 +1,137 @@
+package gocask
+
+import "sync"
+
+// FileOffset is where the record of a key lives. There is one per key in keyDir, so
+// it is packed into 16 bytes without pointers: the file as an id into segmentNames,
+// the offset in the low 48 bits of pos with the record's flag in the top bits, and
+// the value size. Without pointers the garbage collector doesn't have to scan keyDir's
+// values either.
+type FileOffset struct {
+	seg  uint32
+	size uint32 // value length, so a read can fetch the whole record at once
+	pos  uint64
+}
+
+const (
+	offsetBits     = 48
+	offsetMask     = 1<<offsetBits - 1
+	entryTombstone = 1 << 63
+	entryExpiring  = 1 << 62
+	entryMeta      = 1 << 61
+	entryChunked   = 1 << 60
+)
+
+// maxOffset is the largest offset a FileOffset holds, 256TiB into a file.
+const maxOffset = offsetMask
+
+// newFileOffset points at the record at off in file, whose flag and value size are
+// given; the value size counts any expiry and metadata stored ahead of the value.
+func newFileOffset(file string, off int64, flag byte, valueSize uint32) FileOffset {
+	fo := FileOffset{seg: segmentID(file), size: valueSize, pos: uint64(off) & offsetMask}
+	switch flag {
+	case flagTombstone:
+		fo.pos |= entryTombstone
+	case flagExpiring:
+		fo.pos |= entryExpiring
+	case flagMeta:
+		fo.pos |= entryMeta
+	case flagChunked:
+		fo.pos |= entryChunked
+	}
+	return fo
+}
+
+// FileID is the name of the data file holding the record.
+func (fo FileOffset) FileID() string { return segmentName(fo.seg) }
+
+// Offset is where the record starts in the file.
+func (fo FileOffset) Offset() int64 { return int64(fo.pos & offsetMask) }
+
+// Tombstone reports whether the record is a delete marker.
+func (fo FileOffset) Tombstone() bool { return fo.pos&entryTombstone != 0 }
+
+// Expiring reports whether the record may have a TTL: it was written with one, or
+// with metadata or in chunks, which leave room for one. Its expiry says whether it does.
+func (fo FileOffset) Expiring() bool { return fo.pos&(entryExpiring|entryMeta|entryChunked) != 0 }
+
+// HasMeta reports whether the record was written with metadata.
+func (fo FileOffset) HasMeta() bool { return fo.pos&entryMeta != 0 }
+
+// Chunked reports whether the record is the manifest of a value stored in chunks,
+// which may have metadata too.
+func (fo FileOffset) Chunked() bool { return fo.pos&entryChunked != 0 }
+
+// flag is the flag of the record fo points at.
+func (fo FileOffset) flag() byte {
+	switch {
+	case fo.Tombstone():
+		return flagTombstone
+	case fo.Chunked():
+		return flagChunked
+	case fo.HasMeta():
+		return flagMeta
+	case fo.Expiring():
+		return flagExpiring
+	}
+	return flagNormal
+}
+
+// ValueSize is the length of the record's value.
+func (fo FileOffset) ValueSize() uint32 { return fo.size }
+
+// recordSize is the size of the record fo points at, whose key is key.
+func (fo FileOffset) recordSize(key string) int64 {
+	return int64(headerSize+len(key)) + int64(fo.size)
+}
+
+// segmentNames interns data file names, so keyDir entries carry a 4-byte id instead of
+// a string each. Ids are never reused; a removed segment's name just stays behind.
+var segmentNames struct {
+	sync.RWMutex
+	ids   map[string]uint32
+	names []string
+}
+
+// segmentID returns the id of the data file name, assigning one if it has none yet.
+func segmentID(name string) uint32 {
+	segmentNames.RLock()
+	id, ok := segmentNames.ids[name]
+	segmentNames.RUnlock()
+	if ok {
+		return id
+	}
+	segmentNames.Lock()
+	defer segmentNames.Unlock()
+	if id, ok := segmentNames.ids[name]; ok {
+		return id
+	}
+	if segmentNames.ids == nil {
+		segmentNames.ids = make(map[string]uint32)
+	}
+	id = uint32(len(segmentNames.names))
+	segmentNames.names = append(segmentNames.names, name)
+	segmentNames.ids[name] = id
+	return id
+}
+
+func segmentName(id uint32) string {
+	segmentNames.RLock()
+	defer segmentNames.RUnlock()
+	return segmentNames.names[id]
+}
+
+// renameSegment moves the id of from over to to, so every entry that pointed into from
+// now points into to. from gets a fresh id the next time it is used. Rotation uses it
+// to repoint the active file's records at their sealed segment without touching keyDir.
+func renameSegment(from, to string) {
+	segmentNames.Lock()
+	defer segmentNames.Unlock()
+	id, ok := segmentNames.ids[from]
+	if !ok {
+		return
+	}
+	delete(segmentNames.ids, from)
+	segmentNames.names[id] = to
+	segmentNames.ids[to] = id
+}
@@ -0,0 +1,210 @@
+package gocask
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// FuzzRecord decodes data as a data file, checks that every record decoded re-encodes
+// to the bytes it came from, batch headers included, and round-trips records built
+// from data, a batch of them too.
+func FuzzRecord(f *testing.F) {
+	for _, seed := range fuzzSeeds() {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var decoded int64
+		scanRecordsAll("fuzz", bufio.NewReader(bytes.NewReader(data)), int64(len(data)), true, func(off int64, r record) error {
+			if off != decoded {
+				t.Fatalf("record at %d, expected %d", off, decoded)
+			}
+			decoded += r.size()
+			if decoded > int64(len(data)) {
+				t.Fatalf("records add up to %d of %d bytes", decoded, len(data))
+			}
+			if enc := encodeFuzzRecord(r); enc != nil && !bytes.Equal(enc, data[off:decoded]) {
+				t.Fatalf("record at %d re-encodes differently", off)
+			}
+			return nil
+		})
+
+		// and the other way: anything written must read back unchanged
+		key, value := data[:len(data)/2], data[len(data)/2:]
+		ts := uint64(len(data))<<16 | 1
+		var buf bytes.Buffer
+		w := bufio.NewWriter(&buf)
+		writeEntry(w, key, value, ts)
+		writeTombstone(w, key, ts+1)
+		writeExpiring(w, key, value, ts+2, ts)
+		meta := Metadata{"origin": string(key[:min(len(key), maxMetaField)])}
+		enc, err := encodeMeta(meta)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeMeta(w, key, enc, value, ts+3, ts)
+		writeChunked(w, key, enc, value, ts+4, 0)
+		writeBatchHeader(w, 2, 2*(headerSize+int64(len(key)+len(value))), ts+5)
+		writeEntry(w, key, value, ts+6)
+		writeEntry(w, key, value, ts+7)
+		w.Flush()
+		var got []record
+		if err := scanRecords("roundtrip", bufio.NewReader(bytes.NewReader(buf.Bytes())), int64(buf.Len()), func(_ int64, r record) error {
+			r.key, r.value = bytes.Clone(r.key), bytes.Clone(r.value) // scanRecords reuses them
+			got = append(got, r)
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != 7 || got[0].flag != flagNormal || got[0].ts != ts || !bytes.Equal(got[0].key, key) || !bytes.Equal(got[0].value, value) ||
+			got[1].flag != flagTombstone || got[1].ts != ts+1 || !bytes.Equal(got[1].key, key) || len(got[1].value) != 0 ||
+			got[2].flag != flagExpiring || got[2].ts != ts+2 || got[2].expires() != ts || !bytes.Equal(got[2].data(), value) ||
+			got[3].flag != flagMeta || got[3].ts != ts+3 || got[3].expires() != ts || !bytes.Equal(got[3].data(), value) ||
+			got[3].meta()["origin"] != meta["origin"] ||
+			got[4].flag != flagChunked || got[4].ts != ts+4 || got[4].expires() != 0 || !bytes.Equal(got[4].data(), value) ||
+			got[5].ts != ts+6 || got[6].ts != ts+7 || !bytes.Equal(got[6].key, key) || !bytes.Equal(got[6].value, value) {
+			t.Fatal("record round trip changed the record")
+		}
+	})
+}
+
+// encodeFuzzRecord encodes r the way the store writes it, or returns nil for records
+// the store never writes, like tombstones with a value.
+func encodeFuzzRecord(r record) []byte {
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	switch {
+	case r.flag == flagNormal:
+		writeEntry(w, r.key, r.value, r.ts)
+	case r.flag == flagTombstone && len(r.value) == 0:
+		writeTombstone(w, r.key, r.ts)
+	case r.flag == flagExpiring && len(r.value) >= expirySize:
+		writeExpiring(w, r.key, r.data(), r.ts, r.expires())
+	case r.flag == flagMeta || r.flag == flagChunked:
+		expires, meta, data := splitValue(r.flag, r.value)
+		if len(r.value) < metaPrefixSize || metaPrefixSize+len(meta)+len(data) != len(r.value) {
+			return nil
+		}
+		writeWithMeta(w, r.flag, r.key, meta, data, r.ts, expires)
+	case r.flag == flagBatch && len(r.key) == 0:
+		count, size, ok := decodeBatch(r.value)
+		if !ok {
+			return nil
+		}
+		writeBatchHeader(w, int(count), size, r.ts)
+	default:
+		return nil
+	}
+	w.Flush()
+	return buf.Bytes()
+}
+
+// FuzzHint decodes data as a hint file and round-trips a hint entry built from data.
+func FuzzHint(f *testing.F) {
+	for _, seed := range fuzzSeeds() {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var pos int64
+		scanHints("fuzz", bufio.NewReader(bytes.NewReader(data)), int64(len(data)), func(p int64, key []byte, off int64, valLen uint32, flag byte) error {
+			if p != pos {
+				t.Fatalf("hint entry at %d, expected %d", p, pos)
+			}
+			if off < 0 {
+				t.Fatalf("negative offset %d", off)
+			}
+			pos += hintEntrySize(len(key))
+			if pos > int64(len(data)) {
+				t.Fatalf("hint entries add up to %d of %d bytes", pos, len(data))
+			}
+			return nil
+		})
+
+		var off int64
+		if len(data) >= 8 {
+			off = int64(binary.BigEndian.Uint64(data) &^ hintFlags)
+		}
+		flag := byte(len(data) % 5) // flagNormal, flagTombstone, flagExpiring, flagMeta or flagChunked
+		valLen := uint32(len(data) * 7)
+		var buf bytes.Buffer
+		w := bufio.NewWriter(&buf)
+		writeHintEntry(w, string(data), off, valLen, flag)
+		w.Flush()
+		n := 0
+		if err := scanHints("roundtrip", bufio.NewReader(bytes.NewReader(buf.Bytes())), int64(buf.Len()), func(_ int64, key []byte, o int64, v uint32, f byte) error {
+			if !bytes.Equal(key, data) || o != off || v != valLen || f != flag {
+				t.Fatal("hint round trip changed the entry")
+			}
+			n++
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if n != 1 {
+			t.Fatalf("hint round trip read %d entries", n)
+		}
+	})
+}
+
+// FuzzRecovery runs the resilient scanner over data: every byte must end up either
+// in a record it returned or in a damaged region it reported, never both.
+func FuzzRecovery(f *testing.F) {
+	for _, seed := range fuzzSeeds() {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var report RecoveryReport
+		var covered, next int64
+		end, err := scanRecordsResilient("fuzz", bufio.NewReader(bytes.NewReader(data)), int64(len(data)), &report, func(off int64, r record) error {
+			if off < next {
+				t.Fatalf("record at %d overlaps the one before, which ends at %d", off, next)
+			}
+			if _, _, _, ok := plausibleHeader(data[off:off+headerSize], int64(len(data))-off); !ok {
+				t.Fatalf("returned an implausible record at %d", off)
+			}
+			if err := checkRecord(data[off:off+r.size()], "fuzz", off); err != nil {
+				t.Fatalf("returned a record that fails its checksum: %v", err)
+			}
+			next = off + r.size()
+			covered += r.size()
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if end != next {
+			t.Fatalf("reported end %d, last record ends at %d", end, next)
+		}
+		var last int64
+		for _, d := range report.Regions {
+			if d.Offset < last || d.Length <= 0 {
+				t.Fatalf("damaged region %+v out of order", d)
+			}
+			last = d.Offset + d.Length
+		}
+		if covered+report.BytesLost != int64(len(data)) {
+			t.Fatalf("%d bytes in records and %d lost, of %d", covered, report.BytesLost, len(data))
+		}
+	})
+}
+
+// fuzzSeeds are a few well-formed data and hint files to start mutating from.
+func fuzzSeeds() [][]byte {
+	var data, hint bytes.Buffer
+	dw, hw := bufio.NewWriter(&data), bufio.NewWriter(&hint)
+	var off int64
+	for i, key := range []string{"a", "user/1", "", "k"} {
+		value := bytes.Repeat([]byte{byte('0' + i)}, i*3)
+		ts := uint64(i+1) << 16
+		writeEntry(dw, []byte(key), value, ts)
+		writeHintEntry(hw, key, off, uint32(len(value)), flagNormal)
+		off += int64(headerSize + len(key) + len(value))
+		writeTombstone(dw, []byte(key), ts+1<<16)
+		writeHintEntry(hw, key, off, 0, flagTombstone)
+		off += int64(headerSize + len(key))
+	}
+	dw.Flush()
+	hw.Flush()
+	return [][]byte{nil, data.Bytes(), hint.Bytes(), data.Bytes()[:headerSize+3]}
+}
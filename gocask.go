@@ -1,396 +1,709 @@
-package main
+package gocask
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
-	"github.com/gofrs/flock"
+	"hash/crc32"
 	"io"
 	"os"
 	"path/filepath"
+	"runtime"
 	"sort"
 	"strings"
+	"sync"
 	"time"
+
+	"github.com/itsknk/gocask/internal/failpoint"
 )
 
 const (
     flagNormal    byte = 0
     flagTombstone byte = 1
+    flagExpiring  byte = 2 // a value with a TTL, see writeExpiring
+    flagMeta      byte = 3 // a value with metadata and maybe a TTL, see writeMeta
+    flagChunked   byte = 4 // the manifest of a value stored in chunks, see writeChunked
+    flagBatch     byte = 5 // opens a batch of records written together, see writeBatchHeader
 )
 
-var activeFileSize int64 = 0 // tracks the size of the active file
+// every record starts with flag(1) | timestamp(8) | keyLen(4) | valLen(4) | crc(4),
+// where crc is the CRC-32C of the rest of the header, the key and the value
+const headerSize = 1 + 8 + 4 + 4 + 4
+
+// crcOffset is where the checksum sits in the header, after everything it covers
+const crcOffset = headerSize - 4
+
+// an expiring record's value starts with when it expires, in unix nanoseconds;
+// valLen counts it, so records are laid out and sized like any other
+const expirySize = 8
+
+// a record with metadata has room for an expiry (0 for none) whether it has one or
+// not, followed by the length of the metadata and the metadata, see encodeMeta
+const metaPrefixSize = expirySize + 2
+
+// newTimestamp returns the timestamp for a new record: unix nanoseconds with the low
+// 16 bits replaced by the store's node id. Two sites can never produce the same value, so comparing
+// timestamps alone orders writes by (time, node). Values only ever go up, even if the
+// wall clock steps backwards. Each store keeps its own clock. Callers hold the
+// store's mu.
+func (d *dataDir) newTimestamp() uint64 {
+	ts := uint64(time.Now().UnixNano())&^0xffff | uint64(d.node)
+	if ts <= d.lastTimestamp {
+		ts = (d.lastTimestamp&^0xffff + 0x10000) | uint64(d.node)
+	}
+	d.lastTimestamp = ts
+	return ts
+}
 
-type FileOffset struct {
-	FileID string
-	Offset int64
+// WithNodeID sets the id the store stamps on the records it writes, which tells the
+// sites replicating to each other apart: each of them needs its own. It is 0
+// without it.
+func WithNodeID(id uint16) Option {
+	return withSetting(func(s *store) error {
+		s.dir.node = id
+		return nil
+	})
 }
 
+// NodeID is the id the store stamps on the records it writes, see WithNodeID.
+func (db *DB) NodeID() uint16 { return db.s.dir.node }
+
+// TimestampNode extracts the id of the node that wrote a record, see WithNodeID.
+func TimestampNode(ts uint64) uint16 { return uint16(ts & 0xffff) }
 
-// writeEntry writes a normal key→value record (with a 1-byte flag prefix).
-func writeEntry(w *bufio.Writer, key, value []byte) {
-	w.WriteByte(flagNormal)
-	binary.Write(w, binary.BigEndian, uint32(len(key)))
-	binary.Write(w, binary.BigEndian, uint32(len(value)))
-	w.Write(key)
-	w.Write(value)
-	activeFileSize += int64(1 + 8 + len(key) + len(value))
+
+
+// writeEntry writes a normal key→value record (with a 1-byte flag prefix) and
+// returns how many bytes of it reached w.
+func writeEntry(w *bufio.Writer, key, value []byte, ts uint64) (int, error) {
+	return writeRecord(w, flagNormal, key, value, ts)
 }
 
 
 // writeTombstone writes a delete marker for key.
-func writeTombstone(w *bufio.Writer, key []byte) {
-	w.WriteByte(flagTombstone)
-	binary.Write(w, binary.BigEndian, uint32(len(key)))
-	binary.Write(w, binary.BigEndian, uint32(0)) // no value
-	w.Write(key)
-	activeFileSize += int64(1 + 8 + len(key))
+func writeTombstone(w *bufio.Writer, key []byte, ts uint64) (int, error) {
+	return writeRecord(w, flagTombstone, key, nil, ts) // no value
 }
 
 
-// Delete marks a key as deleted: writes a tombstone and updates keyDir.
-func Delete(key string, f *os.File, w *bufio.Writer, keyDir map[string]FileOffset) error {
-	offset, err := f.Seek(0, io.SeekCurrent)
+// writeExpiring writes a key→value record that stops counting at expires.
+func writeExpiring(w *bufio.Writer, key, value []byte, ts, expires uint64) (int, error) {
+	var expiry [expirySize]byte
+	binary.BigEndian.PutUint64(expiry[:], expires)
+	n, err := w.Write(appendHeader(w.AvailableBuffer(), flagExpiring, ts, key, expiry[:], value))
 	if err != nil {
-		return err
+		return n, err
+	}
+	k, err := w.Write(key)
+	if n += k; err != nil {
+		return n, err
+	}
+	e, err := w.Write(expiry[:])
+	if n += e; err != nil {
+		return n, err
 	}
-	writeTombstone(w, []byte(key))
-	w.Flush()
-	keyDir[key] = FileOffset{"data.txt", offset}
-	return nil
+	v, err := w.Write(value)
+	return n + v, err
+}
+
+
+// writeMeta writes a key→value record carrying encoded metadata, which expires at
+// expires unless that is 0.
+func writeMeta(w *bufio.Writer, key, meta, value []byte, ts, expires uint64) (int, error) {
+	return writeWithMeta(w, flagMeta, key, meta, value, ts, expires)
 }
 
 
-// implies?
-func ReadData() {
-	// open the file
-	f, err := os.Open("data.txt")
+// writeChunked writes the manifest of a value stored in chunks, laid out like a record
+// with metadata whose value is the manifest, see putChunks.
+func writeChunked(w *bufio.Writer, key, meta, manifest []byte, ts, expires uint64) (int, error) {
+	return writeWithMeta(w, flagChunked, key, meta, manifest, ts, expires)
+}
+
+
+// writeWithMeta writes a record with flag whose value is expiry(8) | metaLen(2) |
+// meta | value.
+func writeWithMeta(w *bufio.Writer, flag byte, key, meta, value []byte, ts, expires uint64) (int, error) {
+	var prefix [metaPrefixSize]byte
+	binary.BigEndian.PutUint64(prefix[:], expires)
+	binary.BigEndian.PutUint16(prefix[expirySize:], uint16(len(meta)))
+	n, err := w.Write(appendHeader(w.AvailableBuffer(), flag, ts, key, prefix[:], meta, value))
 	if err != nil {
-		fmt.Println(err)
-		return
-	}
-	// defer immediately to ensure file gets closed if program quits in middle
-	defer f.Close()
-
-	// reading binary
-	reader := bufio.NewReader(f)
-	for {
-		var keyLen uint32
-		var valueLen uint32
-
-		// read 4 bytes for key length
-		err = binary.Read(reader, binary.BigEndian, &keyLen)
-		if err != nil {
-			if err == io.EOF {
-				break // normal end of the line
-			}
-			fmt.Println("Error reading key length:", err) // handle errors
-			return                                        // stop immediately on any read error
-		}
+		return n, err
+	}
+	k, err := w.Write(key)
+	if n += k; err != nil {
+		return n, err
+	}
+	e, err := w.Write(prefix[:])
+	if n += e; err != nil {
+		return n, err
+	}
+	m, err := w.Write(meta)
+	if n += m; err != nil {
+		return n, err
+	}
+	v, err := w.Write(value)
+	return n + v, err
+}
 
-		// read 4 bytes for value length
-		err = binary.Read(reader, binary.BigEndian, &valueLen)
-		if err != nil {
-			if err == io.EOF {
-				break // normal end of the line
-			}
-			fmt.Println("Error reading value length:", err) // handle errors
-			return                                          // stop
-		}
 
-		key := make([]byte, keyLen)
-		value := make([]byte, valueLen)
+// writeRecord writes one record. On error the record may be partly in w, the caller
+// has to cut it off again.
+func writeRecord(w *bufio.Writer, flag byte, key, value []byte, ts uint64) (int, error) {
+	// encoded straight into w's free space, so the header needs no buffer of its own
+	n, err := w.Write(appendHeader(w.AvailableBuffer(), flag, ts, key, value))
+	if err != nil {
+		return n, err
+	}
+	k, err := w.Write(key)
+	if n += k; err != nil {
+		return n, err
+	}
+	v, err := w.Write(value)
+	return n + v, err
+}
+
 
-		// read exact key bytes
-		_, err = io.ReadFull(reader, key)
-		if err != nil {
-			fmt.Println("Error reading key:", err)
-			return
-		}
+// appendHeader appends the header of a record for key to b, with its checksum. The
+// record's value is the parts of value one after the other.
+func appendHeader(b []byte, flag byte, ts uint64, key []byte, value ...[]byte) []byte {
+	valLen := 0
+	for _, v := range value {
+		valLen += len(v)
+	}
+	start := len(b)
+	b = append(b, flag)
+	b = binary.BigEndian.AppendUint64(b, ts)
+	b = binary.BigEndian.AppendUint32(b, uint32(len(key)))
+	b = binary.BigEndian.AppendUint32(b, uint32(valLen))
+	crc := crc32.Update(crc32.Checksum(b[start:], crcTable), crcTable, key)
+	for _, v := range value {
+		crc = crc32.Update(crc, crcTable, v)
+	}
+	return binary.BigEndian.AppendUint32(b, crc)
+}
 
-		// read exact value bytes
-		_, err = io.ReadFull(reader, value)
-		if err != nil {
-			fmt.Println("Error reading value:", err)
-			return
+
+// put appends a key→value record and points keyDir at it.
+func put(key, value string, f *os.File, w *bufio.Writer, keyDir *KeyDir) error {
+	return putContext(context.Background(), key, value, f, w, keyDir)
+}
+
+
+// putAt is Put with the caller choosing the record timestamp (replication keeps the
+// origin's), when the value expires, in unix nanoseconds (0 keeps it forever), and
+// the metadata stored with it. Values bigger than the chunk size are stored in
+// chunks, see putChunks.
+func putAt(key, value string, ts, expires uint64, meta Metadata, f *os.File, w *bufio.Writer, keyDir *KeyDir) error {
+	d := keyDir.dir
+	if err := d.checkWritable(); err != nil {
+		return err
+	}
+	enc, err := encodeMeta(meta)
+	if err != nil {
+		return err
+	}
+	prev, had := keyDir.Get(key)
+	if err := checkQuotas(key, prev, had, keyDir.dir.putSize(key, len(value), enc, expires), keyDir); err != nil {
+		return err
+	}
+	var manifest []byte
+	if chunkSize := keyDir.dir.chunkSize; chunkSize > 0 && len(value) > chunkSize && !isChunkKey(key) {
+		if manifest, err = putChunks(key, value, ts, f, w, keyDir); err != nil {
+			return err
 		}
+	}
+	offset, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	flag, size := flagNormal, len(value)
+	var n int
+	switch {
+	case manifest != nil:
+		flag, size = flagChunked, metaPrefixSize+len(enc)+len(manifest)
+		n, err = writeChunked(w, []byte(key), enc, manifest, ts, expires)
+	case enc != nil:
+		flag, size = flagMeta, metaPrefixSize+len(enc)+len(value)
+		n, err = writeMeta(w, []byte(key), enc, []byte(value), ts, expires)
+	case expires != 0:
+		flag, size = flagExpiring, expirySize+len(value)
+		n, err = writeExpiring(w, []byte(key), []byte(value), ts, expires)
+	default:
+		n, err = writeEntry(w, []byte(key), []byte(value), ts)
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = d.appended(f)
+	}
+	if err != nil {
+		return d.abortAppend(f, w, offset, err)
+	}
+	d.activeSize += int64(n)
+	keyDir.dir.cache.invalidate(key)
+	keyDir.set(key, newFileOffset(d.active, offset, flag, uint32(size)))
+	keyDir.dir.metrics.puts.Add(1)
+	keyDir.dir.metrics.bytesWritten.Add(uint64(n))
+	d.firePut(key, value)
+	if err := d.auditWrite("put", key, len(value), ts); err != nil {
+		return err
+	}
+	if err := d.appendChange(changeFlag(flag, expires, enc), []byte(key), []byte(value), ts, expires, enc); err != nil {
+		return err
+	}
+	if err := dropChunks(key, prev, ts, f, w, keyDir); err != nil {
+		return err
+	}
+	d.accesses.touch(key)
+	if err := evictOverflow(key, f, w, keyDir); err != nil {
+		return err
+	}
+	return evictQuotas(key, f, w, keyDir)
+}
+
 
-		// print the entry
-		fmt.Printf("%s : %s\n", strings.TrimSpace(string(key)), strings.TrimSpace(string(value))) // clean up new lines
+// del marks a key as deleted: writes a tombstone and updates keyDir.
+func del(key string, f *os.File, w *bufio.Writer, keyDir *KeyDir) error {
+	return deleteContext(context.Background(), key, f, w, keyDir)
+}
+
+
+// deleteAt is Delete with the caller choosing the tombstone timestamp.
+func deleteAt(key string, ts uint64, f *os.File, w *bufio.Writer, keyDir *KeyDir) error {
+	d := keyDir.dir
+	if err := d.checkWritable(); err != nil {
+		return err
+	}
+	offset, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	prev, _ := keyDir.Get(key)
+	n, err := writeTombstone(w, []byte(key), ts)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = d.appended(f)
+	}
+	if err != nil {
+		return d.abortAppend(f, w, offset, err)
 	}
+	d.activeSize += int64(n)
+	keyDir.dir.cache.invalidate(key)
+	keyDir.set(key, newFileOffset(d.active, offset, flagTombstone, 0))
+	d.accesses.forget(key)
+	keyDir.dir.metrics.deletes.Add(1)
+	keyDir.dir.metrics.bytesWritten.Add(uint64(n))
+	d.fireDelete(key)
+	if err := d.auditWrite("del", key, 0, ts); err != nil {
+		return err
+	}
+	if err := d.appendChange(flagTombstone, []byte(key), nil, ts, 0, nil); err != nil {
+		return err
+	}
+	return dropChunks(key, prev, ts, f, w, keyDir)
 }
 
 
-// rotateFile rotates the active data.txt, compacts all rotated logs into a single new log,
+// rotateAndMerge rotates the active data.txt, compacts all rotated logs into a single new log,
 // writes a matching .hint file, deletes the old logs, rebuilds the in‐memory index, and
-// returns a Bufio writer that now points at the fresh data.txt.
-func rotateFile(oldW *bufio.Writer, keyDir map[string]FileOffset) (*bufio.Writer, error) {
-    // 1) flush & lock
+// returns the fresh data.txt and a Bufio writer that points at it.
+func rotateAndMerge(oldF *os.File, oldW *bufio.Writer, keyDir *KeyDir) (*os.File, *bufio.Writer, error) {
+    start := time.Now()
+    d := keyDir.dir
+
+    // 1) flush & lock, once the previous merge has finished in the background
     oldW.Flush()
-    lock := flock.New("data.txt.lock")
+    d.mergeTail.Wait()
+    lock := lockStore(d.path)
     if err := lock.Lock(); err != nil {
-        return oldW, fmt.Errorf("lock data.txt: %w", err)
+        return oldF, oldW, fmt.Errorf("lock store: %w", err)
     }
     defer lock.Unlock()
 
+    // keepActive is the way out until the fresh data.txt is open: keep appending to
+    // the old one, through a new handle if the platform made us close it to rename
+    keepActive := func(err error) (*os.File, *bufio.Writer, error) {
+        if !closeBeforeRename {
+            return oldF, oldW, err
+        }
+        oldF.Close()
+        f, ferr := os.OpenFile(d.active, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+        if ferr == nil {
+            _, ferr = f.Seek(0, io.SeekEnd)
+        }
+        if ferr != nil {
+            return oldF, oldW, errors.Join(err, ferr)
+        }
+        return f, bufio.NewWriter(f), err
+    }
+
     // 2) rotate data.txt → data_<ts>.log
-    ts := fmt.Sprintf("%d", time.Now().Unix())
-    newLog := fmt.Sprintf("data_%s.log", ts)
-    if err := os.Rename("data.txt", newLog); err != nil {
-        return oldW, fmt.Errorf("rotate: %w", err)
+    newLog, err := newSegmentName(d.path)
+    if err == nil {
+        err = failpoint.Check("rotate.rename")
+    }
+    if err == nil && closeBeforeRename {
+        err = oldF.Close()
+    }
+    if err == nil {
+        d.readers.drop(d.active)
+        err = os.Rename(d.active, newLog)
     }
-    fmt.Println("Renamed active file to:", newLog)
+    if err != nil {
+        return keepActive(fmt.Errorf("rotate: %w", err))
+    }
+    d.logger.Debug("sealed active file", "segment", newLog)
 
     // 3) open fresh data.txt writer
-    f, err := os.OpenFile("data.txt", os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+    var f *os.File
+    err = failpoint.Check("rotate.open")
+    if err == nil {
+        f, err = os.OpenFile(d.active, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+    }
     if err != nil {
-        return oldW, fmt.Errorf("open new data.txt: %w", err)
+        d.readers.drop(newLog)
+        os.Rename(newLog, d.active) // keep writing where keyDir says the records are
+        return keepActive(fmt.Errorf("open new data.txt: %w", err))
     }
+    oldF.Close()
+    if err := syncDir(d.file(segmentsDir)); err != nil {
+        d.logger.Warn("sync segments directory", "err", err)
+    }
+
+    // the sealed records keep their offsets, only the file name changed; repoint
+    // them now so a failed merge below can't leave them aimed at the new data.txt
+    renameSegment(d.active, newLog)
     newW := bufio.NewWriter(f)
-    activeFileSize = 0
+    d.activeSize = 0
+    d.evictedBytes = 0
 
     // 4) gather all rotated logs
-    logs, err := filepath.Glob("data_*.log")
+    logs, _, err := segmentFiles(d.path)
     if err != nil {
-        return newW, fmt.Errorf("glob logs: %w", err)
+        return f, newW, fmt.Errorf("glob logs: %w", err)
     }
     sort.Slice(logs, func(i, j int) bool {
         return extractTimestamp(logs[i]) > extractTimestamp(logs[j])
     })
 
-    // 5) compact them
-    if err := mergeFiles(logs, keyDir); err != nil {
-        return newW, fmt.Errorf("compact: %w", err)
+    // 5) compact them. A marker left by a merge that failed here earlier would make a
+    //    crash while compacted_data.txt is rewritten look like a finished merge.
+    if err := os.Remove(d.file(mergeMarker)); err != nil && !os.IsNotExist(err) {
+        return f, newW, fmt.Errorf("compact: %w", err)
     }
-
-    // 6) install compacted_data.txt as the canonical log
-    if err := os.Rename("compacted_data.txt", newLog); err != nil {
-        return newW, fmt.Errorf("install: %w", err)
+    fresh := newKeyDir()
+    if err := mergeFiles(d, logs, fresh); err != nil {
+        return f, newW, fmt.Errorf("compact: %w", err)
     }
 
-    // 7) ppen the newly‐compacted log and scan it sequentially,
-//    tracking the exact file offset for each live (non-tombstone) entry.
-compF, err := os.Open(newLog)
-if err != nil {
-    return newW, fmt.Errorf("open compacted log: %w", err)
-}
-defer compF.Close()
-
-realOffsets := make(map[string]int64)
-for {
-    // record the start‐of‐record offset
-    off, err := compF.Seek(0, io.SeekCurrent)
+    // 6) install compacted_data.txt as a segment newer than all of its inputs. They
+    //    stay until step 8, so the tombstones the merge dropped keep hiding older
+    //    values until those are gone too. The marker written first lets an open after
+    //    a crash finish the job, see finishMerge.
+    merged, err := newSegmentName(d.path)
     if err != nil {
-        return newW, err
-    }
-
-    // read the 1-byte flag
-    var flag byte
-    if err := binary.Read(compF, binary.BigEndian, &flag); err == io.EOF {
-        break
-    } else if err != nil {
-        return newW, err
+        return f, newW, fmt.Errorf("install: %w", err)
     }
-
-    // read keyLen and valLen
-    var keyLen, valLen uint32
-    if err := binary.Read(compF, binary.BigEndian, &keyLen); err != nil {
-        return newW, err
+    if err := writeMergeMarker(d.path, merged, logs); err != nil {
+        return f, newW, fmt.Errorf("install: %w", err)
     }
-    if err := binary.Read(compF, binary.BigEndian, &valLen); err != nil {
-        return newW, err
+    err = failpoint.Check("merge.install")
+    if err == nil {
+        err = os.Rename(d.file(compactedFile), merged)
     }
-
-    // read the key
-    keyBuf := make([]byte, keyLen)
-    if _, err := io.ReadFull(compF, keyBuf); err != nil {
-        return newW, err
+    if err == nil {
+        err = syncDir(d.file(segmentsDir))
     }
-    keyStr := string(keyBuf)
-
-    if flag == flagNormal {
-        // for normal entries, remember their true offset
-        realOffsets[keyStr] = off
-    }
-    // skip over the value bytes (tombstones have valLen==0)
-    if _, err := compF.Seek(int64(valLen), io.SeekCurrent); err != nil {
-        return newW, err
+    if err != nil {
+        return f, newW, fmt.Errorf("install: %w", err)
     }
-}
-
-// 8) write out the .hint file using those realOffsets
-hintName := fmt.Sprintf("data_%s.hint", ts)
-hf, err := os.Create(hintName)
-if err != nil {
-    return newW, fmt.Errorf("create hint: %w", err)
-}
-for key, off := range realOffsets {
-    binary.Write(hf, binary.BigEndian, uint32(len(key)))
-    hf.Write([]byte(key))
-    binary.Write(hf, binary.BigEndian, uint64(off))
-}
-hf.Close()
 
-    // 9) cleanup old logs and hints
-    for _, old := range logs {
-        if old != newLog {
-            os.Remove(old)
-        }
-    }
-    oldHints, _ := filepath.Glob("data_*.hint")
-    for _, h := range oldHints {
-        if h != hintName {
-            os.Remove(h)
-        }
+    // 7) swap in the index the merge built; data.txt is still empty, so it is
+    //    everything there is. It points into the merged segment only from here on.
+    if err := failpoint.Check("merge.reindex"); err != nil {
+        return f, newW, reindex(keyDir, err)
     }
+    renameSegment(d.file(compactedFile), merged)
+    keyDir.replace(fresh)
 
-    // 10) rebuild keyDir in-place from the fresh hint
-    fresh, err := RebuildKeyDir()
-    if err != nil {
-        return newW, fmt.Errorf("rebuild index: %w", err)
-    }
-    for k := range keyDir {
-        delete(keyDir, k)
-    }
-    for k, fo := range fresh {
-        keyDir[k] = fo
-    }
+    // 8) the hint and removing the old logs and hints, then the marker, don't need
+    //    the writer to wait: they run in the background, see finishMergeAsync
+    d.finishMergeAsync(merged, logs)
 
-    return newW, nil
+    d.metrics.observeMerge(time.Since(start))
+    return f, newW, nil
 }
 
 
-// mergeFiles now understands the 1-byte flag.
-func mergeFiles(sortedFiles []string, keyDir map[string]FileOffset) error {
+// mergeFiles compacts sortedFiles into the compacted_data.txt of d and adds the
+// records it writes to keyDir, which should start out empty.
+func mergeFiles(d *dataDir, sortedFiles []string, keyDir *KeyDir) error {
     // newest→oldest
     sort.Slice(sortedFiles, func(i, j int) bool {
         return extractTimestamp(sortedFiles[i]) > extractTimestamp(sortedFiles[j])
     })
 
     type entry struct {
-        value     []byte
-        tombstone bool
+        value []byte // as stored, an expiring record's expiry included
+        flag  byte
+        ts    uint64
     }
     latest := make(map[string]entry)
+    d.beginMerge(sortedFiles)
+    now := time.Now()
 
     for _, filePath := range sortedFiles {
-        f, err := os.Open(filePath)
-        if err != nil {
+        if err := failpoint.Check("merge.read"); err != nil {
             return err
         }
-        reader := bufio.NewReader(f)
-
-        for {
-            // read flag
-            flag, err := reader.ReadByte()
-            if err == io.EOF {
-                break
-            } else if err != nil {
-                f.Close()
-                return err
-            }
-
-            // read lengths
-            var keyLen, valLen uint32
-            if err := binary.Read(reader, binary.BigEndian, &keyLen); err != nil {
-                f.Close()
-                return err
-            }
-            if err := binary.Read(reader, binary.BigEndian, &valLen); err != nil {
-                f.Close()
-                return err
-            }
-
-            keyBuf := make([]byte, keyLen)
-            if _, err := io.ReadFull(reader, keyBuf); err != nil {
-                f.Close()
-                return err
-            }
-
-            keyStr := strings.TrimSpace(string(keyBuf))
-
-            // if we've already recorded anything for this key, skip
-            if _, seen := latest[keyStr]; seen {
-                // skip over any value bytes
-                if flag == flagNormal && valLen > 0 {
-                    reader.Discard(int(valLen))
-                }
-                continue
+        err := scanFile(filePath, d.scanSize(), func(_ int64, r record) error {
+            // keep only the newest record for each key: files go newest→oldest, but
+            // within a file the later record wins, so compare timestamps. The lookup
+            // doesn't copy the key, only storing it below does.
+            if prev, seen := latest[string(r.key)]; seen && prev.ts >= r.ts {
+                return nil
             }
-
-            if flag == flagTombstone {
-                // mark deletion
-                latest[keyStr] = entry{nil, true}
+            if r.flag == flagTombstone || expired(r.expires()) {
+                // mark deletion; an expired value is gone just the same
+                latest[string(r.key)] = entry{nil, flagTombstone, r.ts}
             } else {
-                // normal
-                valueBuf := make([]byte, valLen)
-                if _, err := io.ReadFull(reader, valueBuf); err != nil {
-                    f.Close()
-                    return err
-                }
-                latest[keyStr] = entry{valueBuf, false}
+                // scanFile reuses its buffer, so the value is copied out
+                latest[string(r.key)] = entry{bytes.Clone(r.value), r.flag, r.ts}
             }
+            return nil
+        })
+        if err != nil {
+            return err
         }
 
-        f.Close()
+        if fi, err := os.Stat(filePath); err == nil {
+            d.mergedSegment(fi.Size())
+            d.metrics.compactionRead.Add(uint64(fi.Size()))
+        }
     }
 
-    // write compacted file: drop any tombstoned entries
-    out, err := os.OpenFile("compacted_data.txt", os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0644)
+    // write compacted file: drop the tombstoned entries, but keep recent tombstones
+    // themselves, so a replicated write older than the delete still loses to it
+    if err := failpoint.Check("merge.write"); err != nil {
+        return err
+    }
+    compacted := d.file(compactedFile)
+    out, err := os.OpenFile(compacted, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0644)
     if err != nil {
         return err
     }
+    // a merge that runs out of space mustn't keep holding it
+    abandon := func(err error) error {
+        out.Close()
+        os.Remove(compacted)
+        return err
+    }
     w := bufio.NewWriter(out)
+    copied := 0
+    var off int64
     for k, e := range latest {
-        if e.tombstone {
+        if e.flag == flagTombstone && !d.compaction.keepTombstone(e.ts, now) {
             continue
         }
-        writeEntry(w, []byte(k), e.value)
+        // chunks are only kept for the version of their value the manifest is of
+        if owner, ver, ok := parseChunkKey(k); ok {
+            if m := latest[owner]; m.flag != flagChunked || m.ts != ver {
+                continue
+            }
+        }
+        if e.flag == flagMeta && d.schema.OnMerge && len(d.schema.migrations) > 0 {
+            if v, ok := d.upgradeStored(k, e.value); ok {
+                e.value = v
+            }
+        }
+        n, err := writeRecord(w, e.flag, []byte(k), e.value, e.ts)
+        if err != nil {
+            return abandon(err)
+        }
+        keyDir.set(k, newFileOffset(compacted, off, e.flag, uint32(len(e.value))))
+        off += int64(n)
+        copied++
+    }
+    d.mergeCopied(copied)
+    if err := w.Flush(); err != nil {
+        return abandon(err)
+    }
+    if err := out.Sync(); err != nil {
+        return abandon(err)
     }
-    w.Flush()
     out.Close()
+    if fi, err := os.Stat(compacted); err == nil {
+        d.metrics.compactionWritten.Add(uint64(fi.Size()))
+    }
     return nil
 }
 
 
-// RebuildKeyDir reads all .hint files (oldest→newest) to reconstruct the index.
-func RebuildKeyDir() (map[string]FileOffset, error) {
-    keyDir := make(map[string]FileOffset)
-
-    hints, err := filepath.Glob("data_*.hint")
+// rebuildKeyDir reconstructs the index from the sealed segments. A segment's hint
+// is used when it exists and checks out; otherwise the segment itself is scanned,
+// and a fresh hint is written so the next open is fast again. Segments are indexed
+// in parallel and then applied oldest→newest, so newer records still win.
+// Damaged records found while scanning are skipped and listed in the returned info,
+// as far as r allows; with strictRepairs, an unusable hint, a damaged record or a
+// hint without a segment is an *IntegrityError instead. The index is of the store
+// in d.
+func rebuildKeyDir(d *dataDir, r repairs) (*KeyDir, RecoveryInfo, error) {
+    keyDir := newKeyDir()
+    keyDir.dir = d
+    info := RecoveryInfo{DryRun: r.DryRun}
+
+    logs, _, err := segmentFiles(d.path)
     if err != nil {
-        return nil, fmt.Errorf("glob hints: %w", err)
+        return nil, info, fmt.Errorf("glob segments: %w", err)
     }
-    sort.Slice(hints, func(i, j int) bool {
-        return extractTimestamp(hints[i]) < extractTimestamp(hints[j])
-    })
 
-    for _, h := range hints {
-        logFile := strings.TrimSuffix(h, ".hint") + ".log"
-        f, err := os.Open(h)
-        if err != nil {
-            return nil, fmt.Errorf("open hint %s: %w", h, err)
+    // workers take segments in order, and results are applied in order as soon as
+    // they are in, so only segments finished out of turn are held in memory at once
+    loads := make([]*segmentIndex, len(logs))
+    for i := range loads {
+        loads[i] = &segmentIndex{done: make(chan struct{})}
+    }
+    next := make(chan int)
+    stop := make(chan struct{})
+    var workers sync.WaitGroup
+    defer workers.Wait() // nothing may still be writing hints once this returns
+    defer close(stop)
+    for w := min(runtime.GOMAXPROCS(0), len(logs)); w > 0; w-- {
+        workers.Add(1)
+        go func() {
+            defer workers.Done()
+            for i := range next {
+                loads[i].load(d, logs[i], r)
+                close(loads[i].done)
+            }
+        }()
+    }
+    go func() {
+        defer close(next)
+        for i := range logs {
+            select {
+            case next <- i:
+            case <-stop:
+                return
+            }
+        }
+    }()
+
+    for _, l := range loads {
+        <-l.done
+        info.add(&l.info)
+        if l.err != nil {
+            return nil, info, l.err
         }
-        r := bufio.NewReader(f)
-        for {
-            var keyLen uint32
-            if err := binary.Read(r, binary.BigEndian, &keyLen); err == io.EOF {
-                break
-            } else if err != nil {
-                return nil, fmt.Errorf("read keyLen: %w", err)
+        keyDir.merge(l.keyDir)
+        l.keyDir = nil
+    }
+
+    hints, _ := filepath.Glob(filepath.Join(d.path, hintsDir, "data_*.hint"))
+    for _, h := range hints {
+        if _, err := os.Stat(hintSegment(h)); os.IsNotExist(err) {
+            if r.strict {
+                return nil, info, &IntegrityError{File: h, Offset: -1, Problem: "hint has no segment, the segment may have been lost"}
+            }
+            d.logger.Warn("ignoring hint without a segment", "file", h)
+            info.OrphanHints = append(info.OrphanHints, h)
+            if err := quarantineAll([]string{h}, "hint has no segment", &info, d.logger); err != nil {
+                return nil, info, err
             }
-            key := make([]byte, keyLen)
-            io.ReadFull(r, key)
+        }
+    }
+
+    return keyDir, info, nil
+}
+
 
-            var off uint64
-            if err := binary.Read(r, binary.BigEndian, &off); err != nil {
-                return nil, fmt.Errorf("read offset: %w", err)
+// segmentIndex is what rebuildKeyDir learned from one segment.
+type segmentIndex struct {
+    keyDir *KeyDir
+    info   RecoveryInfo // what was wrong with this segment and its hint
+    err    error
+    done   chan struct{}
+}
+
+// load indexes logFile, a segment of d, from its hint, or by scanning it, making
+// only the repairs r allows.
+func (l *segmentIndex) load(d *dataDir, logFile string, r repairs) {
+    l.keyDir = newKeyDir()
+    l.info.DryRun = r.DryRun
+    h := hintFile(logFile)
+    if r.RebuildIndexFromLogs {
+        l.info.did(ActionScan, logFile, "rebuilding the index from the segments")
+    } else if err := loadHint(h, logFile, l.keyDir, d.scanSize()); err == nil {
+        return
+    } else if os.IsNotExist(err) {
+        d.logger.Warn("segment has no hint, scanning it", "file", logFile)
+        l.info.MissingHints = append(l.info.MissingHints, h)
+        l.info.did(ActionScan, logFile, "the segment has no hint")
+    } else if r.strict {
+        l.err = &IntegrityError{File: h, Offset: -1, Problem: err.Error()}
+        return
+    } else {
+        d.logger.Warn("hint is unusable, scanning the segment instead", "file", h, "err", err)
+        l.info.BadHints = append(l.info.BadHints, h)
+        // keep the bad hint for inspection, a fresh one is written below
+        if l.err = quarantineAll([]string{h}, "hint unusable: "+err.Error(), &l.info, d.logger); l.err != nil {
+            return
+        }
+        l.info.did(ActionScan, logFile, "its hint is unusable")
+    }
+    good, err := loadSegment(logFile, l.keyDir, &l.info.RecoveryReport, d.scanSize())
+    if err != nil {
+        if r.failUnreadable || !r.SkipBadSegments {
+            l.err = fmt.Errorf("scan segment %s: %w", logFile, err)
+            return
+        }
+        d.logger.Warn("segment can't be read, skipping it", "file", logFile, "err", err)
+        l.keyDir, l.info.RecoveryReport = newKeyDir(), RecoveryReport{}
+        l.err = quarantineAll([]string{logFile}, "unreadable: "+err.Error(), &l.info, d.logger)
+        return
+    }
+    if l.info.Skipped() > 0 {
+        switch {
+        case good == 0 && r.SkipBadSegments:
+            // not a single record decodes, the file only gets in the way
+            l.err = quarantineAll([]string{logFile}, "no readable record in the segment", &l.info, d.logger)
+        case !r.TruncateCorrupt:
+            l.err = damageError(&l.info.RecoveryReport, 0)
+        default:
+            for _, reg := range l.info.Regions {
+                l.info.skippedRegion(reg)
             }
-            keyDir[string(key)] = FileOffset{FileID: logFile, Offset: int64(off)}
         }
-        f.Close()
+        return // no hint, so the damage keeps being reported until someone looks
     }
+    if !r.DryRun {
+        if err := writeHintFor(logFile, h, d.scanSize()); err != nil {
+            d.logger.Warn("could not rewrite hint", "file", h, "err", err)
+            return
+        }
+    }
+    l.info.did(ActionWriteHint, h, "the segment was scanned")
+}
 
-    return keyDir, nil
+
+// reindex replaces the contents of keyDir with an index rebuilt from the files, for
+// when they changed under it. It returns cause, joined with any error rebuilding.
+func reindex(keyDir *KeyDir, cause error) error {
+	keyDir.dir.readers.dropAll() // files may be quarantined
+	fresh, _, err := rebuildKeyDir(keyDir.dir, openRepairs)
+	if err != nil {
+		return errors.Join(cause, fmt.Errorf("rebuild index: %w", err))
+	}
+	keyDir.replace(fresh)
+	return cause
 }
 
 
@@ -406,105 +719,91 @@ func extractTimestamp(filePath string) int64 {
 }
 
 
+// ErrNotFound is what Get returns for a key that isn't set, was deleted or, wrapped
+// with ErrExpired, whose TTL has run out.
+var ErrNotFound = errors.New("key not found")
+
+// errDeleted is the error for reading key after it was deleted.
+func errDeleted(key string) error { return fmt.Errorf("%w: '%s' was deleted", ErrNotFound, key) }
+
 // get now checks for tombstones.
-func Get(key string, keyDir map[string]FileOffset) (string, error) {
-	fo, ok := keyDir[key]
+func get(key string, keyDir *KeyDir) (string, error) {
+	return getContext(context.Background(), key, keyDir)
+}
+
+
+// getRecord reads the value keyDir points at for key.
+func getRecord(key string, keyDir *KeyDir) (string, error) {
+	keyDir.dir.metrics.gets.Add(1)
+	fo, ok := keyDir.Get(key)
 	if !ok {
-		return "", fmt.Errorf("key not found")
+		keyDir.dir.metrics.getMisses.Add(1)
+		return "", ErrNotFound
+	}
+	if v, ok := keyDir.dir.cache.get(key, fo); ok {
+		keyDir.dir.metrics.bytesReturned.Add(uint64(len(v)))
+		return v, nil
 	}
-	f, err := os.Open(fo.FileID)
+	f, err := keyDir.dir.readers.acquire(fo.FileID())
 	if err != nil {
 		return "", err
 	}
-	defer f.Close()
+	defer keyDir.dir.readers.release(f)
 
-	f.Seek(fo.Offset, io.SeekStart)
-	flag := make([]byte, 1)
-	f.Read(flag)
-	if flag[0] == flagTombstone {
-		return "", fmt.Errorf("key '%s' was deleted", key)
+	if fo.Tombstone() {
+		keyDir.dir.metrics.getMisses.Add(1)
+		return "", errDeleted(key)
 	}
-
-	var kLen, vLen uint32
-	binary.Read(f, binary.BigEndian, &kLen)
-	binary.Read(f, binary.BigEndian, &vLen)
-	f.Seek(int64(kLen), io.SeekCurrent)
-
-	valBuf := make([]byte, vLen)
-	io.ReadFull(f, valBuf)
-	return string(valBuf), nil
+	buf := getScratch(int(fo.recordSize(key)))
+	defer putScratch(buf)
+	rec, err := f.readAt(*buf, fo.Offset())
+	if err != nil {
+		return "", fmt.Errorf("%s: record at offset %d: %w", fo.FileID(), fo.Offset(), err)
+	}
+	// the index says what should be there; a record that disagrees means it is stale
+	if rec[0] != fo.flag() || binary.BigEndian.Uint32(rec[9:13]) != uint32(len(key)) ||
+		binary.BigEndian.Uint32(rec[13:17]) != fo.ValueSize() {
+		return "", fmt.Errorf("%s: record at offset %d isn't the one indexed for %q", fo.FileID(), fo.Offset(), key)
+	}
+	if err := checkRecord(rec, fo.FileID(), fo.Offset()); err != nil {
+		return "", err
+	}
+	keyDir.dir.metrics.bytesRead.Add(uint64(len(rec)))
+	expires, _, value := splitValue(rec[0], rec[headerSize+len(key):])
+	if expired(expires) {
+		keyDir.dir.metrics.getMisses.Add(1)
+		return "", expiredError(key)
+	}
+	if rec[0] == flagChunked {
+		var b strings.Builder
+		if _, err := readChunks(key, binary.BigEndian.Uint64(rec[1:9]), value, &b, keyDir); err != nil {
+			return "", err
+		}
+		keyDir.dir.metrics.bytesReturned.Add(uint64(b.Len()))
+		return b.String(), nil
+	}
+	keyDir.dir.metrics.bytesReturned.Add(uint64(len(value)))
+	v := f.valueString(value)
+	if !fo.Expiring() {
+		// the cache doesn't know when values expire, so it only holds ones that don't
+		keyDir.dir.cache.add(key, fo, v, f.pinned)
+	}
+	return v, nil
 }
 
 
-// open a file in read-write mode, create if not exists, append to end
-func main() {
-	const maxFileSize = 100
-	f, err := os.OpenFile("data.txt", os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+// recordHeader reads the flag and timestamp of the record at fo.
+func (d *dataDir) recordHeader(fo FileOffset) (byte, uint64, error) {
+	f, err := d.readers.acquire(fo.FileID())
 	if err != nil {
-		panic(err)
+		return 0, 0, err
 	}
-	defer f.Close()
-
-	w := bufio.NewWriter(f)
-	reader := bufio.NewReader(os.Stdin)
-	keyDir, _ := RebuildKeyDir()
-
-	for {
-		fmt.Print("> ")
-		line, _ := reader.ReadString('\n')
-		parts := strings.Fields(strings.TrimSpace(line))
-		if len(parts) == 0 {
-			continue
-		}
-		cmd := strings.ToUpper(parts[0])
-
-		switch cmd {
-		case "PUT":
-			if len(parts) < 3 {
-				fmt.Println("Usage: PUT <key> <value>")
-				continue
-			}
-			key, val := parts[1], strings.Join(parts[2:], " ")
-			offset, _ := f.Seek(0, io.SeekCurrent)
-			writeEntry(w, []byte(key), []byte(val))
-			w.Flush()
-			keyDir[key] = FileOffset{"data.txt", offset}
-
-		case "DEL":
-			if len(parts) != 2 {
-				fmt.Println("Usage: DEL <key>")
-				continue
-			}
-			if err := Delete(parts[1], f, w, keyDir); err != nil {
-				fmt.Println("Delete failed:", err)
-			}
-
-		case "GET":
-			if len(parts) != 2 {
-				fmt.Println("Usage: GET <key>")
-				continue
-			}
-			if v, err := Get(parts[1], keyDir); err != nil {
-				fmt.Println("Error:", err)
-			} else {
-				fmt.Println("Value:", v)
-			}
-
-		case "EXIT":
-			return
-
-		default:
-			fmt.Println("Commands: PUT, GET, DEL, EXIT")
-		}
-
-		if activeFileSize > maxFileSize {
-    		fmt.Println("Rotating...")
-    		var err error
-    		w, err = rotateFile(w, keyDir)
-    		if err != nil {
-        		fmt.Println("Rotate failed:", err)
-    		}
-		}
+	defer d.readers.release(f)
 
+	var buf [9]byte
+	hdr, err := f.readAt(buf[:], fo.Offset())
+	if err != nil {
+		return 0, 0, err
 	}
+	return hdr[0], binary.BigEndian.Uint64(hdr[1:]), nil
 }
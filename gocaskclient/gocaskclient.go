@@ -0,0 +1,302 @@
+// Package gocaskclient talks to stores served by gocask serve --http-addr, over the
+// REST API, and spreads the requests over several endpoints serving copies of a
+// store kept in step by --replicate. Writes go to the primary, the first endpoint
+// that takes them; reads go to the others, the replicas, as long as they are no
+// further behind than Options.MaxStaleness, and to the primary otherwise. When the
+// primary goes away or stops taking writes, the next endpoint that does takes over.
+package gocaskclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/itsknk/gocask"
+)
+
+// Status is what an endpoint answers GET /status with for a store.
+type Status struct {
+	Node           uint16        `json:"node"`
+	ReadOnly       bool          `json:"read_only"`   // the store refuses writes
+	Replicating    bool          `json:"replicating"` // it is served with --replicate
+	ReplicationLag time.Duration `json:"replication_lag_ns,omitempty"`
+}
+
+// Options configure a Client. The zero value talks to the store in --dir without a
+// token and reads from any replica.
+type Options struct {
+	Token string // the --http-token of the endpoints, "" for none
+	Store string // the name the store is mounted as, "" for the one in --dir
+
+	// MaxStaleness is how far behind a replica's replication may be for it to serve
+	// a read, 0 for no bound. With a bound, replicas that don't replicate and so
+	// can't say how far behind they are serve none.
+	MaxStaleness time.Duration
+
+	// Refresh is how often the endpoints are asked for their status again, which
+	// also happens whenever the primary fails a write. Defaults to 5s.
+	Refresh time.Duration
+
+	HTTPClient *http.Client // defaults to one with a 30s timeout
+}
+
+// Error is a request an endpoint answered with an error status.
+type Error struct {
+	Endpoint   string
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %d %s: %s", e.Endpoint, e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+// ErrNoPrimary is returned for a write when no endpoint takes writes.
+var ErrNoPrimary = errors.New("no endpoint takes writes")
+
+// Client sends the requests for a store to the endpoints serving it. It is safe for
+// concurrent use.
+type Client struct {
+	endpoints []string
+	opts      Options
+
+	mu      sync.Mutex
+	status  []*Status // of each endpoint, nil for one that didn't answer
+	checked time.Time // when status was last refreshed
+	primary int       // index of the primary, -1 if there is none
+	next    int       // the replica to try first for the next read
+}
+
+// New returns a Client for the store served at endpoints, base urls like
+// "http://db1:8080", in the order they are to be tried as the primary.
+func New(endpoints []string, opts Options) (*Client, error) {
+	if len(endpoints) == 0 {
+		return nil, errors.New("no endpoints")
+	}
+	c := &Client{opts: opts, primary: -1}
+	for _, e := range endpoints {
+		u, err := url.Parse(e)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("endpoint %q: want http://host:port or https://host:port", e)
+		}
+		c.endpoints = append(c.endpoints, strings.TrimSuffix(e, "/"))
+	}
+	if c.opts.Refresh <= 0 {
+		c.opts.Refresh = 5 * time.Second
+	}
+	if c.opts.HTTPClient == nil {
+		c.opts.HTTPClient = &http.Client{Timeout: 30 * time.Second}
+	}
+	return c, nil
+}
+
+// Get returns the value of key, from a replica within MaxStaleness if there is one.
+// A key that isn't set is gocask.ErrNotFound.
+func (c *Client) Get(ctx context.Context, key string) (string, error) {
+	var value string
+	err := c.read(ctx, func(endpoint string) error {
+		body, err := c.do(ctx, endpoint, http.MethodGet, c.keyPath(key), nil)
+		value = string(body)
+		return err
+	})
+	return value, err
+}
+
+// Keys returns the live keys starting with prefix, sorted.
+func (c *Client) Keys(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	err := c.read(ctx, func(endpoint string) error {
+		body, err := c.do(ctx, endpoint, http.MethodGet, c.path("/keys/")+"?prefix="+url.QueryEscape(prefix), nil)
+		keys = strings.Fields(string(body))
+		return err
+	})
+	return keys, err
+}
+
+// Put sets key to value on the primary.
+func (c *Client) Put(ctx context.Context, key, value string) error {
+	return c.write(ctx, http.MethodPut, c.keyPath(key), value)
+}
+
+// PutWithTTL sets key to value on the primary, to expire after ttl.
+func (c *Client) PutWithTTL(ctx context.Context, key, value string, ttl time.Duration) error {
+	return c.write(ctx, http.MethodPut, c.keyPath(key)+"?ttl="+ttl.String(), value)
+}
+
+// Delete deletes key on the primary.
+func (c *Client) Delete(ctx context.Context, key string) error {
+	return c.write(ctx, http.MethodDelete, c.keyPath(key), "")
+}
+
+// Primary is the endpoint writes go to, "" if none takes them.
+func (c *Client) Primary(ctx context.Context) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.refreshLocked(ctx, false)
+	if c.primary < 0 {
+		return ""
+	}
+	return c.endpoints[c.primary]
+}
+
+// path is p under the store's mount.
+func (c *Client) path(p string) string {
+	if c.opts.Store == "" {
+		return p
+	}
+	return "/" + c.opts.Store + p
+}
+
+func (c *Client) keyPath(key string) string { return c.path("/keys/" + url.PathEscape(key)) }
+
+// write sends a write to the primary. If the primary can't be reached or no longer
+// takes writes, the endpoints are asked who does now and the write goes there.
+func (c *Client) write(ctx context.Context, method, path, body string) error {
+	c.mu.Lock()
+	c.refreshLocked(ctx, false)
+	primary := c.primary
+	c.mu.Unlock()
+	if primary < 0 {
+		return ErrNoPrimary
+	}
+	_, err := c.do(ctx, c.endpoints[primary], method, path, strings.NewReader(body))
+	if !failover(err) || ctx.Err() != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.refreshLocked(ctx, true)
+	next := c.primary
+	c.mu.Unlock()
+	switch next {
+	case -1:
+		return ErrNoPrimary
+	case primary:
+		return err
+	}
+	_, err = c.do(ctx, c.endpoints[next], method, path, strings.NewReader(body))
+	return err
+}
+
+// failover reports whether err, from a write to the primary, says another endpoint
+// may have to take over: it couldn't be reached, or refused because it is read-only.
+func failover(err error) bool {
+	var herr *Error
+	if errors.As(err, &herr) {
+		return herr.StatusCode == http.StatusForbidden || herr.StatusCode == http.StatusInsufficientStorage ||
+			herr.StatusCode >= http.StatusBadGateway
+	}
+	return err != nil && !errors.Is(err, gocask.ErrNotFound)
+}
+
+// read runs fn against a replica within MaxStaleness, or the primary if none is,
+// trying the next one when an endpoint can't be reached.
+func (c *Client) read(ctx context.Context, fn func(endpoint string) error) error {
+	c.mu.Lock()
+	c.refreshLocked(ctx, false)
+	order := c.readOrderLocked()
+	c.mu.Unlock()
+	if len(order) == 0 {
+		return errors.New("no endpoint can be reached")
+	}
+	var err error
+	for _, i := range order {
+		err = fn(c.endpoints[i])
+		var herr *Error
+		if err == nil || errors.Is(err, gocask.ErrNotFound) || errors.As(err, &herr) || ctx.Err() != nil {
+			return err
+		}
+		c.mu.Lock()
+		c.status[i], c.checked = nil, time.Time{}
+		c.mu.Unlock()
+	}
+	return err
+}
+
+// readOrderLocked lists the endpoints to try a read on: the replicas within
+// MaxStaleness, starting with a different one each time, and then the primary.
+// Callers hold c.mu.
+func (c *Client) readOrderLocked() []int {
+	var replicas []int
+	for i, st := range c.status {
+		if st == nil || i == c.primary {
+			continue
+		}
+		if c.opts.MaxStaleness > 0 && (!st.Replicating || st.ReplicationLag > c.opts.MaxStaleness) {
+			continue
+		}
+		replicas = append(replicas, i)
+	}
+	var order []int
+	if n := len(replicas); n > 0 {
+		c.next = (c.next + 1) % n
+		order = append(replicas[c.next:], replicas[:c.next]...)
+	}
+	if c.primary >= 0 {
+		order = append(order, c.primary)
+	}
+	return order
+}
+
+// refreshLocked asks every endpoint for its status, if that was last done more
+// than Refresh ago or force, and picks the primary. Callers hold c.mu.
+func (c *Client) refreshLocked(ctx context.Context, force bool) {
+	if !force && c.status != nil && time.Since(c.checked) < c.opts.Refresh {
+		return
+	}
+	status := make([]*Status, len(c.endpoints))
+	var wg sync.WaitGroup
+	for i, e := range c.endpoints {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			body, err := c.do(ctx, e, http.MethodGet, c.path("/status"), nil)
+			var st Status
+			if err == nil && json.Unmarshal(body, &st) == nil {
+				status[i] = &st
+			}
+		}()
+	}
+	wg.Wait()
+	c.status, c.checked, c.primary = status, time.Now(), -1
+	for i, st := range status {
+		if st != nil && !st.ReadOnly {
+			c.primary = i
+			break
+		}
+	}
+}
+
+// do sends a request to endpoint and returns the body of a successful reply. A
+// missing key is gocask.ErrNotFound, other error replies an *Error.
+func (c *Client) do(ctx context.Context, endpoint, method, path string, body io.Reader) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, method, endpoint+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if c.opts.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.opts.Token)
+	}
+	resp, err := c.opts.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case resp.StatusCode == http.StatusNotFound && method == http.MethodGet && strings.Contains(path, "/keys/"):
+		return nil, fmt.Errorf("%s: %w", endpoint, gocask.ErrNotFound)
+	case resp.StatusCode >= 300:
+		return nil, &Error{endpoint, resp.StatusCode, strings.TrimSpace(string(data))}
+	}
+	return data, nil
+}
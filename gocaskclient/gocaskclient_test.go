@@ -0,0 +1,208 @@
+package gocaskclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/itsknk/gocask"
+)
+
+// fakeNode serves the REST API of a store out of a map, for what a Client needs of
+// gocask serve.
+type fakeNode struct {
+	*httptest.Server
+	mu       sync.Mutex
+	values   map[string]string
+	status   Status
+	requests []string // method and path of each key request
+}
+
+func newFakeNode(t *testing.T, status Status) *fakeNode {
+	n := &fakeNode{values: map[string]string{}, status: status}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		json.NewEncoder(w).Encode(n.status)
+	})
+	mux.HandleFunc("/keys/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		key := strings.TrimPrefix(r.URL.Path, "/keys/")
+		n.requests = append(n.requests, r.Method+" "+key)
+		switch r.Method {
+		case http.MethodGet:
+			v, ok := n.values[key]
+			if !ok {
+				http.Error(w, "not found", http.StatusNotFound)
+				return
+			}
+			io.WriteString(w, v)
+		default:
+			if n.status.ReadOnly {
+				http.Error(w, "store is read-only", http.StatusForbidden)
+				return
+			}
+			if r.Method == http.MethodDelete {
+				delete(n.values, key)
+				return
+			}
+			body, _ := io.ReadAll(r.Body)
+			n.values[key] = string(body)
+		}
+	})
+	n.Server = httptest.NewServer(mux)
+	t.Cleanup(n.Close)
+	return n
+}
+
+func (n *fakeNode) set(st Status) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.status = st
+}
+
+func (n *fakeNode) put(key, value string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.values[key] = value
+}
+
+func (n *fakeNode) get(key string) (string, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	v, ok := n.values[key]
+	return v, ok
+}
+
+// took returns and forgets the key requests n got.
+func (n *fakeNode) took() []string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	r := n.requests
+	n.requests = nil
+	return r
+}
+
+func newTestClient(t *testing.T, opts Options, nodes ...*fakeNode) *Client {
+	t.Helper()
+	var endpoints []string
+	for _, n := range nodes {
+		endpoints = append(endpoints, n.URL)
+	}
+	opts.Token = "secret"
+	c, err := New(endpoints, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestReadsGoToReplicas(t *testing.T) {
+	ctx := context.Background()
+	primary := newFakeNode(t, Status{Node: 1, Replicating: true})
+	replica := newFakeNode(t, Status{Node: 2, Replicating: true, ReplicationLag: 100 * time.Millisecond})
+	c := newTestClient(t, Options{MaxStaleness: time.Second}, primary, replica)
+
+	if err := c.Put(ctx, "a/b", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if got := primary.took(); len(got) != 1 || got[0] != "PUT a/b" {
+		t.Errorf("primary got %v", got)
+	}
+	replica.put("a/b", "1") // as replication would
+	if v, err := c.Get(ctx, "a/b"); err != nil || v != "1" {
+		t.Errorf("a/b = %q, %v", v, err)
+	}
+	if got := replica.took(); len(got) != 1 || got[0] != "GET a/b" {
+		t.Errorf("replica got %v", got)
+	}
+	if _, err := c.Get(ctx, "missing"); !errors.Is(err, gocask.ErrNotFound) {
+		t.Errorf("missing key: %v", err)
+	}
+	if got := primary.took(); len(got) != 0 {
+		t.Errorf("reads went to the primary: %v", got)
+	}
+}
+
+func TestStaleReplicaIsSkipped(t *testing.T) {
+	ctx := context.Background()
+	primary := newFakeNode(t, Status{Node: 1, Replicating: true})
+	stale := newFakeNode(t, Status{Node: 2, Replicating: true, ReplicationLag: time.Minute})
+	standalone := newFakeNode(t, Status{Node: 3, ReadOnly: true})
+	c := newTestClient(t, Options{MaxStaleness: time.Second}, primary, stale, standalone)
+	primary.put("k", "v")
+
+	if v, err := c.Get(ctx, "k"); err != nil || v != "v" {
+		t.Errorf("k = %q, %v", v, err)
+	}
+	if len(stale.took()) != 0 || len(standalone.took()) != 0 {
+		t.Error("a read went to a replica that can't show it is within MaxStaleness")
+	}
+
+	// without a bound any replica will do
+	c = newTestClient(t, Options{}, primary, stale)
+	stale.put("k", "old")
+	if v, err := c.Get(ctx, "k"); err != nil || v != "old" {
+		t.Errorf("k without MaxStaleness = %q, %v", v, err)
+	}
+}
+
+func TestFailover(t *testing.T) {
+	ctx := context.Background()
+	first := newFakeNode(t, Status{Node: 1})
+	second := newFakeNode(t, Status{Node: 2})
+	c := newTestClient(t, Options{Refresh: time.Hour}, first, second)
+	if got := c.Primary(ctx); got != first.URL {
+		t.Fatalf("primary %s, want the first endpoint %s", got, first.URL)
+	}
+
+	// a primary that stops taking writes hands over to the next one that does
+	first.set(Status{Node: 1, ReadOnly: true})
+	if err := c.Put(ctx, "k", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := second.get("k"); v != "1" {
+		t.Error("the write didn't go to the new primary")
+	}
+	if got := c.Primary(ctx); got != second.URL {
+		t.Errorf("primary %s after the first went read-only", got)
+	}
+
+	// and so does one that goes away
+	first.set(Status{Node: 1})
+	c = newTestClient(t, Options{Refresh: time.Hour}, first, second)
+	c.Primary(ctx)
+	first.Close()
+	if err := c.Delete(ctx, "k"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := second.get("k"); ok {
+		t.Error("the delete didn't go to the new primary")
+	}
+
+	second.set(Status{Node: 2, ReadOnly: true})
+	if err := c.Put(ctx, "k", "2"); !errors.Is(err, ErrNoPrimary) {
+		t.Errorf("write with every endpoint read-only: %v", err)
+	}
+}
+
+func TestNewChecksEndpoints(t *testing.T) {
+	for _, endpoints := range [][]string{nil, {"db1:8080"}, {"ftp://db1"}, {"http://"}} {
+		if _, err := New(endpoints, Options{}); err == nil {
+			t.Errorf("New(%q): no error", endpoints)
+		}
+	}
+}
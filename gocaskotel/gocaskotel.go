@@ -0,0 +1,61 @@
+// Package gocaskotel traces gocask's Put, Get, Delete and merges with OpenTelemetry,
+// for the stores opened with WithTracing:
+//
+//	db, err := gocask.Open(dir, gocaskotel.WithTracing())
+//
+// The spans come from the global tracer provider, so until the application installs
+// one with otel.SetTracerProvider every span is a no-op. Being a package of its own,
+// only binaries that import it carry OpenTelemetry.
+package gocaskotel
+
+import (
+	"context"
+
+	"github.com/itsknk/gocask"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// WithTracing traces the store with a Tracer from the global tracer provider.
+func WithTracing() gocask.Option {
+	return gocask.WithTracer(Tracer{otel.Tracer("github.com/itsknk/gocask")})
+}
+
+// Tracer is a gocask.Tracer starting its spans with an OpenTelemetry tracer, for
+// applications that pass gocask.WithTracer one of their own.
+type Tracer struct {
+	T trace.Tracer
+}
+
+func (t Tracer) Start(ctx context.Context, name string) (context.Context, gocask.Span) {
+	ctx, span := t.T.Start(ctx, name)
+	return ctx, spanOf{span}
+}
+
+type spanOf struct{ trace.Span }
+
+func (s spanOf) SetAttributes(attrs ...gocask.Attribute) {
+	kvs := make([]attribute.KeyValue, 0, len(attrs))
+	for _, a := range attrs {
+		switch v := a.Value.(type) {
+		case int:
+			kvs = append(kvs, attribute.Int(a.Key, v))
+		case bool:
+			kvs = append(kvs, attribute.Bool(a.Key, v))
+		case string:
+			kvs = append(kvs, attribute.String(a.Key, v))
+		}
+	}
+	s.Span.SetAttributes(kvs...)
+}
+
+// End marks the span failed if err is set, then ends it.
+func (s spanOf) End(err error) {
+	if err != nil {
+		s.Span.RecordError(err)
+		s.Span.SetStatus(codes.Error, err.Error())
+	}
+	s.Span.End()
+}
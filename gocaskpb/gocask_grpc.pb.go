@@ -0,0 +1,317 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             (unknown)
+// source: gocaskpb/gocask.proto
+
+package gocaskpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	Gocask_Get_FullMethodName    = "/gocask.v1.Gocask/Get"
+	Gocask_Put_FullMethodName    = "/gocask.v1.Gocask/Put"
+	Gocask_Delete_FullMethodName = "/gocask.v1.Gocask/Delete"
+	Gocask_Batch_FullMethodName  = "/gocask.v1.Gocask/Batch"
+	Gocask_Scan_FullMethodName   = "/gocask.v1.Gocask/Scan"
+)
+
+// GocaskClient is the client API for Gocask service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// Gocask reads and writes the keys of the stores a gocask serve serves. Every
+// request names its store: "" for the one in --dir, or the name of a --mount.
+// Keys and values are bytes, as in the store. Keys under "__gocask/" are
+// gocask's own: requests naming one fail with INVALID_ARGUMENT and scans leave
+// them out.
+//
+// Errors come back as gRPC status codes: NOT_FOUND for a key that isn't set,
+// INVALID_ARGUMENT for a bad request or an unknown store, FAILED_PRECONDITION
+// for a write to a store opened read-only and RESOURCE_EXHAUSTED for one that
+// is out of disk or over its quota.
+type GocaskClient interface {
+	// Get returns the value of a key.
+	Get(ctx context.Context, in *GetRequest, opts ...grpc.CallOption) (*GetResponse, error)
+	// Put sets a key, optionally with a time to live.
+	Put(ctx context.Context, in *PutRequest, opts ...grpc.CallOption) (*PutResponse, error)
+	// Delete deletes a key. Deleting a key that isn't set is not an error.
+	Delete(ctx context.Context, in *DeleteRequest, opts ...grpc.CallOption) (*DeleteResponse, error)
+	// Batch applies puts and deletes atomically: after a crash either all of
+	// them are in the store or none.
+	Batch(ctx context.Context, in *BatchRequest, opts ...grpc.CallOption) (*BatchResponse, error)
+	// Scan streams the live keys starting with a prefix, or those in a range,
+	// in key order, with their values. Each value is read as the stream gets to
+	// it, so a scan of a large store isn't held in memory and a key deleted
+	// while the scan runs is left out.
+	Scan(ctx context.Context, in *ScanRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[KeyValue], error)
+}
+
+type gocaskClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewGocaskClient(cc grpc.ClientConnInterface) GocaskClient {
+	return &gocaskClient{cc}
+}
+
+func (c *gocaskClient) Get(ctx context.Context, in *GetRequest, opts ...grpc.CallOption) (*GetResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(GetResponse)
+	err := c.cc.Invoke(ctx, Gocask_Get_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *gocaskClient) Put(ctx context.Context, in *PutRequest, opts ...grpc.CallOption) (*PutResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(PutResponse)
+	err := c.cc.Invoke(ctx, Gocask_Put_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *gocaskClient) Delete(ctx context.Context, in *DeleteRequest, opts ...grpc.CallOption) (*DeleteResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(DeleteResponse)
+	err := c.cc.Invoke(ctx, Gocask_Delete_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *gocaskClient) Batch(ctx context.Context, in *BatchRequest, opts ...grpc.CallOption) (*BatchResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(BatchResponse)
+	err := c.cc.Invoke(ctx, Gocask_Batch_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *gocaskClient) Scan(ctx context.Context, in *ScanRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[KeyValue], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Gocask_ServiceDesc.Streams[0], Gocask_Scan_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[ScanRequest, KeyValue]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Gocask_ScanClient = grpc.ServerStreamingClient[KeyValue]
+
+// GocaskServer is the server API for Gocask service.
+// All implementations must embed UnimplementedGocaskServer
+// for forward compatibility.
+//
+// Gocask reads and writes the keys of the stores a gocask serve serves. Every
+// request names its store: "" for the one in --dir, or the name of a --mount.
+// Keys and values are bytes, as in the store. Keys under "__gocask/" are
+// gocask's own: requests naming one fail with INVALID_ARGUMENT and scans leave
+// them out.
+//
+// Errors come back as gRPC status codes: NOT_FOUND for a key that isn't set,
+// INVALID_ARGUMENT for a bad request or an unknown store, FAILED_PRECONDITION
+// for a write to a store opened read-only and RESOURCE_EXHAUSTED for one that
+// is out of disk or over its quota.
+type GocaskServer interface {
+	// Get returns the value of a key.
+	Get(context.Context, *GetRequest) (*GetResponse, error)
+	// Put sets a key, optionally with a time to live.
+	Put(context.Context, *PutRequest) (*PutResponse, error)
+	// Delete deletes a key. Deleting a key that isn't set is not an error.
+	Delete(context.Context, *DeleteRequest) (*DeleteResponse, error)
+	// Batch applies puts and deletes atomically: after a crash either all of
+	// them are in the store or none.
+	Batch(context.Context, *BatchRequest) (*BatchResponse, error)
+	// Scan streams the live keys starting with a prefix, or those in a range,
+	// in key order, with their values. Each value is read as the stream gets to
+	// it, so a scan of a large store isn't held in memory and a key deleted
+	// while the scan runs is left out.
+	Scan(*ScanRequest, grpc.ServerStreamingServer[KeyValue]) error
+	mustEmbedUnimplementedGocaskServer()
+}
+
+// UnimplementedGocaskServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedGocaskServer struct{}
+
+func (UnimplementedGocaskServer) Get(context.Context, *GetRequest) (*GetResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Get not implemented")
+}
+func (UnimplementedGocaskServer) Put(context.Context, *PutRequest) (*PutResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Put not implemented")
+}
+func (UnimplementedGocaskServer) Delete(context.Context, *DeleteRequest) (*DeleteResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Delete not implemented")
+}
+func (UnimplementedGocaskServer) Batch(context.Context, *BatchRequest) (*BatchResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Batch not implemented")
+}
+func (UnimplementedGocaskServer) Scan(*ScanRequest, grpc.ServerStreamingServer[KeyValue]) error {
+	return status.Errorf(codes.Unimplemented, "method Scan not implemented")
+}
+func (UnimplementedGocaskServer) mustEmbedUnimplementedGocaskServer() {}
+func (UnimplementedGocaskServer) testEmbeddedByValue()                {}
+
+// UnsafeGocaskServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to GocaskServer will
+// result in compilation errors.
+type UnsafeGocaskServer interface {
+	mustEmbedUnimplementedGocaskServer()
+}
+
+func RegisterGocaskServer(s grpc.ServiceRegistrar, srv GocaskServer) {
+	// If the following call pancis, it indicates UnimplementedGocaskServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&Gocask_ServiceDesc, srv)
+}
+
+func _Gocask_Get_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(GocaskServer).Get(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Gocask_Get_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(GocaskServer).Get(ctx, req.(*GetRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Gocask_Put_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PutRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(GocaskServer).Put(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Gocask_Put_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(GocaskServer).Put(ctx, req.(*PutRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Gocask_Delete_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeleteRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(GocaskServer).Delete(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Gocask_Delete_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(GocaskServer).Delete(ctx, req.(*DeleteRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Gocask_Batch_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BatchRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(GocaskServer).Batch(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Gocask_Batch_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(GocaskServer).Batch(ctx, req.(*BatchRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Gocask_Scan_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(ScanRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(GocaskServer).Scan(m, &grpc.GenericServerStream[ScanRequest, KeyValue]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Gocask_ScanServer = grpc.ServerStreamingServer[KeyValue]
+
+// Gocask_ServiceDesc is the grpc.ServiceDesc for Gocask service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Gocask_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "gocask.v1.Gocask",
+	HandlerType: (*GocaskServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Get",
+			Handler:    _Gocask_Get_Handler,
+		},
+		{
+			MethodName: "Put",
+			Handler:    _Gocask_Put_Handler,
+		},
+		{
+			MethodName: "Delete",
+			Handler:    _Gocask_Delete_Handler,
+		},
+		{
+			MethodName: "Batch",
+			Handler:    _Gocask_Batch_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Scan",
+			Handler:       _Gocask_Scan_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "gocaskpb/gocask.proto",
+}
@@ -0,0 +1,125 @@
+// Package gocaskprom exposes gocask's metrics to prometheus: puts, gets, deletes and
+// misses, bytes written and read, merges and their durations, segments, index size,
+// quotas, the value cache and scheduled backups. Being a package of its own, only
+// binaries that import it carry the prometheus client.
+package gocaskprom
+
+import (
+	"time"
+
+	"github.com/itsknk/gocask"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Collector exposes the counters and gauges of the stores open in the process to
+// prometheus. Register it with any registry; every scrape reads the live values.
+type Collector struct {
+	puts, gets, deletes, getMisses    *prometheus.Desc
+	bytesWritten, bytesRead           *prometheus.Desc
+	bytesReturned                     *prometheus.Desc
+	compactionWritten, compactionRead *prometheus.Desc
+	mergeDuration                     *prometheus.Desc
+	segments, keys                    *prometheus.Desc
+	diskFull, readOnly                *prometheus.Desc
+	quotaUsed, quotaLimit             *prometheus.Desc
+	cacheHits, cacheMisses            *prometheus.Desc
+	expired, evicted                  *prometheus.Desc
+	backups, backupFailures           *prometheus.Desc
+	lastBackup, lastBackupFailure     *prometheus.Desc
+}
+
+// NewCollector returns a Collector labeling every metric of a store with the name
+// gocask.WithName gave it, "" for stores without one, which are added up.
+func NewCollector() *Collector {
+	desc := func(name, help string, labels ...string) *prometheus.Desc {
+		return prometheus.NewDesc("gocask_"+name, help, labels, nil)
+	}
+	return &Collector{
+		puts:              desc("puts_total", "Puts written.", "store"),
+		gets:              desc("gets_total", "Gets served, hits and misses.", "store"),
+		deletes:           desc("deletes_total", "Deletes written.", "store"),
+		getMisses:         desc("get_misses_total", "Gets for keys that don't exist, were deleted or expired.", "store"),
+		bytesWritten:      desc("written_bytes_total", "Bytes of records appended by puts and deletes.", "store"),
+		bytesRead:         desc("read_bytes_total", "Bytes of records read by gets.", "store"),
+		bytesReturned:     desc("returned_bytes_total", "Value bytes returned by gets.", "store"),
+		compactionWritten: desc("compaction_written_bytes_total", "Bytes of merged segments and hints written by merges.", "store"),
+		compactionRead:    desc("compaction_read_bytes_total", "Bytes of segments read by merges.", "store"),
+		mergeDuration:     desc("merge_duration_seconds", "How long each rotation and merge took.", "store"),
+		segments:          desc("segments", "Sealed data segments on disk.", "store"),
+		keys:              desc("keys", "Entries in the in-memory index, tombstones included.", "store"),
+		diskFull:          desc("disk_full_errors_total", "Writes that failed because the disk was full.", "store"),
+		readOnly:          desc("read_only", "1 while a full disk has switched an open store to read-only.", "store"),
+		quotaUsed:         desc("quota_used_bytes", "Bytes of live records under a quota's prefix.", "store", "prefix"),
+		quotaLimit:        desc("quota_limit_bytes", "Bytes of live records a quota allows under its prefix.", "store", "prefix"),
+		cacheHits:         desc("cache_hits_total", "Gets served from the value cache.", "store"),
+		cacheMisses:       desc("cache_misses_total", "Gets the value cache couldn't serve.", "store"),
+		expired:           desc("expired_total", "Keys the expiry sweeper deleted after their TTL ran out.", "store"),
+		evicted:           desc("evicted_total", "Keys deleted to keep the store within its key and size limits.", "store"),
+		backups:           desc("backups_total", "Scheduled backups that succeeded.", "store"),
+		backupFailures:    desc("backup_failures_total", "Scheduled backups that failed.", "store"),
+		lastBackup:        desc("last_backup_success_timestamp_seconds", "When the last scheduled backup succeeded, 0 if none has.", "store"),
+		lastBackupFailure: desc("last_backup_failure_timestamp_seconds", "When the last scheduled backup failed, 0 if none has.", "store"),
+	}
+}
+
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range []*prometheus.Desc{c.puts, c.gets, c.deletes, c.getMisses,
+		c.bytesWritten, c.bytesRead, c.bytesReturned, c.compactionWritten, c.compactionRead, c.mergeDuration, c.segments, c.keys,
+		c.diskFull, c.readOnly, c.quotaUsed, c.quotaLimit, c.cacheHits, c.cacheMisses, c.expired, c.evicted,
+		c.backups, c.backupFailures, c.lastBackup, c.lastBackupFailure} {
+		ch <- d
+	}
+}
+
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	for name, m := range gocask.MetricsByName() {
+		counter := func(d *prometheus.Desc, v uint64) {
+			ch <- prometheus.MustNewConstMetric(d, prometheus.CounterValue, float64(v), name)
+		}
+		gauge := func(d *prometheus.Desc, v float64) {
+			ch <- prometheus.MustNewConstMetric(d, prometheus.GaugeValue, v, name)
+		}
+		counter(c.puts, m.Puts)
+		counter(c.gets, m.Gets)
+		counter(c.deletes, m.Deletes)
+		counter(c.getMisses, m.GetMisses)
+		counter(c.bytesWritten, m.BytesWritten)
+		counter(c.bytesRead, m.BytesRead)
+		counter(c.bytesReturned, m.BytesReturned)
+		counter(c.compactionWritten, m.CompactionWritten)
+		counter(c.compactionRead, m.CompactionRead)
+		counter(c.diskFull, m.DiskFullErrors)
+		counter(c.cacheHits, m.CacheHits)
+		counter(c.cacheMisses, m.CacheMisses)
+		counter(c.expired, m.Expired)
+		counter(c.evicted, m.Evicted)
+		ch <- prometheus.MustNewConstHistogram(c.mergeDuration, m.Merges, m.MergeSeconds, m.MergeBuckets, name)
+
+		if st := m.Backup; st != nil {
+			counter(c.backups, m.Backups)
+			counter(c.backupFailures, m.BackupFailures)
+			gauge(c.lastBackup, unixSeconds(st.LastSuccess))
+			gauge(c.lastBackupFailure, unixSeconds(st.LastFailure))
+		}
+
+		gauge(c.segments, float64(m.Segments))
+		gauge(c.keys, float64(m.Keys))
+		ro := 0.0
+		if m.ReadOnly {
+			ro = 1
+		}
+		gauge(c.readOnly, ro)
+		for _, u := range m.Quotas {
+			ch <- prometheus.MustNewConstMetric(c.quotaUsed, prometheus.GaugeValue, float64(u.Used), name, u.Prefix)
+			ch <- prometheus.MustNewConstMetric(c.quotaLimit, prometheus.GaugeValue, float64(u.MaxBytes), name, u.Prefix)
+		}
+	}
+}
+
+// unixSeconds is t as a prometheus timestamp, 0 for the zero time.
+func unixSeconds(t time.Time) float64 {
+	if t.IsZero() {
+		return 0
+	}
+	return float64(t.UnixNano()) / 1e9
+}
@@ -0,0 +1,246 @@
+// Package gocasktest has helpers for integration tests of code built on gocask: temp
+// stores, generated data, comparing stores, injecting faults and checking what a step
+// did to the files on disk. It goes through gocask's public API like the code under
+// test does, and being a package of its own, only binaries that import it carry the
+// testing package. InjectFault needs -tags gocask_failpoints.
+package gocasktest
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/fs"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/itsknk/gocask"
+	"github.com/itsknk/gocask/internal/failpoint"
+)
+
+// lockFile is the file a store takes a lock on to rotate, merge or pin files for a
+// backup, which SnapshotDir leaves out.
+const lockFile = "LOCK"
+
+// TempStore opens a store in a fresh directory from t.TempDir, closed when the test
+// ends unless the test closed it itself.
+func TempStore(t testing.TB) *gocask.DB {
+	t.Helper()
+	db, err := gocask.Open(t.TempDir())
+	if err != nil {
+		t.Fatalf("open temp store: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// FillOptions says what Fill writes. The zero value writes 1000 keys with values of
+// 100 bytes.
+type FillOptions struct {
+	Keys       int     // distinct keys written, key000000 and up
+	MinValue   int     // smallest value in bytes
+	MaxValue   int     // biggest value in bytes, MinValue if smaller
+	Overwrites float64 // fraction of keys written a second time
+	Deletes    float64 // fraction of keys deleted again
+	Seed       int64   // the same seed writes the same data
+}
+
+// Fill writes generated keys and values into db and returns what it should now hold.
+func Fill(t testing.TB, db *gocask.DB, o FillOptions) map[string]string {
+	t.Helper()
+	if o.Keys == 0 {
+		o.Keys = 1000
+	}
+	if o.MinValue == 0 && o.MaxValue == 0 {
+		o.MinValue = 100
+	}
+	if o.MaxValue < o.MinValue {
+		o.MaxValue = o.MinValue
+	}
+	rng := rand.New(rand.NewSource(o.Seed))
+	value := func() string {
+		b := make([]byte, o.MinValue+rng.Intn(o.MaxValue-o.MinValue+1))
+		for i := range b {
+			b[i] = byte('a' + rng.Intn(26))
+		}
+		return string(b)
+	}
+	want := make(map[string]string, o.Keys)
+	put := func(k string) {
+		v := value()
+		if err := db.Put(k, v); err != nil {
+			t.Fatalf("fill: put %q: %v", k, err)
+		}
+		want[k] = v
+	}
+	for i := 0; i < o.Keys; i++ {
+		put(fmt.Sprintf("key%06d", i))
+	}
+	for i := 0; i < o.Keys; i++ {
+		k := fmt.Sprintf("key%06d", i)
+		switch r := rng.Float64(); {
+		case r < o.Deletes:
+			if err := db.Delete(k); err != nil {
+				t.Fatalf("fill: delete %q: %v", k, err)
+			}
+			delete(want, k)
+		case r < o.Deletes+o.Overwrites:
+			put(k)
+		}
+	}
+	return want
+}
+
+// AssertContents fails the test unless db holds exactly the keys and values in want.
+func AssertContents(t testing.TB, db *gocask.DB, want map[string]string) {
+	t.Helper()
+	got := make(map[string]string)
+	for _, k := range db.Keys() {
+		v, err := db.Get(k)
+		if err != nil {
+			t.Fatalf("read %q: %v", k, err)
+		}
+		got[k] = v
+	}
+	for _, diff := range diffContents(got, want) {
+		t.Error(diff)
+	}
+}
+
+// AssertStoresEqual fails the test unless a and b hold the same live keys, with the
+// same values and metadata.
+func AssertStoresEqual(t testing.TB, a, b *gocask.DB) {
+	t.Helper()
+	read := func(db *gocask.DB) (map[string]string, map[string]gocask.Metadata) {
+		values, metas := make(map[string]string), make(map[string]gocask.Metadata)
+		for _, k := range db.Keys() {
+			v, err := db.Get(k)
+			if err != nil {
+				t.Fatalf("read %q from %s: %v", k, db.Path(), err)
+			}
+			meta, err := db.GetMeta(k)
+			if err != nil {
+				t.Fatalf("read the metadata of %q from %s: %v", k, db.Path(), err)
+			}
+			values[k], metas[k] = v, meta
+		}
+		return values, metas
+	}
+	av, am := read(a)
+	bv, bm := read(b)
+	for _, diff := range diffContents(av, bv) {
+		t.Error(diff)
+	}
+	for k, meta := range am {
+		if _, ok := bv[k]; ok && len(meta)+len(bm[k]) > 0 && !reflect.DeepEqual(meta, bm[k]) {
+			t.Errorf("%q: metadata %v, want %v", k, meta, bm[k])
+		}
+	}
+}
+
+// diffContents describes each key whose value in got is not the one in want, in
+// key order.
+func diffContents(got, want map[string]string) []string {
+	var diffs []string
+	for k, v := range got {
+		w, ok := want[k]
+		switch {
+		case !ok:
+			diffs = append(diffs, fmt.Sprintf("%q: unexpected, holds %s", k, clip(v)))
+		case v != w:
+			diffs = append(diffs, fmt.Sprintf("%q: holds %s, want %s", k, clip(v), clip(w)))
+		}
+	}
+	for k, w := range want {
+		if _, ok := got[k]; !ok {
+			diffs = append(diffs, fmt.Sprintf("%q: missing, want %s", k, clip(w)))
+		}
+	}
+	sort.Strings(diffs)
+	return diffs
+}
+
+// clip quotes v, shortened so a big value doesn't swamp the test output.
+func clip(v string) string {
+	if len(v) > 40 {
+		return fmt.Sprintf("%q... (%d bytes)", v[:40], len(v))
+	}
+	return fmt.Sprintf("%q", v)
+}
+
+// InjectFault makes the named step of rotation or merge (rotate.rename, merge.write
+// and the others rotation and merge check) fail with an error until the test ends.
+// Without -tags gocask_failpoints the test is skipped.
+func InjectFault(t testing.TB, name string) {
+	t.Helper()
+	if !failpoint.Set(name, "error") {
+		t.Skip("injecting faults needs -tags gocask_failpoints")
+	}
+	t.Cleanup(func() { failpoint.Set(name, "") })
+}
+
+// DirState is the size and checksum of every file under a directory, by its slash
+// separated path in it.
+type DirState map[string]FileState
+
+// FileState is what SnapshotDir records of a file.
+type FileState struct {
+	Size int64
+	Sum  [sha256.Size]byte
+}
+
+// SnapshotDir records the state of the files under dir, but for the lock file.
+func SnapshotDir(t testing.TB, dir string) DirState {
+	t.Helper()
+	state := make(DirState)
+	err := filepath.WalkDir(dir, func(path string, e fs.DirEntry, err error) error {
+		if err != nil || e.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil || rel == lockFile {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		state[filepath.ToSlash(rel)] = FileState{Size: int64(len(data)), Sum: sha256.Sum256(data)}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("snapshot %s: %v", dir, err)
+	}
+	return state
+}
+
+// Diff describes each file added, removed or changed from before to d, by name.
+func (d DirState) Diff(before DirState) []string {
+	var diffs []string
+	for name, f := range d {
+		prev, ok := before[name]
+		switch {
+		case !ok:
+			diffs = append(diffs, fmt.Sprintf("%s: added, %d bytes", name, f.Size))
+		case f != prev:
+			diffs = append(diffs, fmt.Sprintf("%s: changed, %d bytes, was %d", name, f.Size, prev.Size))
+		}
+	}
+	for name := range before {
+		if _, ok := d[name]; !ok {
+			diffs = append(diffs, name+": removed")
+		}
+	}
+	sort.Strings(diffs)
+	return diffs
+}
+
+// AssertDirUnchanged fails the test if the files under dir differ from before.
+func AssertDirUnchanged(t testing.TB, dir string, before DirState) {
+	t.Helper()
+	for _, diff := range SnapshotDir(t, dir).Diff(before) {
+		t.Errorf("%s: %s", dir, diff)
+	}
+}
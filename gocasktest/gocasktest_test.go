@@ -0,0 +1,15 @@
+package gocasktest
+
+import "testing"
+
+func TestFillAndCompare(t *testing.T) {
+	a, b := TempStore(t), TempStore(t)
+	o := FillOptions{Keys: 50, Deletes: 0.2, Overwrites: 0.2, Seed: 1}
+	want := Fill(t, a, o)
+	AssertContents(t, a, want)
+	Fill(t, b, o)
+	AssertStoresEqual(t, a, b)
+
+	before := SnapshotDir(t, a.Path())
+	AssertDirUnchanged(t, a.Path(), before)
+}
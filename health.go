@@ -0,0 +1,165 @@
+package gocask
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// healthCanary is the key the health checks read back from disk.
+const healthCanary = internalPrefix + "health/canary"
+
+// HealthOptions are what Health holds the store to.
+type HealthOptions struct {
+	MinFreeBytes      uint64        // free disk space below which the store isn't ready
+	MinFreeRatio      float64       // the same as a share of the disk, 0.05 for 5%
+	MaxMergeFailures  int           // merges that may fail in a row, 0 for no limit
+	MaxReplicationLag time.Duration // 0 for no limit
+}
+
+// Health runs the checks behind serve's /healthz and /readyz. Live only asks whether
+// the store still reads, which a restart may fix; Ready also asks whether it should
+// take traffic, which waiting for space, merges or replication to catch up fixes.
+type Health struct {
+	s      *store
+	opts   HealthOptions
+	canary string               // the canary's value, "" if a read-only store had none
+	lag    func() time.Duration // nil without replication
+}
+
+// healthCheck is one check: it returns what it found, or why the store fails it.
+type healthCheck struct {
+	name string
+	run  func() (string, error)
+}
+
+// NewHealth writes the canary the checks read back, unless the store is read-only,
+// in which case the one it has, if any, is read. lag reports how far behind
+// replication is, nil without it.
+func NewHealth(db *DB, opts HealthOptions, lag func() time.Duration) (*Health, error) {
+	s := db.s
+	h := &Health{s: s, opts: opts, lag: lag}
+	if s.dir.checkWritable() != nil {
+		h.canary, _ = readCanary(s.keyDir)
+		return h, nil
+	}
+	h.canary = time.Now().UTC().Format(time.RFC3339Nano)
+	defer db.lock()()
+	// not Put, which would give it the default TTL
+	if err := putAt(healthCanary, h.canary, s.dir.newTimestamp(), 0, nil, s.f, s.w, s.keyDir); err != nil {
+		return nil, fmt.Errorf("write health canary: %w", err)
+	}
+	return h, nil
+}
+
+// readCanary reads the canary's record from its file, past the value cache and
+// without counting as a get.
+func readCanary(keyDir *KeyDir) (string, error) {
+	fo, ok := keyDir.Get(healthCanary)
+	if !ok || fo.Tombstone() {
+		return "", errors.New("the canary key is gone")
+	}
+	f, err := keyDir.dir.readers.acquire(fo.FileID())
+	if err != nil {
+		return "", err
+	}
+	defer keyDir.dir.readers.release(f)
+	rec, err := f.readAt(make([]byte, fo.recordSize(healthCanary)), fo.Offset())
+	if err != nil {
+		return "", fmt.Errorf("%s: record at offset %d: %w", fo.FileID(), fo.Offset(), err)
+	}
+	if err := checkRecord(rec, fo.FileID(), fo.Offset()); err != nil {
+		return "", err
+	}
+	_, _, value := splitValue(rec[0], rec[headerSize+len(healthCanary):])
+	return string(value), nil
+}
+
+func (h *Health) checkCanary() (string, error) {
+	if h.canary == "" {
+		return "skipped, the read-only store has no canary", nil
+	}
+	v, err := readCanary(h.s.keyDir)
+	if err != nil {
+		return "", err
+	}
+	if v != h.canary {
+		return "", fmt.Errorf("read %q back, want %q", v, h.canary)
+	}
+	return "read back", nil
+}
+
+func (h *Health) checkDisk() (string, error) {
+	if h.s.dir.readOnly.Load() {
+		return "", ErrReadOnly
+	}
+	free, total, err := diskSpace(h.s.path)
+	if err != nil {
+		return "", err
+	}
+	msg := fmt.Sprintf("%d of %d bytes free", free, total)
+	if free < h.opts.MinFreeBytes || float64(free) < h.opts.MinFreeRatio*float64(total) {
+		return "", errors.New(msg + ", below the minimum")
+	}
+	return msg, nil
+}
+
+func (h *Health) checkMerges() (string, error) {
+	n, err := h.s.dir.failedMerges()
+	if h.opts.MaxMergeFailures > 0 && n >= h.opts.MaxMergeFailures {
+		return "", fmt.Errorf("the last %d merges failed, the last with: %v", n, err)
+	}
+	return fmt.Sprintf("%d failed in a row", n), nil
+}
+
+func (h *Health) checkReplication() (string, error) {
+	if h.lag == nil {
+		return "not replicating", nil
+	}
+	lag := h.lag().Round(time.Millisecond)
+	if h.opts.MaxReplicationLag > 0 && lag > h.opts.MaxReplicationLag {
+		return "", fmt.Errorf("%v behind, more than %v", lag, h.opts.MaxReplicationLag)
+	}
+	return fmt.Sprintf("%v behind", lag), nil
+}
+
+// handler serves the checks as one line each, with status 503 if any failed.
+func (h *Health) handler(checks ...healthCheck) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet && req.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "check with a GET", http.StatusMethodNotAllowed)
+			return
+		}
+		var b strings.Builder
+		status := http.StatusOK
+		for _, c := range checks {
+			msg, err := c.run()
+			if err != nil {
+				status = http.StatusServiceUnavailable
+				h.s.dir.logger.Warn("health check failed", "check", c.name, "path", req.URL.Path, "err", err)
+				fmt.Fprintf(&b, "fail %s: %v\n", c.name, err)
+			} else {
+				fmt.Fprintf(&b, "ok   %s: %s\n", c.name, msg)
+			}
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(status)
+		fmt.Fprint(w, b.String())
+	}
+}
+
+// Live serves the canary check as /healthz does.
+func (h *Health) Live() http.Handler {
+	return h.handler(healthCheck{"canary", h.checkCanary})
+}
+
+// Ready serves every check as /readyz does.
+func (h *Health) Ready() http.Handler {
+	return h.handler(healthCheck{"canary", h.checkCanary},
+		healthCheck{"disk", h.checkDisk},
+		healthCheck{"merges", h.checkMerges},
+		healthCheck{"replication", h.checkReplication})
+}
@@ -0,0 +1,116 @@
+package gocask
+
+// Hooks are callbacks on mutations and merges, for audit logs, cache invalidation
+// or custom metrics. Any of them may be nil. Like the changefeed, they skip gocask's
+// own internal keys. They run on the goroutine doing the write, while it holds the
+// store, unless Async is set: then they run one at a time, in order, on a goroutine
+// of their own, and a writer only waits for them once hookQueueSize calls are pending.
+// Each store has its own, see WithHooks.
+type Hooks struct {
+	OnPut       func(key, value string)
+	OnDelete    func(key string)
+	BeforeMerge func()
+	AfterMerge  func(err error) // err is what the merge returned
+	// OnMergeProgress is called when a merge starts, after each segment it reads,
+	// and when it finishes or aborts.
+	OnMergeProgress func(MergeProgress)
+	// OnDiskFull is called when a write fails for lack of space.
+	OnDiskFull func(err error)
+	Async      bool
+}
+
+const hookQueueSize = 1024
+
+// noHooks are the hooks of a store nothing has installed any on.
+var noHooks Hooks
+
+// WithHooks installs h on the store, see Hooks.
+func WithHooks(h Hooks) Option {
+	return withSetting(func(s *store) error {
+		s.dir.setHooks(h)
+		return nil
+	})
+}
+
+// SetHooks replaces the store's hooks, see Hooks. Writes already running may still
+// call the earlier ones.
+func (db *DB) SetHooks(h Hooks) {
+	db.s.dir.setHooks(h)
+}
+
+// setHooks installs h, starting the store's hook goroutine the first time they are
+// Async.
+func (d *dataDir) setHooks(h Hooks) {
+	if h.Async {
+		d.hookOnce.Do(func() {
+			d.hookQueue = make(chan func(), hookQueueSize)
+			go func() {
+				for fn := range d.hookQueue {
+					fn()
+				}
+			}()
+		})
+	}
+	d.hooks.Store(&h)
+}
+
+// stopHooks lets the hook goroutine finish the calls pending and exit. Hooks fired
+// after it run on the goroutine firing them.
+func (d *dataDir) stopHooks() {
+	d.hookOnce.Do(func() {})
+	if d.hookQueue != nil {
+		close(d.hookQueue)
+		d.hookQueue = nil
+	}
+}
+
+func (d *dataDir) currentHooks() *Hooks {
+	if h := d.hooks.Load(); h != nil {
+		return h
+	}
+	return &noHooks
+}
+
+func (d *dataDir) runHook(h *Hooks, fn func()) {
+	if h.Async && d.hookQueue != nil {
+		d.hookQueue <- fn
+		return
+	}
+	fn()
+}
+
+func (d *dataDir) firePut(key, value string) {
+	if h := d.currentHooks(); h.OnPut != nil && !isInternalKey([]byte(key)) {
+		d.runHook(h, func() { h.OnPut(key, value) })
+	}
+}
+
+func (d *dataDir) fireDelete(key string) {
+	if h := d.currentHooks(); h.OnDelete != nil && !isInternalKey([]byte(key)) {
+		d.runHook(h, func() { h.OnDelete(key) })
+	}
+}
+
+func (d *dataDir) fireBeforeMerge() {
+	if h := d.currentHooks(); h.BeforeMerge != nil {
+		d.runHook(h, h.BeforeMerge)
+	}
+}
+
+func (d *dataDir) fireAfterMerge(err error) {
+	if h := d.currentHooks(); h.AfterMerge != nil {
+		d.runHook(h, func() { h.AfterMerge(err) })
+	}
+}
+
+func (d *dataDir) fireMergeProgress(p MergeProgress) {
+	if h := d.currentHooks(); h.OnMergeProgress != nil {
+		d.runHook(h, func() { h.OnMergeProgress(p) })
+	}
+}
+
+func (d *dataDir) fireDiskFull(err error) {
+	if h := d.currentHooks(); h.OnDiskFull != nil {
+		d.runHook(h, func() { h.OnDiskFull(err) })
+	}
+}
@@ -0,0 +1,49 @@
+package gocask
+
+import (
+	"sync"
+	"testing"
+)
+
+// Hooks are a store's own: writes to another store in the process don't call them.
+func TestHooksPerStore(t *testing.T) {
+	var (
+		mu   sync.Mutex
+		puts []string
+	)
+	done := make(chan struct{})
+	hooked, err := Open(t.TempDir(), WithHooks(Hooks{
+		OnPut: func(key, value string) {
+			mu.Lock()
+			puts = append(puts, key)
+			mu.Unlock()
+		},
+		OnDelete: func(string) { close(done) },
+		Async:    true,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hooked.Close()
+	other, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+
+	if err := other.Put("b", "v"); err != nil {
+		t.Fatal(err)
+	}
+	if err := hooked.Put("a", "v"); err != nil {
+		t.Fatal(err)
+	}
+	if err := hooked.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	<-done // the async hooks run in order
+	mu.Lock()
+	defer mu.Unlock()
+	if len(puts) != 1 || puts[0] != "a" {
+		t.Errorf("OnPut called for %q, want just a", puts)
+	}
+}
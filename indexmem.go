@@ -0,0 +1,103 @@
+package gocask
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unsafe"
+)
+
+// indexUsage estimates the memory held by keyDir. Go doesn't report a map's size,
+// so the estimate is built from the entry layout: every entry costs its key's bytes,
+// rounded up to the allocator's size class, plus a fixed overhead for the key string
+// header, the FileOffset, the map's per-slot hash byte and its unused slots, and the
+// key's string header in the sorted key list.
+type indexUsage struct {
+	Entries  int64
+	KeyBytes int64 // allocated for key data
+	Overhead int64 // everything else
+	ByPrefix map[string]*indexUsage
+}
+
+func (u *indexUsage) Total() int64 { return u.KeyBytes + u.Overhead }
+
+// indexEntryOverhead is the per-entry cost besides the key bytes. Map buckets hold
+// 8 slots and grow at an average load of 6.5, so each live entry carries 8/6.5 of a slot;
+// the sorted key list adds one more string header.
+const indexEntryOverhead = int64(unsafe.Sizeof("")+unsafe.Sizeof(FileOffset{})+1)*16/13 + int64(unsafe.Sizeof(""))
+
+// smallSizeClasses are the Go allocator's size classes up to 1KiB.
+var smallSizeClasses = []int64{8, 16, 24, 32, 48, 64, 80, 96, 112, 128, 144, 160, 176, 192, 208, 224,
+	240, 256, 288, 320, 352, 384, 416, 448, 480, 512, 576, 640, 704, 768, 896, 1024}
+
+func allocSize(n int64) int64 {
+	if n == 0 {
+		return 0
+	}
+	if i := sort.Search(len(smallSizeClasses), func(i int) bool { return smallSizeClasses[i] >= n }); i < len(smallSizeClasses) {
+		return smallSizeClasses[i]
+	}
+	return (n + 127) &^ 127 // coarser classes above 1KiB, close enough for an estimate
+}
+
+// keyPrefix buckets keys by their first path segment: "user/1" counts under "user/".
+func keyPrefix(key string) string {
+	if i := strings.IndexByte(key, '/'); i >= 0 {
+		return key[:i+1]
+	}
+	return "(no prefix)"
+}
+
+func measureIndex(keyDir *KeyDir) *indexUsage {
+	total := &indexUsage{ByPrefix: make(map[string]*indexUsage)}
+	keyDir.Range(func(k string, _ FileOffset) bool {
+		kb := allocSize(int64(len(k)))
+		total.Entries++
+		total.KeyBytes += kb
+		total.Overhead += indexEntryOverhead
+
+		p := total.ByPrefix[keyPrefix(k)]
+		if p == nil {
+			p = &indexUsage{}
+			total.ByPrefix[keyPrefix(k)] = p
+		}
+		p.Entries++
+		p.KeyBytes += kb
+		p.Overhead += indexEntryOverhead
+		return true
+	})
+	return total
+}
+
+// indexLines is the breakdown printed by gocask stats --index, largest prefix first.
+func indexLines(u *indexUsage, limit int) []string {
+	prefixes := make([]string, 0, len(u.ByPrefix))
+	for p := range u.ByPrefix {
+		prefixes = append(prefixes, p)
+	}
+	sort.Slice(prefixes, func(i, j int) bool {
+		a, b := u.ByPrefix[prefixes[i]].Total(), u.ByPrefix[prefixes[j]].Total()
+		if a != b {
+			return a > b
+		}
+		return prefixes[i] < prefixes[j]
+	})
+
+	lines := []string{fmt.Sprintf("%-24s %10s %12s %12s %12s", "PREFIX", "ENTRIES", "KEY BYTES", "OVERHEAD", "TOTAL")}
+	row := func(name string, p *indexUsage) string {
+		return fmt.Sprintf("%-24s %10d %12d %12d %12d", name, p.Entries, p.KeyBytes, p.Overhead, p.Total())
+	}
+	for i, name := range prefixes {
+		if i == limit {
+			lines = append(lines, fmt.Sprintf("... %d more prefixes", len(prefixes)-limit))
+			break
+		}
+		lines = append(lines, row(strings.ToValidUTF8(name, "?"), u.ByPrefix[name]))
+	}
+	lines = append(lines, row("total", u))
+	if u.Entries > 0 {
+		lines = append(lines, fmt.Sprintf("about %d bytes per key; a million keys like these need about %d MiB",
+			u.Total()/u.Entries, u.Total()*1000000/u.Entries>>20))
+	}
+	return lines
+}
@@ -0,0 +1,60 @@
+//go:build gocask_failpoints
+
+// Package failpoint lets the crash test and gocasktest stop rotation and merge
+// between any two steps. A binary built with -tags gocask_failpoints reads
+// GOCASK_FAILPOINTS, a comma separated list of name=action: "error" makes the step
+// fail as if its own IO had, "crash" exits the process on the spot, leaving the files
+// as a killed process would. Without the tag every step goes ahead.
+package failpoint
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+var points = parse(os.Getenv("GOCASK_FAILPOINTS"))
+
+// mu guards points against Set while a merge runs.
+var mu sync.Mutex
+
+// CrashCode is the exit status of a simulated crash.
+const CrashCode = 86
+
+func parse(spec string) map[string]string {
+	m := make(map[string]string)
+	for _, fp := range strings.Split(spec, ",") {
+		if name, action, ok := strings.Cut(strings.TrimSpace(fp), "="); ok {
+			m[name] = action
+		}
+	}
+	return m
+}
+
+// Check is called before a step of rotation or merge that can fail.
+func Check(name string) error {
+	mu.Lock()
+	action := points[name]
+	mu.Unlock()
+	switch action {
+	case "error":
+		return fmt.Errorf("failpoint %s", name)
+	case "crash":
+		os.Exit(CrashCode)
+	}
+	return nil
+}
+
+// Set makes the named step take action from now on, or no longer fail if action is
+// "". It reports whether failpoints are compiled in.
+func Set(name, action string) bool {
+	mu.Lock()
+	defer mu.Unlock()
+	if action == "" {
+		delete(points, name)
+	} else {
+		points[name] = action
+	}
+	return true
+}
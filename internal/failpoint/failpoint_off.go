@@ -0,0 +1,9 @@
+//go:build !gocask_failpoints
+
+package failpoint
+
+// Check is a no-op outside crash-test builds, see failpoint.go.
+func Check(name string) error { return nil }
+
+// Set reports that failpoints are compiled out.
+func Set(name, action string) bool { return false }
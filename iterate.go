@@ -0,0 +1,143 @@
+package gocask
+
+import "errors"
+
+// Keys returns every live key, sorted. Deleted keys and ones whose TTL ran out are
+// left out, and so are the keys collections are stored under.
+func (db *DB) Keys() []string {
+	defer db.rlock()()
+	return db.s.keys(false)
+}
+
+// keys returns the live keys, sorted, with those of collections if colls. Keys whose
+// TTL ran out are left out; one that can't be checked is kept.
+func (s *store) keys(colls bool) []string {
+	var live []string
+	for _, k := range s.keyDir.order.between("", "") {
+		if isInternalKey([]byte(k)) || (!colls && isCollKey(k)) {
+			continue
+		}
+		fo, ok := s.keyDir.Get(k)
+		if !ok || fo.Tombstone() {
+			continue
+		}
+		if gone, _ := s.dir.hasExpired(k, fo); !gone {
+			live = append(live, k)
+		}
+	}
+	return live
+}
+
+// Fold calls fn with every live key and its value, in key order, and stops at the
+// first error fn returns, which Fold then returns. The keys are listed when it
+// starts and each value is read just before fn gets it, so a key deleted meanwhile
+// is skipped and one changed meanwhile comes with its new value. No lock is held
+// while fn runs, so fn may write to db. The slices are fn's to keep.
+func (db *DB) Fold(fn func(key, value []byte) error) error {
+	for _, k := range db.Keys() {
+		v, ok, err := db.liveValue(k)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		if err := fn([]byte(k), []byte(v)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Scan is PrefixScan.
+func (db *DB) Scan(prefix string) *Iterator {
+	return db.PrefixScan(prefix)
+}
+
+// PrefixScan returns an iterator over the live keys starting with prefix, all of
+// them for "", in key order. Like Fold, it takes the keys as they are when it
+// starts and reads each value as it gets to it. The keys come from the sorted
+// index kept in memory, so finding them reads nothing from disk.
+func (db *DB) PrefixScan(prefix string) *Iterator {
+	return db.Range(prefix, prefixEnd(prefix))
+}
+
+// Range returns an iterator over the live keys from start up to but not including
+// end, in key order; an end of "" has no upper bound. See PrefixScan.
+func (db *DB) Range(start, end string) *Iterator {
+	unlock := db.rlock()
+	keys := db.s.keyDir.order.between(start, end)
+	unlock()
+	return &Iterator{db: db, keys: keys}
+}
+
+// liveValue reads the value of key for an iteration; ok is false if the key was
+// deleted or expired since the keys were listed.
+func (db *DB) liveValue(key string) (value string, ok bool, err error) {
+	defer db.rlock()()
+	return db.s.liveGet(key)
+}
+
+// liveGet returns the value of key; found is false if it isn't set, was deleted or
+// expired. Callers hold the store's mu.
+func (s *store) liveGet(key string) (value string, found bool, err error) {
+	fo, ok := s.keyDir.Get(key)
+	if !ok || fo.Tombstone() {
+		return "", false, nil
+	}
+	value, err = get(key, s.keyDir)
+	if errors.Is(err, ErrNotFound) {
+		return "", false, nil
+	}
+	return value, err == nil, err
+}
+
+// Iterator steps through keys and their values, as returned by PrefixScan and Range:
+//
+//	it := db.PrefixScan("user:")
+//	for it.Next() {
+//		fmt.Println(it.Key(), it.Value())
+//	}
+//	if err := it.Err(); err != nil {
+//		...
+//	}
+//
+// An Iterator is not safe for concurrent use.
+type Iterator struct {
+	db         *DB
+	keys       []string // still to go, deleted, internal and collection ones included
+	key, value string
+	err        error
+}
+
+// Next moves to the next key that is still live and reports whether there was one.
+// It returns false at the end and after an error reading a value, see Err.
+func (it *Iterator) Next() bool {
+	for it.err == nil && len(it.keys) > 0 {
+		k := it.keys[0]
+		it.keys = it.keys[1:]
+		if isInternalKey([]byte(k)) || isCollKey(k) {
+			continue
+		}
+		v, ok, err := it.db.liveValue(k)
+		if err != nil {
+			it.err = err
+			break
+		}
+		if ok {
+			it.key, it.value = k, v
+			return true
+		}
+	}
+	it.key, it.value = "", ""
+	return false
+}
+
+// Key is the key Next moved to.
+func (it *Iterator) Key() string { return it.key }
+
+// Value is the value of Key.
+func (it *Iterator) Value() string { return it.value }
+
+// Err is the error that stopped the iteration, nil if it ran to the end.
+func (it *Iterator) Err() error { return it.err }
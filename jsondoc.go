@@ -0,0 +1,257 @@
+package gocask
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// pathStep is one step of a field path: an object member, or an array index.
+type pathStep struct {
+	name  string
+	index int // -1 for an object member
+}
+
+// parseFieldPath parses a path like a.b[2].c into its steps. Members are separated by
+// dots and indexes written in brackets; the empty path is the whole document.
+func parseFieldPath(path string) ([]pathStep, error) {
+	var steps []pathStep
+	rest := path
+	for rest != "" {
+		if strings.HasPrefix(rest, "[") {
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("path %q: unclosed [", path)
+			}
+			i, err := strconv.Atoi(rest[1:end])
+			if err != nil || i < 0 {
+				return nil, fmt.Errorf("path %q: bad index %q", path, rest[1:end])
+			}
+			steps = append(steps, pathStep{index: i})
+			rest = rest[end+1:]
+			if strings.HasPrefix(rest, ".") && len(rest) > 1 {
+				rest = rest[1:]
+			}
+			continue
+		}
+		end := strings.IndexAny(rest, ".[")
+		if end < 0 {
+			end = len(rest)
+		}
+		if end == 0 {
+			return nil, fmt.Errorf("path %q: empty member name", path)
+		}
+		steps = append(steps, pathStep{name: rest[:end], index: -1})
+		rest = rest[end:]
+		if strings.HasPrefix(rest, ".") {
+			if rest = rest[1:]; rest == "" {
+				return nil, fmt.Errorf("path %q: ends in a dot", path)
+			}
+		}
+	}
+	return steps, nil
+}
+
+func (s pathStep) String() string {
+	if s.index >= 0 {
+		return fmt.Sprintf("[%d]", s.index)
+	}
+	return s.name
+}
+
+// decodeJSON decodes one JSON value, keeping numbers as they were written.
+func decodeJSON(data string) (any, error) {
+	dec := json.NewDecoder(strings.NewReader(data))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, fmt.Errorf("more than one JSON value")
+	}
+	return v, nil
+}
+
+// GetField returns the field of key's JSON value at path, like a.b[2], as JSON. Only
+// the field crosses the API, however big the document is.
+func (db *DB) GetField(key, path string) (string, error) {
+	if err := checkKey(key); err != nil {
+		return "", err
+	}
+	defer db.rlock()()
+	return getField(key, path, db.s.keyDir)
+}
+
+// getField is DB.GetField for callers holding the store's mu.
+func getField(key, path string, keyDir *KeyDir) (string, error) {
+	steps, err := parseFieldPath(path)
+	if err != nil {
+		return "", err
+	}
+	value, err := get(key, keyDir)
+	if err != nil {
+		return "", err
+	}
+	doc, err := decodeJSON(value)
+	if err != nil {
+		return "", fmt.Errorf("value of %q isn't JSON: %w", key, err)
+	}
+	for i, step := range steps {
+		if doc, err = fieldStep(doc, step); err != nil {
+			return "", fmt.Errorf("%s: %w", joinPath(steps[:i+1]), err)
+		}
+	}
+	return encodeJSON(doc)
+}
+
+// fieldStep returns the member or element of v that step names.
+func fieldStep(v any, step pathStep) (any, error) {
+	if step.index >= 0 {
+		arr, ok := v.([]any)
+		if !ok {
+			return nil, fmt.Errorf("not an array")
+		}
+		if step.index >= len(arr) {
+			return nil, fmt.Errorf("index out of range, the array has %d elements", len(arr))
+		}
+		return arr[step.index], nil
+	}
+	obj, ok := v.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("not an object")
+	}
+	field, ok := obj[step.name]
+	if !ok {
+		return nil, fmt.Errorf("no such field")
+	}
+	return field, nil
+}
+
+// SetField replaces the field of key's JSON value at path with the JSON in field, and
+// writes the document back with the metadata and expiry it had. Missing object members
+// along the path are created, an index one past the end of an array appends to it, and
+// a key that doesn't exist or has expired starts out as an empty object. Like every
+// write it runs under the store's mu, so no other write to key lands between the read
+// and the write. Objects are written back with their members sorted.
+func (db *DB) SetField(key, path, field string) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	defer db.lock()()
+	if err := setField(key, path, field, db.s.f, db.s.w, db.s.keyDir); err != nil {
+		return err
+	}
+	return db.s.rotateIfFull()
+}
+
+// setField is DB.SetField for callers holding the store's mu.
+func setField(key, path, field string, f *os.File, w *bufio.Writer, keyDir *KeyDir) error {
+	steps, err := parseFieldPath(path)
+	if err != nil {
+		return err
+	}
+	v, err := decodeJSON(field)
+	if err != nil {
+		return fmt.Errorf("new value of %s isn't JSON: %w", path, err)
+	}
+
+	var doc any = map[string]any{}
+	var meta Metadata
+	expires := keyDir.dir.defaultExpiry(key)
+	if fo, ok := keyDir.Get(key); ok && !fo.Tombstone() {
+		value, m, err := getWithMeta(key, keyDir)
+		switch {
+		case errors.Is(err, ErrExpired):
+		case err != nil:
+			return err
+		default:
+			if doc, err = decodeJSON(value); err != nil {
+				return fmt.Errorf("value of %q isn't JSON: %w", key, err)
+			}
+			if expires, err = keyDir.dir.expiryOf(key, fo); err != nil {
+				return err
+			}
+			meta = m
+		}
+	}
+
+	if doc, err = setFieldAt(doc, steps, 0, v); err != nil {
+		return err
+	}
+	out, err := encodeJSON(doc)
+	if err != nil {
+		return err
+	}
+	return putAt(key, out, keyDir.dir.newTimestamp(), expires, meta, f, w, keyDir)
+}
+
+// setFieldAt returns doc, found at steps[:depth], with the field at the rest of steps
+// set to v.
+func setFieldAt(doc any, steps []pathStep, depth int, v any) (any, error) {
+	if depth == len(steps) {
+		return v, nil
+	}
+	step := steps[depth]
+	at := joinPath(steps[:depth+1])
+	if step.index >= 0 {
+		arr, ok := doc.([]any)
+		if !ok {
+			return nil, fmt.Errorf("%s: not an array", at)
+		}
+		switch {
+		case step.index < len(arr):
+		case step.index == len(arr):
+			arr = append(arr, nil)
+		default:
+			return nil, fmt.Errorf("%s: index out of range, the array has %d elements", at, len(arr))
+		}
+		elem, err := setFieldAt(arr[step.index], steps, depth+1, v)
+		if err != nil {
+			return nil, err
+		}
+		arr[step.index] = elem
+		return arr, nil
+	}
+	if doc == nil {
+		doc = map[string]any{}
+	}
+	obj, ok := doc.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an object", at)
+	}
+	member, err := setFieldAt(obj[step.name], steps, depth+1, v)
+	if err != nil {
+		return nil, err
+	}
+	obj[step.name] = member
+	return obj, nil
+}
+
+// encodeJSON encodes v compactly, without escaping HTML characters.
+func encodeJSON(v any) (string, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(buf.String(), "\n"), nil
+}
+
+func joinPath(steps []pathStep) string {
+	var b strings.Builder
+	for i, s := range steps {
+		if i > 0 && s.index < 0 {
+			b.WriteByte('.')
+		}
+		b.WriteString(s.String())
+	}
+	return b.String()
+}
@@ -0,0 +1,171 @@
+package gocask
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// keyDirShards is how many independently locked maps a KeyDir is split into.
+const keyDirShards = 64
+
+// KeyDir is the in-memory index from key to the newest record of the key. It is split
+// into shards by key hash, each with its own lock, so readers and writers on different
+// keys don't queue up behind one another.
+type KeyDir struct {
+	shards [keyDirShards]keyDirShard
+	n      atomic.Int64 // entries over all shards
+	live   atomic.Int64 // entries that aren't tombstones
+	bytes  atomic.Int64 // size of the records live entries point at
+	tombs  atomic.Int64 // size of the tombstones entries point at
+	order  keyOrder     // the keys with a value, in order, for prefix and range queries
+
+	dir *dataDir // the store whose files the entries point into, nil while one is built
+}
+
+type keyDirShard struct {
+	sync.RWMutex
+	m           map[string]FileOffset
+	live, bytes int64    // this shard's part of KeyDir.live and KeyDir.bytes
+	tombs       int64    // and of KeyDir.tombs
+	quota       []int64  // this shard's bytes under each of the quotas in force, see WithQuotas
+	_           [64]byte // keep neighbouring shard locks off the same cache line
+}
+
+// count adds sign times the live entry and record bytes of fo, or the tombstone bytes,
+// to s and d. Callers hold s locked.
+func (d *KeyDir) count(s *keyDirShard, key string, fo FileOffset, sign int64) {
+	n := sign * fo.recordSize(key)
+	if fo.Tombstone() {
+		s.tombs += n
+		d.tombs.Add(n)
+		return
+	}
+	s.live += sign
+	s.bytes += n
+	s.addQuotas(d.quotas(), key, n)
+	d.live.Add(sign)
+	d.bytes.Add(n)
+}
+
+func newKeyDir() *KeyDir {
+	d := &KeyDir{}
+	for i := range d.shards {
+		d.shards[i].m = make(map[string]FileOffset)
+	}
+	return d
+}
+
+// shard picks the shard of key.
+func (d *KeyDir) shard(key string) *keyDirShard { return &d.shards[shardOf(key)] }
+
+// shardOf is the shard of key by its FNV-1a hash.
+func shardOf(key string) int {
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return int(h % keyDirShards)
+}
+
+// Get returns the entry of key.
+func (d *KeyDir) Get(key string) (FileOffset, bool) {
+	s := d.shard(key)
+	s.RLock()
+	fo, ok := s.m[key]
+	s.RUnlock()
+	return fo, ok
+}
+
+// Len is the number of entries, tombstones included.
+func (d *KeyDir) Len() int { return int(d.n.Load()) }
+
+// Live is the number of entries that aren't tombstones, expired ones included.
+func (d *KeyDir) Live() int { return int(d.live.Load()) }
+
+// LiveBytes is the size of the records the live entries point at, which is what a
+// merge would keep of them.
+func (d *KeyDir) LiveBytes() int64 { return d.bytes.Load() }
+
+// tombstoneBytes is the size of the tombstones the entries point at, which a merge
+// keeps while they are younger than the compaction policy's TombstoneAge.
+func (d *KeyDir) tombstoneBytes() int64 { return d.tombs.Load() }
+
+// Range calls fn for every entry until fn returns false. Each shard is read-locked
+// while fn runs on its entries, so fn must not change d. Entries changed meanwhile in
+// shards not visited yet show up with their new value.
+func (d *KeyDir) Range(fn func(key string, fo FileOffset) bool) { d.rangeFrom(0, fn) }
+
+// rangeFrom is Range starting at shard first and wrapping around, for callers that
+// stop early and want a different part of the index each time.
+func (d *KeyDir) rangeFrom(first int, fn func(key string, fo FileOffset) bool) {
+	for i := range d.shards {
+		s := &d.shards[(first+i)%keyDirShards]
+		s.RLock()
+		for k, fo := range s.m {
+			if !fn(k, fo) {
+				s.RUnlock()
+				return
+			}
+		}
+		s.RUnlock()
+	}
+}
+
+func (d *KeyDir) set(key string, fo FileOffset) {
+	s := d.shard(key)
+	s.Lock()
+	old, ok := s.m[key]
+	if !ok {
+		d.n.Add(1)
+	} else {
+		d.count(s, key, old, -1)
+	}
+	if !fo.Tombstone() && (!ok || old.Tombstone()) {
+		d.order.add(key)
+	}
+	s.m[key] = fo
+	d.count(s, key, fo, 1)
+	s.Unlock()
+}
+
+// merge adds the entries of newer to d, replacing those of the same keys.
+func (d *KeyDir) merge(newer *KeyDir) {
+	for i := range d.shards {
+		s, from := &d.shards[i], newer.shards[i].m
+		s.Lock()
+		for k, fo := range from {
+			old, ok := s.m[k]
+			if !ok {
+				d.n.Add(1)
+			} else {
+				d.count(s, k, old, -1)
+			}
+			if !fo.Tombstone() && (!ok || old.Tombstone()) {
+				d.order.add(k)
+			}
+			s.m[k] = fo
+			d.count(s, k, fo, 1)
+		}
+		s.Unlock()
+	}
+}
+
+// replace swaps the contents of d for those of fresh, a shard at a time. fresh must
+// not be used afterwards.
+func (d *KeyDir) replace(fresh *KeyDir) {
+	for i := range d.shards {
+		s, from := &d.shards[i], &fresh.shards[i]
+		s.Lock()
+		d.n.Add(int64(len(from.m) - len(s.m)))
+		d.live.Add(from.live - s.live)
+		d.bytes.Add(from.bytes - s.bytes)
+		d.tombs.Add(from.tombs - s.tombs)
+		s.m, s.live, s.bytes, s.tombs, s.quota = from.m, from.live, from.bytes, from.tombs, from.quota
+		if qs := d.quotas(); len(qs) > 0 {
+			s.recountQuotas(qs) // fresh was built without them
+		}
+		s.Unlock()
+	}
+	d.order.take(&fresh.order)
+}
@@ -0,0 +1,85 @@
+package gocask
+
+import (
+	"slices"
+	"sort"
+	"sync"
+)
+
+// keyOrder keeps the keys of a KeyDir that have a value in sorted order, for prefix
+// and range queries that shouldn't have to sort the whole index each time. A key that
+// gets a value goes to a pending list that is only sorted and merged in when a query
+// needs the order, so a write pays for an append and a run of writes for one sort.
+// Deleting a key leaves it in the order, which queries check against the KeyDir
+// anyway, until a merge replaces both: the order it builds has none of the keys it
+// kept only a tombstone of.
+type keyOrder struct {
+	mu      sync.Mutex
+	sorted  []string // never changed in place, so queries can keep slices of it
+	pending []string
+}
+
+// add records key, which just got a value. It may be in the order already, from
+// before it was deleted.
+func (o *keyOrder) add(key string) {
+	o.mu.Lock()
+	o.pending = append(o.pending, key)
+	o.mu.Unlock()
+}
+
+// take replaces the keys of o with those of fresh, which must not be used afterwards.
+func (o *keyOrder) take(fresh *keyOrder) {
+	fresh.mu.Lock()
+	sorted, pending := fresh.sorted, fresh.pending
+	fresh.mu.Unlock()
+	o.mu.Lock()
+	o.sorted, o.pending = sorted, pending
+	o.mu.Unlock()
+}
+
+// between returns the keys from start up to but not including end, in order; an
+// end of "" has no upper bound. The slice is shared, callers mustn't change it.
+func (o *keyOrder) between(start, end string) []string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if len(o.pending) > 0 {
+		sort.Strings(o.pending)
+		o.sorted = mergeSorted(o.sorted, slices.Compact(o.pending))
+		o.pending = nil
+	}
+	i := sort.SearchStrings(o.sorted, start)
+	j := len(o.sorted)
+	if end != "" {
+		j = i + sort.SearchStrings(o.sorted[i:], end)
+	}
+	return o.sorted[i:j:j]
+}
+
+// mergeSorted merges the sorted slices a and b into a new one, with the strings
+// both have once.
+func mergeSorted(a, b []string) []string {
+	out := make([]string, 0, len(a)+len(b))
+	for len(a) > 0 && len(b) > 0 {
+		switch {
+		case a[0] == b[0]:
+			b = b[1:]
+		case a[0] < b[0]:
+			out, a = append(out, a[0]), a[1:]
+		default:
+			out, b = append(out, b[0]), b[1:]
+		}
+	}
+	out = append(out, a...)
+	return append(out, b...)
+}
+
+// prefixEnd is the first key after every key starting with prefix, "" if there is
+// none, which between takes as no upper bound.
+func prefixEnd(prefix string) string {
+	for i := len(prefix) - 1; i >= 0; i-- {
+		if prefix[i] != 0xff {
+			return prefix[:i] + string([]byte{prefix[i] + 1})
+		}
+	}
+	return ""
+}
@@ -0,0 +1,127 @@
+package gocask
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestKeyOrderBetween(t *testing.T) {
+	var o keyOrder
+	for _, k := range []string{"b", "a/2", "a", "a/1", "c\xff", "c\xff\xff", "a/1", "d"} {
+		o.add(k)
+	}
+	o.between("", "") // sorts what was added so far in
+	o.add("a/0")
+	o.add("b") // added again after a delete
+	for _, tc := range []struct {
+		start, end string
+		want       string
+	}{
+		{"", "", "[a a/0 a/1 a/2 b c\xff c\xff\xff d]"},
+		{"a/", prefixEnd("a/"), "[a/0 a/1 a/2]"},
+		{"a/1", "a/2", "[a/1]"},
+		{"a/1", "a/1", "[]"},
+		{"b", "", "[b c\xff c\xff\xff d]"},
+		{"", "b", "[a a/0 a/1 a/2]"},
+		{"c\xff", prefixEnd("c\xff"), "[c\xff c\xff\xff]"},
+		{"e", "", "[]"},
+	} {
+		if got := fmt.Sprint(o.between(tc.start, tc.end)); got != tc.want {
+			t.Errorf("between(%q, %q) = %q, want %q", tc.start, tc.end, got, tc.want)
+		}
+	}
+	if got := prefixEnd("\xff\xff"); got != "" {
+		t.Errorf("prefixEnd of all 0xff = %q, want no upper bound", got)
+	}
+}
+
+func TestPrefixScanAndRange(t *testing.T) {
+	db, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, k := range []string{"user:3", "user:1", "users", "user:2", "admin", "user;"} {
+		if err := db.Put(k, "v-"+k); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Delete("user:2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.HSet("user:h", "f", "v"); err != nil {
+		t.Fatal(err)
+	}
+	scan := func(it *Iterator) string {
+		var got []string
+		for it.Next() {
+			if it.Value() != "v-"+it.Key() {
+				t.Errorf("%s = %q", it.Key(), it.Value())
+			}
+			got = append(got, it.Key())
+		}
+		if err := it.Err(); err != nil {
+			t.Fatal(err)
+		}
+		return fmt.Sprint(got)
+	}
+	if got := scan(db.PrefixScan("user:")); got != "[user:1 user:3]" {
+		t.Errorf("PrefixScan(user:) = %s", got)
+	}
+	if got := scan(db.PrefixScan("")); got != "[admin user:1 user:3 user; users]" {
+		t.Errorf("PrefixScan() = %s", got)
+	}
+	if got := scan(db.Range("user:1", "user;")); got != "[user:1 user:3]" {
+		t.Errorf("Range(user:1, user;) = %s", got)
+	}
+	if got := scan(db.Range("user:2", "")); got != "[user:3 user; users]" {
+		t.Errorf("Range(user:2, ) = %s", got)
+	}
+}
+
+// A merge drops the keys deleted before it from the order, even those it keeps the
+// tombstone of, and a key deleted and put again is in it once.
+func TestKeyOrderAfterMerge(t *testing.T) {
+	db, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, k := range []string{"a", "b", "c", "d"} {
+		if err := db.Put(k, "v"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, k := range []string{"b", "d"} {
+		if err := db.Delete(k); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Put("d", "again"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete("nothing"); err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(db.s.keyDir.order.between("", "")); got != "[a b c d]" {
+		t.Errorf("order before the merge: %s", got)
+	}
+	if err := db.Merge(); err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(db.s.keyDir.order.between("", "")); got != "[a c d]" {
+		t.Errorf("order after the merge: %s", got)
+	}
+	if fo, ok := db.Locate("b"); !ok || !fo.Tombstone() {
+		t.Error("the merge dropped the tombstone of b, which is recent")
+	}
+	if err := db.Delete("c"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("c", "again"); err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(db.Keys()); got != "[a c d]" {
+		t.Errorf("keys after putting c again: %s", got)
+	}
+}
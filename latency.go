@@ -0,0 +1,123 @@
+package gocask
+
+import (
+	"fmt"
+	"math/bits"
+	"sync"
+	"time"
+)
+
+// latencySubBits sets the precision of latency histograms: every power-of-two range of
+// nanoseconds is split into 1<<latencySubBits linear buckets, as in HdrHistogram, so a
+// reported percentile is within 1/16th (6.25%) of the true value.
+const latencySubBits = 4
+
+const latencySub = 1 << latencySubBits
+
+// latencyHistogram records durations in constant memory.
+type latencyHistogram struct {
+	mu     sync.Mutex
+	counts [(64 - latencySubBits + 1) * latencySub]uint64
+	total  uint64
+	max    time.Duration
+}
+
+func latencyBucket(d time.Duration) int {
+	v := uint64(d)
+	if d < 0 {
+		v = 0
+	}
+	if v < latencySub {
+		return int(v)
+	}
+	exp := bits.Len64(v) - 1
+	sub := int(v>>(exp-latencySubBits)) & (latencySub - 1)
+	return (exp-latencySubBits+1)*latencySub + sub
+}
+
+// latencyBucketMax is the largest duration that lands in bucket i.
+func latencyBucketMax(i int) time.Duration {
+	b, sub := i/latencySub, i%latencySub
+	if b == 0 {
+		return time.Duration(sub)
+	}
+	lo := uint64(latencySub+sub) << (b - 1)
+	return time.Duration(lo + 1<<(b-1) - 1)
+}
+
+func (h *latencyHistogram) record(d time.Duration) {
+	h.mu.Lock()
+	h.counts[latencyBucket(d)]++
+	h.total++
+	if d > h.max {
+		h.max = d
+	}
+	h.mu.Unlock()
+}
+
+// latencySummary is a snapshot of one histogram.
+type latencySummary struct {
+	Count              uint64
+	P50, P95, P99, Max time.Duration
+}
+
+func (h *latencyHistogram) summary() latencySummary {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := latencySummary{Count: h.total, Max: h.max}
+	if h.total == 0 {
+		return s
+	}
+	targets := []struct {
+		q   float64
+		dst *time.Duration
+	}{{0.50, &s.P50}, {0.95, &s.P95}, {0.99, &s.P99}}
+
+	var seen uint64
+	t := 0
+	for i, n := range h.counts {
+		seen += n
+		for t < len(targets) && float64(seen) >= targets[t].q*float64(h.total) {
+			// a bucket's upper edge can overshoot the largest value actually seen
+			*targets[t].dst = min(latencyBucketMax(i), h.max)
+			t++
+		}
+		if t == len(targets) {
+			break
+		}
+	}
+	return s
+}
+
+func (s latencySummary) String() string {
+	return fmt.Sprintf("n=%d p50=%v p95=%v p99=%v max=%v", s.Count, s.P50, s.P95, s.P99, s.Max)
+}
+
+// add adds the durations from recorded to h.
+func (h *latencyHistogram) add(from *latencyHistogram) {
+	from.mu.Lock()
+	defer from.mu.Unlock()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, n := range from.counts {
+		h.counts[i] += n
+	}
+	h.total += from.total
+	h.max = max(h.max, from.max)
+}
+
+// latencyOp is a latency histogram and the operation it times.
+type latencyOp struct {
+	name string
+	h    *latencyHistogram
+}
+
+// latencyOps names every histogram of m, in the order stats report them.
+func (m *opStats) latencyOps() []latencyOp {
+	return []latencyOp{
+		{"put", &m.putLatency},
+		{"get", &m.getLatency},
+		{"delete", &m.deleteLatency},
+		{"merge", &m.mergeLatency},
+	}
+}
@@ -0,0 +1,209 @@
+package gocask
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gofrs/flock"
+)
+
+// The data directory is laid out as:
+//
+//	MANIFEST                   the format version every file is written in
+//	LOCK                       held to rotate, merge, or pin files for a backup
+//	segments/data.txt          the active file
+//	segments/data_<time>.log   sealed segments, named after the second they were sealed
+//	hints/data_<time>.hint     the hint of each segment
+//
+// with cdc.log, audit/ and quarantine/ next to them once they are used. The names
+// below are relative to the data directory; the code, and the index, name files by
+// their path under it, see dataDir.
+const (
+	segmentsDir = "segments"
+	hintsDir    = "hints"
+	lockFile    = "LOCK"
+
+	activeFile    = segmentsDir + "/data.txt"
+	compactedFile = segmentsDir + "/compacted_data.txt" // a merge being written
+)
+
+// legacyFormatFile and legacyLockFile are what MANIFEST and LOCK were called when
+// every file sat at the top of the data directory.
+const (
+	legacyFormatFile = "FORMAT"
+	legacyLockFile   = "data.txt.lock"
+)
+
+// segmentFile names the segment sealed at ts.
+func segmentFile(ts int64) string {
+	return fmt.Sprintf("%s/data_%d.log", segmentsDir, ts)
+}
+
+// hintFile names the hint of segment, in the hints directory beside the segments
+// directory it is in.
+func hintFile(segment string) string {
+	root := filepath.Dir(filepath.Dir(segment))
+	return filepath.Join(root, hintsDir, strings.TrimSuffix(filepath.Base(segment), ".log")+".hint")
+}
+
+// hintSegment names the segment hint is the hint of.
+func hintSegment(hint string) string {
+	root := filepath.Dir(filepath.Dir(hint))
+	return filepath.Join(root, segmentsDir, strings.TrimSuffix(filepath.Base(hint), ".hint")+".log")
+}
+
+// syncDataDirs syncs the segments and hints directories of the store in dir, after
+// files were added to or removed from them.
+func syncDataDirs(dir string) error {
+	if err := syncDir(filepath.Join(dir, segmentsDir)); err != nil {
+		return err
+	}
+	return syncDir(filepath.Join(dir, hintsDir))
+}
+
+// lockStore returns the lock of the store in dir, taken to rotate, merge and pin
+// files.
+func lockStore(dir string) *flock.Flock {
+	return flock.New(filepath.Join(dir, lockFile))
+}
+
+// upgradeLayout moves the files of a store in dir written when they all sat at the
+// top of the data directory into their places, and creates the directories of a new
+// store. It is run on every open, and moving the format file goes last, so an upgrade
+// that was interrupted finishes the next time. It takes both the old and the new
+// lock, so neither an older gocask nor this one is using the files meanwhile. What
+// it moved is logged to log.
+func upgradeLayout(dir string, log Logger) error {
+	for _, d := range []string{segmentsDir, hintsDir} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0755); err != nil {
+			return err
+		}
+	}
+	// earlier versions made an index directory nothing was ever put in
+	os.Remove(filepath.Join(dir, "index"))
+	moves, err := flatFiles(dir)
+	if err != nil {
+		return err
+	}
+	legacyFormat, format := filepath.Join(dir, legacyFormatFile), filepath.Join(dir, formatFile)
+	_, ferr := os.Stat(legacyFormat)
+	if len(moves) == 0 && os.IsNotExist(ferr) {
+		return nil
+	}
+
+	for _, name := range []string{legacyLockFile, lockFile} {
+		lock := flock.New(filepath.Join(dir, name))
+		if err := lock.Lock(); err != nil {
+			return fmt.Errorf("lock store: %w", err)
+		}
+		defer lock.Unlock()
+	}
+	// another process may have upgraded the store while we waited
+	if moves, err = flatFiles(dir); err != nil {
+		return err
+	}
+	for from, to := range moves {
+		if _, err := os.Stat(to); err == nil {
+			return fmt.Errorf("both %s and %s exist, move one of them out of the data directory", from, to)
+		}
+		if err := os.Rename(from, to); err != nil {
+			return err
+		}
+	}
+	if err := upgradeMergeMarker(dir); err != nil {
+		return err
+	}
+	for _, d := range []string{segmentsDir, hintsDir} {
+		if err := syncDir(filepath.Join(dir, d)); err != nil {
+			return err
+		}
+	}
+	if _, err := os.Stat(legacyFormat); err == nil {
+		if _, err := os.Stat(format); err == nil {
+			return fmt.Errorf("both %s and %s exist, remove the one that is out of date", legacyFormat, format)
+		}
+		if err := os.Rename(legacyFormat, format); err != nil {
+			return err
+		}
+	}
+	if err := syncDir(dir); err != nil {
+		return err
+	}
+	os.Remove(filepath.Join(dir, legacyLockFile))
+	log.Info("moved the store's files into segments/ and hints/", "dir", dir, "files", len(moves))
+	return nil
+}
+
+// flatFiles maps the data files at the top of dir to where they go now.
+func flatFiles(dir string) (map[string]string, error) {
+	moves := make(map[string]string)
+	for _, pattern := range []string{"data.txt", "compacted_data.txt", "data_*.log", "data_*.hint"} {
+		matches, err := filepath.Glob(filepath.Join(dir, pattern))
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range matches {
+			moves[m] = filepath.Join(dir, layoutPath(filepath.Base(m)))
+		}
+	}
+	return moves, nil
+}
+
+// layoutPath is where the file called name at the top of a flat data directory
+// belongs. Files that stay at the top are returned as they are.
+func layoutPath(name string) string {
+	switch {
+	case strings.Contains(name, "/"):
+		return name
+	case name == "data.txt" || name == "compacted_data.txt":
+		return filepath.Join(segmentsDir, name)
+	case strings.HasPrefix(name, "data_") && strings.HasSuffix(name, ".log"):
+		return filepath.Join(segmentsDir, name)
+	case strings.HasPrefix(name, "data_") && strings.HasSuffix(name, ".hint"):
+		return filepath.Join(hintsDir, name)
+	}
+	return name
+}
+
+// upgradeMergeMarker points the marker of an interrupted merge, which names the
+// segments it was merging, at their new places.
+func upgradeMergeMarker(dir string) error {
+	marker := filepath.Join(dir, mergeMarker)
+	data, err := os.ReadFile(marker)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	names := strings.Fields(string(data))
+	if len(names) == 0 || strings.Contains(names[0], "/") {
+		return nil
+	}
+	for i, name := range names {
+		names[i] = layoutPath(name)
+	}
+	tmp := marker + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strings.Join(names, "\n")+"\n"), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, marker)
+}
+
+// archiveName is the name the file at path in the data directory has in a backup.
+// Archives keep the names of the flat layout, so older ones restore as they did.
+func archiveName(path string) string {
+	if path == formatFile {
+		return legacyFormatFile
+	}
+	return filepath.Base(path)
+}
+
+// restoredPath is where the file called name in a backup goes in the data directory.
+func restoredPath(name string) string {
+	if name == legacyFormatFile {
+		return formatFile
+	}
+	return layoutPath(name)
+}
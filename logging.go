@@ -0,0 +1,43 @@
+package gocask
+
+import (
+	"io"
+	"log/slog"
+	"os"
+)
+
+// Logger receives the store's diagnostics: rotations, merges, feed and replication
+// trouble. Arguments after msg are alternating key/value pairs, as with slog, and a
+// *slog.Logger satisfies the interface as is.
+type Logger interface {
+	Debug(msg string, args ...any)
+	Info(msg string, args ...any)
+	Warn(msg string, args ...any)
+	Error(msg string, args ...any)
+}
+
+// defaultLogger is where diagnostics go without WithLogger, and those of the functions
+// that work on a store's files without opening it: slog text on stderr at info
+// level, so command output on stdout stays clean.
+var defaultLogger Logger = slog.New(slog.NewTextHandler(os.Stderr, nil))
+
+// WithLogger routes the store's diagnostics to l; nil silences them.
+func WithLogger(l Logger) Option {
+	return func(o *dbOptions) { o.logger = orDiscard(l) }
+}
+
+// orDiscard is l, or a logger printing nothing if it is nil.
+func orDiscard(l Logger) Logger {
+	if l == nil {
+		return slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
+	return l
+}
+
+// orDefault is l, or defaultLogger if it is nil.
+func orDefault(l Logger) Logger {
+	if l == nil {
+		return defaultLogger
+	}
+	return l
+}
@@ -0,0 +1,139 @@
+package gocask
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// MergeProgress describes the running merge or, once it is over, the last one.
+type MergeProgress struct {
+	State          string // "running", "finished" or "aborted"
+	SegmentsDone   int
+	SegmentsTotal  int
+	BytesProcessed int64
+	BytesTotal     int64
+	RecordsCopied  int // live records written to the merged segment
+	Started        time.Time
+	Elapsed        time.Duration
+	Remaining      time.Duration // estimated from the rate so far, zero once over
+	Err            error         // why an aborted merge stopped
+}
+
+// currentMerge returns a copy of the merge progress of the store, or false if no
+// merge has run.
+func (d *dataDir) currentMerge() (MergeProgress, bool) {
+	d.mergeMu.Lock()
+	defer d.mergeMu.Unlock()
+	if d.mergeProgress == nil {
+		return MergeProgress{}, false
+	}
+	p := *d.mergeProgress
+	if p.State == "running" {
+		p.Elapsed = time.Since(p.Started)
+	}
+	return p, true
+}
+
+// updateMerge applies fn to the progress and reports the result to the hook.
+func (d *dataDir) updateMerge(fn func(p *MergeProgress)) {
+	d.mergeMu.Lock()
+	if d.mergeProgress == nil {
+		d.mergeMu.Unlock()
+		return
+	}
+	fn(d.mergeProgress)
+	p := *d.mergeProgress
+	p.Elapsed = time.Since(p.Started)
+	if p.State == "running" && p.BytesProcessed > 0 {
+		rate := float64(p.BytesProcessed) / p.Elapsed.Seconds()
+		p.Remaining = time.Duration(float64(p.BytesTotal-p.BytesProcessed) / rate * float64(time.Second))
+	}
+	*d.mergeProgress = p
+	d.mergeMu.Unlock()
+
+	d.fireMergeProgress(p)
+}
+
+// beginMerge starts tracking a merge of files.
+func (d *dataDir) beginMerge(files []string) {
+	p := &MergeProgress{State: "running", SegmentsTotal: len(files), Started: time.Now()}
+	for _, name := range files {
+		if fi, err := os.Stat(name); err == nil {
+			p.BytesTotal += fi.Size()
+		}
+	}
+	d.mergeMu.Lock()
+	d.mergeProgress = p
+	d.mergeMu.Unlock()
+
+	d.logger.Debug("merge started", "dir", d.path, "segments", p.SegmentsTotal, "bytes", p.BytesTotal)
+	d.updateMerge(func(*MergeProgress) {})
+}
+
+// mergedSegment records that one more input file was read in full.
+func (d *dataDir) mergedSegment(size int64) {
+	d.updateMerge(func(p *MergeProgress) {
+		p.SegmentsDone++
+		p.BytesProcessed += size
+	})
+}
+
+// mergeCopied records that n live records were written to the merged segment.
+func (d *dataDir) mergeCopied(n int) {
+	d.updateMerge(func(p *MergeProgress) { p.RecordsCopied = n })
+}
+
+// endMerge counts the merge as failed or not and closes it out, if it was started.
+func (d *dataDir) endMerge(err error) {
+	d.mergeMu.Lock()
+	if err != nil {
+		d.mergeFailures++
+	} else {
+		d.mergeFailures = 0
+	}
+	d.mergeErr = err
+	d.mergeMu.Unlock()
+	if p, ok := d.currentMerge(); !ok || p.State != "running" {
+		return // failed before there was anything to merge
+	}
+	d.updateMerge(func(p *MergeProgress) {
+		p.Remaining = 0
+		if err != nil {
+			p.State, p.Err = "aborted", err
+		} else {
+			p.State = "finished"
+		}
+	})
+	p, _ := d.currentMerge()
+	if err != nil {
+		d.logger.Warn("merge aborted", "dir", d.path, "segments_done", p.SegmentsDone, "elapsed", p.Elapsed, "err", err)
+	} else {
+		d.logger.Info("merge finished", "dir", d.path, "segments", p.SegmentsTotal, "records", p.RecordsCopied, "elapsed", p.Elapsed)
+	}
+}
+
+// mergeStatsLine summarizes the merge for STATS.
+func (d *dataDir) mergeStatsLine() (string, bool) {
+	p, ok := d.currentMerge()
+	if !ok {
+		return "", false
+	}
+	switch p.State {
+	case "running":
+		return fmt.Sprintf("merge:       running, %d/%d segments, %d/%d bytes, ~%v left",
+			p.SegmentsDone, p.SegmentsTotal, p.BytesProcessed, p.BytesTotal, p.Remaining.Round(time.Second)), true
+	case "aborted":
+		return fmt.Sprintf("last merge:  aborted after %d/%d segments: %v", p.SegmentsDone, p.SegmentsTotal, p.Err), true
+	default:
+		return fmt.Sprintf("last merge:  %d segments, %d bytes, %d records copied in %v",
+			p.SegmentsTotal, p.BytesTotal, p.RecordsCopied, p.Elapsed.Round(time.Microsecond)), true
+	}
+}
+
+// failedMerges returns how many merges failed in a row, and the last one's error.
+func (d *dataDir) failedMerges() (int, error) {
+	d.mergeMu.Lock()
+	defer d.mergeMu.Unlock()
+	return d.mergeFailures, d.mergeErr
+}
@@ -0,0 +1,167 @@
+package gocask
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Metadata is a small set of named strings stored with a value, such as its content
+// type, schema version or origin, so they don't have to be packed into the value.
+type Metadata map[string]string
+
+// maxMetaField is how long a metadata name or value may be, and maxMetaSize how big
+// all of a record's metadata may be once encoded.
+const (
+	maxMetaField = 255
+	maxMetaSize  = 1<<16 - 1
+)
+
+// encodeMeta encodes m as its fields sorted by name, each nameLen(1) | name |
+// valueLen(1) | value. Empty metadata encodes to nil.
+func encodeMeta(m Metadata) ([]byte, error) {
+	if len(m) == 0 {
+		return nil, nil
+	}
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b []byte
+	for _, name := range names {
+		v := m[name]
+		if name == "" || len(name) > maxMetaField || len(v) > maxMetaField {
+			return nil, fmt.Errorf("metadata %q: names must be 1 to %d bytes and values at most %d", name, maxMetaField, maxMetaField)
+		}
+		b = append(append(b, byte(len(name))), name...)
+		b = append(append(b, byte(len(v))), v...)
+	}
+	if len(b) > maxMetaSize {
+		return nil, fmt.Errorf("metadata takes %d bytes, more than %d", len(b), maxMetaSize)
+	}
+	return b, nil
+}
+
+// decodeMeta reverses encodeMeta; nil decodes to nil.
+func decodeMeta(b []byte) (Metadata, error) {
+	if len(b) == 0 {
+		return nil, nil
+	}
+	m := make(Metadata)
+	for len(b) > 0 {
+		var field [2]string
+		for i := range field {
+			if len(b) < 1 || len(b) < 1+int(b[0]) {
+				return nil, fmt.Errorf("metadata cut short")
+			}
+			n := 1 + int(b[0])
+			field[i], b = string(b[1:n]), b[n:]
+		}
+		m[field[0]] = field[1]
+	}
+	return m, nil
+}
+
+// PutWithMeta is Put storing meta with the value, see GetMeta. A ttl of 0 gives the
+// value the default TTL, as for Put. Writing the key again without metadata, or with
+// other metadata, replaces it along with the value; Expire and Persist keep it.
+func (db *DB) PutWithMeta(key, value string, meta Metadata, ttl time.Duration) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	defer db.lock()()
+	if err := putWithMeta(key, value, meta, ttl, db.s.f, db.s.w, db.s.keyDir); err != nil {
+		return err
+	}
+	return db.s.rotateIfFull()
+}
+
+// putWithMeta is DB.PutWithMeta for callers holding the store's mu.
+func putWithMeta(key, value string, meta Metadata, ttl time.Duration, f *os.File, w *bufio.Writer, keyDir *KeyDir) error {
+	return putWithMetaContext(context.Background(), key, value, meta, ttl, f, w, keyDir)
+}
+
+// GetMeta returns the metadata key's value was put with, nil if it has none. A key
+// that is missing, deleted or has expired is an error, as for Get.
+func (db *DB) GetMeta(key string) (Metadata, error) {
+	if err := checkKey(key); err != nil {
+		return nil, err
+	}
+	defer db.rlock()()
+	return getMeta(key, db.s.keyDir)
+}
+
+// getMeta is DB.GetMeta for callers holding the store's mu.
+func getMeta(key string, keyDir *KeyDir) (Metadata, error) {
+	_, meta, err := getWithMeta(key, keyDir)
+	return meta, err
+}
+
+// getWithMeta is Get also returning the value's metadata. Like the value, the
+// metadata is upgraded to the schema version the migrations end at, see WithSchema.
+func getWithMeta(key string, keyDir *KeyDir) (string, Metadata, error) {
+	value, err := get(key, keyDir)
+	if err != nil {
+		return "", nil, err
+	}
+	fo, _ := keyDir.Get(key)
+	meta, err := keyDir.dir.metaOf(key, fo)
+	return value, keyDir.dir.schema.upgradedMeta(meta), err
+}
+
+// metaOf reads the metadata of the record fo points at for key, nil if it has none.
+func (d *dataDir) metaOf(key string, fo FileOffset) (Metadata, error) {
+	if !fo.HasMeta() && !fo.Chunked() {
+		return nil, nil
+	}
+	f, err := d.readers.acquire(fo.FileID())
+	if err != nil {
+		return nil, err
+	}
+	defer d.readers.release(f)
+
+	start := fo.Offset() + headerSize + int64(len(key))
+	var buf [metaPrefixSize]byte
+	prefix, err := f.readAt(buf[:], start)
+	if err != nil {
+		return nil, err
+	}
+	n := int(binary.BigEndian.Uint16(prefix[expirySize:]))
+	if metaPrefixSize+n > int(fo.ValueSize()) {
+		return nil, fmt.Errorf("%s: record at offset %d has more metadata than value", fo.FileID(), fo.Offset())
+	}
+	enc, err := f.readAt(make([]byte, n), start+metaPrefixSize)
+	if err != nil {
+		return nil, err
+	}
+	return decodeMeta(enc)
+}
+
+// ParseMetadata parses name=value fields, as put --meta and PUTMETA take them.
+func ParseMetadata(fields []string) (Metadata, error) {
+	m := make(Metadata, len(fields))
+	for _, f := range fields {
+		name, value, ok := strings.Cut(f, "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("metadata %q: want name=value", f)
+		}
+		m[name] = value
+	}
+	return m, nil
+}
+
+// String formats m as sorted name=value fields.
+func (m Metadata) String() string {
+	fields := make([]string, 0, len(m))
+	for name, v := range m {
+		fields = append(fields, name+"="+v)
+	}
+	sort.Strings(fields)
+	return strings.Join(fields, " ")
+}
@@ -0,0 +1,324 @@
+package gocask
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// mergeBuckets are the upper bounds, in seconds, of the merge duration histogram.
+var mergeBuckets = []float64{0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30, 60}
+
+// opStats counts what a store does; each has its own. Everything is safe to read
+// without the store's mu, so exporters can sample it while commands run.
+type opStats struct {
+	puts, gets, deletes, getMisses atomic.Uint64
+	bytesWritten, bytesRead        atomic.Uint64 // records written by puts and deletes, read by gets
+	bytesReturned                  atomic.Uint64 // value bytes handed back by gets
+	compactionWritten              atomic.Uint64 // merged segments and their hints
+	compactionRead                 atomic.Uint64 // segments read by merges
+	diskFull                       atomic.Uint64 // writes that failed for lack of space
+	cacheHits, cacheMisses         atomic.Uint64 // value cache lookups, see WithValueCache
+	expired                        atomic.Uint64 // keys deleted by the expiry sweeper
+	evicted                        atomic.Uint64 // keys deleted to stay within the eviction limits
+
+	mu          sync.Mutex
+	merges      uint64
+	mergeSum    float64   // seconds
+	mergeCounts []uint64  // per mergeBuckets entry, not cumulative
+	lastMerge   time.Time // zero until the first merge
+
+	backups, backupFailures uint64 // scheduled backups that succeeded and failed
+	backup                  *BackupStatus
+
+	putLatency, getLatency, deleteLatency, mergeLatency latencyHistogram
+}
+
+func (m *opStats) observeMerge(d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.mergeCounts == nil {
+		m.mergeCounts = make([]uint64, len(mergeBuckets))
+	}
+	m.merges++
+	m.mergeSum += d.Seconds()
+	for i, le := range mergeBuckets {
+		if d.Seconds() <= le {
+			m.mergeCounts[i]++
+			break
+		}
+	}
+	m.lastMerge = time.Now()
+}
+
+// mergeHistogram returns the merge count, total seconds, and cumulative bucket counts.
+func (m *opStats) mergeHistogram() (uint64, float64, map[float64]uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	buckets := make(map[float64]uint64, len(mergeBuckets))
+	var cum uint64
+	for i, le := range mergeBuckets {
+		if m.mergeCounts != nil {
+			cum += m.mergeCounts[i]
+		}
+		buckets[le] = cum
+	}
+	return m.merges, m.mergeSum, buckets
+}
+
+func (m *opStats) lastMergeTime() time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.lastMerge
+}
+
+// observeBackup records the outcome of a scheduled backup, and returns the status
+// it leaves.
+func (m *opStats) observeBackup(name string, err error) BackupStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.backup == nil {
+		m.backup = new(BackupStatus)
+	}
+	if err != nil {
+		m.backupFailures++
+		m.backup.LastFailure, m.backup.LastError = time.Now(), err.Error()
+	} else {
+		m.backups++
+		m.backup.LastSuccess, m.backup.LastName = time.Now(), name
+	}
+	return *m.backup
+}
+
+// setBackupStatus carries the status of earlier runs over, so the times of the last
+// success and failure survive a restart.
+func (m *opStats) setBackupStatus(st BackupStatus) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.backup = &st
+}
+
+// backupStatus returns the counts and status of scheduled backups; ok is false if
+// none are scheduled.
+func (m *opStats) backupStatus() (BackupStatus, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.backup == nil {
+		return BackupStatus{}, false
+	}
+	return *m.backup, true
+}
+
+func (m *opStats) backupCounts() (ok, failed uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.backups, m.backupFailures
+}
+
+// segmentCount counts the sealed segments of the store in dir.
+func segmentCount(dir string) int {
+	logs, _, _ := segmentFiles(dir)
+	return len(logs)
+}
+
+// add adds the counts of m to sum, which nothing else uses yet. The backup status
+// added up is the newest success and failure of any.
+func (m *opStats) add(sum *opStats) {
+	for _, c := range []struct{ from, to *atomic.Uint64 }{
+		{&m.puts, &sum.puts}, {&m.gets, &sum.gets}, {&m.deletes, &sum.deletes}, {&m.getMisses, &sum.getMisses},
+		{&m.bytesWritten, &sum.bytesWritten}, {&m.bytesRead, &sum.bytesRead}, {&m.bytesReturned, &sum.bytesReturned},
+		{&m.compactionWritten, &sum.compactionWritten}, {&m.compactionRead, &sum.compactionRead},
+		{&m.diskFull, &sum.diskFull}, {&m.cacheHits, &sum.cacheHits}, {&m.cacheMisses, &sum.cacheMisses},
+		{&m.expired, &sum.expired}, {&m.evicted, &sum.evicted},
+	} {
+		c.to.Add(c.from.Load())
+	}
+	into := sum.latencyOps()
+	for i, op := range m.latencyOps() {
+		into[i].h.add(op.h)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sum.merges += m.merges
+	sum.mergeSum += m.mergeSum
+	if m.mergeCounts != nil {
+		if sum.mergeCounts == nil {
+			sum.mergeCounts = make([]uint64, len(mergeBuckets))
+		}
+		for i, n := range m.mergeCounts {
+			sum.mergeCounts[i] += n
+		}
+	}
+	if m.lastMerge.After(sum.lastMerge) {
+		sum.lastMerge = m.lastMerge
+	}
+	sum.backups += m.backups
+	sum.backupFailures += m.backupFailures
+	if b := m.backup; b != nil {
+		if sum.backup == nil {
+			sum.backup = new(BackupStatus)
+		}
+		if b.LastSuccess.After(sum.backup.LastSuccess) {
+			sum.backup.LastSuccess, sum.backup.LastName = b.LastSuccess, b.LastName
+		}
+		if b.LastFailure.After(sum.backup.LastFailure) {
+			sum.backup.LastFailure, sum.backup.LastError = b.LastFailure, b.LastError
+		}
+	}
+}
+
+// openStats adds up the counts of the stores open in the process.
+func openStats() *opStats {
+	sum := new(opStats)
+	for _, s := range openedStores() {
+		s.dir.metrics.add(sum)
+	}
+	return sum
+}
+
+// mountStats adds up the counts of the stores open in the process by the name serve
+// mounted them as, like mountGauges.
+func mountStats() map[string]*opStats {
+	ms := make(map[string]*opStats)
+	for _, s := range openedStores() {
+		m := ms[s.name]
+		if m == nil {
+			m = new(opStats)
+			ms[s.name] = m
+		}
+		s.dir.metrics.add(m)
+	}
+	return ms
+}
+
+// storeGauges are the gauges of the stores open in the process, added up.
+type storeGauges struct {
+	keys      int // keyDir entries, tombstones included
+	segments  int
+	diskBytes int64          // active files, segments and hints
+	readOnly  bool           // a full disk switched one of them to read-only
+	merge     *MergeProgress // the merge started last
+}
+
+// openGauges samples the gauges of the stores open in the process.
+func openGauges() storeGauges {
+	var g storeGauges
+	for _, s := range openedStores() {
+		g.add(s)
+	}
+	return g
+}
+
+// mountGauges samples the gauges of the stores open in the process by the name serve
+// mounted them as; those of stores without one are added up under "".
+func mountGauges() map[string]*storeGauges {
+	gs := make(map[string]*storeGauges)
+	for _, s := range openedStores() {
+		g := gs[s.name]
+		if g == nil {
+			g = new(storeGauges)
+			gs[s.name] = g
+		}
+		g.add(s)
+	}
+	return gs
+}
+
+// add adds the gauges of s to g.
+func (g *storeGauges) add(s *store) {
+	g.keys += s.keyDir.Len()
+	g.segments += segmentCount(s.path)
+	for _, pattern := range []string{activeFile, segmentsDir + "/data_*.log", hintsDir + "/data_*.hint"} {
+		if _, size, err := globSize(s.dir.file(pattern)); err == nil {
+			g.diskBytes += size
+		}
+	}
+	g.readOnly = g.readOnly || s.dir.readOnly.Load()
+	if p, ok := s.dir.currentMerge(); ok && (g.merge == nil || p.Started.After(g.merge.Started)) {
+		g.merge = &p
+	}
+}
+
+// amplification returns bytes written to disk per byte users wrote, and bytes read
+// from disk per byte returned to users. A ratio is 0 until there is something to divide by.
+func (m *opStats) amplification() (write, read float64) {
+	if w := m.bytesWritten.Load(); w > 0 {
+		write = float64(w+m.compactionWritten.Load()) / float64(w)
+	}
+	if r := m.bytesReturned.Load(); r > 0 {
+		read = float64(m.bytesRead.Load()+m.compactionRead.Load()) / float64(r)
+	}
+	return write, read
+}
+
+// Metrics are the counters and gauges of the stores open in the process under one
+// name, added up, as gocaskprom exports them.
+type Metrics struct {
+	Puts, Gets, Deletes, GetMisses    uint64
+	BytesWritten, BytesRead           uint64 // records written by puts and deletes, read by gets
+	BytesReturned                     uint64 // value bytes handed back by gets
+	CompactionWritten, CompactionRead uint64 // by merges
+	DiskFullErrors                    uint64 // writes that failed for lack of space
+	CacheHits, CacheMisses            uint64 // value cache lookups
+	Expired, Evicted                  uint64 // keys deleted by the expiry sweeper and to stay within limits
+
+	Merges       uint64
+	MergeSeconds float64
+	MergeBuckets map[float64]uint64 // merges that took at most so many seconds
+
+	Backups, BackupFailures uint64        // scheduled backups that succeeded and failed
+	Backup                  *BackupStatus // nil unless backups are scheduled
+
+	Keys      int // index entries, tombstones included
+	Segments  int
+	DiskBytes int64 // active files, segments and hints
+	ReadOnly  bool  // a full disk switched a store to read-only
+	Quotas    []QuotaUsage
+}
+
+// MetricsByName samples the metrics of the stores open in the process by the name
+// WithName gave them, those of stores without one added up under "".
+func MetricsByName() map[string]Metrics {
+	ms := make(map[string]Metrics)
+	gauges := mountGauges()
+	for name, m := range mountStats() {
+		count, sum, buckets := m.mergeHistogram()
+		okCount, failed := m.backupCounts()
+		x := Metrics{
+			Puts: m.puts.Load(), Gets: m.gets.Load(), Deletes: m.deletes.Load(), GetMisses: m.getMisses.Load(),
+			BytesWritten: m.bytesWritten.Load(), BytesRead: m.bytesRead.Load(), BytesReturned: m.bytesReturned.Load(),
+			CompactionWritten: m.compactionWritten.Load(), CompactionRead: m.compactionRead.Load(),
+			DiskFullErrors: m.diskFull.Load(), CacheHits: m.cacheHits.Load(), CacheMisses: m.cacheMisses.Load(),
+			Expired: m.expired.Load(), Evicted: m.evicted.Load(),
+			Merges: count, MergeSeconds: sum, MergeBuckets: buckets,
+			Backups: okCount, BackupFailures: failed,
+		}
+		if st, ok := m.backupStatus(); ok {
+			x.Backup = &st
+		}
+		if g := gauges[name]; g != nil {
+			x.Keys, x.Segments, x.DiskBytes, x.ReadOnly = g.keys, g.segments, g.diskBytes, g.readOnly
+		}
+		ms[name] = x
+	}
+	// each store's mu keeps a reload from swapping its quotas meanwhile
+	for _, s := range openedStores() {
+		s.mu.RLock()
+		qs := s.quotas()
+		s.mu.RUnlock()
+		x := ms[s.name]
+	next:
+		for _, u := range qs {
+			for i := range x.Quotas {
+				if x.Quotas[i].Prefix == u.Prefix {
+					x.Quotas[i].Used += u.Used
+					continue next
+				}
+			}
+			x.Quotas = append(x.Quotas, u)
+		}
+		ms[s.name] = x
+	}
+	return ms
+}
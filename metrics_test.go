@@ -0,0 +1,31 @@
+package gocask
+
+import "testing"
+
+// Each store counts its own operations; the process's counts add them up.
+func TestMetricsPerStore(t *testing.T) {
+	var dbs []*DB
+	for range 2 {
+		db, err := Open(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		dbs = append(dbs, db)
+	}
+	for i, db := range dbs {
+		for range i + 1 {
+			if err := db.Put("k", "v"); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for i, db := range dbs {
+		if n := db.s.dir.metrics.puts.Load(); n != uint64(i+1) {
+			t.Errorf("store %d counts %d puts, want %d", i, n, i+1)
+		}
+	}
+	if n := openStats().puts.Load(); n < 3 {
+		t.Errorf("the process counts %d puts, want at least 3", n)
+	}
+}
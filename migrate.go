@@ -0,0 +1,354 @@
+package gocask
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// On-disk format versions:
+//
+//	v0  keyLen(4) | valLen(4) | key | value
+//	v1  flag(1) | keyLen(4) | valLen(4) | key | value
+//	v2  flag(1) | timestamp(8) | keyLen(4) | valLen(4) | key | value
+//	v3  records as in v2; hint entries gained the value length
+//	v4  records as in v2, but flagExpiring ones start their value with expiry(8)
+//	v5  records as in v4, and flagMeta ones start their value with expiry(8) |
+//	    metaLen(2) | metadata
+//	v6  records as in v5, and flagChunked ones, laid out like flagMeta ones, hold
+//	    the manifest of a value stored in chunks under internal keys
+//	v7  flag(1) | timestamp(8) | keyLen(4) | valLen(4) | crc(4) | key | value, where
+//	    crc is the CRC-32C of the rest of the record
+//	v8  records as in v7, and flagBatch ones, with an empty key and count(4) |
+//	    size(8) as their value, open a batch of the count records after them
+//
+// Hint entries are keyLen(4) | key | offset(8), and since v3 valLen(4), so Get can read
+// a record in one go. Their offsets depend on the record layout. Hints may flag
+// tombstones with hintTombstone, since v4 expiring records with hintExpiring, and since
+// v5 records with metadata with hintMeta and since v6 chunk manifests with hintChunked;
+// ones written before that just list live keys.
+const formatVersion = 8
+
+// FormatVersion is the on-disk format gocask writes stores in, the one Migrate
+// converts older stores to.
+const FormatVersion = formatVersion
+
+// formatFile records which version every file in the store is written in.
+const formatFile = "MANIFEST"
+
+// migrateDir is where converted files are staged before they replace the originals.
+const migrateDir = ".migrate"
+
+// checkFormat makes sure the store in dir is in formatVersion, stamping brand-new
+// stores. Stores written before versioning was tracked are refused, since their
+// records can't be told apart from current ones by looking at them.
+func checkFormat(dir string) error {
+	data, err := os.ReadFile(filepath.Join(dir, formatFile))
+	if os.IsNotExist(err) {
+		if hasData, err := storeHasData(dir); err != nil {
+			return err
+		} else if hasData {
+			return fmt.Errorf("store has no %s file, it was written by an older gocask; "+
+				"run gocask migrate --from %s --to v%d with the version it was written in", formatFile, sourceVersions("|", "|"), formatVersion)
+		}
+		return writeFormat(dir)
+	} else if err != nil {
+		return err
+	}
+
+	var v int
+	if _, err := fmt.Sscanf(string(data), "gocask format %d", &v); err != nil {
+		return fmt.Errorf("unreadable %s file: %q", formatFile, data)
+	}
+	if _, err := os.Stat(filepath.Join(dir, migrateDir)); err == nil {
+		return fmt.Errorf("a migration was interrupted, run gocask migrate again to finish it")
+	}
+	if v != formatVersion {
+		return fmt.Errorf("store is in format v%d, run gocask migrate --from v%d --to v%d", v, v, formatVersion)
+	}
+	return nil
+}
+
+// sourceVersions lists the formats migrate converts from, every one before the
+// current, the last one after final: "v0, v1 or v2".
+func sourceVersions(sep, final string) string {
+	vs := make([]string, formatVersion)
+	for i := range vs {
+		vs[i] = fmt.Sprintf("v%d", i)
+	}
+	return strings.Join(vs[:len(vs)-1], sep) + final + vs[len(vs)-1]
+}
+
+func writeFormat(dir string) error {
+	return os.WriteFile(filepath.Join(dir, formatFile), []byte(fmt.Sprintf("gocask format %d\n", formatVersion)), 0644)
+}
+
+// storeHasData reports whether any data or journal file in dir holds bytes.
+func storeHasData(dir string) (bool, error) {
+	names, err := formatFiles(dir)
+	if err != nil {
+		return false, err
+	}
+	for _, name := range names {
+		if fi, err := os.Stat(name); err == nil && fi.Size() > 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// formatFiles lists the files in dir whose layout depends on the format version,
+// oldest segment first.
+func formatFiles(dir string) ([]string, error) {
+	logs, _, err := segmentFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range []string{activeFile, cdcJournal} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+			logs = append(logs, filepath.Join(dir, name))
+		}
+	}
+	return logs, nil
+}
+
+// readVersioned reads one record written in format version v.
+func readVersioned(r *bufio.Reader, v int) (record, error) {
+	var rec record
+	if v >= 1 {
+		flag, err := r.ReadByte()
+		if err != nil {
+			return rec, err
+		}
+		rec.flag = flag
+	}
+	if v >= 2 {
+		if err := binary.Read(r, binary.BigEndian, &rec.ts); err != nil {
+			return rec, eofIsUnexpected(err)
+		}
+	}
+
+	var keyLen, valLen uint32
+	if err := binary.Read(r, binary.BigEndian, &keyLen); err != nil {
+		if v >= 1 {
+			err = eofIsUnexpected(err)
+		}
+		return rec, err
+	}
+	if err := binary.Read(r, binary.BigEndian, &valLen); err != nil {
+		return rec, eofIsUnexpected(err)
+	}
+	if v >= 7 {
+		// the record is written again with a checksum of its own
+		if _, err := r.Discard(4); err != nil {
+			return rec, eofIsUnexpected(err)
+		}
+	}
+	body := make([]byte, int(keyLen)+int(valLen))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return rec, eofIsUnexpected(err)
+	}
+	rec.key, rec.value = body[:keyLen:keyLen], body[keyLen:]
+	return rec, nil
+}
+
+// convertFile rewrites src (format from) as dst in the current format. Records from
+// before timestamps existed get synthetic ones that keep their order: base plus one
+// tick per record, node 0. It returns the timestamp after the last record written.
+func convertFile(src, dst string, from int, base uint64) (uint64, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return base, err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return base, err
+	}
+	defer out.Close()
+
+	r := bufio.NewReader(in)
+	w := bufio.NewWriter(out)
+	ts := base
+	for n := 0; ; n++ {
+		rec, err := readVersioned(r, from)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return ts, fmt.Errorf("%s: record %d: %w", src, n, err)
+		}
+		if from < 2 {
+			rec.ts = ts
+			ts += 1 << 16
+		}
+		switch rec.flag {
+		case flagTombstone:
+			_, err = writeTombstone(w, rec.key, rec.ts)
+		case flagExpiring, flagMeta, flagChunked, flagBatch:
+			// batches only exist since v8, whose records keep their layout, so its size holds
+			_, err = writeRecord(w, rec.flag, rec.key, rec.value, rec.ts)
+		default:
+			_, err = writeEntry(w, rec.key, rec.value, rec.ts)
+		}
+		if err != nil {
+			return ts, fmt.Errorf("%s: record %d: %w", dst, n, err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return ts, err
+	}
+	return ts, out.Sync()
+}
+
+// writeHintFor writes a hint for the newest record of each key in a current-format
+// segment, tombstones included, reading it readAhead bytes at a time.
+func writeHintFor(segment, hint string, readAhead int) error {
+	offsets := make(map[string]FileOffset)
+	err := scanFile(segment, readAhead, func(off int64, r record) error {
+		offsets[string(r.key)] = newFileOffset(segment, off, r.flag, uint32(len(r.value)))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	hf, err := os.Create(hint)
+	if err != nil {
+		return err
+	}
+	defer hf.Close()
+	w := bufio.NewWriter(hf)
+	for key, fo := range offsets {
+		writeHintEntry(w, key, fo.Offset(), fo.ValueSize(), fo.flag())
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return hf.Sync()
+}
+
+// Migrate converts the store in dir from format version from to FormatVersion,
+// writing what it does to progress. Converted files are staged in migrateDir and
+// only swapped in once all of them are written; if that swap is interrupted,
+// running Migrate again finishes it, which a from of -1 does and nothing else.
+func Migrate(dir string, from int, progress io.Writer) error {
+	if err := upgradeLayout(dir, defaultLogger); err != nil {
+		return err
+	}
+	lock := lockStore(dir)
+	if err := lock.Lock(); err != nil {
+		return fmt.Errorf("lock store: %w", err)
+	}
+	defer lock.Unlock()
+
+	stage := filepath.Join(dir, migrateDir)
+	if _, err := os.Stat(filepath.Join(stage, "READY")); err == nil {
+		fmt.Fprintln(progress, "Finishing an interrupted migration")
+		return finishMigration(dir)
+	}
+	if from < 0 {
+		return fmt.Errorf("no interrupted migration to finish, and no format to migrate from")
+	}
+	if from == formatVersion {
+		return fmt.Errorf("the store is in the current format v%d already", from)
+	}
+	if from > formatVersion {
+		return fmt.Errorf("unknown source format v%d", from)
+	}
+
+	os.RemoveAll(stage)
+	if err := os.Mkdir(stage, 0755); err != nil {
+		return err
+	}
+	names, err := formatFiles(dir)
+	if err != nil {
+		return err
+	}
+
+	var ts uint64
+	for _, name := range names {
+		// segments are named after the second they were sealed, use that as their time
+		base := uint64(extractTimestamp(name)) * uint64(time.Second)
+		if fi, err := os.Stat(name); err == nil && base == 0 {
+			base = uint64(fi.ModTime().UnixNano())
+		}
+		base &^= 0xffff
+		if base < ts {
+			base = ts
+		}
+
+		rel, err := filepath.Rel(dir, name)
+		if err != nil {
+			return err
+		}
+		staged := filepath.Join(stage, rel)
+		if err := os.MkdirAll(filepath.Dir(hintFile(staged)), 0755); err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(staged), 0755); err != nil {
+			return err
+		}
+		if ts, err = convertFile(name, staged, from, base); err != nil {
+			return err
+		}
+		if _, ok := segmentTime(name); ok {
+			if err := writeHintFor(staged, hintFile(staged), defaultReadAhead); err != nil {
+				return err
+			}
+		}
+		fmt.Fprintln(progress, "Converted", rel)
+	}
+
+	if err := os.WriteFile(filepath.Join(stage, "READY"), nil, 0644); err != nil {
+		return err
+	}
+	// records kept their layout from v2 to v6 and from v7 on, and with it their offsets
+	if from < 7 && len(names) > 0 {
+		fmt.Fprintln(progress, "Note: changefeed positions handed out before the migration are no longer valid")
+	}
+	return finishMigration(dir)
+}
+
+// finishMigration moves every staged file of the store in dir into place, then stamps
+// the new format.
+func finishMigration(dir string) error {
+	stage := filepath.Join(dir, migrateDir)
+	var staged []string
+	err := filepath.WalkDir(stage, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() && d.Name() != "READY" {
+			staged = append(staged, path)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	// hints of segments that were converted are regenerated, drop any stale ones
+	oldHints, _ := filepath.Glob(filepath.Join(dir, hintsDir, "data_*.hint"))
+	for _, h := range oldHints {
+		if _, err := os.Stat(filepath.Join(stage, hintsDir, filepath.Base(h))); os.IsNotExist(err) {
+			os.Remove(h)
+		}
+	}
+	for _, path := range staged {
+		name, err := filepath.Rel(stage, path)
+		if err != nil {
+			return err
+		}
+		// a migration started before the files moved into segments/ and hints/
+		// staged them flat
+		if err := os.Rename(path, filepath.Join(dir, layoutPath(filepath.ToSlash(name)))); err != nil {
+			return err
+		}
+	}
+	if err := writeFormat(dir); err != nil {
+		return err
+	}
+	return os.RemoveAll(stage)
+}
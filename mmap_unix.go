@@ -0,0 +1,19 @@
+//go:build !windows
+
+package gocask
+
+import (
+	"os"
+	"syscall"
+)
+
+// mmapFile maps all of f read-only. An empty file maps to nil.
+func mmapFile(f *os.File) ([]byte, error) {
+	fi, err := f.Stat()
+	if err != nil || fi.Size() == 0 {
+		return nil, err
+	}
+	return syscall.Mmap(int(f.Fd()), 0, int(fi.Size()), syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+func munmapFile(b []byte) error { return syscall.Munmap(b) }
@@ -0,0 +1,33 @@
+//go:build windows
+
+package gocask
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// mmapFile maps all of f read-only. An empty file maps to nil: Windows refuses to
+// map zero bytes.
+func mmapFile(f *os.File) ([]byte, error) {
+	fi, err := f.Stat()
+	if err != nil || fi.Size() == 0 {
+		return nil, err
+	}
+	m, err := syscall.CreateFileMapping(syscall.Handle(f.Fd()), nil, syscall.PAGE_READONLY, 0, 0, nil)
+	if err != nil {
+		return nil, os.NewSyscallError("CreateFileMapping", err)
+	}
+	// the view keeps the mapping object alive on its own
+	defer syscall.CloseHandle(m)
+	addr, err := syscall.MapViewOfFile(m, syscall.FILE_MAP_READ, 0, 0, uintptr(fi.Size()))
+	if err != nil {
+		return nil, os.NewSyscallError("MapViewOfFile", err)
+	}
+	return unsafe.Slice((*byte)(*(*unsafe.Pointer)(unsafe.Pointer(&addr))), fi.Size()), nil
+}
+
+func munmapFile(b []byte) error {
+	return syscall.UnmapViewOfFile(uintptr(unsafe.Pointer(&b[0])))
+}
@@ -0,0 +1,9 @@
+package gocask
+
+import (
+	"errors"
+)
+
+// ErrOpenedReadOnly is returned for writes and merges to a store opened with
+// --read-only, which every store mounted from a --snapshot is.
+var ErrOpenedReadOnly = errors.New("store was opened read-only")
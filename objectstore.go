@@ -0,0 +1,175 @@
+package gocask
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ObjectStore is the little of an object store backups need, so they can go to S3,
+// MinIO, GCS or anything else speaking the S3 protocol without passing through disk.
+type ObjectStore interface {
+	// Put stores what r yields as the object name, uploading it in parts as it is
+	// read so its size needn't be known up front. The object only appears once r is
+	// drained and every part is stored; if r fails the upload is abandoned.
+	Put(ctx context.Context, name string, r io.Reader) error
+	// Get opens the object name for reading.
+	Get(ctx context.Context, name string) (io.ReadCloser, error)
+	// List returns the names of the objects starting with prefix.
+	List(ctx context.Context, prefix string) ([]string, error)
+	// Delete removes the object name.
+	Delete(ctx context.Context, name string) error
+}
+
+// up to 10000 parts, so objects up to 160GiB
+
+// dirStore is an ObjectStore keeping objects as files in a directory. Put writes
+// beside the file and renames, so a file is only there once it is complete.
+type dirStore struct{ dir string }
+
+// DirObjectStore returns an ObjectStore keeping objects as files in dir, for backups
+// to a local disk or a mounted share.
+func DirObjectStore(dir string) ObjectStore { return dirStore{dir} }
+
+func (d dirStore) Put(ctx context.Context, name string, r io.Reader) error {
+	path := filepath.Join(d.dir, name)
+	f, err := os.Create(path + ".partial")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if _, err := io.Copy(f, r); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return err
+	}
+	return syncDir(d.dir)
+}
+
+func (d dirStore) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(d.dir, name))
+}
+
+func (d dirStore) List(ctx context.Context, prefix string) ([]string, error) {
+	entries, err := os.ReadDir(d.dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, e := range entries {
+		if e.Type().IsRegular() && strings.HasPrefix(e.Name(), prefix) {
+			names = append(names, e.Name())
+		}
+	}
+	return names, nil
+}
+
+func (d dirStore) Delete(ctx context.Context, name string) error {
+	// as on S3, deleting what is not there is not an error
+	if err := os.Remove(filepath.Join(d.dir, name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// checksumSuffix names the object holding the sha256 of a backup uploaded beside it,
+// written once the backup is complete, in sha256sum's format.
+const checksumSuffix = ".sha256"
+
+// UploadBackup streams the backup that backup writes to the object name, compressed
+// according to its extension, followed by its checksum as the object name.sha256,
+// which OpenBackupObject checks it against. It returns the sequence number backup
+// does.
+func UploadBackup(ctx context.Context, s ObjectStore, name string, backup func(io.Writer) (int64, error)) (int64, error) {
+	pr, pw := io.Pipe()
+	h := sha256.New()
+	var seq int64
+	done := make(chan error, 1)
+	go func() {
+		cw, err := CompressWriter(name, io.MultiWriter(pw, h))
+		if err == nil {
+			if seq, err = backup(cw); err == nil {
+				err = cw.Close()
+			}
+		}
+		pw.CloseWithError(err) // nil ends the upload
+		done <- err
+	}()
+	err := s.Put(ctx, name, pr)
+	pr.CloseWithError(errors.New("upload stopped")) // so the backup stops if the upload gave up early
+	werr := <-done
+	if err != nil {
+		return 0, err // it carries werr if that is what stopped it
+	}
+	if werr != nil {
+		return 0, werr
+	}
+
+	sum := hex.EncodeToString(h.Sum(nil))
+	line := sum + "  " + name[strings.LastIndex(name, "/")+1:] + "\n"
+	if err := s.Put(ctx, name+checksumSuffix, strings.NewReader(line)); err != nil {
+		return 0, err
+	}
+	return seq, nil
+}
+
+// OpenBackupObject opens the backup stored as the object name for reading, checking it
+// against the checksum uploaded with it as it is read: the read that reaches its end
+// fails if they differ.
+func OpenBackupObject(ctx context.Context, s ObjectStore, name string) (io.ReadCloser, error) {
+	r, err := s.Get(ctx, name+checksumSuffix)
+	if err != nil {
+		return nil, err
+	}
+	line, err := bufio.NewReader(io.LimitReader(r, 1024)).ReadString('\n')
+	r.Close()
+	if err != nil {
+		return nil, fmt.Errorf("read %s%s, the backup may not have finished: %w", name, checksumSuffix, err)
+	}
+	want, _, _ := strings.Cut(line, " ")
+	if len(want) != 2*sha256.Size {
+		return nil, fmt.Errorf("%s%s doesn't hold a sha256", name, checksumSuffix)
+	}
+
+	obj, err := s.Get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return &checkedReader{ReadCloser: obj, name: name, h: sha256.New(), want: want}, nil
+}
+
+// checkedReader hashes what it reads and turns its EOF into an error if the sum isn't
+// the one expected.
+type checkedReader struct {
+	io.ReadCloser
+	name string
+	h    hash.Hash
+	want string
+}
+
+func (c *checkedReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.h.Write(p[:n])
+	if err == io.EOF {
+		if got := hex.EncodeToString(c.h.Sum(nil)); got != c.want {
+			return n, fmt.Errorf("%s: sha256 %s, its checksum says %s", c.name, got, c.want)
+		}
+	}
+	return n, err
+}
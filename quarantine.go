@@ -0,0 +1,97 @@
+package gocask
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// quarantineDir holds files recovery took out of the data directory, so later scans
+// stop tripping over them while they are kept around for someone to look at.
+const quarantineDir = "quarantine"
+
+// quarantineManifest lists every quarantined file, one json object per line.
+const quarantineManifest = "MANIFEST"
+
+// quarantineMu keeps segments indexed in parallel from picking the same name.
+var quarantineMu sync.Mutex
+
+type quarantineEntry struct {
+	Time    time.Time `json:"time"`
+	File    string    `json:"file"`     // where the file was
+	MovedTo string    `json:"moved_to"` // where it is now, relative to the data directory
+	Reason  string    `json:"reason"`
+}
+
+// quarantine moves name, a file in the segments or hints directory of a store, into
+// the store's quarantine directory and records why. A file that was quarantined before
+// under the same name doesn't get replaced, the new one gets a numbered name instead.
+func quarantine(name, reason string, log Logger) (string, error) {
+	quarantineMu.Lock()
+	defer quarantineMu.Unlock()
+	root := filepath.Dir(filepath.Dir(name))
+	qdir := filepath.Join(root, quarantineDir)
+	if err := os.MkdirAll(qdir, 0755); err != nil {
+		return "", err
+	}
+	moved := filepath.Join(quarantineDir, filepath.Base(name))
+	for n := 1; ; n++ {
+		if _, err := os.Lstat(filepath.Join(root, moved)); os.IsNotExist(err) {
+			break
+		} else if err != nil {
+			return "", err
+		}
+		moved = filepath.Join(quarantineDir, fmt.Sprintf("%s.%d", filepath.Base(name), n))
+	}
+	dst := filepath.Join(root, moved)
+
+	// the manifest goes first: a file in quarantine nobody knows the reason for is
+	// worse than an entry for a move that never happened
+	m, err := os.OpenFile(filepath.Join(qdir, quarantineManifest), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return "", err
+	}
+	file, _ := filepath.Rel(root, name)
+	line, _ := json.Marshal(quarantineEntry{Time: time.Now().UTC(), File: filepath.ToSlash(file), MovedTo: filepath.ToSlash(moved), Reason: reason})
+	if _, err := m.Write(append(line, '\n')); err != nil {
+		m.Close()
+		return "", err
+	}
+	if err := m.Sync(); err != nil {
+		m.Close()
+		return "", err
+	}
+	if err := m.Close(); err != nil {
+		return "", err
+	}
+
+	if err := os.Rename(name, dst); err != nil {
+		return "", err
+	}
+	if err := syncDir(qdir); err != nil {
+		return "", err
+	}
+	if err := syncDir(filepath.Dir(name)); err != nil {
+		return "", err
+	}
+	log.Warn("quarantined file", "file", name, "to", dst, "reason", reason)
+	return dst, nil
+}
+
+// quarantineAll quarantines each of names for reason and adds them to info, or only
+// adds them on a dry run.
+func quarantineAll(names []string, reason string, info *RecoveryInfo, log Logger) error {
+	for _, name := range names {
+		if !info.DryRun {
+			if _, err := quarantine(name, reason, log); err != nil {
+				return fmt.Errorf("quarantine %s: %w", name, err)
+			}
+		}
+		info.Quarantined = append(info.Quarantined, name)
+		info.did(ActionQuarantine, name, reason)
+	}
+	return nil
+}
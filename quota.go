@@ -0,0 +1,305 @@
+package gocask
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Quota bounds the bytes of live records under a prefix, so tenants sharing a store
+// can't crowd one another out. Like for retention, the store has no buckets of its
+// own; a prefix like tenants/acme/ is one, and the prefix "" is the whole store. The
+// chunks of a value count towards the key they belong to.
+type Quota struct {
+	Prefix   string
+	MaxBytes int64
+	Policy   QuotaPolicy
+}
+
+// QuotaPolicy is what a put that takes a prefix past its quota does.
+type QuotaPolicy int
+
+const (
+	QuotaReject QuotaPolicy = iota // the put fails with ErrQuotaExceeded
+	QuotaEvict                     // the least recently used keys under the prefix go
+)
+
+func (p QuotaPolicy) String() string {
+	if p == QuotaEvict {
+		return "evict"
+	}
+	return "reject"
+}
+
+func parseQuotaPolicy(s string) (QuotaPolicy, error) {
+	switch s {
+	case "reject":
+		return QuotaReject, nil
+	case "evict":
+		return QuotaEvict, nil
+	}
+	return 0, fmt.Errorf("unknown quota policy %q (want reject or evict)", s)
+}
+
+// ErrQuotaExceeded is returned for a put that would take a prefix past a quota that
+// rejects writes.
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// WithQuotas gives the store quotas. A key counts towards every quota whose prefix
+// it starts with, so a store-wide quota can sit on top of per-tenant ones. Quotas
+// that reject fail a put that would take them past their budget, while deletes
+// always go through; quotas that evict let the put through and then delete the least
+// recently used keys under their prefix until it fits again, sampling like
+// WithEviction does. Internal keys, such as changefeed checkpoints, count but are
+// never rejected or evicted, and neither bulk loads nor merges are checked.
+func WithQuotas(qs ...Quota) Option {
+	return withSetting(func(s *store) error {
+		if err := validateQuotas(qs); err != nil {
+			return err
+		}
+		s.setQuotas(qs)
+		return nil
+	})
+}
+
+// SetQuotas replaces the store's quotas, see WithQuotas. The usage of the new ones
+// is counted before it returns.
+func (db *DB) SetQuotas(qs ...Quota) error {
+	if err := validateQuotas(qs); err != nil {
+		return err
+	}
+	defer db.lock()()
+	db.s.setQuotas(qs)
+	return nil
+}
+
+// setQuotas replaces the quotas of s, which validateQuotas passed. Callers hold
+// the store's mu.
+func (s *store) setQuotas(qs []Quota) {
+	d := s.dir
+	d.quotas = append([]Quota(nil), qs...)
+	s.keyDir.recountQuotas()
+	d.quotaEvicts = false
+	for _, q := range qs {
+		d.quotaEvicts = d.quotaEvicts || q.Policy == QuotaEvict
+	}
+	d.updateTracking()
+}
+
+func validateQuotas(qs []Quota) error {
+	seen := make(map[string]bool)
+	for _, q := range qs {
+		if seen[q.Prefix] {
+			return fmt.Errorf("two quotas for prefix %q", q.Prefix)
+		}
+		seen[q.Prefix] = true
+		if q.MaxBytes <= 0 {
+			return fmt.Errorf("quota for prefix %q: max-bytes must be positive", q.Prefix)
+		}
+	}
+	return nil
+}
+
+// quotas are the quotas in force in d's store, none while d is built apart from it;
+// the index of one is where the shards count the bytes under its prefix.
+func (d *KeyDir) quotas() []Quota {
+	if d.dir != nil {
+		return d.dir.quotas
+	}
+	return nil
+}
+
+// addQuotas adds n bytes of key to those of qs it counts towards. Callers hold s
+// locked.
+func (s *keyDirShard) addQuotas(qs []Quota, key string, n int64) {
+	key = strings.TrimPrefix(key, chunkPrefix)
+	for i := range min(len(s.quota), len(qs)) {
+		if strings.HasPrefix(key, qs[i].Prefix) {
+			s.quota[i] += n
+		}
+	}
+}
+
+// recountQuotas counts the bytes under qs afresh, for when they changed. Callers
+// hold s locked.
+func (s *keyDirShard) recountQuotas(qs []Quota) {
+	s.quota = nil
+	if len(qs) == 0 {
+		return
+	}
+	s.quota = make([]int64, len(qs))
+	for k, fo := range s.m {
+		if !fo.Tombstone() {
+			s.addQuotas(qs, k, fo.recordSize(k))
+		}
+	}
+}
+
+func (d *KeyDir) recountQuotas() {
+	qs := d.quotas()
+	for i := range d.shards {
+		s := &d.shards[i]
+		s.Lock()
+		s.recountQuotas(qs)
+		s.Unlock()
+	}
+}
+
+// quotaUsed is the bytes of live records under quota i.
+func (d *KeyDir) quotaUsed(i int) int64 {
+	var n int64
+	for j := range d.shards {
+		s := &d.shards[j]
+		s.RLock()
+		if i < len(s.quota) {
+			n += s.quota[i]
+		}
+		s.RUnlock()
+	}
+	return n
+}
+
+// putSize is how many bytes putting a value of size bytes, with enc as its encoded
+// metadata, under key adds to the live records: its record, or the chunks and
+// manifest of a value stored in chunks.
+func (d *dataDir) putSize(key string, size int, enc []byte, expires uint64) int64 {
+	if chunkSize := d.chunkSize; chunkSize > 0 && size > chunkSize && !isChunkKey(key) {
+		count := (size + chunkSize - 1) / chunkSize
+		chunks := int64(count*(headerSize+len(chunkPrefix)+len(key)+chunkKeySuffix) + size)
+		return chunks + int64(headerSize+len(key)+metaPrefixSize+len(enc)+manifestHeader+4*count)
+	}
+	n := int64(headerSize + len(key) + size)
+	switch {
+	case enc != nil:
+		n += int64(metaPrefixSize + len(enc))
+	case expires != 0:
+		n += expirySize
+	}
+	return n
+}
+
+// checkQuotas fails a put of size bytes, see putSize, under key if it would take a
+// prefix past a quota that rejects writes. The record the key had goes, but the chunks
+// of an earlier value only count as gone once they have been deleted.
+func checkQuotas(key string, prev FileOffset, had bool, size int64, keyDir *KeyDir) error {
+	qs := keyDir.quotas()
+	if len(qs) == 0 || isInternalKey([]byte(key)) {
+		return nil
+	}
+	var freed int64
+	if had && !prev.Tombstone() {
+		freed = prev.recordSize(key)
+	}
+	for i, q := range qs {
+		if q.Policy != QuotaReject || !strings.HasPrefix(key, q.Prefix) {
+			continue
+		}
+		if used := keyDir.quotaUsed(i); used-freed+size > q.MaxBytes {
+			return fmt.Errorf("%w: %s holds %d of %d bytes, %q needs %d more", ErrQuotaExceeded,
+				quotaName(q.Prefix), used, q.MaxBytes, key, size-freed)
+		}
+	}
+	return nil
+}
+
+// evictQuotas deletes keys under the prefixes over a quota that evicts until they fit
+// again. kept, the key just written, is never picked.
+func evictQuotas(kept string, f *os.File, w *bufio.Writer, keyDir *KeyDir) error {
+	if !keyDir.dir.quotaEvicts || isInternalKey([]byte(kept)) {
+		return nil
+	}
+	for i, q := range keyDir.quotas() {
+		if q.Policy != QuotaEvict || !strings.HasPrefix(kept, q.Prefix) {
+			continue
+		}
+		for keyDir.quotaUsed(i) > q.MaxBytes {
+			victim, fo, ok := pickVictim(kept, q.Prefix, keyDir)
+			if !ok {
+				break // nothing left that may go
+			}
+			if err := deleteAt(victim, keyDir.dir.newTimestamp(), f, w, keyDir); err != nil {
+				return fmt.Errorf("quota of %s: evict %q: %w", quotaName(q.Prefix), victim, err)
+			}
+			keyDir.dir.metrics.evicted.Add(1)
+			keyDir.dir.evictedBytes += fo.recordSize(victim)
+			keyDir.dir.logger.Debug("evicted for quota", "prefix", q.Prefix, "key", victim)
+		}
+	}
+	return nil
+}
+
+// quotaName is how messages refer to the quota of prefix.
+func quotaName(prefix string) string {
+	if prefix == "" {
+		return "the store"
+	}
+	return strconv.Quote(prefix)
+}
+
+// QuotaUsage is a quota with what the store uses of it.
+type QuotaUsage struct {
+	Quota
+	Used int64 // bytes of live records under Prefix
+}
+
+// Headroom is how many more bytes fit under the quota.
+func (u QuotaUsage) Headroom() int64 { return max(u.MaxBytes-u.Used, 0) }
+
+// Quotas returns the quotas in force with the usage of each.
+func (db *DB) Quotas() []QuotaUsage {
+	defer db.rlock()()
+	return db.s.quotas()
+}
+
+// quotas is DB.Quotas for callers holding the store's mu.
+func (s *store) quotas() []QuotaUsage {
+	qs := s.keyDir.quotas()
+	usage := make([]QuotaUsage, len(qs))
+	for i, q := range qs {
+		usage[i] = QuotaUsage{Quota: q, Used: s.keyDir.quotaUsed(i)}
+	}
+	return usage
+}
+
+// quotaStatsLines are the lines stats prints for the quotas.
+func (s *store) quotaStatsLines() []string {
+	var lines []string
+	for _, u := range s.quotas() {
+		lines = append(lines, fmt.Sprintf("quota:       %s uses %d of %d bytes, %d headroom (%s when full)",
+			quotaName(u.Prefix), u.Used, u.MaxBytes, u.Headroom(), u.Policy))
+	}
+	return lines
+}
+
+// ParseQuota parses a quota as the command line's --quota takes it: a prefix, left
+// out for the whole store, followed by max-bytes=<n> and optionally
+// policy=<reject|evict>.
+func ParseQuota(s string) (Quota, error) {
+	fields := strings.Fields(s)
+	var q Quota
+	if len(fields) > 0 && !strings.HasPrefix(fields[0], "max-bytes=") && !strings.HasPrefix(fields[0], "policy=") {
+		q.Prefix, fields = fields[0], fields[1:]
+	}
+	for _, f := range fields {
+		name, value, _ := strings.Cut(f, "=")
+		var err error
+		switch name {
+		case "max-bytes":
+			q.MaxBytes, err = strconv.ParseInt(value, 10, 64)
+		case "policy":
+			q.Policy, err = parseQuotaPolicy(value)
+		default:
+			err = fmt.Errorf("unknown setting")
+		}
+		if err != nil {
+			return Quota{}, fmt.Errorf("quota %q: %s: %w", s, f, err)
+		}
+	}
+	if q.MaxBytes <= 0 {
+		return Quota{}, fmt.Errorf("quota %q: want a positive max-bytes=", s)
+	}
+	return q, nil
+}
@@ -0,0 +1,39 @@
+package gocask
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// Quotas are a store's own: a second store in the process isn't bound by them.
+func TestQuotasPerStore(t *testing.T) {
+	limited, err := Open(t.TempDir(), WithQuotas(Quota{Prefix: "t/", MaxBytes: 100}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer limited.Close()
+	free, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer free.Close()
+
+	big := strings.Repeat("x", 200)
+	if err := limited.Put("t/a", big); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("put past the quota: %v, want ErrQuotaExceeded", err)
+	}
+	if err := free.Put("t/a", big); err != nil {
+		t.Errorf("put to the store without quotas: %v", err)
+	}
+
+	if err := limited.SetQuotas(); err != nil {
+		t.Fatal(err)
+	}
+	if err := limited.Put("t/a", big); err != nil {
+		t.Errorf("put once the quota is gone: %v", err)
+	}
+	if err := limited.SetQuotas(Quota{MaxBytes: 1}, Quota{MaxBytes: 2}); err == nil {
+		t.Error("set two quotas for one prefix")
+	}
+}
@@ -0,0 +1,118 @@
+package gocask
+
+import (
+	"container/list"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+)
+
+// maxReadHandles is how many segment files Get keeps open between calls.
+const maxReadHandles = 64
+
+// readHandle is an open, read-only data file. Reads go through ReadAt, which doesn't
+// move a file position, so one handle serves any number of concurrent readers.
+type readHandle struct {
+	*os.File
+	name    string
+	mapped  []byte // the whole file, when sealed segments are read through mmap
+	pinned  bool   // zero-copy values point into mapped, so LRU eviction skips it
+	refs    int    // readers using the handle right now
+	dropped bool   // out of the pool, closed when the last reader is done
+	elem    *list.Element
+}
+
+func (h *readHandle) close() {
+	if h.mapped != nil {
+		munmapFile(h.mapped)
+	}
+	h.Close()
+}
+
+// handlePool keeps the most recently read data files of a store open, so a Get
+// costs a pread instead of an open, a read and a close.
+type handlePool struct {
+	mode  atomic.Int32 // the ReadMode files are opened in, see setMode
+	mu    sync.Mutex
+	max   int
+	files map[string]*readHandle
+	lru   *list.List // front is the most recently used
+}
+
+func newHandlePool(max int) *handlePool {
+	return &handlePool{max: max, files: make(map[string]*readHandle), lru: list.New()}
+}
+
+// acquire returns an open handle for name. Hand it back with release.
+func (p *handlePool) acquire(name string) (*readHandle, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if h, ok := p.files[name]; ok {
+		p.lru.MoveToFront(h.elem)
+		h.refs++
+		return h, nil
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	h := &readHandle{File: f, name: name, refs: 1}
+	// the active file keeps growing, only sealed segments are mapped
+	if mode := ReadMode(p.mode.Load()); mode != ReadPread && filepath.Base(name) != filepath.Base(activeFile) {
+		if h.mapped, err = mmapFile(f); err != nil {
+			f.Close()
+			return nil, err
+		}
+		h.pinned = mode == ReadMmapZeroCopy
+	}
+	h.elem = p.lru.PushFront(h)
+	p.files[name] = h
+	for e := p.lru.Back(); e != nil && p.lru.Len() > p.max; {
+		old := e.Value.(*readHandle)
+		e = e.Prev()
+		if !old.pinned {
+			p.evict(old)
+		}
+	}
+	return h, nil
+}
+
+func (p *handlePool) release(h *readHandle) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	h.refs--
+	if h.dropped && h.refs == 0 {
+		h.close()
+	}
+}
+
+// drop closes the handle for name, if there is one. It must be called before a data
+// file is renamed, replaced or deleted: a cached handle would go on reading the old
+// file, and on Windows it keeps the rename or delete from happening at all.
+func (p *handlePool) drop(name string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if h, ok := p.files[name]; ok {
+		p.evict(h)
+	}
+}
+
+// dropAll closes every handle, for when the way files are read changes or the store
+// is closed.
+func (p *handlePool) dropAll() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, h := range p.files {
+		p.evict(h)
+	}
+}
+
+func (p *handlePool) evict(h *readHandle) {
+	p.lru.Remove(h.elem)
+	delete(p.files, h.name)
+	h.dropped = true
+	if h.refs == 0 {
+		h.close()
+	}
+}
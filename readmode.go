@@ -0,0 +1,91 @@
+package gocask
+
+import (
+	"fmt"
+	"io"
+	"unsafe"
+)
+
+// ReadMode selects how Get reads values out of sealed segments.
+type ReadMode int
+
+const (
+	// ReadPread reads each value with a pread on a cached file handle.
+	ReadPread ReadMode = iota
+	// ReadMmap maps sealed segments into memory and copies values out of the mapping,
+	// so a read costs no system call at all once its pages are resident.
+	ReadMmap
+	// ReadMmapZeroCopy is ReadMmap without the copy: returned values point straight
+	// into the mapping. That is only safe as long as the segment is mapped, so a value
+	// must not be used after a merge removed its segment or the store was closed; it
+	// crashes the process rather than returning an error.
+	ReadMmapZeroCopy
+)
+
+// WithReadMode makes m how the store reads values, ReadPread without it.
+func WithReadMode(m ReadMode) Option {
+	return withSetting(func(s *store) error {
+		s.dir.readers.setMode(m)
+		return nil
+	})
+}
+
+// SetReadMode switches how the store reads values. Segments already open are
+// reopened in the new mode on their next read. It is safe to call while reads run:
+// each of them reads in the mode its segment was opened in.
+func (db *DB) SetReadMode(m ReadMode) { db.s.dir.readers.setMode(m) }
+
+// setMode makes m the ReadMode files are opened in, closing those open in another.
+func (p *handlePool) setMode(m ReadMode) {
+	if ReadMode(p.mode.Swap(int32(m))) != m {
+		p.dropAll()
+	}
+}
+
+func (m ReadMode) String() string {
+	switch m {
+	case ReadPread:
+		return "pread"
+	case ReadMmap:
+		return "mmap"
+	case ReadMmapZeroCopy:
+		return "mmap-zero-copy"
+	}
+	return fmt.Sprintf("ReadMode(%d)", int(m))
+}
+
+// ParseReadMode parses the name String returns.
+func ParseReadMode(s string) (ReadMode, error) {
+	for m := ReadPread; m <= ReadMmapZeroCopy; m++ {
+		if m.String() == s {
+			return m, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown read mode %q, want pread, mmap or mmap-zero-copy", s)
+}
+
+// readAt returns len(buf) bytes of h at off: read into buf, or from a mapping the
+// mapped memory itself. Either way callers must copy what they keep, unless zero-copy
+// reads were asked for.
+func (h *readHandle) readAt(buf []byte, off int64) ([]byte, error) {
+	n := int64(len(buf))
+	if h.mapped != nil {
+		if off < 0 || off+n > int64(len(h.mapped)) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return h.mapped[off : off+n : off+n], nil
+	}
+	if _, err := h.ReadAt(buf, off); err != nil {
+		return nil, eofIsUnexpected(err)
+	}
+	return buf, nil
+}
+
+// valueString turns bytes from readAt into the value handed to the caller, pointing
+// into the mapping if h was opened for zero-copy reads.
+func (h *readHandle) valueString(b []byte) string {
+	if h.pinned && len(b) > 0 {
+		return unsafe.String(&b[0], len(b))
+	}
+	return string(b)
+}
@@ -0,0 +1,49 @@
+package gocask
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// Switching the read mode while Gets run mustn't race with them or break them.
+func TestSetReadModeWhileReading(t *testing.T) {
+	// small segments, so most values are read from sealed ones, which get mapped
+	db, err := Open(t.TempDir(), WithCompaction(CompactionPolicy{ActiveSize: 100}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	const keys = 50
+	for i := range keys {
+		if err := db.Put(fmt.Sprint("k", i), fmt.Sprint("v", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := 0; ; n++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				i := n % keys
+				if v, err := db.Get(fmt.Sprint("k", i)); err != nil || v != fmt.Sprint("v", i) {
+					t.Errorf("get k%d = %q, %v", i, v, err)
+					return
+				}
+			}
+		}()
+	}
+	for n := range 200 {
+		db.SetReadMode(ReadMode(n % 2)) // pread and mmap: zero-copy values may not outlive a switch
+	}
+	close(stop)
+	wg.Wait()
+}
@@ -0,0 +1,498 @@
+package gocask
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/itsknk/gocask/internal/failpoint"
+)
+
+// DamagedRegion is a stretch of a data file that held no readable record.
+type DamagedRegion struct {
+	File   string
+	Offset int64
+	Length int64
+}
+
+// RecoveryReport lists what a resilient scan had to skip.
+type RecoveryReport struct {
+	Regions   []DamagedRegion
+	BytesLost int64
+}
+
+func (r *RecoveryReport) add(file string, off, n int64) {
+	r.Regions = append(r.Regions, DamagedRegion{file, off, n})
+	r.BytesLost += n
+}
+
+// Skipped is the number of damaged regions.
+func (r *RecoveryReport) Skipped() int { return len(r.Regions) }
+
+func (r *RecoveryReport) String() string {
+	if r.Skipped() == 0 {
+		return "no damage found"
+	}
+	return fmt.Sprintf("skipped %d damaged regions, %d bytes lost", r.Skipped(), r.BytesLost)
+}
+
+// RecoveryInfo is everything opening a store found wrong with its files, and what
+// was done about it.
+type RecoveryInfo struct {
+	RecoveryReport                  // damaged records skipped
+	Truncated      int64            // bytes of a torn record cut off the end of the active file
+	BadHints       []string         // hints ignored in favor of scanning their segment
+	MissingHints   []string         // segments that had no hint and were scanned
+	OrphanHints    []string         // hints whose segment is gone
+	Quarantined    []string         // files moved into the quarantine directory
+	FinishedMerge  string           // segment of a merge a crash interrupted, completed on open
+	Actions        []RecoveryAction // every step taken about the above, in order
+	DryRun         bool             // the actions were only planned, the files are as they were
+}
+
+// add appends what other found to i.
+func (i *RecoveryInfo) add(other *RecoveryInfo) {
+	i.Regions = append(i.Regions, other.Regions...)
+	i.BytesLost += other.BytesLost
+	i.Truncated += other.Truncated
+	i.BadHints = append(i.BadHints, other.BadHints...)
+	i.MissingHints = append(i.MissingHints, other.MissingHints...)
+	i.OrphanHints = append(i.OrphanHints, other.OrphanHints...)
+	i.Quarantined = append(i.Quarantined, other.Quarantined...)
+	i.Actions = append(i.Actions, other.Actions...)
+}
+
+// RecoveryActionKind is what a RecoveryAction did.
+type RecoveryActionKind string
+
+const (
+	ActionFinishMerge RecoveryActionKind = "finish-merge" // completed a merge a crash interrupted
+	ActionQuarantine  RecoveryActionKind = "quarantine"   // moved a file into the quarantine directory
+	ActionScan        RecoveryActionKind = "scan"         // indexed a segment by reading its records
+	ActionSkipDamage  RecoveryActionKind = "skip-damage"  // left records out of the index that don't decode
+	ActionWriteHint   RecoveryActionKind = "write-hint"   // wrote a fresh hint for a scanned segment
+	ActionTruncate    RecoveryActionKind = "truncate"     // cut a torn record off the end of the active file or the cdc journal
+)
+
+// RecoveryAction is one step opening a store took to get around a problem with its
+// files, or, with RecoveryOptions.DryRun, would have taken.
+type RecoveryAction struct {
+	Kind   RecoveryActionKind
+	File   string
+	Offset int64 // where in File the step applies, -1 for the file as a whole
+	Bytes  int64 // how many bytes it skipped or cut off, if any
+	Reason string
+}
+
+func (a RecoveryAction) String() string {
+	s := fmt.Sprintf("%s %s", a.Kind, a.File)
+	if a.Offset >= 0 {
+		s += fmt.Sprintf(" at offset %d", a.Offset)
+	}
+	if a.Bytes > 0 {
+		s += fmt.Sprintf(", %d bytes", a.Bytes)
+	}
+	return s + ": " + a.Reason
+}
+
+// did records an action on the whole of file.
+func (i *RecoveryInfo) did(kind RecoveryActionKind, file, reason string) {
+	i.Actions = append(i.Actions, RecoveryAction{Kind: kind, File: file, Offset: -1, Reason: reason})
+}
+
+// skippedRegion records leaving r out of the index.
+func (i *RecoveryInfo) skippedRegion(r DamagedRegion) {
+	i.Actions = append(i.Actions, RecoveryAction{ActionSkipDamage, r.File, r.Offset, r.Length, "no readable record"})
+}
+
+// RecoveryOptions say which repairs OpenWithRecovery may make. A problem that needs a
+// repair they don't allow fails the open with an *IntegrityError instead. Problems
+// that lose nothing are always dealt with: an unusable hint is replaced by scanning
+// its segment, hints without a segment and files gocask didn't write are quarantined,
+// and a merge a crash interrupted is finished.
+type RecoveryOptions struct {
+	// RebuildIndexFromLogs ignores every hint and indexes the segments by scanning
+	// them, writing fresh hints, for when hints are suspected to be stale or wrong.
+	RebuildIndexFromLogs bool
+	// TruncateCorrupt drops records that don't decode: damaged stretches of segments
+	// are left out of the index and a torn record is cut off the end of the active
+	// file.
+	TruncateCorrupt bool
+	// SkipBadSegments quarantines segments that hold no readable record or can't be
+	// read at all, and opens the store without them.
+	SkipBadSegments bool
+	// DryRun changes nothing on disk: the store opens read-only, as it would look
+	// after the repairs, and the report lists what they would have been.
+	DryRun bool
+}
+
+// repairs is what an open may do about the problems it finds.
+type repairs struct {
+	RecoveryOptions
+	strict         bool // fail on the first problem, even one that loses nothing
+	failUnreadable bool // fail on a segment that can't be read, rather than skip it
+}
+
+var (
+	// openRepairs are Open's: whatever gets the store open, but a segment that
+	// fails to read may well read on the next try.
+	openRepairs = repairs{RecoveryOptions: RecoveryOptions{TruncateCorrupt: true, SkipBadSegments: true}, failUnreadable: true}
+	// strictRepairs are OpenStrict's.
+	strictRepairs = repairs{strict: true, failUnreadable: true}
+)
+
+// Clean reports whether the store opened without finding any problem.
+func (i *RecoveryInfo) Clean() bool {
+	return i.Skipped() == 0 && i.Truncated == 0 && len(i.BadHints) == 0 &&
+		len(i.MissingHints) == 0 && len(i.OrphanHints) == 0 && len(i.Quarantined) == 0 && i.FinishedMerge == ""
+}
+
+func (i *RecoveryInfo) String() string {
+	if i.Clean() {
+		return "no problems found"
+	}
+	s := fmt.Sprintf("%s, %d bytes truncated, %d bad hints, %d missing hints, %d orphan hints, %d files quarantined",
+		i.RecoveryReport.String(), i.Truncated, len(i.BadHints), len(i.MissingHints), len(i.OrphanHints), len(i.Quarantined))
+	if i.FinishedMerge != "" {
+		s += ", finished the interrupted merge into " + i.FinishedMerge
+	}
+	if i.DryRun {
+		s += " (dry run, nothing was changed)"
+	}
+	return s
+}
+
+// IntegrityError is what OpenStrict returns for the first problem it finds.
+type IntegrityError struct {
+	File    string
+	Offset  int64 // -1 when the problem is with the file as a whole
+	Problem string
+}
+
+func (e *IntegrityError) Error() string {
+	if e.Offset < 0 {
+		return fmt.Sprintf("integrity check failed: %s: %s", e.File, e.Problem)
+	}
+	return fmt.Sprintf("integrity check failed: %s at offset %d: %s", e.File, e.Offset, e.Problem)
+}
+
+// damageError turns the first damaged region found since report held skipped regions into an IntegrityError.
+func damageError(report *RecoveryReport, skipped int) error {
+	if report.Skipped() == skipped {
+		return nil
+	}
+	d := report.Regions[skipped]
+	return &IntegrityError{File: d.File, Offset: d.Offset, Problem: fmt.Sprintf("%d bytes hold no readable record", d.Length)}
+}
+
+// plausibleHeader decodes a record header and reports whether it could start a real
+// record with remaining bytes left in the file. It only catches headers that are
+// obviously wrong: an unknown flag, a zero timestamp, a tombstone with a value, an
+// expiring record too short for its expiry, one with metadata for its prefix or a
+// chunk manifest for its prefix and header, a batch header of the wrong size, or
+// lengths running past the end of the file. The checksum catches the rest once the
+// body is read.
+func plausibleHeader(hdr []byte, remaining int64) (r record, keyLen, valLen int64, ok bool) {
+	r = record{flag: hdr[0], ts: binary.BigEndian.Uint64(hdr[1:9])}
+	keyLen = int64(binary.BigEndian.Uint32(hdr[9:13]))
+	valLen = int64(binary.BigEndian.Uint32(hdr[13:17]))
+	switch {
+	case r.flag > flagBatch:
+	case r.ts == 0:
+	case r.flag == flagTombstone && valLen != 0:
+	case r.flag == flagExpiring && valLen < expirySize:
+	case r.flag == flagMeta && valLen < metaPrefixSize:
+	case r.flag == flagChunked && valLen < metaPrefixSize+manifestHeader:
+	case r.flag == flagBatch && (keyLen != 0 || valLen != batchValueSize):
+	case keyLen+valLen > remaining-headerSize:
+	default:
+		return r, keyLen, valLen, true
+	}
+	return r, 0, 0, false
+}
+
+// scanFileResilient is scanFile for files that may be damaged. Instead of stopping
+// at the first bad record it moves forward a byte at a time until a plausible header
+// of a record that matches its checksum turns up, and adds every stretch it skipped
+// to report. The records of a batch are only handed to fn once the whole batch has
+// been read; a batch that is cut short or damaged is skipped whole. A record torn off
+// at the end of the file counts as a damaged region too. It returns where the last
+// good record ends.
+func scanFileResilient(path string, readAhead int, report *RecoveryReport, fn func(off int64, r record) error) (int64, error) {
+	f, size, err := openSized(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return scanRecordsResilient(path, newScanReader(f, readAhead), size, report, fn)
+}
+
+// scanRecordsResilient is scanFileResilient over size bytes of reader; name labels
+// errors and damaged regions.
+func scanRecordsResilient(name string, reader *bufio.Reader, size int64, report *RecoveryReport, fn func(off int64, r record) error) (int64, error) {
+	var off, end int64
+	var body []byte
+	badStart := int64(-1)
+	// the batch being read, and skipTo the end of one that turned out damaged
+	var batch batchReader
+	var skipTo int64
+	// damaged makes off the start of a damaged region, or the start of the batch
+	// it is in, which then goes whole
+	damaged := func() {
+		if batch.open {
+			badStart, skipTo = batch.start, batch.end
+			batch.drop()
+		} else if badStart < 0 {
+			badStart = off
+		}
+	}
+	for off < size {
+		hdr, err := reader.Peek(headerSize)
+		if err != nil && err != io.EOF {
+			return end, fmt.Errorf("%s: offset %d: %w", name, off, err)
+		}
+		if len(hdr) == headerSize {
+			if r, keyLen, valLen, ok := plausibleHeader(hdr, size-off); ok {
+				crc, want := headerChecksum(hdr)
+				var pending int
+				r.key, r.value, pending, err = readBody(reader, int(keyLen), int(valLen), &body)
+				if err != nil {
+					return end, fmt.Errorf("%s: record body at offset %d: %w", name, off, err)
+				}
+				_, _, batchOK := decodeBatch(r.value)
+				good := bodyChecksum(crc, r.key, r.value) == want && (r.flag != flagBatch || batchOK)
+				switch {
+				case !good && pending > 0:
+					// still in the buffer: look for the next record a byte further on
+				case !good:
+					// too big for the buffer, so it is read already and skipped whole
+					damaged()
+					off += r.size()
+					continue
+				case off < skipTo:
+					// part of a batch that was damaged
+				case r.flag == flagBatch:
+					if batch.open {
+						report.add(name, batch.start, off-batch.start) // the one before never finished
+					}
+					if badStart >= 0 {
+						report.add(name, badStart, off-badStart)
+						badStart = -1
+					}
+					batch.begin(off, r)
+				case batch.open:
+					last, err := batch.add(off, r)
+					if err != nil {
+						damaged()
+						break
+					}
+					if last {
+						end = batch.end
+						if err := batch.flush(false, fn); err != nil {
+							return end, err
+						}
+					}
+				default:
+					if badStart >= 0 {
+						report.add(name, badStart, off-badStart)
+						badStart = -1
+					}
+					if err := fn(off, r); err != nil {
+						return end, err
+					}
+					end = off + r.size()
+				}
+				if good {
+					reader.Discard(pending)
+					off += r.size()
+					continue
+				}
+			}
+		}
+		damaged()
+		if len(hdr) < headerSize {
+			off = size // too short to hold a record
+			break
+		}
+		reader.Discard(1)
+		off++
+	}
+	if batch.open {
+		badStart = batch.start // cut short by the end of the file
+	}
+	if badStart >= 0 {
+		report.add(name, badStart, off-badStart)
+	}
+	return end, nil
+}
+
+// mergeMarker names the merged segment and its inputs while a merge swaps them. The
+// merged records are complete and synced before it is written, so if it is still
+// there on open, the merge got that far and finishMerge can roll it forward. The
+// names in it are relative to the data directory, so it survives the store moving.
+const mergeMarker = "MERGE"
+
+// writeMergeMarker writes the marker of a merge of inputs into target in dir.
+func writeMergeMarker(dir, target string, inputs []string) error {
+	names := make([]string, 0, len(inputs)+1)
+	for _, name := range append([]string{target}, inputs...) {
+		rel, err := filepath.Rel(dir, name)
+		if err != nil {
+			return err
+		}
+		names = append(names, filepath.ToSlash(rel))
+	}
+	marker := filepath.Join(dir, mergeMarker)
+	tmp := marker + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(f, "%s\n", strings.Join(names, "\n"))
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, marker)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return syncDir(dir)
+}
+
+// removeMerged deletes the inputs of a merge in dir that target now holds, oldest
+// first: a crash halfway must leave newer segments, whose tombstones hide what's left
+// of the older ones. The marker goes last.
+func removeMerged(dir, target string, inputs []string) error {
+	inputs = append([]string(nil), inputs...)
+	sort.Slice(inputs, func(i, j int) bool {
+		return extractTimestamp(inputs[i]) < extractTimestamp(inputs[j])
+	})
+	for _, old := range inputs {
+		if old == target {
+			continue
+		}
+		if err := failpoint.Check("merge.cleanup"); err != nil {
+			return err
+		}
+		if err := removeFile(hintFile(old)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err := removeFile(old); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := syncDataDirs(dir); err != nil {
+		return err
+	}
+	if err := os.Remove(filepath.Join(dir, mergeMarker)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// finishMergeAsync writes the hint for target and removes the inputs it replaced on a
+// goroutine of its own, so the writer doesn't wait for either. It holds the rotation
+// lock, as backups need segments to stay put while they copy. The MERGE marker goes
+// last as always: a crash before that is finished on open, and a failure on the next
+// open or merge. The index must already point into target and not its inputs.
+// Closing the store waits for it.
+func (d *dataDir) finishMergeAsync(target string, inputs []string) {
+	d.mergeTail.Add(1)
+	go func() {
+		defer d.mergeTail.Done()
+		lock := lockStore(d.path)
+		if err := lock.Lock(); err != nil {
+			d.logger.Error("lock store to finish merge", "err", err)
+			return
+		}
+		defer lock.Unlock()
+
+		hint := hintFile(target)
+		err := failpoint.Check("merge.hint")
+		if err == nil {
+			err = writeHintFor(target, hint, d.scanSize())
+		}
+		if err != nil {
+			// a segment without a hint is scanned on open, which writes one
+			d.logger.Warn("write hint for merged segment", "segment", target, "err", err)
+			os.Remove(hint)
+		} else if fi, err := os.Stat(hint); err == nil {
+			d.metrics.compactionWritten.Add(uint64(fi.Size()))
+		}
+		for _, old := range inputs {
+			d.readers.drop(old)
+		}
+		if err := removeMerged(d.path, target, inputs); err != nil {
+			d.logger.Error("remove merged segments", "segment", target, "err", err)
+		}
+	}()
+}
+
+// pendingMerge returns the segment of a merge of the store in dir a crash
+// interrupted, or "" if there is none, for a dry run to report without finishing it.
+func pendingMerge(dir string, _ Logger) (string, error) {
+	data, err := os.ReadFile(filepath.Join(dir, mergeMarker))
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	names := strings.Fields(string(data))
+	if len(names) == 0 {
+		return "", nil
+	}
+	return filepath.Join(dir, names[0]), nil
+}
+
+// finishMerge completes a merge of the store in dir that was interrupted after its
+// marker was written, and returns the segment it finished, or "" if there was
+// nothing to do.
+func finishMerge(dir string, log Logger) (string, error) {
+	marker := filepath.Join(dir, mergeMarker)
+	data, err := os.ReadFile(marker)
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	// a merge still running in another process holds the lock and removes the marker when done
+	lock := lockStore(dir)
+	if err := lock.Lock(); err != nil {
+		return "", fmt.Errorf("lock store: %w", err)
+	}
+	defer lock.Unlock()
+	if _, err := os.Stat(marker); os.IsNotExist(err) {
+		return "", nil
+	}
+
+	names := strings.Fields(string(data))
+	if len(names) == 0 {
+		return "", os.Remove(marker)
+	}
+	for i, name := range names {
+		if _, ok := segmentTime(name); !ok {
+			return "", fmt.Errorf("%s names %q, which is not a segment", mergeMarker, name)
+		}
+		names[i] = filepath.Join(dir, name)
+	}
+	target, inputs := names[0], names[1:]
+	log.Warn("finishing a merge interrupted by a crash", "segment", target, "inputs", len(inputs))
+	compacted := filepath.Join(dir, compactedFile)
+	if _, err := os.Stat(compacted); err == nil {
+		if err := os.Rename(compacted, target); err != nil {
+			return "", err
+		}
+	}
+	return target, removeMerged(dir, target, inputs)
+}
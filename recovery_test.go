@@ -0,0 +1,117 @@
+package gocask
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// A record torn by a crash at the end of the active file or of the cdc journal is
+// cut off with TruncateCorrupt, and an *IntegrityError without it.
+func TestTruncateTornTail(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		file func(dir string) string
+	}{
+		{"active file", func(dir string) string { return filepath.Join(dir, activeFile) }},
+		{"journal", JournalPath},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			db, err := Open(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 3; i++ {
+				if err := db.Put(fmt.Sprint("k", i), "v"); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := db.Close(); err != nil {
+				t.Fatal(err)
+			}
+			path := tc.file(dir)
+			fi, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			good := fi.Size()
+			// the header of a record whose body never made it
+			f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			torn := appendHeader(nil, flagNormal, 1<<16, []byte("k3"), nil, []byte("v"))
+			if _, err := f.Write(torn); err != nil {
+				t.Fatal(err)
+			}
+			f.Close()
+			size := func() int64 {
+				t.Helper()
+				fi, err := os.Stat(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return fi.Size()
+			}
+
+			_, _, err = OpenWithRecovery(dir, RecoveryOptions{})
+			var ie *IntegrityError
+			if !errors.As(err, &ie) || ie.Offset != good {
+				t.Fatalf("open without TruncateCorrupt: %v, want an *IntegrityError at offset %d", err, good)
+			}
+			if size() != good+int64(len(torn)) {
+				t.Error("open without TruncateCorrupt changed the file")
+			}
+
+			db, info, err := OpenWithRecovery(dir, RecoveryOptions{TruncateCorrupt: true, DryRun: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			db.Close()
+			if info.Truncated != int64(len(torn)) || size() != good+int64(len(torn)) {
+				t.Errorf("dry run: truncated %d of %d bytes, file is %d bytes", info.Truncated, len(torn), size())
+			}
+
+			db, info, err = OpenWithRecovery(dir, RecoveryOptions{TruncateCorrupt: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Truncated != int64(len(torn)) || size() != good {
+				t.Errorf("truncated %d of %d bytes, file is %d bytes, want %d", info.Truncated, len(torn), size(), good)
+			}
+			want := RecoveryAction{ActionTruncate, path, good, int64(len(torn)), ""}
+			found := false
+			for _, a := range info.Actions {
+				found = found || a.Kind == want.Kind && a.File == want.File && a.Offset == want.Offset && a.Bytes == want.Bytes
+			}
+			if !found {
+				t.Errorf("no %v among the actions %v", want, info.Actions)
+			}
+
+			// what is written next reads back, from the file and the changefeed
+			if err := db.Put("k3", "v"); err != nil {
+				t.Fatal(err)
+			}
+			if err := db.Close(); err != nil {
+				t.Fatal(err)
+			}
+			db, info, err = OpenStrict(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			if !info.Clean() {
+				t.Errorf("reopen after the repair: %s", info.String())
+			}
+			if got := fmt.Sprint(readChanges(t, db, 0)); got != "[k0 k1 k2 k3]" {
+				t.Errorf("changes after the repair: %s", got)
+			}
+			if v, err := db.Get("k3"); err != nil || v != "v" {
+				t.Errorf("k3 = %q, %v", v, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,111 @@
+package gocask
+
+import (
+	"bufio"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// Replication is last-writer-wins between sites sharing one nats subject or kafka topic.
+// Every site publishes the writes it originated (through a Connector) and applies what
+// the others published. Record timestamps carry the origin node id, so comparing them
+// settles every conflict the same way on every site and both sides converge.
+
+// Source delivers events published by other sites.
+type Source interface {
+	// Run calls handle for each message until Close. Sources that can redeliver
+	// do so when handle returns an error.
+	Run(handle func(payload []byte) error) error
+	Close() error
+}
+
+// Conflict describes a replicated write that was dropped because the local
+// version of the key is newer.
+type Conflict struct {
+	Key             string
+	LocalTimestamp  uint64
+	RemoteTimestamp uint64
+	RemoteDeleted   bool
+}
+
+// Replicator applies remote events to the local store.
+type Replicator struct {
+	Source Source
+	// Apply writes a remote change locally, usually DB.ApplyRemote.
+	Apply func(c Change) (*Conflict, error)
+	// OnConflict, if set, is called for every remote write that lost.
+	OnConflict func(Conflict)
+	// Node is the local store's node id, see DB.NodeID: events it wrote are ours.
+	Node uint16
+	// Logger gets what goes wrong without stopping Run, slog text on stderr if nil.
+	Logger Logger
+
+	delay atomic.Int64 // nanoseconds from the last applied change being written to applying it
+}
+
+// Run applies events until the source is closed. Our own events echoed back are ignored.
+func (r *Replicator) Run() error {
+	return r.Source.Run(func(payload []byte) error {
+		c, err := DecodeChangeJSON(payload)
+		if err != nil {
+			// a malformed event will never decode, don't block the stream on it
+			orDefault(r.Logger).Warn("replication skipped bad event", "err", err)
+			return nil
+		}
+		if TimestampNode(c.Timestamp) == r.Node {
+			return nil
+		}
+		conflict, err := r.Apply(c)
+		if err != nil {
+			return err
+		}
+		r.delay.Store(max(time.Now().UnixNano()-int64(c.Timestamp&^0xffff), 0))
+		if conflict != nil && r.OnConflict != nil {
+			r.OnConflict(*conflict)
+		}
+		return nil
+	})
+}
+
+// Lag is how long the last change applied took to arrive from the site that wrote it,
+// as far as the clocks of the two agree.
+func (r *Replicator) Lag() time.Duration { return time.Duration(r.delay.Load()) }
+
+// ApplyRemote writes c, a change another site published, unless the store has a newer
+// version of its key, which it returns the Conflict with. The record keeps the remote
+// timestamp, so it is journaled as the other site's write and not published back.
+func (db *DB) ApplyRemote(c Change) (*Conflict, error) {
+	defer db.lock()()
+	conflict, err := applyRemote(c, db.s.f, db.s.w, db.s.keyDir)
+	if err != nil {
+		return nil, err
+	}
+	return conflict, db.s.rotateIfFull()
+}
+
+// applyRemote is DB.ApplyRemote for callers holding the store's mu.
+func applyRemote(c Change, f *os.File, w *bufio.Writer, keyDir *KeyDir) (*Conflict, error) {
+	key := string(c.Key)
+	if fo, ok := keyDir.Get(key); ok {
+		_, local, err := keyDir.dir.recordHeader(fo)
+		if err != nil {
+			return nil, err
+		}
+		if c.Timestamp == local {
+			return nil, nil // redelivery of something we already have
+		}
+		if c.Timestamp < local {
+			return &Conflict{key, local, c.Timestamp, c.Deleted}, nil
+		}
+	}
+
+	// keep our clock ahead of everything we've seen, so later local writes win over it
+	if c.Timestamp > keyDir.dir.lastTimestamp {
+		keyDir.dir.lastTimestamp = c.Timestamp
+	}
+	if c.Deleted {
+		return nil, deleteAt(key, c.Timestamp, f, w, keyDir)
+	}
+	return nil, putAt(key, string(c.Value), c.Timestamp, c.Expires, c.Meta, f, w, keyDir)
+}
@@ -0,0 +1,52 @@
+package gocask
+
+import (
+	"testing"
+	"time"
+)
+
+// A remote put older than a local delete must lose to it also after a merge, while
+// the merge still keeps the tombstone.
+func TestApplyRemoteAfterMerge(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		age   time.Duration
+		keeps bool
+	}{
+		{"kept", 0, true},
+		{"dropped", -1, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			db, err := Open(t.TempDir(), WithCompaction(CompactionPolicy{TombstoneAge: tc.age}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			if err := db.Put("k", "local"); err != nil {
+				t.Fatal(err)
+			}
+			older := db.s.dir.newTimestamp()
+			if err := db.Delete("k"); err != nil {
+				t.Fatal(err)
+			}
+
+			s := db.s
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			if err := s.rotate(); err != nil {
+				t.Fatal(err)
+			}
+			conflict, err := applyRemote(Change{Key: []byte("k"), Value: []byte("remote"), Timestamp: older}, s.f, s.w, s.keyDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = get("k", s.keyDir)
+			if tc.keeps && (conflict == nil || err == nil) {
+				t.Fatalf("the older remote put won over the merged delete: conflict %v, get error %v", conflict, err)
+			}
+			if !tc.keeps && (conflict != nil || err != nil) {
+				t.Fatalf("the remote put lost to a dropped delete: conflict %v, get error %v", conflict, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,254 @@
+package gocask
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// RestoreOptions tune RestoreChain.
+type RestoreOptions struct {
+	// At, unless zero, restores the store as it was at that moment, see pointInTime.
+	// A backup taken after it is only read for its changefeed, and must be the
+	// last archive.
+	At time.Time
+	// Changefeed is what to replay up to At: a changefeed journal, see JournalPath,
+	// or a store directory holding one. Empty means that of the backup taken after At.
+	Changefeed string
+	Strict     bool // open the store the changes are replayed into as WithStrict does
+	// Open opens an archive for reading, os.Open if nil. Archives are decompressed
+	// according to their names.
+	Open func(archive string) (io.ReadCloser, error)
+	// Progress, unless nil, gets a line per archive restored and one for the replay.
+	Progress io.Writer
+}
+
+// RestoreChain restores archives, a full backup and the incremental ones taken after
+// it, into dir, in order, like Restore and ApplyIncremental do, and replays the
+// changefeed over them as of o.At if that is set.
+func RestoreChain(archives []string, dir string, o RestoreOptions) error {
+	if o.Open == nil {
+		o.Open = func(archive string) (io.ReadCloser, error) { return os.Open(archive) }
+	}
+	if o.Progress == nil {
+		o.Progress = io.Discard
+	}
+	var pit *pointInTime
+	if !o.At.IsZero() {
+		pit = &pointInTime{At: o.At, Changefeed: o.Changefeed}
+		defer pit.cleanup()
+	}
+	for i, archive := range archives {
+		apply := restore
+		if i > 0 {
+			apply = applyIncremental
+		}
+		if pit != nil {
+			apply = pit.apply(i == 0)
+		}
+		manifest, err := restoreArchive(archive, dir, o.Open, apply)
+		if err != nil {
+			return err
+		}
+		if pit != nil && pit.later == "" && manifest.Created.After(pit.At) {
+			pit.later = archive
+			fmt.Fprintf(o.Progress, "read the changefeed of a backup taken %s\n", manifest.Created.Format(time.RFC3339))
+			continue
+		}
+		fmt.Fprintf(o.Progress, "restored %d files from a backup taken %s\n", len(manifest.Files), manifest.Created.Format(time.RFC3339))
+	}
+	if pit == nil {
+		return nil
+	}
+	return pit.replay(dir, o.Strict, o.Progress)
+}
+
+// restoreArchive opens archive with open and restores it into dir with apply.
+func restoreArchive(archive, dir string, open func(string) (io.ReadCloser, error), apply func(io.Reader, string) (*backupManifest, error)) (*backupManifest, error) {
+	f, err := open(archive)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r, err := decompressReader(archive, f)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	manifest, err := apply(r, dir)
+	if err != nil {
+		return nil, fmt.Errorf("restore %s: %w", archive, err)
+	}
+	return manifest, nil
+}
+
+// pointInTime rebuilds a store as of a moment from a chain of backups and the
+// changefeed: the backups taken up to then are restored, and the changes journaled
+// after the newest of them and stamped no later than at are replayed over it. The
+// changes come from the journal of a backup taken after at, or from Changefeed,
+// which wins if both are there. The journal is never compacted, so either one holds
+// everything the restored one does, and then some, unless TrimChanges dropped it.
+type pointInTime struct {
+	At         time.Time
+	Changefeed string // a journal, or a store directory holding one
+
+	journal string // the later backup's journal, once one was read
+	later   string // the archive it came from
+}
+
+// cleanup removes the journal a later backup left beside the store.
+func (p *pointInTime) cleanup() {
+	if p.journal != "" {
+		os.Remove(p.journal)
+	}
+}
+
+// apply is restore or applyIncremental, as first says, for an archive taken no later
+// than At. Of one taken after, only the journal is kept, in journal beside dir.
+func (p *pointInTime) apply(first bool) func(io.Reader, string) (*backupManifest, error) {
+	return func(r io.Reader, dir string) (*backupManifest, error) {
+		if p.later != "" {
+			return nil, fmt.Errorf("backups are only needed up to the first one taken after --at, which was %s", p.later)
+		}
+		if first {
+			if entries, err := os.ReadDir(dir); err == nil && len(entries) > 0 {
+				return nil, fmt.Errorf("%s is not empty, restore needs a fresh directory", dir)
+			}
+		} else if err := upgradeLayout(dir, defaultLogger); err != nil {
+			return nil, err
+		}
+		tmp := filepath.Clean(dir) + ".restoring"
+		if err := os.Mkdir(tmp, 0755); err != nil {
+			return nil, err
+		}
+		defer os.RemoveAll(tmp)
+		base := dir
+		if first {
+			base = tmp
+		}
+		manifest, err := readBackup(r, tmp, base)
+		if err != nil {
+			return nil, err
+		}
+		if !manifest.Created.After(p.At) {
+			if first {
+				return manifest, installFull(tmp, dir, manifest)
+			}
+			return manifest, installIncremental(tmp, dir, manifest)
+		}
+		if first {
+			return nil, fmt.Errorf("the backup was taken %s, after --at; start from an older one", manifest.Created.Local().Format(time.RFC3339))
+		}
+		p.journal = filepath.Clean(dir) + ".changefeed"
+		if err := os.Rename(filepath.Join(tmp, cdcJournal), p.journal); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		} else if err != nil {
+			p.journal = ""
+		}
+		return manifest, nil
+	}
+}
+
+// replay replays the changes journaled after the restored store's journal into
+// the store in dir, and tells progress how many there were.
+func (p *pointInTime) replay(dir string, strict bool, progress io.Writer) error {
+	journal := p.journal
+	if p.Changefeed != "" {
+		journal = p.Changefeed
+		if fi, err := os.Stat(journal); err == nil && fi.IsDir() {
+			journal = filepath.Join(journal, cdcJournal)
+		}
+	}
+	if journal == "" {
+		return fmt.Errorf("no changefeed to replay up to --at, pass --changefeed with the store's %s or a backup taken after --at", cdcJournal)
+	}
+	from, err := continuesJournal(filepath.Join(dir, cdcJournal), journal)
+	if err != nil {
+		return err
+	}
+
+	s, _, err := openStore(dir, strict)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	changes, err := ReadJournal(journal, from)
+	if err != nil {
+		return err
+	}
+	defer changes.Close()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	until := uint64(p.At.UnixNano())
+	replayed, later := 0, 0
+	for changes.Next() {
+		c := changes.Change()
+		if c.Timestamp > until {
+			later++
+			continue
+		}
+		if _, err := applyRemote(c, s.f, s.w, s.keyDir); err != nil {
+			return fmt.Errorf("replay %q: %w", c.Key, err)
+		}
+		replayed++
+	}
+	if err := changes.Err(); err != nil {
+		return err
+	}
+	fmt.Fprintf(progress, "replayed %d changes up to %s, left out %d made after it\n", replayed, p.At.Format(time.RFC3339), later)
+	return nil
+}
+
+// continuesJournal checks that journal holds on from base, the journal of a restored
+// backup, with the same changes where both have them, and returns the Position it
+// goes on from there.
+func continuesJournal(base, journal string) (Position, error) {
+	b, err := os.Open(base)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	defer b.Close()
+	j, err := os.Open(journal)
+	if err != nil {
+		return 0, err
+	}
+	defer j.Close()
+
+	bBase, bOff, err := journalStart(b)
+	if err != nil {
+		return 0, err
+	}
+	jBase, jOff, err := journalStart(j)
+	if err != nil {
+		return 0, err
+	}
+	fi, err := b.Stat()
+	if err != nil {
+		return 0, err
+	}
+	end := bBase + Position(fi.Size()-bOff)
+	if jBase > end {
+		return 0, fmt.Errorf("%s was trimmed past the backup's changefeed, it starts at %d and the backup ends at %d", journal, jBase, end)
+	}
+	// what both journals still have must be the same
+	from := max(bBase, jBase)
+	n := int64(end - from)
+	bh, jh := sha256.New(), sha256.New()
+	if _, err := io.Copy(bh, io.NewSectionReader(b, bOff+int64(from-bBase), n)); err != nil {
+		return 0, err
+	}
+	if m, err := io.Copy(jh, io.NewSectionReader(j, jOff+int64(from-jBase), n)); err != nil {
+		return 0, err
+	} else if m < n || !bytes.Equal(bh.Sum(nil), jh.Sum(nil)) {
+		return 0, fmt.Errorf("%s doesn't continue the backup's changefeed, it is older or of another store", journal)
+	}
+	return end, nil
+}
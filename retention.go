@@ -0,0 +1,177 @@
+package gocask
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RetentionPolicy limits the keys under one prefix, so that say sessions/ can expire
+// while config/ is kept forever in the same store. The store has no buckets of its
+// own; a prefix like sessions/ is one.
+type RetentionPolicy struct {
+	Prefix string
+	// TTL is how long values put under Prefix without a TTL of their own last. 0 leaves
+	// that to the default TTL, and a negative TTL keeps them even if there is one.
+	TTL      time.Duration
+	MaxKeys  int   // live keys to keep under Prefix, 0 for no limit
+	MaxBytes int64 // bytes of live records to keep under Prefix, 0 for no limit
+}
+
+func (p *RetentionPolicy) limited() bool { return p.MaxKeys > 0 || p.MaxBytes > 0 }
+
+// WithRetention gives the store retention policies. A key follows the policy with
+// the longest prefix it starts with. TTLs are given to values as they are put, and
+// the expiry sweeper and merges drop them like any other. The key and byte limits are
+// checked by the sweeper, see WithExpirySweep, on every round: a prefix over either
+// loses its least recently used keys, keys not used since the store was opened going
+// first. That is a pass over the whole index, so keep the sweep interval coarse on
+// large stores.
+func WithRetention(policies ...RetentionPolicy) Option {
+	return withSetting(func(s *store) error {
+		if err := validateRetention(policies); err != nil {
+			return err
+		}
+		s.setRetention(policies)
+		return nil
+	})
+}
+
+// SetRetention replaces the store's retention policies, see WithRetention.
+func (db *DB) SetRetention(policies ...RetentionPolicy) error {
+	if err := validateRetention(policies); err != nil {
+		return err
+	}
+	defer db.lock()()
+	db.s.setRetention(policies)
+	return nil
+}
+
+func validateRetention(policies []RetentionPolicy) error {
+	seen := make(map[string]bool)
+	for _, p := range policies {
+		if seen[p.Prefix] {
+			return fmt.Errorf("two retention policies for prefix %q", p.Prefix)
+		}
+		seen[p.Prefix] = true
+	}
+	return nil
+}
+
+// setRetention replaces the retention policies of s, which validateRetention passed.
+// Callers hold the store's mu.
+func (s *store) setRetention(policies []RetentionPolicy) {
+	sorted := append([]RetentionPolicy(nil), policies...)
+	sort.SliceStable(sorted, func(i, j int) bool { return len(sorted[i].Prefix) > len(sorted[j].Prefix) })
+	s.dir.retention = sorted
+	s.dir.retentionLimits = false
+	for i := range sorted {
+		s.dir.retentionLimits = s.dir.retentionLimits || sorted[i].limited()
+	}
+	s.dir.updateTracking()
+}
+
+// retentionFor returns the index of the policy key follows, or -1 if there is none.
+func (d *dataDir) retentionFor(key string) int {
+	for i := range d.retention {
+		if strings.HasPrefix(key, d.retention[i].Prefix) {
+			return i
+		}
+	}
+	return -1
+}
+
+// enforceRetention deletes the least recently used keys of every prefix that is over
+// its limits, and returns how many it deleted. Callers hold the store's mu.
+func (s *store) enforceRetention() (int, error) {
+	d := s.dir
+	if !d.retentionLimits || d.checkWritable() != nil {
+		return 0, nil
+	}
+	type candidate struct {
+		key  string
+		size int64
+		last int64
+	}
+	type usage struct {
+		keys  int
+		bytes int64
+		cands []candidate
+	}
+	used := make([]usage, len(d.retention))
+	s.keyDir.Range(func(key string, fo FileOffset) bool {
+		i := d.retentionFor(key)
+		if i < 0 || !d.retention[i].limited() || fo.Tombstone() || isInternalKey([]byte(key)) {
+			return true
+		}
+		u := &used[i]
+		u.keys++
+		u.bytes += fo.recordSize(key)
+		u.cands = append(u.cands, candidate{key: key, size: fo.recordSize(key)})
+		return true
+	})
+
+	deleted := 0
+	for i, u := range used {
+		p := &d.retention[i]
+		over := func() bool {
+			return (p.MaxKeys > 0 && u.keys > p.MaxKeys) || (p.MaxBytes > 0 && u.bytes > p.MaxBytes)
+		}
+		if !over() {
+			continue
+		}
+		for j := range u.cands {
+			u.cands[j].last = d.accesses.get(u.cands[j].key).last
+		}
+		sort.Slice(u.cands, func(a, b int) bool { return u.cands[a].last < u.cands[b].last })
+		for _, c := range u.cands {
+			if !over() {
+				break
+			}
+			if err := deleteAt(c.key, s.dir.newTimestamp(), s.f, s.w, s.keyDir); err != nil {
+				return deleted, fmt.Errorf("retention of %q: delete %q: %w", p.Prefix, c.key, err)
+			}
+			u.keys--
+			u.bytes -= c.size
+			d.metrics.evicted.Add(1)
+			deleted++
+		}
+		d.logger.Info("retention limit enforced", "prefix", p.Prefix, "keys", u.keys, "bytes", u.bytes)
+	}
+	return deleted, nil
+}
+
+// ParseRetention parses a policy as the command line's --retention takes it: a
+// prefix followed by space-separated ttl=<duration|forever>, max-keys=<n> and
+// max-bytes=<n> settings.
+func ParseRetention(s string) (RetentionPolicy, error) {
+	fields := strings.Fields(s)
+	if len(fields) < 2 {
+		return RetentionPolicy{}, fmt.Errorf("retention %q: want a prefix and at least one of ttl=, max-keys= and max-bytes=", s)
+	}
+	p := RetentionPolicy{Prefix: fields[0]}
+	for _, f := range fields[1:] {
+		name, value, _ := strings.Cut(f, "=")
+		var err error
+		switch name {
+		case "ttl":
+			if value == "forever" {
+				p.TTL = -1
+			} else if p.TTL, err = time.ParseDuration(value); err == nil && p.TTL <= 0 {
+				err = fmt.Errorf("must be positive")
+			}
+		case "max-keys":
+			p.MaxKeys, err = strconv.Atoi(value)
+		case "max-bytes":
+			p.MaxBytes, err = strconv.ParseInt(value, 10, 64)
+		default:
+			err = fmt.Errorf("unknown setting")
+		}
+		if err != nil {
+			return RetentionPolicy{}, fmt.Errorf("retention %q: %s: %w", s, f, err)
+		}
+	}
+	return p, nil
+}
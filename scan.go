@@ -0,0 +1,486 @@
+package gocask
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"time"
+)
+
+// record is one decoded log entry.
+type record struct {
+	flag  byte
+	ts    uint64
+	key   []byte
+	value []byte
+}
+
+func (r record) size() int64 { return int64(headerSize + len(r.key) + len(r.value)) }
+
+// ErrChecksumMismatch is returned, wrapped with the file and offset, for a record
+// whose contents don't match its checksum: it was torn or damaged on disk, which is
+// not the same as its key not being there.
+var ErrChecksumMismatch = errors.New("record checksum mismatch")
+
+// crcTable is for the CRC-32C records carry, see appendHeader.
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// checkRecord returns an error wrapping ErrChecksumMismatch unless rec, the whole
+// record at off in file, matches its checksum.
+func checkRecord(rec []byte, file string, off int64) error {
+	crc := crc32.Update(crc32.Checksum(rec[:crcOffset], crcTable), crcTable, rec[headerSize:])
+	if crc != binary.BigEndian.Uint32(rec[crcOffset:headerSize]) {
+		return fmt.Errorf("%s: record at offset %d: %w", file, off, ErrChecksumMismatch)
+	}
+	return nil
+}
+
+// headerChecksum starts the checksum of the record whose header is hdr; the header
+// itself has to be read before the body, which may reuse its memory.
+func headerChecksum(hdr []byte) (crc, want uint32) {
+	return crc32.Checksum(hdr[:crcOffset], crcTable), binary.BigEndian.Uint32(hdr[crcOffset:headerSize])
+}
+
+// bodyChecksum finishes crc, as started by headerChecksum, over key and value.
+func bodyChecksum(crc uint32, key, value []byte) uint32 {
+	return crc32.Update(crc32.Update(crc, crcTable, key), crcTable, value)
+}
+
+// expires is when the record stops counting, in unix nanoseconds, and 0 if it never does.
+func (r record) expires() uint64 {
+	expires, _, _ := splitValue(r.flag, r.value)
+	return expires
+}
+
+// data is the value the record was written with, without the expiry and metadata
+// stored ahead of it.
+func (r record) data() []byte {
+	_, _, data := splitValue(r.flag, r.value)
+	return data
+}
+
+// meta is the metadata the record was written with, nil if it has none.
+func (r record) meta() Metadata {
+	_, enc, _ := splitValue(r.flag, r.value)
+	m, _ := decodeMeta(enc)
+	return m
+}
+
+// splitValue splits what a record with flag stores as its value into the expiry (0
+// for none), the encoded metadata (nil for none) and the value it was written with.
+// A value too short for what flag says it starts with is returned whole.
+func splitValue(flag byte, v []byte) (expires uint64, meta, data []byte) {
+	switch flag {
+	case flagExpiring:
+		if len(v) >= expirySize {
+			return binary.BigEndian.Uint64(v), nil, v[expirySize:]
+		}
+	case flagMeta, flagChunked:
+		if len(v) >= metaPrefixSize {
+			end := metaPrefixSize + int(binary.BigEndian.Uint16(v[expirySize:]))
+			if len(v) >= end {
+				return binary.BigEndian.Uint64(v), v[metaPrefixSize:end:end], v[end:]
+			}
+		}
+	}
+	return 0, nil, v
+}
+
+// expired reports whether a record that expires at expires (0 for never) has.
+func expired(expires uint64) bool {
+	return expires != 0 && expires <= uint64(time.Now().UnixNano())
+}
+
+const defaultReadAhead = 1 << 20
+
+// WithReadAhead sets how many bytes the store's scans, merges and index rebuilds read
+// from a file at a time; 0 or less keeps the 1 MiB default, and anything under 4 KiB
+// is raised to that. Records that fit are decoded in place in the buffer, bigger ones
+// are read out into memory of their own.
+func WithReadAhead(n int) Option {
+	return func(o *dbOptions) { o.readAhead = n }
+}
+
+// SetReadAhead changes the read-ahead WithReadAhead set, for the scans started next.
+func (db *DB) SetReadAhead(n int) { db.s.dir.setReadAhead(n) }
+
+// setReadAhead is DB.SetReadAhead. It needs no lock: a reload changes it while
+// background merges scan.
+func (d *dataDir) setReadAhead(n int) {
+	switch {
+	case n <= 0:
+		n = defaultReadAhead
+	case n < 4096:
+		n = 4096
+	}
+	d.readAhead.Store(int64(n))
+}
+
+// scanSize is the read-ahead the store's scans read files with.
+func (d *dataDir) scanSize() int { return int(d.readAhead.Load()) }
+
+// newScanReader reads r in blocks of size bytes, see WithReadAhead.
+func newScanReader(r io.Reader, size int) *bufio.Reader { return bufio.NewReaderSize(r, size) }
+
+// scanFile calls fn with the offset and contents of every record in path, in order,
+// reading it readAhead bytes at a time.
+// A record cut short by the end of the file is reported as io.ErrUnexpectedEOF. The
+// key and value are only valid until fn returns, their memory is reused for the next
+// record, so fn must copy what it keeps.
+func scanFile(path string, readAhead int, fn func(off int64, r record) error) error {
+	f, size, err := openSized(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return scanRecords(path, newScanReader(f, readAhead), size, fn)
+}
+
+// scanFileAll is scanFile, but fn also gets the record opening each batch, just
+// before the records of the batch, for dump to show every record there is.
+func scanFileAll(path string, fn func(off int64, r record) error) error {
+	f, size, err := openSized(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return scanRecordsAll(path, newScanReader(f, defaultReadAhead), size, true, fn)
+}
+
+// openSized opens path for reading and returns its size.
+func openSized(path string) (*os.File, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, fi.Size(), nil
+}
+
+// scanRecords is scanFile over size bytes of r, name only labels errors. A length
+// reaching past size is treated as a cut-off record before anything is allocated
+// for it, so a damaged header can't make it allocate gigabytes. A record that doesn't
+// match its checksum stops the scan with ErrChecksumMismatch. The records of a batch
+// are held back until the last of them has been read, and a batch cut off by the
+// end counts as a cut-off record; fn never sees the record opening a batch.
+func scanRecords(name string, r *bufio.Reader, size int64, fn func(off int64, r record) error) error {
+	return scanRecordsAll(name, r, size, false, fn)
+}
+
+// scanRecordsAll is scanRecords that, with headers, hands fn the record opening a
+// batch too, right before its records.
+func scanRecordsAll(name string, r *bufio.Reader, size int64, headers bool, fn func(off int64, r record) error) error {
+	var off int64
+	var body []byte
+	var batch batchReader
+	for {
+		hdr, err := r.Peek(headerSize)
+		if len(hdr) == 0 && err == io.EOF {
+			if batch.open {
+				return fmt.Errorf("%s: batch at offset %d: %w", name, batch.start, io.ErrUnexpectedEOF)
+			}
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("%s: record header at offset %d: %w", name, off, eofIsUnexpected(err))
+		}
+
+		rec := record{flag: hdr[0], ts: binary.BigEndian.Uint64(hdr[1:9])}
+		keyLen := binary.BigEndian.Uint32(hdr[9:13])
+		valLen := binary.BigEndian.Uint32(hdr[13:17])
+		if int64(keyLen)+int64(valLen) > size-off-headerSize {
+			return fmt.Errorf("%s: record body at offset %d: %w", name, off, io.ErrUnexpectedEOF)
+		}
+		crc, want := headerChecksum(hdr)
+		var pending int
+		rec.key, rec.value, pending, err = readBody(r, int(keyLen), int(valLen), &body)
+		if err != nil {
+			return fmt.Errorf("%s: record body at offset %d: %w", name, off, err)
+		}
+		if bodyChecksum(crc, rec.key, rec.value) != want {
+			return fmt.Errorf("%s: record at offset %d: %w", name, off, ErrChecksumMismatch)
+		}
+
+		switch {
+		case rec.flag == flagBatch:
+			if batch.open || !batch.begin(off, rec) {
+				return fmt.Errorf("%s: record at offset %d: bad batch header", name, off)
+			}
+		case batch.open:
+			last, err := batch.add(off, rec)
+			if err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+			if last {
+				if err := batch.flush(headers, fn); err != nil {
+					return err
+				}
+			}
+		default:
+			if err := fn(off, rec); err != nil {
+				return err
+			}
+		}
+		r.Discard(pending)
+		off += rec.size()
+	}
+}
+
+// readBody returns the key and value of the record whose header r is at. When the
+// whole record is in r's buffer they point into it, and pending is how much the caller
+// must Discard once done with them; otherwise they are read out into *body.
+func readBody(r *bufio.Reader, keyLen, valLen int, body *[]byte) (key, value []byte, pending int, err error) {
+	n := headerSize + keyLen + valLen
+	b, err := r.Peek(n)
+	if err == nil {
+		return b[headerSize : headerSize+keyLen : headerSize+keyLen], b[headerSize+keyLen:], n, nil
+	} else if err != bufio.ErrBufferFull {
+		return nil, nil, 0, eofIsUnexpected(err)
+	}
+	r.Discard(headerSize)
+	*body = grow(*body, keyLen+valLen)
+	if _, err := io.ReadFull(r, *body); err != nil {
+		return nil, nil, 0, eofIsUnexpected(err)
+	}
+	return (*body)[:keyLen:keyLen], (*body)[keyLen:], 0, nil
+}
+
+// hintTombstone is set in the offset of a hint entry whose record is a delete marker.
+// Hints list deleted keys too, or loading them would bring back older values.
+// hintExpiring marks records written with a TTL, hintMeta ones with metadata and
+// hintChunked the manifests of values stored in chunks.
+const (
+	hintTombstone = 1 << 63
+	hintExpiring  = 1 << 62
+	hintMeta      = 1 << 61
+	hintChunked   = 1 << 60
+	hintFlags     = hintTombstone | hintExpiring | hintMeta | hintChunked
+)
+
+// hintEntrySize is the size of a hint entry for a key of keyLen bytes:
+// keyLen(4) | key | offset(8) | valLen(4).
+func hintEntrySize(keyLen int) int64 { return int64(4 + keyLen + 8 + 4) }
+
+// scanHint calls fn with the position, key, record offset, value length and record
+// flag of every hint entry in path. Like with scanFile, the key is only valid until
+// fn returns.
+func scanHint(path string, readAhead int, fn func(pos int64, key []byte, off int64, valLen uint32, flag byte) error) error {
+	f, size, err := openSized(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return scanHints(path, newScanReader(f, readAhead), size, fn)
+}
+
+// scanHints is scanHint over size bytes of r, name only labels errors.
+func scanHints(name string, r *bufio.Reader, size int64, fn func(pos int64, key []byte, off int64, valLen uint32, flag byte) error) error {
+	var pos int64
+	var big []byte
+	for {
+		b, err := r.Peek(4)
+		if len(b) == 0 && err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("%s: hint entry at %d: %w", name, pos, eofIsUnexpected(err))
+		}
+		keyLen := int(binary.BigEndian.Uint32(b))
+		n := hintEntrySize(keyLen)
+		if n > size-pos {
+			return fmt.Errorf("%s: hint key at %d: %w", name, pos, io.ErrUnexpectedEOF)
+		}
+		// like records, entries are decoded in r's buffer unless they don't fit
+		pending := int(n)
+		entry, err := r.Peek(pending)
+		if err == bufio.ErrBufferFull {
+			big, pending = grow(big, pending), 0
+			_, err = io.ReadFull(r, big)
+			entry = big
+		}
+		if err != nil {
+			return fmt.Errorf("%s: hint entry at %d: %w", name, pos, eofIsUnexpected(err))
+		}
+		key := entry[4 : 4+keyLen : 4+keyLen]
+		off := binary.BigEndian.Uint64(entry[4+keyLen:])
+		valLen := binary.BigEndian.Uint32(entry[12+keyLen:])
+		flag := flagNormal
+		switch off & hintFlags {
+		case 0:
+		case hintTombstone:
+			flag = flagTombstone
+		case hintExpiring:
+			flag = flagExpiring
+		case hintMeta:
+			flag = flagMeta
+		case hintChunked:
+			flag = flagChunked
+		default:
+			return fmt.Errorf("%s: hint entry at %d has more than one flag", name, pos)
+		}
+
+		if err := fn(pos, key, int64(off&^hintFlags), valLen, flag); err != nil {
+			return err
+		}
+		r.Discard(pending)
+		pos += n
+	}
+}
+
+// writeHintEntry appends one hint entry for a record with flag; tombstones carry
+// hintTombstone, expiring records hintExpiring, ones with metadata hintMeta and
+// chunk manifests hintChunked.
+func writeHintEntry(w *bufio.Writer, key string, off int64, valLen uint32, flag byte) {
+	raw := uint64(off)
+	switch flag {
+	case flagTombstone:
+		raw |= hintTombstone
+	case flagExpiring:
+		raw |= hintExpiring
+	case flagMeta:
+		raw |= hintMeta
+	case flagChunked:
+		raw |= hintChunked
+	}
+	w.Write(binary.BigEndian.AppendUint32(w.AvailableBuffer(), uint32(len(key))))
+	w.WriteString(key)
+	w.Write(binary.BigEndian.AppendUint32(binary.BigEndian.AppendUint64(w.AvailableBuffer(), raw), valLen))
+}
+
+// grow returns buf resized to n bytes, reallocating only when it is too small.
+func grow(buf []byte, n int) []byte {
+	if cap(buf) < n {
+		return make([]byte, n)
+	}
+	return buf[:n]
+}
+
+// eofIsUnexpected turns a clean EOF in the middle of an entry into io.ErrUnexpectedEOF.
+func eofIsUnexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// loadHint adds the entries of a segment's hint file to keyDir. The hint is checked
+// in full first, every record it describes must fit inside the segment, so a damaged
+// hint changes nothing and the caller can fall back to scanning the segment.
+func loadHint(hint, segment string, keyDir *KeyDir, readAhead int) error {
+	fi, err := os.Stat(segment)
+	if err != nil {
+		return err
+	}
+	entries := make(map[string]FileOffset)
+	err = scanHint(hint, readAhead, func(pos int64, key []byte, off int64, valLen uint32, flag byte) error {
+		fo := newFileOffset(segment, off, flag, valLen)
+		if flag == flagTombstone && valLen != 0 {
+			return fmt.Errorf("%s: entry at %d is a tombstone with a value", hint, pos)
+		}
+		if flag == flagExpiring && valLen < expirySize {
+			return fmt.Errorf("%s: entry at %d is too short for an expiring record", hint, pos)
+		}
+		if flag == flagMeta && valLen < metaPrefixSize {
+			return fmt.Errorf("%s: entry at %d is too short for a record with metadata", hint, pos)
+		}
+		if flag == flagChunked && valLen < metaPrefixSize+manifestHeader {
+			return fmt.Errorf("%s: entry at %d is too short for a chunk manifest", hint, pos)
+		}
+		if off+fo.recordSize(string(key)) > fi.Size() {
+			return fmt.Errorf("%s: entry at %d points past the end of %s", hint, pos, segment)
+		}
+		entries[string(key)] = fo
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for k, fo := range entries {
+		keyDir.set(k, fo)
+	}
+	return nil
+}
+
+// loadSegment indexes a data file by reading every record; later records of a key
+// replace earlier ones and tombstones are kept so they hide older segments. Damaged
+// records are skipped and added to report. It returns where the last good record ends.
+func loadSegment(path string, keyDir *KeyDir, report *RecoveryReport, readAhead int) (int64, error) {
+	return scanFileResilient(path, readAhead, report, func(off int64, r record) error {
+		keyDir.set(string(r.key), newFileOffset(path, off, r.flag, uint32(len(r.value))))
+		return nil
+	})
+}
+
+// Record is a record as a data file holds it, for tools that look at the files
+// rather than the keys, see ScanSegment.
+type Record struct {
+	Offset    int64
+	Kind      string // put, del, ttl, meta, chnk for a chunked value's manifest or btch
+	Key       []byte
+	Value     []byte // without the expiry and metadata stored ahead of it
+	Size      int    // bytes stored for the value, expiry and metadata included
+	Timestamp uint64
+	Expires   uint64 // 0 for never
+	Meta      Metadata
+}
+
+// ScanSegment calls fn with every record of the data file at path, in order,
+// including those opening a batch, and stops at the first one that doesn't decode.
+// The key and value are only valid until fn returns.
+func ScanSegment(path string, fn func(Record) error) error {
+	return scanFileAll(path, func(off int64, r record) error {
+		return fn(Record{
+			Offset:    off,
+			Kind:      kindName(r.flag),
+			Key:       r.key,
+			Value:     r.data(),
+			Size:      len(r.value),
+			Timestamp: r.ts,
+			Expires:   r.expires(),
+			Meta:      r.meta(),
+		})
+	})
+}
+
+// HintEntry is an entry of a hint file, see ScanHints.
+type HintEntry struct {
+	Pos       int64 // of the entry in the hint file
+	Key       []byte
+	Offset    int64 // of the record in its data file
+	ValueSize uint32
+	Kind      string // of the record, as Record has it
+}
+
+// ScanHints calls fn with every entry of the hint file at path, in order. Like with
+// ScanSegment, the key is only valid until fn returns.
+func ScanHints(path string, fn func(HintEntry) error) error {
+	return scanHint(path, defaultReadAhead, func(pos int64, key []byte, off int64, valLen uint32, flag byte) error {
+		return fn(HintEntry{Pos: pos, Key: key, Offset: off, ValueSize: valLen, Kind: kindName(flag)})
+	})
+}
+
+// kindName is what Record.Kind calls records with flag.
+func kindName(flag byte) string {
+	switch flag {
+	case flagNormal:
+		return "put"
+	case flagTombstone:
+		return "del"
+	case flagExpiring:
+		return "ttl"
+	case flagMeta:
+		return "meta"
+	case flagChunked:
+		return "chnk"
+	case flagBatch:
+		return "btch"
+	default:
+		return fmt.Sprintf("?%d", flag)
+	}
+}
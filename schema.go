@@ -0,0 +1,184 @@
+package gocask
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"maps"
+	"os"
+)
+
+// ValueMigration upgrades a value written at schema version From to version To.
+type ValueMigration struct {
+	From, To string
+	Migrate  func(value string) (string, error)
+}
+
+// SchemaOptions tag values with the version of the application schema they were
+// written in, in a metadata field, and upgrade old ones as they are read. Values
+// without the field are left alone.
+type SchemaOptions struct {
+	Field string // metadata field holding the version, "schema" if empty
+	// Migrations are chained by version: a value at From is migrated to To, then on
+	// from To if some migration starts there, until none does.
+	Migrations []ValueMigration
+	OnMerge    bool // merges upgrade every value they copy that isn't stored in chunks
+}
+
+const defaultSchemaField = "schema"
+
+// schemaSet is the SchemaOptions of a store, ready to use.
+type schemaSet struct {
+	SchemaOptions
+	migrations map[string]ValueMigration // by From, empty without a schema
+}
+
+// WithSchema tags and upgrades the store's values as o says. Migrations must start at
+// distinct versions and their chains must not loop, or the open fails.
+func WithSchema(o SchemaOptions) Option {
+	return withSetting(func(s *store) error {
+		set, err := newSchemaSet(o)
+		if err != nil {
+			return err
+		}
+		s.dir.schema = set
+		return nil
+	})
+}
+
+// newSchemaSet checks o and indexes its migrations.
+func newSchemaSet(o SchemaOptions) (schemaSet, error) {
+	if o.Field == "" {
+		o.Field = defaultSchemaField
+	}
+	next := make(map[string]ValueMigration, len(o.Migrations))
+	for _, m := range o.Migrations {
+		if m.From == "" || m.To == "" || m.Migrate == nil {
+			return schemaSet{}, fmt.Errorf("migration %q to %q needs both versions and a func", m.From, m.To)
+		}
+		if _, dup := next[m.From]; dup {
+			return schemaSet{}, fmt.Errorf("more than one migration from version %q", m.From)
+		}
+		next[m.From] = m
+	}
+	for from := range next {
+		seen := map[string]bool{from: true}
+		for m, ok := next[from]; ok; m, ok = next[m.To] {
+			if seen[m.To] {
+				return schemaSet{}, fmt.Errorf("migrations from version %q loop back to %q", from, m.To)
+			}
+			seen[m.To] = true
+		}
+	}
+	return schemaSet{o, next}, nil
+}
+
+// upgradeValue runs the migrations for the version in meta over value, and returns
+// the result with meta moved to the version it ended up at. ok is false if there was
+// nothing to migrate; then value and meta come back as they were.
+func (sc *schemaSet) upgradeValue(value string, meta Metadata) (string, Metadata, bool, error) {
+	version, tagged := meta[sc.Field]
+	m, ok := sc.migrations[version]
+	if !tagged || !ok {
+		return value, meta, false, nil
+	}
+	for ; ok; m, ok = sc.migrations[m.To] {
+		v, err := m.Migrate(value)
+		if err != nil {
+			return "", nil, false, fmt.Errorf("migrate value from schema version %q to %q: %w", m.From, m.To, err)
+		}
+		value, version = v, m.To
+	}
+	meta = maps.Clone(meta)
+	meta[sc.Field] = version
+	return value, meta, true, nil
+}
+
+// upgradedMeta is meta with the version it is at moved to the one its value's
+// migrations end at.
+func (sc *schemaSet) upgradedMeta(meta Metadata) Metadata {
+	version, tagged := meta[sc.Field]
+	m, ok := sc.migrations[version]
+	if !tagged || !ok {
+		return meta
+	}
+	for ; ok; m, ok = sc.migrations[m.To] {
+		version = m.To
+	}
+	meta = maps.Clone(meta)
+	meta[sc.Field] = version
+	return meta
+}
+
+// upgradeRead upgrades value, read for key from the record fo points at, if the
+// record has a schema version migrations start at.
+func (d *dataDir) upgradeRead(key string, fo FileOffset, value string) (string, error) {
+	if len(d.schema.migrations) == 0 || (!fo.HasMeta() && !fo.Chunked()) {
+		return value, nil
+	}
+	meta, err := d.metaOf(key, fo)
+	if err != nil {
+		return "", err
+	}
+	value, _, _, err = d.schema.upgradeValue(value, meta)
+	return value, err
+}
+
+// GetAndUpgrade is Get storing the value back, along with its new schema version, if
+// it had to be migrated, so the migrations don't run again on the next read. The
+// value keeps its expiry and the rest of its metadata.
+func (db *DB) GetAndUpgrade(key string) (string, error) {
+	if err := checkKey(key); err != nil {
+		return "", err
+	}
+	defer db.lock()()
+	v, err := getAndUpgrade(key, db.s.f, db.s.w, db.s.keyDir)
+	if err != nil {
+		return v, err
+	}
+	return v, db.s.rotateIfFull()
+}
+
+// getAndUpgrade is DB.GetAndUpgrade for callers holding the store's mu.
+func getAndUpgrade(key string, f *os.File, w *bufio.Writer, keyDir *KeyDir) (string, error) {
+	value, meta, err := getWithMeta(key, keyDir)
+	sc := &keyDir.dir.schema
+	if err != nil || len(sc.migrations) == 0 {
+		return value, err
+	}
+	fo, _ := keyDir.Get(key)
+	stored, err := keyDir.dir.metaOf(key, fo)
+	if err != nil || stored[sc.Field] == meta[sc.Field] {
+		return value, err
+	}
+	expires, err := keyDir.dir.expiryOf(key, fo)
+	if err != nil {
+		return "", err
+	}
+	return value, putAt(key, value, keyDir.dir.newTimestamp(), expires, meta, f, w, keyDir)
+}
+
+// upgradeStored upgrades the value of a flagMeta record as a merge copies it, and
+// returns what the record stores as its value afterwards, or false if it is unchanged.
+// A value whose migration fails is copied as it is.
+func (d *dataDir) upgradeStored(key string, stored []byte) ([]byte, bool) {
+	expires, enc, data := splitValue(flagMeta, stored)
+	meta, err := decodeMeta(enc)
+	if err != nil {
+		return nil, false
+	}
+	value, meta, ok, err := d.schema.upgradeValue(string(data), meta)
+	if err == nil && ok {
+		enc, err = encodeMeta(meta)
+	}
+	if err != nil {
+		d.logger.Warn("merge kept a value it couldn't upgrade", "key", key, "err", err)
+		return nil, false
+	}
+	if !ok {
+		return nil, false
+	}
+	b := binary.BigEndian.AppendUint64(make([]byte, 0, metaPrefixSize+len(enc)+len(value)), expires)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(enc)))
+	return append(append(b, enc...), value...), true
+}
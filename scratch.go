@@ -0,0 +1,27 @@
+package gocask
+
+import "sync"
+
+// scratchPool recycles the buffers records are read into on their way to becoming a
+// string, so a read doesn't leave one behind for the garbage collector.
+var scratchPool = sync.Pool{New: func() any { return new([]byte) }}
+
+// getScratch returns a buffer of n bytes from the pool. Hand it back with putScratch
+// once nothing refers to its contents anymore.
+func getScratch(n int) *[]byte {
+	buf := scratchPool.Get().(*[]byte)
+	if cap(*buf) < n {
+		*buf = make([]byte, n)
+	}
+	*buf = (*buf)[:n]
+	return buf
+}
+
+// maxPooledScratch keeps the odd huge value from pinning its buffer in the pool.
+const maxPooledScratch = 64 << 10
+
+func putScratch(buf *[]byte) {
+	if cap(*buf) <= maxPooledScratch {
+		scratchPool.Put(buf)
+	}
+}
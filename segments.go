@@ -0,0 +1,85 @@
+package gocask
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// segmentTime parses the name of a sealed segment or its hint. Only the exact names
+// gocask writes are accepted: "data_012.log" or "data_1x.log" would otherwise sort as
+// some other segment, or at time 0, and be merged as if they belonged to the store.
+func segmentTime(name string) (int64, bool) {
+	base := filepath.Base(name)
+	ext := filepath.Ext(base)
+	if ext != ".log" && ext != ".hint" {
+		return 0, false
+	}
+	var ts int64
+	if _, err := fmt.Sscanf(base, "data_%d"+ext, &ts); err != nil || ts <= 0 {
+		return 0, false
+	}
+	return ts, fmt.Sprintf("data_%d%s", ts, ext) == base
+}
+
+// segmentFiles lists the sealed segments in dir oldest first, and separately every
+// file that uses the segment or hint naming scheme without being named like one.
+func segmentFiles(dir string) (logs, foreign []string, err error) {
+	for _, pattern := range []string{filepath.Join(segmentsDir, "data_*.log"), filepath.Join(hintsDir, "data_*.hint")} {
+		matches, err := filepath.Glob(filepath.Join(dir, pattern))
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, m := range matches {
+			if _, ok := segmentTime(m); !ok {
+				foreign = append(foreign, m)
+			} else if strings.HasSuffix(m, ".log") {
+				logs = append(logs, m)
+			}
+		}
+	}
+	sort.Slice(logs, func(i, j int) bool {
+		return extractTimestamp(logs[i]) < extractTimestamp(logs[j])
+	})
+	return logs, foreign, nil
+}
+
+// checkForeignFiles deals with files in the data directory dir that gocask would
+// mistake for its own. They are never merged or deleted: a strict open refuses the
+// directory until the user moves them, otherwise they are quarantined and added to
+// info.
+func checkForeignFiles(dir string, strict bool, info *RecoveryInfo, log Logger) error {
+	_, foreign, err := segmentFiles(dir)
+	if err != nil || len(foreign) == 0 {
+		return err
+	}
+	if strict {
+		return fmt.Errorf("unexpected files in the data directory, move them elsewhere: %s", strings.Join(foreign, ", "))
+	}
+	return quarantineAll(foreign, "not named like a segment or hint gocask writes", info, log)
+}
+
+// newSegmentName names the segment the active file of the store in dir is sealed
+// into. Segments are named after the second they were sealed, but two rotations in the
+// same second, or a clock that stepped back, must not reuse a name: renaming onto an
+// existing segment replaces it.
+func newSegmentName(dir string) (string, error) {
+	logs, _, err := segmentFiles(dir)
+	if err != nil {
+		return "", err
+	}
+	ts := time.Now().Unix()
+	if n := len(logs); n > 0 {
+		if last := extractTimestamp(logs[n-1]); last >= ts {
+			ts = last + 1
+		}
+	}
+	name := filepath.Join(dir, segmentFile(ts))
+	if _, err := os.Stat(name); err == nil {
+		return "", fmt.Errorf("segment %s already exists", name)
+	}
+	return name, nil
+}
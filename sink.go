@@ -0,0 +1,226 @@
+package gocask
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// keys under this prefix are bookkeeping (sink checkpoints) and never enter the changefeed.
+const internalPrefix = "__gocask/"
+
+func isInternalKey(key []byte) bool {
+	return bytes.HasPrefix(key, []byte(internalPrefix))
+}
+
+// ErrReservedKey refuses a caller of DB a key under internalPrefix: reading one would
+// expose gocask's bookkeeping and writing one would corrupt it.
+var ErrReservedKey = errors.New("keys under " + internalPrefix + " are reserved for gocask")
+
+// IsReservedKey reports whether key is one of gocask's own, which DB's reads and
+// writes refuse with ErrReservedKey.
+func IsReservedKey(key string) bool { return isInternalKey([]byte(key)) }
+
+// checkKey refuses a reserved key.
+func checkKey(key string) error {
+	if IsReservedKey(key) {
+		return fmt.Errorf("%w: %q", ErrReservedKey, key)
+	}
+	return nil
+}
+
+// Sink is somewhere changefeed events get published to.
+type Sink interface {
+	// Publish queues one serialized event, keyed by the record key.
+	Publish(key, payload []byte) error
+	// Flush blocks until everything published so far has been acknowledged.
+	Flush() error
+	Close() error
+}
+
+// AvroChangeSchema is the writer schema for the avro serialization.
+const AvroChangeSchema = `{"type":"record","name":"Change","namespace":"gocask","fields":[` +
+	`{"name":"position","type":"long"},` +
+	`{"name":"timestamp","type":"long"},` +
+	`{"name":"key","type":"bytes"},` +
+	`{"name":"value","type":"bytes"},` +
+	`{"name":"deleted","type":"boolean"},` +
+	`{"name":"expires","type":"long","default":0},` +
+	`{"name":"meta","type":{"type":"map","values":"string"},"default":{}}]}`
+
+// EncodeChangeAvro writes c in avro binary encoding according to AvroChangeSchema.
+func EncodeChangeAvro(c Change) []byte {
+	buf := make([]byte, 0, 5*binary.MaxVarintLen64+len(c.Key)+len(c.Value)+1)
+	buf = binary.AppendVarint(buf, int64(c.Pos)) // avro longs are zigzag varints, same as go's
+	buf = binary.AppendVarint(buf, int64(c.Timestamp))
+	buf = binary.AppendVarint(buf, int64(len(c.Key)))
+	buf = append(buf, c.Key...)
+	buf = binary.AppendVarint(buf, int64(len(c.Value)))
+	buf = append(buf, c.Value...)
+	if c.Deleted {
+		buf = append(buf, 1)
+	} else {
+		buf = append(buf, 0)
+	}
+	buf = binary.AppendVarint(buf, int64(c.Expires))
+	// a map is a block of its entries, sorted here so equal changes encode the same,
+	// then an empty block
+	if len(c.Meta) > 0 {
+		names := make([]string, 0, len(c.Meta))
+		for name := range c.Meta {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		buf = binary.AppendVarint(buf, int64(len(names)))
+		for _, name := range names {
+			buf = binary.AppendVarint(buf, int64(len(name)))
+			buf = append(buf, name...)
+			buf = binary.AppendVarint(buf, int64(len(c.Meta[name])))
+			buf = append(buf, c.Meta[name]...)
+		}
+	}
+	return binary.AppendVarint(buf, 0)
+}
+
+// jsonChange is the json form of a Change; key and value are base64 so binary data survives.
+type jsonChange struct {
+	Position  Position `json:"position"`
+	Timestamp uint64   `json:"timestamp"`
+	Key       []byte   `json:"key"`
+	Value     []byte   `json:"value,omitempty"`
+	Deleted   bool     `json:"deleted"`
+	Expires   uint64   `json:"expires,omitempty"`
+	Meta      Metadata `json:"meta,omitempty"`
+}
+
+// EncodeChangeJSON writes c as a json object, the form replication reads back.
+func EncodeChangeJSON(c Change) []byte {
+	out, _ := json.Marshal(jsonChange{c.Pos, c.Timestamp, c.Key, c.Value, c.Deleted, c.Expires, c.Meta})
+	return out
+}
+
+// DecodeChangeJSON reads a change EncodeChangeJSON wrote.
+func DecodeChangeJSON(data []byte) (Change, error) {
+	var j jsonChange
+	if err := json.Unmarshal(data, &j); err != nil {
+		return Change{}, err
+	}
+	return Change{Key: j.Key, Value: j.Value, Deleted: j.Deleted, Expires: j.Expires, Meta: j.Meta, Timestamp: j.Timestamp, Pos: j.Position}, nil
+}
+
+// Connector pumps the changefeed into a Sink. It is at-least-once: the checkpoint only
+// moves after the sink acknowledged a batch, so a crash in between republishes that batch.
+type Connector struct {
+	Name     string
+	Sink     Sink
+	Encode   func(Change) []byte
+	Interval time.Duration
+	Filter   func(Change) bool // optional, events it rejects are skipped but still checkpointed
+	Journal  string            // the changefeed journal of the store, see JournalPath
+
+	// Load and Save read and persist the checkpoint, usually as a key of the store
+	// itself with DB.LoadCheckpoint and DB.SaveCheckpoint.
+	Load func(key string) (string, error)
+	Save func(key, value string) error
+
+	// Logger gets what goes wrong without stopping Run, slog text on stderr if nil.
+	Logger Logger
+
+	caughtUp atomic.Int64 // unix nanoseconds of the last time everything was published
+}
+
+func (c *Connector) checkpointKey() string { return internalPrefix + "cdc/" + c.Name }
+
+// LoadCheckpoint returns the value of key, one of the reserved keys a Connector keeps
+// its checkpoint under, which Get refuses.
+func (db *DB) LoadCheckpoint(key string) (string, error) {
+	defer db.rlock()()
+	return get(key, db.s.keyDir)
+}
+
+// SaveCheckpoint sets key, one of the reserved keys a Connector keeps its checkpoint
+// under, which Put refuses, to value.
+func (db *DB) SaveCheckpoint(key, value string) error {
+	defer db.lock()()
+	if err := put(key, value, db.s.f, db.s.w, db.s.keyDir); err != nil {
+		return err
+	}
+	return db.s.rotateIfFull()
+}
+
+// Run publishes from the last checkpoint onwards, then keeps polling the journal until stop is closed.
+func (c *Connector) Run(stop <-chan struct{}) error {
+	var pos Position
+	if v, err := c.Load(c.checkpointKey()); err == nil {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return fmt.Errorf("bad checkpoint %q: %w", v, err)
+		}
+		pos = Position(n)
+	}
+
+	c.caughtUp.Store(time.Now().UnixNano())
+	ticker := time.NewTicker(c.Interval)
+	defer ticker.Stop()
+	for {
+		start := time.Now()
+		next, err := c.publishFrom(pos)
+		if err != nil {
+			orDefault(c.Logger).Error("sink publish failed", "connector", c.Name, "err", err)
+		} else {
+			c.caughtUp.Store(start.UnixNano())
+		}
+		if next != pos {
+			if err := c.Save(c.checkpointKey(), strconv.FormatInt(int64(next), 10)); err != nil {
+				orDefault(c.Logger).Error("sink checkpoint failed", "connector", c.Name, "err", err)
+			} else {
+				pos = next
+			}
+		}
+
+		select {
+		case <-stop:
+			return c.Sink.Close()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Lag is how long ago the connector last had everything in the journal published,
+// about its Interval while it keeps up.
+func (c *Connector) Lag() time.Duration {
+	if t := c.caughtUp.Load(); t != 0 {
+		return time.Since(time.Unix(0, t))
+	}
+	return 0
+}
+
+// publishFrom sends every event after pos and returns how far the sink has acked.
+func (c *Connector) publishFrom(pos Position) (Position, error) {
+	s, err := ReadJournal(c.Journal, pos)
+	if err != nil {
+		return pos, err
+	}
+	defer s.Close()
+
+	for s.Next() {
+		ch := s.Change()
+		if c.Filter != nil && !c.Filter(ch) {
+			continue
+		}
+		if err := c.Sink.Publish(ch.Key, c.Encode(ch)); err != nil {
+			return pos, err
+		}
+	}
+	if err := c.Sink.Flush(); err != nil {
+		return pos, err
+	}
+	// everything read before a journal error is still good to checkpoint
+	return s.Pos(), s.Err()
+}
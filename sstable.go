@@ -0,0 +1,532 @@
+package gocask
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// A snapshot is a directory of tables, 000001.sst, 000002.sst, ..., that never change
+// once written. Each holds a sorted run of the live keys, and the runs follow each
+// other in the order of the file names, so a snapshot can be read, or two of them
+// diffed, in key order without an index of the store. A table is
+//
+//	block... | index | footer
+//
+// A block holds entries sorted by key, each
+//
+//	shared(uvarint) | unshared(uvarint) | metaLen(uvarint) | valueLen(uvarint) |
+//	expires(uvarint) | ts(uvarint) | key suffix | meta | value
+//
+// where the key is the first shared bytes of the one before it in the block followed
+// by the suffix and ts is the timestamp the value was written at (version 1 tables
+// don't have it), and ends in the crc32 of its entries (4). The index has an entry per
+// block, keyLen(uvarint) | last key | offset(uvarint) | size(uvarint), and the footer is
+//
+//	indexOffset(8) | indexSize(8) | count(8) | indexCRC(4) | version(4) | magic(8)
+const (
+	sstMagic      = "gocaskst"
+	sstVersion    = 2
+	sstFooterSize = 8 + 8 + 8 + 4 + 4 + len(sstMagic)
+
+	// DefaultBlockSize and DefaultTableSize are what SnapshotOptions left at 0 get.
+	DefaultBlockSize = 64 << 10
+	DefaultTableSize = 256 << 20
+)
+
+// SSTEntry is one key of a snapshot. Expires is 0 for a value that never expires;
+// Timestamp is when the value was written, 0 if the table is too old to say.
+type SSTEntry struct {
+	Key, Value string
+	Meta       Metadata
+	Expires    uint64
+	Timestamp  uint64
+}
+
+// sstWriter writes one table. Entries have to be added in ascending key order.
+type sstWriter struct {
+	f         *os.File
+	w         *bufio.Writer
+	off       int64 // of the block being built
+	blockSize int
+	block     []byte
+	prev      string // the last key added
+	index     []byte
+	count     uint64
+}
+
+func createSSTable(path string, blockSize int) (*sstWriter, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &sstWriter{f: f, w: bufio.NewWriterSize(f, 1<<20), blockSize: blockSize}, nil
+}
+
+// size is roughly how big the table is so far.
+func (t *sstWriter) size() int64 { return t.off + int64(len(t.block)) }
+
+func (t *sstWriter) add(e SSTEntry) error {
+	if t.count > 0 && e.Key <= t.prev {
+		return fmt.Errorf("sstable: key %q added after %q", e.Key, t.prev)
+	}
+	meta, err := encodeMeta(e.Meta)
+	if err != nil {
+		return fmt.Errorf("%q: %w", e.Key, err)
+	}
+	shared := 0
+	if len(t.block) > 0 {
+		for shared < min(len(e.Key), len(t.prev)) && e.Key[shared] == t.prev[shared] {
+			shared++
+		}
+	}
+	t.block = binary.AppendUvarint(t.block, uint64(shared))
+	t.block = binary.AppendUvarint(t.block, uint64(len(e.Key)-shared))
+	t.block = binary.AppendUvarint(t.block, uint64(len(meta)))
+	t.block = binary.AppendUvarint(t.block, uint64(len(e.Value)))
+	t.block = binary.AppendUvarint(t.block, e.Expires)
+	t.block = binary.AppendUvarint(t.block, e.Timestamp)
+	t.block = append(append(append(t.block, e.Key[shared:]...), meta...), e.Value...)
+	t.prev = e.Key
+	t.count++
+	if len(t.block) >= t.blockSize {
+		return t.flushBlock()
+	}
+	return nil
+}
+
+// flushBlock writes out the block being built and indexes it under its last key.
+func (t *sstWriter) flushBlock() error {
+	if len(t.block) == 0 {
+		return nil
+	}
+	t.block = binary.BigEndian.AppendUint32(t.block, crc32.ChecksumIEEE(t.block))
+	if _, err := t.w.Write(t.block); err != nil {
+		return err
+	}
+	t.index = binary.AppendUvarint(t.index, uint64(len(t.prev)))
+	t.index = append(t.index, t.prev...)
+	t.index = binary.AppendUvarint(t.index, uint64(t.off))
+	t.index = binary.AppendUvarint(t.index, uint64(len(t.block)))
+	t.off += int64(len(t.block))
+	t.block = t.block[:0]
+	return nil
+}
+
+// close writes the index and footer and syncs the table.
+func (t *sstWriter) close() error {
+	defer t.f.Close()
+	if err := t.flushBlock(); err != nil {
+		return err
+	}
+	footer := binary.BigEndian.AppendUint64(make([]byte, 0, sstFooterSize), uint64(t.off))
+	footer = binary.BigEndian.AppendUint64(footer, uint64(len(t.index)))
+	footer = binary.BigEndian.AppendUint64(footer, t.count)
+	footer = binary.BigEndian.AppendUint32(footer, crc32.ChecksumIEEE(t.index))
+	footer = binary.BigEndian.AppendUint32(footer, sstVersion)
+	footer = append(footer, sstMagic...)
+	if _, err := t.w.Write(t.index); err != nil {
+		return err
+	}
+	if _, err := t.w.Write(footer); err != nil {
+		return err
+	}
+	if err := t.w.Flush(); err != nil {
+		return err
+	}
+	if err := t.f.Sync(); err != nil {
+		return err
+	}
+	return t.f.Close()
+}
+
+// SnapshotOptions tune WriteSnapshot.
+type SnapshotOptions struct {
+	BlockSize int   // bytes of entries per block, before the one that crosses it
+	TableSize int64 // bytes per table, before the block that crosses it
+}
+
+// WriteSnapshot writes the live keys of the store to a new snapshot in dir, which
+// must be empty or not exist yet. It is written beside dir and only takes its place
+// once every table is complete. It returns how many keys it wrote. The store's mu is
+// held shared while it writes, so the snapshot is of one moment and writes wait for
+// it.
+func (db *DB) WriteSnapshot(dir string, o SnapshotOptions) (int, error) {
+	defer db.rlock()()
+	s := db.s
+	if o.BlockSize <= 0 {
+		o.BlockSize = DefaultBlockSize
+	}
+	if o.TableSize <= 0 {
+		o.TableSize = DefaultTableSize
+	}
+	if entries, err := os.ReadDir(dir); err == nil && len(entries) > 0 {
+		return 0, fmt.Errorf("%s is not empty, a snapshot needs a fresh directory", dir)
+	}
+	tmp := filepath.Clean(dir) + ".partial"
+	if err := os.Mkdir(tmp, 0755); err != nil {
+		return 0, err
+	}
+	defer os.RemoveAll(tmp)
+
+	var t *sstWriter
+	tables, n := 0, 0
+	for _, k := range s.keys(true) {
+		if t != nil && t.size() >= o.TableSize {
+			if err := t.close(); err != nil {
+				return 0, err
+			}
+			t = nil
+		}
+		if t == nil {
+			tables++
+			var err error
+			if t, err = createSSTable(filepath.Join(tmp, fmt.Sprintf("%06d.sst", tables)), o.BlockSize); err != nil {
+				return 0, err
+			}
+			defer t.f.Close()
+		}
+		e, err := s.snapshotEntry(k)
+		if err != nil {
+			return 0, fmt.Errorf("read %q: %w", k, err)
+		}
+		if err := t.add(e); err != nil {
+			return 0, err
+		}
+		n++
+	}
+	if t != nil {
+		if err := t.close(); err != nil {
+			return 0, err
+		}
+	}
+	if err := syncDir(tmp); err != nil {
+		return 0, err
+	}
+	os.Remove(dir) // empty or missing, checked above
+	return n, os.Rename(tmp, dir)
+}
+
+// GetEntry returns the value of key along with its metadata, its expiry and when it
+// was written, as a snapshot would hold it. It fails like Get.
+func (db *DB) GetEntry(key string) (SSTEntry, error) {
+	if err := checkKey(key); err != nil {
+		return SSTEntry{}, err
+	}
+	defer db.rlock()()
+	return db.s.snapshotEntry(key)
+}
+
+// PutEntry stores e as GetEntry returns it or a snapshot holds it: its value with
+// its metadata and expiry, an Expires of 0 getting the default TTL as with Put. A
+// nonzero Timestamp is kept as the record's, so the key looks as written then.
+func (db *DB) PutEntry(e SSTEntry) error {
+	if err := checkKey(e.Key); err != nil {
+		return err
+	}
+	defer db.lock()()
+	s := db.s
+	if e.Expires == 0 {
+		e.Expires = s.dir.defaultExpiry(e.Key)
+	}
+	if e.Timestamp == 0 {
+		e.Timestamp = s.dir.newTimestamp()
+	}
+	if err := putAt(e.Key, e.Value, e.Timestamp, e.Expires, e.Meta, s.f, s.w, s.keyDir); err != nil {
+		return err
+	}
+	return s.rotateIfFull()
+}
+
+func (s *store) snapshotEntry(key string) (SSTEntry, error) {
+	value, meta, err := getWithMeta(key, s.keyDir)
+	if err != nil {
+		return SSTEntry{}, err
+	}
+	fo, _ := s.keyDir.Get(key)
+	expires, err := s.dir.expiryOf(key, fo)
+	if err != nil {
+		return SSTEntry{}, err
+	}
+	_, ts, err := s.dir.recordHeader(fo)
+	return SSTEntry{Key: key, Value: value, Meta: meta, Expires: expires, Timestamp: ts}, err
+}
+
+// sstBlock locates a block of a table.
+type sstBlock struct {
+	last      string
+	off, size int64
+}
+
+// SSTable is a table of a snapshot opened for reading. Its index is kept in memory,
+// so a Get reads a single block.
+type SSTable struct {
+	f       *os.File
+	name    string
+	version uint32
+	blocks  []sstBlock
+	count   uint64
+}
+
+// OpenSSTable opens the table at path, checking its footer and index.
+func OpenSSTable(path string) (*SSTable, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	t, err := readSSTable(f, path)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return t, nil
+}
+
+func readSSTable(f *os.File, path string) (*SSTable, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if fi.Size() < int64(sstFooterSize) {
+		return nil, fmt.Errorf("%s: too short to be a table", path)
+	}
+	footer := make([]byte, sstFooterSize)
+	if _, err := f.ReadAt(footer, fi.Size()-int64(sstFooterSize)); err != nil {
+		return nil, fmt.Errorf("%s: footer: %w", path, err)
+	}
+	if string(footer[32:]) != sstMagic {
+		return nil, fmt.Errorf("%s: not a gocask table", path)
+	}
+	version := binary.BigEndian.Uint32(footer[28:])
+	if version < 1 || version > sstVersion {
+		return nil, fmt.Errorf("%s: table version %d, this gocask reads 1 to %d", path, version, sstVersion)
+	}
+	indexOff, indexSize := binary.BigEndian.Uint64(footer), binary.BigEndian.Uint64(footer[8:])
+	if indexOff+indexSize != uint64(fi.Size())-uint64(sstFooterSize) {
+		return nil, fmt.Errorf("%s: footer doesn't match the file's size", path)
+	}
+	index := make([]byte, indexSize)
+	if _, err := f.ReadAt(index, int64(indexOff)); err != nil {
+		return nil, fmt.Errorf("%s: index: %w", path, err)
+	}
+	if crc32.ChecksumIEEE(index) != binary.BigEndian.Uint32(footer[24:]) {
+		return nil, fmt.Errorf("%s: index doesn't match its checksum", path)
+	}
+
+	t := &SSTable{f: f, name: path, version: version, count: binary.BigEndian.Uint64(footer[16:])}
+	for len(index) > 0 {
+		var b sstBlock
+		var vals [3]uint64
+		for i := range vals {
+			v, n := binary.Uvarint(index)
+			if n <= 0 || (i == 0 && uint64(len(index)-n) < v) {
+				return nil, fmt.Errorf("%s: index cut short", path)
+			}
+			vals[i], index = v, index[n:]
+			if i == 0 {
+				b.last, index = string(index[:v]), index[v:]
+			}
+		}
+		b.off, b.size = int64(vals[1]), int64(vals[2])
+		if vals[1]+vals[2] > indexOff {
+			return nil, fmt.Errorf("%s: index points past the blocks", path)
+		}
+		t.blocks = append(t.blocks, b)
+	}
+	return t, nil
+}
+
+// Len is how many keys the table holds.
+func (t *SSTable) Len() int { return int(t.count) }
+
+// First and Last are the smallest and largest keys in the table; "" if it is empty.
+func (t *SSTable) First() (string, error) {
+	if len(t.blocks) == 0 {
+		return "", nil
+	}
+	entries, err := t.readBlock(0)
+	if err != nil {
+		return "", err
+	}
+	return entries[0].Key, nil
+}
+
+func (t *SSTable) Last() string {
+	if len(t.blocks) == 0 {
+		return ""
+	}
+	return t.blocks[len(t.blocks)-1].last
+}
+
+// Get returns the entry for key, and false if the table doesn't have it.
+func (t *SSTable) Get(key string) (SSTEntry, bool, error) {
+	i := sort.Search(len(t.blocks), func(i int) bool { return t.blocks[i].last >= key })
+	if i == len(t.blocks) {
+		return SSTEntry{}, false, nil
+	}
+	entries, err := t.readBlock(i)
+	if err != nil {
+		return SSTEntry{}, false, err
+	}
+	j := sort.Search(len(entries), func(j int) bool { return entries[j].Key >= key })
+	if j == len(entries) || entries[j].Key != key {
+		return SSTEntry{}, false, nil
+	}
+	return entries[j], true, nil
+}
+
+// Range calls fn for every entry of the table in key order, until fn returns an error.
+func (t *SSTable) Range(fn func(SSTEntry) error) error {
+	for i := range t.blocks {
+		entries, err := t.readBlock(i)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if err := fn(e); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (t *SSTable) Close() error { return t.f.Close() }
+
+// readBlock reads and decodes block i, checking it against its checksum.
+func (t *SSTable) readBlock(i int) ([]SSTEntry, error) {
+	b := t.blocks[i]
+	buf := make([]byte, b.size)
+	if _, err := t.f.ReadAt(buf, b.off); err != nil {
+		return nil, fmt.Errorf("%s: block at offset %d: %w", t.name, b.off, err)
+	}
+	if len(buf) < 4 || crc32.ChecksumIEEE(buf[:len(buf)-4]) != binary.BigEndian.Uint32(buf[len(buf)-4:]) {
+		return nil, fmt.Errorf("%s: block at offset %d doesn't match its checksum", t.name, b.off)
+	}
+	buf = buf[:len(buf)-4]
+
+	fields := 6
+	if t.version == 1 {
+		fields = 5
+	}
+	var entries []SSTEntry
+	prev := ""
+	for len(buf) > 0 {
+		var vals [6]uint64
+		for j := range vals[:fields] {
+			v, n := binary.Uvarint(buf)
+			if n <= 0 {
+				return nil, fmt.Errorf("%s: block at offset %d: entry cut short", t.name, b.off)
+			}
+			vals[j], buf = v, buf[n:]
+		}
+		shared, unshared, metaLen, valueLen := vals[0], vals[1], vals[2], vals[3]
+		if shared > uint64(len(prev)) || unshared+metaLen+valueLen > uint64(len(buf)) {
+			return nil, fmt.Errorf("%s: block at offset %d: entry cut short", t.name, b.off)
+		}
+		e := SSTEntry{Key: prev[:shared] + string(buf[:unshared]), Expires: vals[4], Timestamp: vals[5]}
+		buf = buf[unshared:]
+		meta, err := decodeMeta(buf[:metaLen])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %q: %w", t.name, e.Key, err)
+		}
+		e.Meta, e.Value, buf = meta, string(buf[metaLen:metaLen+valueLen]), buf[metaLen+valueLen:]
+		entries = append(entries, e)
+		prev = e.Key
+	}
+	if len(entries) == 0 || entries[len(entries)-1].Key != b.last {
+		return nil, fmt.Errorf("%s: block at offset %d doesn't end at the key the index has for it", t.name, b.off)
+	}
+	return entries, nil
+}
+
+// Snapshot is a snapshot opened for reading: its tables, in key order.
+type Snapshot struct {
+	tables []*SSTable
+}
+
+// OpenSnapshot opens the tables of the snapshot in dir, checking their key ranges
+// follow each other. Empty tables are left out.
+func OpenSnapshot(dir string) (*Snapshot, error) {
+	names, err := filepath.Glob(filepath.Join(dir, "*.sst"))
+	if err != nil {
+		return nil, err
+	}
+	if len(names) == 0 {
+		if _, err := os.Stat(dir); err != nil {
+			return nil, err
+		}
+	}
+	sort.Strings(names)
+	snap := new(Snapshot)
+	last := ""
+	for _, name := range names {
+		t, err := OpenSSTable(name)
+		if err != nil {
+			snap.Close()
+			return nil, err
+		}
+		if t.Len() == 0 {
+			t.Close()
+			continue
+		}
+		snap.tables = append(snap.tables, t)
+		first, err := t.First()
+		if err == nil && len(snap.tables) > 1 && first <= last {
+			err = fmt.Errorf("%s starts at %q, not after %q where the table before it ends", name, first, last)
+		}
+		if err != nil {
+			snap.Close()
+			return nil, err
+		}
+		last = t.Last()
+	}
+	return snap, nil
+}
+
+// Len is how many keys the snapshot holds.
+func (s *Snapshot) Len() int {
+	n := 0
+	for _, t := range s.tables {
+		n += t.Len()
+	}
+	return n
+}
+
+// Get returns the entry for key, and false if the snapshot doesn't have it or it has
+// expired.
+func (s *Snapshot) Get(key string) (SSTEntry, bool, error) {
+	i := sort.Search(len(s.tables), func(i int) bool { return s.tables[i].Last() >= key })
+	if i == len(s.tables) {
+		return SSTEntry{}, false, nil
+	}
+	e, ok, err := s.tables[i].Get(key)
+	if ok && e.Expires != 0 && expired(e.Expires) {
+		return SSTEntry{}, false, nil
+	}
+	return e, ok, err
+}
+
+// Range calls fn for every entry of the snapshot in key order, expired ones included,
+// until fn returns an error.
+func (s *Snapshot) Range(fn func(SSTEntry) error) error {
+	for _, t := range s.tables {
+		if err := t.Range(fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Snapshot) Close() error {
+	var errs []error
+	for _, t := range s.tables {
+		errs = append(errs, t.Close())
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,127 @@
+package gocask
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// StatsReport describes the store for people, as gocask stats prints it: key counts,
+// the memory the index takes, expired bytes, quota use, file counts and sizes, read
+// and write amplification, the last merge and backup, and operation latencies.
+func (db *DB) StatsReport() ([]string, error) {
+	defer db.rlock()()
+	return db.s.statsLines()
+}
+
+// IndexReport breaks down the memory the index takes by key prefix, the prefix
+// being the key up to its first slash, largest first and at most limit of them.
+func (db *DB) IndexReport(limit int) []string {
+	defer db.rlock()()
+	return indexLines(measureIndex(db.s.keyDir), limit)
+}
+
+// expiredLines describes the expired records a merge would reclaim, per data file.
+func expiredLines(bySegment map[string]int64, keys int) []string {
+	var total int64
+	files := make([]string, 0, len(bySegment))
+	for f, n := range bySegment {
+		total += n
+		files = append(files, f)
+	}
+	lines := []string{fmt.Sprintf("expired:     %d bytes in %d keys, until a sweep or merge drops them", total, keys)}
+	// oldest segment first, the active file last
+	age := func(f string) int64 {
+		if ts := extractTimestamp(f); ts > 0 {
+			return ts
+		}
+		return math.MaxInt64
+	}
+	sort.Slice(files, func(i, j int) bool { return age(files[i]) < age(files[j]) })
+	for _, f := range files {
+		lines = append(lines, fmt.Sprintf("             %d bytes in %s", bySegment[f], f))
+	}
+	return lines
+}
+
+// statsLines reports key counts and on-disk file sizes. Callers hold the store's mu.
+func (s *store) statsLines() ([]string, error) {
+	live, deleted, ttl, meta, chunked := 0, 0, 0, 0, 0
+	s.keyDir.Range(func(k string, fo FileOffset) bool {
+		switch {
+		case isInternalKey([]byte(k)):
+		case fo.Tombstone():
+			deleted++
+		default:
+			live++
+			if fo.Chunked() {
+				chunked++
+			} else if fo.HasMeta() {
+				meta++
+			} else if fo.Expiring() {
+				ttl++
+			}
+		}
+		return true
+	})
+	lines := []string{fmt.Sprintf("keys:        %d live (%d with a ttl, expired or not, %d with metadata and maybe a ttl, %d stored in chunks), %d deleted",
+		live, ttl, meta, chunked, deleted)}
+	idx := measureIndex(s.keyDir)
+	lines = append(lines, fmt.Sprintf("index:       ~%d bytes in memory (%d key bytes, %d overhead)",
+		idx.Total(), idx.KeyBytes, idx.Overhead))
+	expired, n, err := expiredBySegment(s.keyDir)
+	if err != nil {
+		return nil, err
+	}
+	lines = append(lines, expiredLines(expired, n)...)
+	lines = append(lines, s.quotaStatsLines()...)
+
+	for _, g := range []struct{ label, pattern string }{
+		{"active file:", activeFile},
+		{"segments:", segmentsDir + "/data_*.log"},
+		{"hints:", hintsDir + "/data_*.hint"},
+		{"changefeed:", cdcJournal},
+	} {
+		n, size, err := globSize(s.dir.file(g.pattern))
+		if err != nil {
+			return nil, err
+		}
+		lines = append(lines, fmt.Sprintf("%-12s %d files, %d bytes", g.label, n, size))
+	}
+	wa, ra := s.dir.metrics.amplification()
+	lines = append(lines, fmt.Sprintf("written:     %d bytes by users, %d by merges (write amplification %.2f)",
+		s.dir.metrics.bytesWritten.Load(), s.dir.metrics.compactionWritten.Load(), wa))
+	lines = append(lines, fmt.Sprintf("read:        %d bytes returned, %d read by gets, %d by merges (read amplification %.2f)",
+		s.dir.metrics.bytesReturned.Load(), s.dir.metrics.bytesRead.Load(), s.dir.metrics.compactionRead.Load(), ra))
+	if l, ok := s.dir.mergeStatsLine(); ok {
+		lines = append(lines, l)
+	}
+	if l, ok := s.backupStatsLine(); ok {
+		lines = append(lines, l)
+	}
+	for _, op := range s.dir.metrics.latencyOps() {
+		if s := op.h.summary(); s.Count > 0 {
+			lines = append(lines, fmt.Sprintf("%-12s %v", op.name+" latency:", s))
+		}
+	}
+	return lines, nil
+}
+
+// globSize returns how many files match pattern and their total size.
+func globSize(pattern string) (int, int64, error) {
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return 0, 0, err
+	}
+	var total int64
+	for _, m := range matches {
+		fi, err := os.Stat(m)
+		if err != nil {
+			return 0, 0, err
+		}
+		total += fi.Size()
+	}
+	return len(matches), total, nil
+}
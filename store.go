@@ -0,0 +1,268 @@
+package gocask
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// store bundles the open handles every command works with.
+type store struct {
+	// mu serializes commands with background writers such as the cdc connector.
+	// DB.Get only holds it shared, so reads through a DB run side by side: the index,
+	// read handles, cache and counters have locks of their own, and what it keeps out
+	// is a rotation or merge moving records while a read is on its way to them. Each
+	// store has its own, so stores open side by side don't wait for each other.
+	mu sync.RWMutex
+
+	f      *os.File
+	w      *bufio.Writer
+	keyDir *KeyDir
+	dir    *dataDir // the same as keyDir's
+
+	recovery RecoveryInfo // what was wrong with the files on open
+
+	path string // absolute, the key in openStores
+	refs int    // handles given out by Open and OpenShared, guarded by openMu
+	name string // what its metrics are labeled with, see WithName
+}
+
+// ErrAlreadyOpen is returned for a second open of a store in the same process. The
+// flock only keeps other processes out; two handles in one would each append, merge
+// and index as if they were alone.
+var ErrAlreadyOpen = errors.New("store is already open in this process")
+
+var (
+	openMu     sync.Mutex
+	openStores = make(map[string]*store)
+)
+
+// storePath is the absolute path that identifies the store in dir, creating dir.
+func storePath(dir string) (string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	return filepath.EvalSymlinks(abs)
+}
+
+// openStore opens the store in dir unless this process has it open already.
+func openStore(dir string, strict bool) (*store, RecoveryInfo, error) {
+	if strict {
+		return registerOpen(dir, dbOptions{repairs: strictRepairs}, false)
+	}
+	return registerOpen(dir, dbOptions{repairs: openRepairs}, false)
+}
+
+// registerOpen opens the store in dir and records it in openStores. If it is there
+// already, shared hands out the open handle again; otherwise that's ErrAlreadyOpen.
+// Opening it makes the repairs o allows, and names it and logs as o says.
+func registerOpen(dir string, o dbOptions, shared bool) (*store, RecoveryInfo, error) {
+	path, err := storePath(dir)
+	if err != nil {
+		return nil, RecoveryInfo{}, err
+	}
+	openMu.Lock()
+	defer openMu.Unlock()
+	if s, ok := openStores[path]; ok {
+		if !shared {
+			return nil, RecoveryInfo{}, fmt.Errorf("%s: %w", dir, ErrAlreadyOpen)
+		}
+		s.refs++
+		return s, s.recovery, nil
+	}
+	s, info, err := openDir(path, o)
+	if err != nil {
+		return nil, info, err
+	}
+	s.path, s.refs, s.name = path, 1, o.name
+	openStores[path] = s
+	return s, info, nil
+}
+
+// openedStores returns the stores open in the process.
+func openedStores() []*store {
+	openMu.Lock()
+	defer openMu.Unlock()
+	stores := make([]*store, 0, len(openStores))
+	for _, s := range openStores {
+		stores = append(stores, s)
+	}
+	return stores
+}
+
+// openDir opens (or creates) the store in the absolute directory path. Its files
+// are named by their paths under it, the working directory doesn't matter. Opening
+// it makes the repairs o allows, and on a dry run opens it read-only without any.
+func openDir(path string, o dbOptions) (*store, RecoveryInfo, error) {
+	r := o.repairs
+	info := RecoveryInfo{DryRun: r.DryRun}
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return nil, info, err
+	}
+	d := newDataDir(path)
+	d.logger = orDefault(o.logger)
+	d.setReadAhead(o.readAhead)
+	// a store with a format file has its layout upgraded already, which is all a
+	// dry run opens
+	if !r.DryRun {
+		if err := upgradeLayout(path, d.logger); err != nil {
+			return nil, info, fmt.Errorf("upgrade data directory layout: %w", err)
+		}
+	}
+	if err := checkFormat(path); err != nil {
+		return nil, info, err
+	}
+	if err := checkForeignFiles(path, r.strict, &info, d.logger); err != nil {
+		return nil, info, err
+	}
+	if err := d.openAudit(); err != nil {
+		return nil, info, err
+	}
+
+	finish := finishMerge
+	if r.DryRun {
+		finish = pendingMerge
+	}
+	merged, err := finish(path, d.logger)
+	if err != nil {
+		return nil, info, fmt.Errorf("finish interrupted merge: %w", err)
+	}
+	if merged != "" {
+		info.FinishedMerge = merged
+		info.did(ActionFinishMerge, merged, "a crash interrupted the merge")
+	}
+	keyDir, rebuilt, err := rebuildKeyDir(d, r)
+	info.add(&rebuilt)
+	if err != nil {
+		return nil, info, err
+	}
+
+	var f *os.File
+	if r.DryRun {
+		// a missing active file is only created, a stand-in will do for that
+		if f, err = os.Open(d.active); os.IsNotExist(err) {
+			f, err = os.Open(os.DevNull)
+		}
+		d.openedReadOnly.Store(true)
+	} else {
+		f, err = os.OpenFile(d.active, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	}
+	if err != nil {
+		return nil, info, err
+	}
+	// writes since the last rotation are only in data.txt; it goes on top of the
+	// segments. A record torn by a crash is cut off so new appends start clean.
+	damaged := info.Skipped()
+	var good int64
+	if f.Name() == d.active { // not a dry run's stand-in
+		good, err = loadSegment(d.active, keyDir, &info.RecoveryReport, d.scanSize())
+	}
+	if err == nil && !r.TruncateCorrupt {
+		err = damageError(&info.RecoveryReport, damaged)
+	}
+	if err != nil {
+		f.Close()
+		return nil, info, err
+	}
+	for _, reg := range info.Regions[damaged:] {
+		if reg.Offset < good { // a torn tail is cut off below
+			info.skippedRegion(reg)
+		}
+	}
+	if fi, err := f.Stat(); err == nil && fi.Size() > good {
+		d.logger.Warn("truncating partial record at the end of the active file", "offset", good, "bytes", fi.Size()-good, "dry_run", r.DryRun)
+		if !r.DryRun {
+			if err := f.Truncate(good); err != nil {
+				f.Close()
+				return nil, info, err
+			}
+		}
+		info.Truncated = fi.Size() - good
+		info.Actions = append(info.Actions, RecoveryAction{ActionTruncate, d.active, good, info.Truncated, "a torn record at the end of the file"})
+	}
+	if err := repairJournal(d, r, &info); err != nil {
+		f.Close()
+		return nil, info, err
+	}
+	// appends land at the end anyway, but Put takes record offsets from the file
+	// position, which starts at 0 on open, and rotation goes by the active size
+	end, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		f.Close()
+		return nil, info, err
+	}
+	d.activeSize = end
+	for _, r := range info.Regions {
+		d.logger.Warn("skipped damaged data", "file", r.File, "offset", r.Offset, "bytes", r.Length)
+	}
+	if !info.Clean() {
+		d.logger.Warn("opened store after recovery", "found", info.String())
+	}
+	return &store{f: f, w: bufio.NewWriter(f), keyDir: keyDir, dir: d, recovery: info}, info, nil
+}
+
+func (s *store) Close() error {
+	openMu.Lock()
+	s.refs--
+	if s.refs > 0 {
+		openMu.Unlock()
+		return nil
+	}
+	delete(openStores, s.path)
+	openMu.Unlock()
+	s.dir.mergeTail.Wait()
+	s.dir.readers.dropAll()
+	s.dir.stopHooks()
+	s.dir.closeJournal()
+	s.dir.closeAudit()
+	s.w.Flush()
+	var err error
+	if s.dir.syncPolicy != SyncNever && s.dir.unsynced {
+		err = s.dir.syncActive(s.f) // what the interval hadn't got to yet
+	}
+	if cerr := s.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// rotate seals the active file and compacts every segment.
+func (s *store) rotate() error {
+	if s.dir.openedReadOnly.Load() {
+		return ErrOpenedReadOnly
+	}
+	if s.dir.syncPolicy != SyncNever {
+		// the sealed segment is only synced by the merge, which may fail
+		if err := s.sync(); err != nil {
+			return err
+		}
+	}
+	f, w, err := rotateFile(s.f, s.w, s.keyDir)
+	s.f, s.w = f, w
+	return err
+}
+
+// rotateIfFull rotates once the active file outgrows the compaction policy's
+// ActiveSize, or evictions have left that much dead data to merge away, if a merge
+// window is open. Callers hold s.mu, and pass on its error: the write before it
+// was made, but the store isn't rotating as it should.
+func (s *store) rotateIfFull() error {
+	p := &s.dir.compaction
+	if (s.dir.activeSize <= p.ActiveSize && s.dir.evictedBytes <= p.ActiveSize) || !p.allowed(time.Now()) {
+		return nil
+	}
+	s.dir.logger.Debug("rotating", "dir", s.path, "active_bytes", s.dir.activeSize)
+	if err := s.rotate(); err != nil {
+		return fmt.Errorf("rotate: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package gocask
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Many goroutines at once on one DB: readers Get random keys while writers put,
+// delete and expire them, rotating and merging every hundred bytes or so, with the
+// expiry sweeper running alongside. Every value read must be whole and belong to its
+// key, and once the writers stop the store, opened again, must hold what each of
+// them wrote last. Run it with -race.
+func TestConcurrentReadWrite(t *testing.T) {
+	const readers, writers, keys = 8, 2, 64
+	duration := time.Second
+	if testing.Short() {
+		duration = 100 * time.Millisecond
+	}
+	dir := t.TempDir()
+	db, err := Open(dir, WithExpirySweep(10*time.Millisecond), WithCompaction(CompactionPolicy{ActiveSize: 100}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := func(i int) string { return fmt.Sprintf("key%04d", i) }
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	// last holds what each key should end up as: its value, or "" if deleted or expired
+	last := make([]string, keys)
+	for w := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rng := rand.New(rand.NewSource(int64(w)))
+			for seq := 0; ; seq++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				i := w + writers*rng.Intn((keys-w+writers-1)/writers)
+				k := key(i)
+				v := fmt.Sprintf("%s:%d:%s", k, seq, strings.Repeat("v", rng.Intn(64)))
+				var err error
+				switch r := rng.Intn(10); {
+				case r == 0:
+					err, v = db.Delete(k), ""
+				case r == 1:
+					err, v = db.PutWithTTL(k, v, time.Millisecond), ""
+				case r == 2:
+					err = db.PutWithTTL(k, v, time.Hour)
+				default:
+					err = db.Put(k, v)
+				}
+				if err != nil {
+					t.Errorf("write %s: %v", k, err)
+					return
+				}
+				last[i] = v
+			}
+		}()
+	}
+	for r := range readers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rng := rand.New(rand.NewSource(int64(1000 + r)))
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				k := key(rng.Intn(keys))
+				v, err := db.Get(k)
+				switch {
+				case err == nil && !strings.HasPrefix(v, k+":"):
+					t.Errorf("read %s: got %.40q, a value of another key or a torn one", k, v)
+					return
+				case err != nil && !errors.Is(err, ErrNotFound):
+					t.Errorf("read %s: %v", k, err)
+					return
+				}
+			}
+		}()
+	}
+	time.Sleep(duration)
+	close(stop)
+	wg.Wait()
+	if err := db.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	db, err = Open(dir)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer db.Close()
+	for i, want := range last {
+		k := key(i)
+		v, err := db.Get(k)
+		switch {
+		case err != nil && !errors.Is(err, ErrNotFound):
+			t.Errorf("after reopening, read %s: %v", k, err)
+		case v != want:
+			t.Errorf("after reopening, %s holds %.40q, want %.40q", k, v, want)
+		}
+	}
+}
+
+// Stores opened side by side share no locks or state, so using them from goroutines
+// of their own mustn't race.
+func TestConcurrentStores(t *testing.T) {
+	var wg sync.WaitGroup
+	for s := range 4 {
+		db, err := Open(t.TempDir(), WithCompaction(CompactionPolicy{ActiveSize: 100}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range 200 {
+				k, v := fmt.Sprint("k", i%16), fmt.Sprint(s, ":", i)
+				if err := db.Put(k, v); err != nil {
+					t.Errorf("store %d: put %s: %v", s, k, err)
+					return
+				}
+				if got, err := db.Get(k); err != nil || got != v {
+					t.Errorf("store %d: get %s = %q, %v, want %q", s, k, got, err, v)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,114 @@
+package gocask
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TimeSeries writes the points of one metric as keys metric:<unix nanoseconds>, the
+// time zero-padded so the keys of a metric sort in time order, each point expiring
+// Retention after its own time. A retention policy on the "metric:" prefix works too.
+type TimeSeries struct {
+	Metric    string
+	Retention time.Duration // how long points are kept, 0 for forever
+	// Bucket truncates point times, so that a later write in the same bucket replaces
+	// the earlier one, e.g. a minute for one value per minute; 0 keeps times exact.
+	Bucket time.Duration
+}
+
+// Point is one value of a time series.
+type Point struct {
+	Time  time.Time
+	Value string
+}
+
+// timeKey is the key of the point of metric at t.
+func timeKey(metric string, t time.Time) string {
+	return fmt.Sprintf("%s:%020d", metric, t.UnixNano())
+}
+
+// parseTimeKey returns the time of a key of metric, and false for other keys.
+func parseTimeKey(metric, key string) (time.Time, bool) {
+	rest, ok := strings.CutPrefix(key, metric+":")
+	if !ok || len(rest) != 20 {
+		return time.Time{}, false
+	}
+	n, err := strconv.ParseInt(rest, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(0, n), true
+}
+
+// Add writes value as the point at t into db. A point already past its retention
+// isn't written.
+func (ts *TimeSeries) Add(db *DB, t time.Time, value string) error {
+	defer db.lock()()
+	if err := ts.add(t, value, db.s.f, db.s.w, db.s.keyDir); err != nil {
+		return err
+	}
+	return db.s.rotateIfFull()
+}
+
+// add is Add for callers holding the store's mu.
+func (ts *TimeSeries) add(t time.Time, value string, f *os.File, w *bufio.Writer, keyDir *KeyDir) error {
+	if ts.Bucket > 0 {
+		t = t.Truncate(ts.Bucket)
+	}
+	if t.UnixNano() < 0 {
+		return fmt.Errorf("point at %s is before 1970", t)
+	}
+	var expires uint64
+	if ts.Retention > 0 {
+		end := t.Add(ts.Retention)
+		if !end.After(time.Now()) {
+			return nil
+		}
+		expires = uint64(end.UnixNano())
+	} else {
+		expires = keyDir.dir.defaultExpiry(ts.Metric + ":")
+	}
+	return putAt(timeKey(ts.Metric, t), value, keyDir.dir.newTimestamp(), expires, nil, f, w, keyDir)
+}
+
+// RangeTime returns the points of metric from from up to but not including to, oldest
+// first. A zero from or to leaves that end open. There is no ordered index, so this
+// walks all keys like KEYS does.
+func (db *DB) RangeTime(metric string, from, to time.Time) ([]Point, error) {
+	defer db.rlock()()
+	return rangeTime(metric, from, to, db.s.keyDir)
+}
+
+// rangeTime is DB.RangeTime for callers holding the store's mu.
+func rangeTime(metric string, from, to time.Time, keyDir *KeyDir) ([]Point, error) {
+	var keys []string
+	keyDir.Range(func(key string, fo FileOffset) bool {
+		if fo.Tombstone() {
+			return true
+		}
+		if t, ok := parseTimeKey(metric, key); ok && (from.IsZero() || !t.Before(from)) && (to.IsZero() || t.Before(to)) {
+			keys = append(keys, key)
+		}
+		return true
+	})
+	sort.Strings(keys)
+
+	points := make([]Point, 0, len(keys))
+	for _, key := range keys {
+		v, err := get(key, keyDir)
+		if errors.Is(err, ErrExpired) {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("read %q: %w", key, err)
+		}
+		t, _ := parseTimeKey(metric, key)
+		points = append(points, Point{t, v})
+	}
+	return points, nil
+}
@@ -0,0 +1,213 @@
+package gocask
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"os"
+	"time"
+)
+
+// Tracer starts the spans Put, Get, Delete and merges are traced in, so their latency
+// shows up in the traces of the services embedding the store. gocaskotel has one
+// reporting to OpenTelemetry.
+type Tracer interface {
+	// Start starts the span name as a child of the one in ctx, if any.
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is a traced operation.
+type Span interface {
+	// SetAttributes describes the operation, with values that are ints, bools or
+	// strings.
+	SetAttributes(attrs ...Attribute)
+	// End ends the span, marking it failed if err is set.
+	End(err error)
+}
+
+// Attribute is one thing a Span records about its operation.
+type Attribute struct {
+	Key   string
+	Value any
+}
+
+// WithTracer makes t trace the store's operations. Without it, or with nil, they
+// aren't traced.
+func WithTracer(t Tracer) Option {
+	return withSetting(func(s *store) error {
+		if t == nil {
+			t = noopTracer{}
+		}
+		s.dir.tracer = t
+		return nil
+	})
+}
+
+type noopTracer struct{}
+
+func (noopTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	return ctx, noopSpan{}
+}
+
+type noopSpan struct{}
+
+func (noopSpan) SetAttributes(...Attribute) {}
+func (noopSpan) End(error)                  {}
+
+func (d *dataDir) startSpan(ctx context.Context, name string, attrs ...Attribute) (context.Context, Span) {
+	ctx, span := d.tracer.Start(ctx, name)
+	if len(attrs) > 0 {
+		span.SetAttributes(attrs...)
+	}
+	return ctx, span
+}
+
+// PutContext is Put traced as a child of ctx.
+func (db *DB) PutContext(ctx context.Context, key, value string) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	defer db.lock()()
+	if err := putContext(ctx, key, value, db.s.f, db.s.w, db.s.keyDir); err != nil {
+		return err
+	}
+	return db.s.rotateIfFull()
+}
+
+// putContext is DB.PutContext for callers holding the store's mu.
+func putContext(ctx context.Context, key, value string, f *os.File, w *bufio.Writer, keyDir *KeyDir) error {
+	return tracePut(ctx, key, value, keyDir.dir.defaultExpiry(key), nil, f, w, keyDir)
+}
+
+// PutWithTTLContext is PutWithTTL traced as a child of ctx.
+func (db *DB) PutWithTTLContext(ctx context.Context, key, value string, ttl time.Duration) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	defer db.lock()()
+	if err := putWithTTLContext(ctx, key, value, ttl, db.s.f, db.s.w, db.s.keyDir); err != nil {
+		return err
+	}
+	return db.s.rotateIfFull()
+}
+
+// putWithTTLContext is DB.PutWithTTLContext for callers holding the store's mu.
+func putWithTTLContext(ctx context.Context, key, value string, ttl time.Duration, f *os.File, w *bufio.Writer, keyDir *KeyDir) error {
+	expires, err := expiresAfter(ttl)
+	if err != nil {
+		return err
+	}
+	return tracePut(ctx, key, value, expires, nil, f, w, keyDir)
+}
+
+// PutWithMetaContext is PutWithMeta traced as a child of ctx.
+func (db *DB) PutWithMetaContext(ctx context.Context, key, value string, meta Metadata, ttl time.Duration) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	defer db.lock()()
+	if err := putWithMetaContext(ctx, key, value, meta, ttl, db.s.f, db.s.w, db.s.keyDir); err != nil {
+		return err
+	}
+	return db.s.rotateIfFull()
+}
+
+// putWithMetaContext is DB.PutWithMetaContext for callers holding the store's mu.
+func putWithMetaContext(ctx context.Context, key, value string, meta Metadata, ttl time.Duration, f *os.File, w *bufio.Writer, keyDir *KeyDir) error {
+	expires := keyDir.dir.defaultExpiry(key)
+	if ttl != 0 {
+		var err error
+		if expires, err = expiresAfter(ttl); err != nil {
+			return err
+		}
+	}
+	return tracePut(ctx, key, value, expires, meta, f, w, keyDir)
+}
+
+func tracePut(ctx context.Context, key, value string, expires uint64, meta Metadata, f *os.File, w *bufio.Writer, keyDir *KeyDir) error {
+	_, span := keyDir.dir.startSpan(ctx, "gocask.Put",
+		Attribute{"gocask.key_size", len(key)},
+		Attribute{"gocask.value_size", len(value)},
+		Attribute{"gocask.ttl", expires != 0},
+		Attribute{"gocask.meta_fields", len(meta)})
+	defer keyDir.dir.actingFor(ctx)()
+	start := time.Now()
+	err := putAt(key, value, keyDir.dir.newTimestamp(), expires, meta, f, w, keyDir)
+	keyDir.dir.metrics.putLatency.record(time.Since(start))
+	span.End(err)
+	return err
+}
+
+// GetContext is Get traced as a child of ctx. The span records which file the value
+// was read from and whether the key was found.
+func (db *DB) GetContext(ctx context.Context, key string) (string, error) {
+	if err := checkKey(key); err != nil {
+		return "", err
+	}
+	defer db.rlock()()
+	return getContext(ctx, key, db.s.keyDir)
+}
+
+// getContext is DB.GetContext for callers holding the store's mu.
+func getContext(ctx context.Context, key string, keyDir *KeyDir) (string, error) {
+	_, span := keyDir.dir.startSpan(ctx, "gocask.Get", Attribute{"gocask.key_size", len(key)})
+	fo, found := keyDir.Get(key)
+	if found {
+		span.SetAttributes(Attribute{"gocask.segment", fo.FileID()})
+	}
+	start := time.Now()
+	v, err := getRecord(key, keyDir)
+	if err == nil {
+		v, err = keyDir.dir.upgradeRead(key, fo, v)
+	}
+	keyDir.dir.metrics.getLatency.record(time.Since(start))
+	hit := found && !fo.Tombstone() && err == nil
+	if hit {
+		keyDir.dir.accesses.touch(key)
+	}
+	span.SetAttributes(Attribute{"gocask.found", hit}, Attribute{"gocask.value_size", len(v)})
+	if !found || fo.Tombstone() || errors.Is(err, ErrExpired) {
+		span.End(nil) // a miss is an answer, not a failure
+	} else {
+		span.End(err)
+	}
+	return v, err
+}
+
+// DeleteContext is Delete traced as a child of ctx.
+func (db *DB) DeleteContext(ctx context.Context, key string) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	defer db.lock()()
+	if err := deleteContext(ctx, key, db.s.f, db.s.w, db.s.keyDir); err != nil {
+		return err
+	}
+	return db.s.rotateIfFull()
+}
+
+// deleteContext is DB.DeleteContext for callers holding the store's mu.
+func deleteContext(ctx context.Context, key string, f *os.File, w *bufio.Writer, keyDir *KeyDir) error {
+	_, span := keyDir.dir.startSpan(ctx, "gocask.Delete", Attribute{"gocask.key_size", len(key)})
+	defer keyDir.dir.actingFor(ctx)()
+	start := time.Now()
+	err := deleteAt(key, keyDir.dir.newTimestamp(), f, w, keyDir)
+	keyDir.dir.metrics.deleteLatency.record(time.Since(start))
+	span.End(err)
+	return err
+}
+
+// rotateFile is rotateAndMerge in a "gocask.Merge" span. Merges start on their own,
+// not on behalf of a caller, so the span is a root.
+func rotateFile(oldF *os.File, oldW *bufio.Writer, keyDir *KeyDir) (*os.File, *bufio.Writer, error) {
+	_, span := keyDir.dir.startSpan(context.Background(), "gocask.Merge")
+	keyDir.dir.fireBeforeMerge()
+	start := time.Now()
+	f, w, err := rotateAndMerge(oldF, oldW, keyDir)
+	keyDir.dir.metrics.mergeLatency.record(time.Since(start))
+	keyDir.dir.endMerge(err)
+	keyDir.dir.fireAfterMerge(err)
+	span.SetAttributes(Attribute{"gocask.keys", keyDir.Len()}, Attribute{"gocask.segments", segmentCount(keyDir.dir.path)})
+	span.End(err)
+	return f, w, err
+}
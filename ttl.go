@@ -0,0 +1,199 @@
+package gocask
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// ErrExpired is what Get returns, along with ErrNotFound, for a key whose TTL has run
+// out. The record stays on disk, and in the index, until the next merge drops it.
+var ErrExpired = errors.New("key has expired")
+
+// expiredError is the error for key having expired: ErrExpired, and ErrNotFound for
+// callers that only care the key isn't there.
+type expiredError string
+
+func (e expiredError) Error() string { return ErrExpired.Error() + ": " + string(e) }
+
+func (e expiredError) Unwrap() []error { return []error{ErrExpired, ErrNotFound} }
+
+// WithDefaultTTL makes every Put and bulk load that doesn't give a TTL of its own
+// expire its value after d, so a store used as a cache never holds anything older.
+// Replicated values keep the expiry they were written with, and keys with a
+// retention policy follow its TTL if it has one.
+func WithDefaultTTL(d time.Duration) Option {
+	return withSetting(func(s *store) error {
+		s.setDefaultTTL(d)
+		return nil
+	})
+}
+
+// SetDefaultTTL replaces the store's default TTL, see WithDefaultTTL, for the values
+// put from now on; 0 or less turns it off.
+func (db *DB) SetDefaultTTL(d time.Duration) {
+	defer db.lock()()
+	db.s.setDefaultTTL(d)
+}
+
+// setDefaultTTL replaces the default TTL of s. Callers hold the store's mu.
+func (s *store) setDefaultTTL(d time.Duration) { s.dir.defaultTTL = max(d, 0) }
+
+// defaultExpiry is the expiry for a value of key put now without a TTL: that of its
+// retention policy, else the default, else 0 for none.
+func (d *dataDir) defaultExpiry(key string) uint64 {
+	ttl := d.defaultTTL
+	if i := d.retentionFor(key); i >= 0 && d.retention[i].TTL != 0 {
+		ttl = d.retention[i].TTL
+	}
+	if ttl <= 0 {
+		return 0
+	}
+	return uint64(time.Now().Add(ttl).UnixNano())
+}
+
+// putWithTTL is Put for a value that lasts ttl: from then on Get treats the key as not
+// found and merges drop it. Writing the key again replaces the TTL with the value.
+func putWithTTL(key, value string, ttl time.Duration, f *os.File, w *bufio.Writer, keyDir *KeyDir) error {
+	return putWithTTLContext(context.Background(), key, value, ttl, f, w, keyDir)
+}
+
+// expiresAfter is the expiry stored for a value put now with ttl.
+func expiresAfter(ttl time.Duration) (uint64, error) {
+	if ttl <= 0 {
+		return 0, fmt.Errorf("ttl must be positive, got %s", ttl)
+	}
+	return uint64(time.Now().Add(ttl).UnixNano()), nil
+}
+
+// hasExpired reports whether the record fo points at for key has a TTL that ran out.
+// Only expiring records are read.
+func (d *dataDir) hasExpired(key string, fo FileOffset) (bool, error) {
+	expires, err := d.expiryOf(key, fo)
+	if err != nil {
+		return false, err
+	}
+	return expired(expires), nil
+}
+
+// expiryOf reads the expiry of the record fo points at for key, 0 if it has none.
+func (d *dataDir) expiryOf(key string, fo FileOffset) (uint64, error) {
+	if !fo.Expiring() {
+		return 0, nil
+	}
+	f, err := d.readers.acquire(fo.FileID())
+	if err != nil {
+		return 0, err
+	}
+	defer d.readers.release(f)
+
+	var buf [expirySize]byte
+	b, err := f.readAt(buf[:], fo.Offset()+headerSize+int64(len(key)))
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(b), nil
+}
+
+// TTL returns how long key has left, and false if it has no TTL and lasts until it
+// is overwritten or deleted. A key that is missing or has expired is an error, as
+// for Get.
+func (db *DB) TTL(key string) (time.Duration, bool, error) {
+	if err := checkKey(key); err != nil {
+		return 0, false, err
+	}
+	defer db.rlock()()
+	return ttlOf(key, db.s.keyDir)
+}
+
+// ttlOf is DB.TTL for callers holding the store's mu.
+func ttlOf(key string, keyDir *KeyDir) (time.Duration, bool, error) {
+	fo, ok := keyDir.Get(key)
+	if !ok {
+		return 0, false, ErrNotFound
+	} else if fo.Tombstone() {
+		return 0, false, errDeleted(key)
+	}
+	expires, err := keyDir.dir.expiryOf(key, fo)
+	if err != nil || expires == 0 {
+		return 0, false, err
+	}
+	left := time.Until(time.Unix(0, int64(expires)))
+	if left <= 0 {
+		return 0, false, expiredError(key)
+	}
+	return left, true, nil
+}
+
+// Expire gives key a TTL of d from now, replacing any it had.
+func (db *DB) Expire(key string, d time.Duration) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	defer db.lock()()
+	if err := expire(key, d, db.s.f, db.s.w, db.s.keyDir); err != nil {
+		return err
+	}
+	return db.s.rotateIfFull()
+}
+
+// expire is DB.Expire for callers holding the store's mu.
+func expire(key string, d time.Duration, f *os.File, w *bufio.Writer, keyDir *KeyDir) error {
+	return expireAt(key, time.Now().Add(d), f, w, keyDir)
+}
+
+// ExpireAt makes key expire at t, replacing any TTL it had; a t that has passed
+// deletes it. As the expiry is part of the record, the value and its metadata are
+// written again.
+func (db *DB) ExpireAt(key string, t time.Time) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	defer db.lock()()
+	if err := expireAt(key, t, db.s.f, db.s.w, db.s.keyDir); err != nil {
+		return err
+	}
+	return db.s.rotateIfFull()
+}
+
+// expireAt is DB.ExpireAt for callers holding the store's mu.
+func expireAt(key string, t time.Time, f *os.File, w *bufio.Writer, keyDir *KeyDir) error {
+	value, meta, err := getWithMeta(key, keyDir)
+	if err != nil {
+		return err
+	}
+	if !t.After(time.Now()) {
+		return del(key, f, w, keyDir)
+	}
+	return putAt(key, value, keyDir.dir.newTimestamp(), uint64(t.UnixNano()), meta, f, w, keyDir)
+}
+
+// Persist takes the TTL off key so it lasts until overwritten or deleted, even with
+// a default TTL set. A key without one is left alone.
+func (db *DB) Persist(key string) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	defer db.lock()()
+	if err := persist(key, db.s.f, db.s.w, db.s.keyDir); err != nil {
+		return err
+	}
+	return db.s.rotateIfFull()
+}
+
+// persist is DB.Persist for callers holding the store's mu.
+func persist(key string, f *os.File, w *bufio.Writer, keyDir *KeyDir) error {
+	value, meta, err := getWithMeta(key, keyDir)
+	if err != nil {
+		return err
+	}
+	fo, _ := keyDir.Get(key)
+	if expires, err := keyDir.dir.expiryOf(key, fo); err != nil || expires == 0 {
+		return err
+	}
+	return putAt(key, value, keyDir.dir.newTimestamp(), 0, meta, f, w, keyDir)
+}
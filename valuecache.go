@@ -0,0 +1,134 @@
+package gocask
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+)
+
+// cacheEntryOverhead approximates what an entry costs beyond its key and value: the
+// list element, the map slot and the FileOffset.
+const cacheEntryOverhead = 96
+
+// valueCache keeps recently read values in memory, least recently used out first
+// once they take more than budget bytes. Every entry remembers the record it was
+// read from, so when a merge moves the record the entry stops matching keyDir and
+// is dropped on the next read instead of being served.
+type valueCache struct {
+	mu      sync.Mutex
+	budget  int64
+	used    int64
+	entries map[string]*list.Element
+	lru     *list.List // front is the most recently used
+	metrics *opStats   // the store's, which counts the hits and misses
+}
+
+type cachedValue struct {
+	key   string
+	fo    FileOffset
+	value string
+}
+
+// WithValueCache caches up to budget bytes of the store's values in front of disk
+// reads. Writes invalidate what they replace, so a cached value is never stale.
+func WithValueCache(budget int64) Option {
+	return withSetting(func(s *store) error {
+		s.dir.setValueCache(budget)
+		return nil
+	})
+}
+
+// SetValueCache replaces the store's value cache with an empty one of budget bytes,
+// see WithValueCache; 0 turns the cache off. The same budget keeps the cache as it is.
+func (db *DB) SetValueCache(budget int64) {
+	defer db.lock()()
+	db.s.dir.setValueCache(budget)
+}
+
+// setValueCache gives d a value cache of budget bytes, nil for 0, unless it has one
+// of that size already. Callers hold the store's mu.
+func (d *dataDir) setValueCache(budget int64) {
+	switch {
+	case budget <= 0:
+		d.cache = nil
+	case d.cache == nil || d.cache.budget != budget:
+		d.cache = &valueCache{budget: budget, entries: make(map[string]*list.Element), lru: list.New(), metrics: &d.metrics}
+	}
+}
+
+func cacheCost(key, value string) int64 { return int64(len(key) + len(value) + cacheEntryOverhead) }
+
+// get returns the cached value of key if it was read from the record at fo.
+func (c *valueCache) get(key string, fo FileOffset) (string, bool) {
+	if c == nil {
+		return "", false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		c.metrics.cacheMisses.Add(1)
+		return "", false
+	}
+	v := e.Value.(*cachedValue)
+	if v.fo != fo {
+		c.remove(e)
+		c.metrics.cacheMisses.Add(1)
+		return "", false
+	}
+	c.lru.MoveToFront(e)
+	c.metrics.cacheHits.Add(1)
+	return v.value, true
+}
+
+// add caches value, read from the record at fo; mapped says it points into the
+// mapping of a segment, which the cache outlives, so it keeps a copy. Values too big
+// for the whole budget aren't cached at all.
+func (c *valueCache) add(key string, fo FileOffset, value string, mapped bool) {
+	if c == nil || cacheCost(key, value) > c.budget {
+		return
+	}
+	if mapped {
+		value = strings.Clone(value)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok {
+		c.remove(e)
+	}
+	c.entries[key] = c.lru.PushFront(&cachedValue{key, fo, value})
+	c.used += cacheCost(key, value)
+	for c.used > c.budget {
+		c.remove(c.lru.Back())
+	}
+}
+
+// invalidate forgets key, for writes that replace or delete it.
+func (c *valueCache) invalidate(key string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok {
+		c.remove(e)
+	}
+}
+
+// clear empties the cache, for when the store is closed or its files replaced.
+func (c *valueCache) clear() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[string]*list.Element)
+	c.lru.Init()
+	c.used = 0
+}
+
+func (c *valueCache) remove(e *list.Element) {
+	v := c.lru.Remove(e).(*cachedValue)
+	delete(c.entries, v.key)
+	c.used -= cacheCost(v.key, v.value)
+}
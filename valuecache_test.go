@@ -0,0 +1,30 @@
+package gocask
+
+import "testing"
+
+// Each store caches its own values: the same key in two stores reads back as each
+// store has it.
+func TestValueCachePerStore(t *testing.T) {
+	var dbs []*DB
+	for _, v := range []string{"a", "b"} {
+		db, err := Open(t.TempDir(), WithValueCache(1<<20))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		if err := db.Put("k", v); err != nil {
+			t.Fatal(err)
+		}
+		dbs = append(dbs, db)
+	}
+	for range 2 { // a miss, then a hit
+		for i, want := range []string{"a", "b"} {
+			if v, err := dbs[i].Get("k"); err != nil || v != want {
+				t.Errorf("store %d: get k = %q, %v, want %q", i, v, err, want)
+			}
+		}
+	}
+	if used, _, n := dbs[0].s.dir.cache.stats(); n != 1 || used == 0 {
+		t.Errorf("store 0 caches %d values in %d bytes, want 1", n, used)
+	}
+}